@@ -0,0 +1,117 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata keys set by the frontend to correlate logs across services
+const (
+	headerRequestID = "x-request-id"
+	headerSessionID = "x-session-id"
+)
+
+// Context keys for the request-scoped logger and correlation IDs
+type ctxKeyLog struct{}
+type ctxKeyCorrelation struct{}
+
+type correlationIDs struct {
+	requestID string
+	sessionID string
+}
+
+// withCorrelation reads the correlation IDs from incoming metadata and stores
+// them, together with a logger carrying them as fields, in the context
+func withCorrelation(ctx context.Context) context.Context {
+	var ids correlationIDs
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(headerRequestID); len(v) > 0 {
+			ids.requestID = v[0]
+		}
+		if v := md.Get(headerSessionID); len(v) > 0 {
+			ids.sessionID = v[0]
+		}
+	}
+
+	var l logrus.FieldLogger = log
+	if ids.requestID != "" {
+		l = l.WithField("http.req.id", ids.requestID)
+	}
+	if ids.sessionID != "" {
+		l = l.WithField("session", ids.sessionID)
+	}
+	ctx = context.WithValue(ctx, ctxKeyCorrelation{}, ids)
+	return context.WithValue(ctx, ctxKeyLog{}, l)
+}
+
+// logFromContext returns the request-scoped logger, falling back to the
+// package logger outside of an RPC
+func logFromContext(ctx context.Context) logrus.FieldLogger {
+	if l, ok := ctx.Value(ctxKeyLog{}).(logrus.FieldLogger); ok {
+		return l
+	}
+	return log
+}
+
+// appendCorrelationMetadata forwards the correlation IDs of the incoming
+// request to outgoing calls
+func appendCorrelationMetadata(ctx context.Context) context.Context {
+	ids, ok := ctx.Value(ctxKeyCorrelation{}).(correlationIDs)
+	if !ok {
+		return ctx
+	}
+	if ids.requestID != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, headerRequestID, ids.requestID)
+	}
+	if ids.sessionID != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, headerSessionID, ids.sessionID)
+	}
+	return ctx
+}
+
+// correlationUnaryServerInterceptor attaches correlation IDs and a contextual logger to the request
+func correlationUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(withCorrelation(ctx), req)
+}
+
+// correlationStreamServerInterceptor attaches correlation IDs and a contextual logger to the stream
+func correlationStreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: withCorrelation(ss.Context())})
+}
+
+// correlationUnaryClientInterceptor forwards correlation IDs to outgoing gRPC calls
+func correlationUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(appendCorrelationMetadata(ctx), method, req, reply, cc, opts...)
+}
+
+// correlationStreamClientInterceptor forwards correlation IDs to outgoing gRPC stream calls
+func correlationStreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(appendCorrelationMetadata(ctx), desc, cc, method, opts...)
+}
+
+// wrappedServerStream wraps a grpc.ServerStream with a custom context
+type wrappedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (w *wrappedServerStream) Context() context.Context {
+	return w.ctx
+}
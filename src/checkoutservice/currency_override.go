@@ -0,0 +1,71 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"os"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// currencyOverrideHeader is set by the frontend when the currency cookie
+// changed after the JWT was issued, so the token's currency claim is
+// stale. It only names the currency the user picked, which the user
+// chooses freely anyway, so it needs no signature.
+const currencyOverrideHeader = "x-override-currency"
+
+// orderCurrencySources counts orders by where their currency came from:
+// override, claim, request or default
+var orderCurrencySources = expvar.NewMap("order_currency_source")
+
+// isCurrencyClaimOnly reports whether the JWT's currency claim is the only
+// source of the order currency when the token has one
+// (JWT_CURRENCY_FROM_CLAIM=true, set alongside the frontend's). The
+// x-override-currency header is ignored then; the currency in the request
+// still serves calls whose token has no currency claim.
+func isCurrencyClaimOnly() bool {
+	return os.Getenv("JWT_CURRENCY_FROM_CLAIM") == "true"
+}
+
+// orderCurrency returns the currency to charge an order in: the
+// x-override-currency header, else the JWT's currency claim, else the
+// currency in the request, else USD
+func orderCurrency(ctx context.Context, requested string) string {
+	currency, source := usdCurrency, "default"
+	if md, ok := metadata.FromIncomingContext(ctx); ok && !isCurrencyClaimOnly() && validCurrencyCode(firstMD(md, currencyOverrideHeader)) {
+		currency, source = firstMD(md, currencyOverrideHeader), "override"
+	} else if claims, ok := claimsFromContext(ctx); ok && validCurrencyCode(claims.Currency) {
+		currency, source = claims.Currency, "claim"
+	} else if validCurrencyCode(requested) {
+		currency, source = requested, "request"
+	}
+	orderCurrencySources.Add(source, 1)
+	return currency
+}
+
+// validCurrencyCode reports whether code looks like an ISO 4217 code
+func validCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for i := 0; i < len(code); i++ {
+		if code[i] < 'A' || code[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestOrderCurrencyPrecedence(t *testing.T) {
+	withClaim := func(ctx context.Context, currency string) context.Context {
+		return context.WithValue(ctx, ctxKeyClaims{}, jwtClaimSet{Currency: currency})
+	}
+	withOverride := func(currency string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(currencyOverrideHeader, currency))
+	}
+	for _, tc := range []struct {
+		name      string
+		ctx       context.Context
+		requested string
+		want      string
+	}{
+		{"override beats claim", withClaim(withOverride("EUR"), "JPY"), "CAD", "EUR"},
+		{"claim beats request", withClaim(context.Background(), "JPY"), "CAD", "JPY"},
+		{"request without claim", context.Background(), "CAD", "CAD"},
+		{"default", context.Background(), "", usdCurrency},
+		{"invalid override is ignored", withClaim(withOverride("euro"), "JPY"), "CAD", "JPY"},
+		{"invalid claim is ignored", withClaim(context.Background(), ""), "GBP", "GBP"},
+	} {
+		if got := orderCurrency(tc.ctx, tc.requested); got != tc.want {
+			t.Errorf("%s: orderCurrency() = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestOrderCurrencyClaimOnly(t *testing.T) {
+	t.Setenv("JWT_CURRENCY_FROM_CLAIM", "true")
+	override := metadata.NewIncomingContext(context.Background(), metadata.Pairs(currencyOverrideHeader, "EUR"))
+	withClaim := context.WithValue(override, ctxKeyClaims{}, jwtClaimSet{Currency: "JPY"})
+	if got := orderCurrency(withClaim, "CAD"); got != "JPY" {
+		t.Errorf("orderCurrency() = %s, want the claim's JPY over the override", got)
+	}
+	if got := orderCurrency(override, "CAD"); got != "CAD" {
+		t.Errorf("orderCurrency() without a claim = %s, want the request's CAD", got)
+	}
+}
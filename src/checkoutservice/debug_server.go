@@ -0,0 +1,120 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// goRuntimeSamples are the runtime metrics published as go_runtime, by the
+// names they are published under
+var goRuntimeSamples = map[string]string{
+	"goroutines":                "/sched/goroutines:goroutines",
+	"gomaxprocs":                "/sched/gomaxprocs:threads",
+	"gc_cycles":                 "/gc/cycles/total:gc-cycles",
+	"gc_cpu_seconds":            "/cpu/classes/gc/total:cpu-seconds",
+	"user_cpu_seconds":          "/cpu/classes/user:cpu-seconds",
+	"heap_live_bytes":           "/gc/heap/live:bytes",
+	"heap_allocs_bytes":         "/gc/heap/allocs:bytes",
+	"heap_allocs_objects":       "/gc/heap/allocs:objects",
+	"memory_total_bytes":        "/memory/classes/total:bytes",
+	"gc_heap_goal_bytes":        "/gc/heap/goal:bytes",
+	"sched_latency_p99_seconds": "/sched/latencies:seconds",
+}
+
+// goRuntime publishes goroutines, GC, heap and CPU time split between GC and
+// user code, read when the metrics are served, so the cost of signing and
+// encoding JWTs under load shows next to the JWT metrics
+var goRuntime = func() expvar.Func {
+	f := expvar.Func(readGoRuntime)
+	expvar.Publish("go_runtime", f)
+	return f
+}()
+
+func readGoRuntime() interface{} {
+	samples := make([]metrics.Sample, 0, len(goRuntimeSamples))
+	names := make(map[string]string, len(goRuntimeSamples))
+	for name, key := range goRuntimeSamples {
+		samples = append(samples, metrics.Sample{Name: key})
+		names[key] = name
+	}
+	metrics.Read(samples)
+	out := make(map[string]interface{}, len(samples))
+	for _, s := range samples {
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			out[names[s.Name]] = s.Value.Uint64()
+		case metrics.KindFloat64:
+			out[names[s.Name]] = s.Value.Float64()
+		case metrics.KindFloat64Histogram:
+			out[names[s.Name]] = histogramQuantile(s.Value.Float64Histogram(), 0.99)
+		}
+	}
+	return out
+}
+
+// histogramQuantile returns the upper bound of the bucket holding quantile q
+func histogramQuantile(h *metrics.Float64Histogram, q float64) float64 {
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	var seen uint64
+	for i, c := range h.Counts {
+		seen += c
+		if float64(seen) >= q*float64(total) {
+			return h.Buckets[i+1]
+		}
+	}
+	return h.Buckets[len(h.Buckets)-1]
+}
+
+// debugHandler serves pprof under /debug/pprof/, expvar, with the runtime
+// metrics, under /debug/vars, and the latency histograms for Prometheus
+// under /metrics
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/metrics", serveOpenMetrics)
+	return mux
+}
+
+// serveDebug serves debugHandler on DEBUG_ADDR, such as "localhost:6060",
+// when set. It is a listener of its own, kept off the service port, so
+// profiles can be taken in place during load tests without exposing them.
+func serveDebug(log logrus.FieldLogger) {
+	addr := os.Getenv("DEBUG_ADDR")
+	if addr == "" {
+		return
+	}
+	log.Infof("serving pprof and runtime metrics on %s/debug/", addr)
+	if err := http.ListenAndServe(addr, debugHandler()); err != nil {
+		log.Errorf("debug server failed: %v", err)
+	}
+}
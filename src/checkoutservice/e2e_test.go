@@ -0,0 +1,363 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// The e2e fixtures chain the services' tests into one checkout flow, see
+// testdata/e2e/README.md in the frontend. This test replays the PlaceOrder
+// call the frontend recorded through checkout's server and client
+// interceptors and the real PlaceOrder, and records what checkout sends
+// its backends in testdata/e2e for shippingservice's e2e_test.go.
+// Regenerate after the frontend's fixtures, or an intended change here,
+// with
+//
+//	go test -run TestE2EPlaceOrder -update
+
+var updateE2E = flag.Bool("update", false, "rewrite the e2e fixtures")
+
+const (
+	e2eFrontendDir = "../frontend/testdata/e2e"
+	e2eFixtureDir  = "testdata/e2e"
+)
+
+// e2eFixture is what one hop sent downstream in a compression mode
+type e2eFixture struct {
+	Version int    `json:"version"`
+	Mode    string `json:"mode"`
+	// Now is the time, in Unix seconds, the calls were made at
+	Now int64 `json:"now"`
+	// Claims are those of the user's token as the frontend issued it
+	Claims map[string]interface{} `json:"claims"`
+	Calls  []e2eCall              `json:"calls"`
+}
+
+type e2eCall struct {
+	Method string `json:"method"`
+	// Metadata is what the call carried, without the keys gRPC sets
+	// itself; -bin values are standard base64 as on the wire
+	Metadata map[string][]string `json:"metadata"`
+}
+
+// shape lists each call's method and metadata keys, which stay the same
+// from run to run while token values do not
+func (f e2eFixture) shape() []string {
+	var out []string
+	for _, c := range f.Calls {
+		keys := make([]string, 0, len(c.Metadata))
+		for k := range c.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out = append(out, c.Method+" "+strings.Join(keys, ","))
+	}
+	return out
+}
+
+// md decodes the call's metadata as it is received
+func (c e2eCall) md(t *testing.T) metadata.MD {
+	t.Helper()
+	md := metadata.MD{}
+	for k, values := range c.Metadata {
+		for _, v := range values {
+			if strings.HasSuffix(k, "-bin") {
+				b, err := base64.StdEncoding.DecodeString(v)
+				if err != nil {
+					t.Fatalf("%s %s: %v", c.Method, k, err)
+				}
+				v = string(b)
+			}
+			md.Append(k, v)
+		}
+	}
+	return md
+}
+
+// newE2ECall records md as a fixture call
+func newE2ECall(method string, md metadata.MD) e2eCall {
+	c := e2eCall{Method: method, Metadata: make(map[string][]string)}
+	for k, values := range md {
+		if k == ":authority" || k == "content-type" || k == "user-agent" || strings.HasPrefix(k, "grpc-") {
+			continue
+		}
+		for _, v := range values {
+			if strings.HasSuffix(k, "-bin") {
+				v = base64.StdEncoding.EncodeToString([]byte(v))
+			}
+			c.Metadata[k] = append(c.Metadata[k], v)
+		}
+	}
+	return c
+}
+
+func readE2EFixture(t *testing.T, path string) e2eFixture {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("missing fixture, run with -update: %v", err)
+	}
+	var f e2eFixture
+	if err := json.Unmarshal(b, &f); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return f
+}
+
+// e2eReplies are the backends' answers to checkout's calls; the others get
+// an empty message
+var e2eReplies = map[string]proto.Message{
+	pb.CartService_GetCart_FullMethodName: &pb.Cart{Items: []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}},
+	pb.ProductCatalogService_GetProduct_FullMethodName: &pb.Product{Id: "OLJCESPC7Z",
+		PriceUsd: &pb.Money{CurrencyCode: usdCurrency, Units: 19, Nanos: 990000000}},
+	pb.CurrencyService_Convert_FullMethodName:   &pb.Money{CurrencyCode: usdCurrency, Units: 19, Nanos: 990000000},
+	pb.ShippingService_GetQuote_FullMethodName:  &pb.GetQuoteResponse{CostUsd: &pb.Money{CurrencyCode: usdCurrency, Units: 8, Nanos: 990000000}},
+	pb.ShippingService_ShipOrder_FullMethodName: &pb.ShipOrderResponse{TrackingId: "AB-1234-5678"},
+	pb.PaymentService_Charge_FullMethodName:     &pb.ChargeResponse{TransactionId: "tx-1"},
+}
+
+// e2eBackends stands in for every backend of checkout, recording the
+// metadata of each call
+type e2eBackends struct {
+	mu    sync.Mutex
+	calls []e2eCall
+	md    []metadata.MD
+}
+
+func (b *e2eBackends) record(_ interface{}, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	b.mu.Lock()
+	b.calls = append(b.calls, newE2ECall(method, md))
+	b.md = append(b.md, md)
+	b.mu.Unlock()
+	if err := stream.RecvMsg(new(emptypb.Empty)); err != nil {
+		return err
+	}
+	if reply, ok := e2eReplies[method]; ok {
+		return stream.SendMsg(reply)
+	}
+	return stream.SendMsg(new(emptypb.Empty))
+}
+
+// serveBufconn serves srv in memory and returns a dialer for it
+func serveBufconn(t *testing.T, srv *grpc.Server) grpc.DialOption {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	})
+}
+
+// fakeClock is a Clock that stands still
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestE2EPlaceOrder(t *testing.T) {
+	defer func(prev Clock) { jwtClock = prev }(jwtClock)
+
+	for _, mode := range []string{"full", "compressed"} {
+		t.Run(mode, func(t *testing.T) {
+			in := readE2EFixture(t, filepath.Join(e2eFrontendDir, mode+".json"))
+			jwtClock = &fakeClock{now: time.Unix(in.Now, 0)}
+			t.Setenv("ENABLE_JWT_COMPRESSION", strconv.FormatBool(mode == "compressed"))
+
+			backends := &e2eBackends{}
+			backendDialer := serveBufconn(t, grpc.NewServer(grpc.UnknownServiceHandler(backends.record)))
+			svc := new(checkoutService)
+			for _, conn := range []**grpc.ClientConn{&svc.shippingSvcConn, &svc.productCatalogSvcConn, &svc.cartSvcConn,
+				&svc.currencySvcConn, &svc.emailSvcConn, &svc.paymentSvcConn} {
+				var err error
+				if *conn, err = grpc.Dial("bufnet", append(dialOptions("bufnet"), backendDialer)...); err != nil {
+					t.Fatal(err)
+				}
+				defer (*conn).Close()
+			}
+
+			// The claims checkout's handler sees
+			var received map[string]interface{}
+			var session string
+			capture := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				token, _ := ctx.Value(ctxKeyJWT{}).(string)
+				_, received, _, _ = parseJWT(token)
+				if claims, ok := claimsFromContext(ctx); ok {
+					session = claims.SessionID
+				}
+				return handler(ctx, req)
+			}
+			srv := grpc.NewServer(append(serverOptions(), grpc.ChainUnaryInterceptor(capture))...)
+			pb.RegisterCheckoutServiceServer(srv, svc)
+			conn, err := grpc.Dial("bufnet", serveBufconn(t, srv), grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			i := slices.IndexFunc(in.Calls, func(c e2eCall) bool { return c.Method == pb.CheckoutService_PlaceOrder_FullMethodName })
+			if i < 0 {
+				t.Fatalf("%s mode fixture has no PlaceOrder call", mode)
+			}
+			ctx := metadata.NewOutgoingContext(context.Background(), in.Calls[i].md(t))
+			if _, err := pb.NewCheckoutServiceClient(conn).PlaceOrder(ctx, &pb.PlaceOrderRequest{
+				UserId:       in.Claims["session_id"].(string),
+				UserCurrency: usdCurrency,
+				Email:        "someone@example.com",
+				Address:      &pb.Address{StreetAddress: "1600 Amphitheatre Parkway", City: "Mountain View", State: "CA", Country: "United States", ZipCode: 94043},
+				CreditCard:   &pb.CreditCardInfo{CreditCardNumber: "4432-8015-6152-0454", CreditCardCvv: 672, CreditCardExpirationYear: 2030, CreditCardExpirationMonth: 1},
+			}); err != nil {
+				t.Fatalf("PlaceOrder() error = %v", err)
+			}
+			if !reflect.DeepEqual(received, in.Claims) {
+				t.Errorf("checkout received claims %v, want %v", received, in.Claims)
+			}
+			if session != in.Claims["session_id"] {
+				t.Errorf("claimsFromContext() session = %q, want %q", session, in.Claims["session_id"])
+			}
+
+			forwarded := 0
+			for i, md := range backends.md {
+				method := backends.calls[i].Method
+				if !slices.ContainsFunc(e2eJWTKeys(), func(k string) bool { return len(md.Get(k)) > 0 }) {
+					if strings.HasPrefix(method, "/hipstershop.ShippingService/") {
+						t.Errorf("%s: no JWT forwarded", method)
+					}
+					continue
+				}
+				forwarded++
+				checkE2EHeaders(t, mode, method, md)
+				if got := e2eClaims(t, method, md); !reflect.DeepEqual(got, in.Claims) {
+					t.Errorf("%s: claims = %v, want %v", method, got, in.Claims)
+				}
+			}
+			if forwarded == 0 {
+				t.Error("no backend call carried the JWT")
+			}
+
+			out := e2eFixture{Version: in.Version, Mode: mode, Now: in.Now, Claims: in.Claims, Calls: backends.calls}
+			path := filepath.Join(e2eFixtureDir, mode+".json")
+			if *updateE2E {
+				b, err := json.MarshalIndent(out, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, append(b, '\n'), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if want := readE2EFixture(t, path); !reflect.DeepEqual(out.shape(), want.shape()) {
+				t.Errorf("calls changed, run with -update if intended\n got: %q\nwant: %q", out.shape(), want.shape())
+			}
+		})
+	}
+}
+
+// e2eJWTKeys are the keys a JWT travels in, in either mode
+func e2eJWTKeys() []string {
+	return []string{"authorization", jwtHeaders.Static, jwtHeaders.Session, jwtHeaders.Dynamic, jwtHeaders.Signature}
+}
+
+// checkE2EHeaders checks that md carries the token in the headers of mode,
+// and only in those
+func checkE2EHeaders(t *testing.T, mode, method string, md metadata.MD) {
+	t.Helper()
+	for _, k := range e2eJWTKeys() {
+		want := 0
+		if (k == "authorization") == (mode == "full") {
+			want = 1
+		}
+		if n := len(md.Get(k)); n != want {
+			t.Errorf("%s: %d %s headers in %s mode, want %d", method, n, k, mode, want)
+		}
+	}
+	if mode == "full" {
+		if v := md.Get("authorization"); len(v) == 1 && !strings.HasPrefix(v[0], "Bearer ") {
+			t.Errorf("%s: authorization = %q, want a Bearer token", method, v[0])
+		}
+		return
+	}
+	static := append([]string{"alg", "typ"}, jwtStaticClaims...)
+	checkE2EComponent(t, method, md, jwtHeaders.Static, func(claim string) bool { return slices.Contains(static, claim) })
+	checkE2EComponent(t, method, md, jwtHeaders.Session, func(claim string) bool { return slices.Contains(jwtSessionClaims, claim) })
+	checkE2EComponent(t, method, md, jwtHeaders.Dynamic, func(claim string) bool {
+		return !slices.Contains(static, claim) && !slices.Contains(jwtSessionClaims, claim)
+	})
+}
+
+// checkE2EComponent checks that the component in key is a JSON object of
+// claims of its class
+func checkE2EComponent(t *testing.T, method string, md metadata.MD, key string, inClass func(claim string) bool) {
+	t.Helper()
+	v := md.Get(key)
+	if len(v) != 1 {
+		return
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal([]byte(v[0]), &claims); err != nil {
+		t.Errorf("%s: %s is not a JSON object: %v", method, key, err)
+		return
+	}
+	for claim := range claims {
+		if !inClass(claim) {
+			t.Errorf("%s: %s carries %q of another class", method, key, claim)
+		}
+	}
+}
+
+// e2eClaims decodes the claims of the token md carries
+func e2eClaims(t *testing.T, method string, md metadata.MD) map[string]interface{} {
+	t.Helper()
+	decoded, err := DecodeJWTMetadata(md)
+	if err != nil {
+		t.Fatalf("%s: DecodeJWTMetadata() error = %v", method, err)
+	}
+	var token string
+	if decoded != nil {
+		token = decoded.Token
+	} else if v := md.Get("authorization"); len(v) > 0 {
+		token = strings.TrimPrefix(v[0], "Bearer ")
+	}
+	_, claims, _, err := parseJWT(token)
+	if err != nil {
+		t.Fatalf("%s: token does not parse: %v", method, err)
+	}
+	return claims
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+// defaultMaxHeaderListSize is 256KB (224KB HPACK table + 32KB overhead)
+const defaultMaxHeaderListSize = 262144
+
+// maxHeaderListSize is the SETTINGS_MAX_HEADER_LIST_SIZE this service
+// advertises, as a server and as a client, read from MAX_HEADER_LIST_SIZE.
+// Peers refuse to send header lists over it, so split-JWT headers that
+// outgrow it fail the call instead of being truncated.
+var maxHeaderListSize = loadMaxHeaderListSize()
+
+func loadMaxHeaderListSize() uint32 {
+	v := os.Getenv("MAX_HEADER_LIST_SIZE")
+	if v == "" {
+		return defaultMaxHeaderListSize
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		log.Warnf("ignoring invalid MAX_HEADER_LIST_SIZE=%q: %v", v, err)
+		return defaultMaxHeaderListSize
+	}
+	return uint32(n)
+}
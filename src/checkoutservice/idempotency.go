@@ -0,0 +1,128 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+const (
+	// idempotencyKeyHeader identifies a PlaceOrder attempt; retries of the
+	// same attempt carry the same key
+	idempotencyKeyHeader = "x-idempotency-key"
+	// idempotentReplayHeader is set on responses served from the cache
+	idempotentReplayHeader = "x-idempotent-replay"
+
+	defaultIdempotencyWindow = 10 * time.Minute
+)
+
+var (
+	placeOrderResults = newIdempotencyCache(loadIdempotencyWindow())
+
+	// placeOrderDeduplicated counts PlaceOrder calls answered from the
+	// idempotency cache instead of placing the order again; it is served
+	// with the other expvars on the DEBUG_ADDR listener
+	placeOrderDeduplicated = expvar.NewInt("place_order_deduplicated")
+)
+
+// loadIdempotencyWindow reads IDEMPOTENCY_WINDOW, how long a placed order
+// is remembered for retries
+func loadIdempotencyWindow() time.Duration {
+	if v := os.Getenv("IDEMPOTENCY_WINDOW"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		log.Warnf("ignoring invalid IDEMPOTENCY_WINDOW=%q", v)
+	}
+	return defaultIdempotencyWindow
+}
+
+// idempotencyCache remembers PlaceOrder responses by idempotency key.
+// Expired ones are swept every window.
+type idempotencyCache struct {
+	window time.Duration
+	sweep  sync.Once
+
+	mu      sync.Mutex
+	results map[string]placedOrder
+}
+
+// placedOrder is a cached PlaceOrder response and the order token sent
+// with it
+type placedOrder struct {
+	resp       *pb.PlaceOrderResponse
+	orderToken string
+	expiresAt  time.Time
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{window: window, results: make(map[string]placedOrder)}
+}
+
+func (c *idempotencyCache) get(key string) (placedOrder, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res, ok := c.results[key]
+	if !ok || time.Now().After(res.expiresAt) {
+		return placedOrder{}, false
+	}
+	return res, true
+}
+
+func (c *idempotencyCache) put(key string, resp *pb.PlaceOrderResponse, orderToken string) {
+	c.sweep.Do(func() { go c.run() })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results[key] = placedOrder{resp: resp, orderToken: orderToken, expiresAt: time.Now().Add(c.window)}
+}
+
+func (c *idempotencyCache) run() {
+	ticker := time.NewTicker(c.window)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		c.expire(now)
+	}
+}
+
+// expire drops the responses that expired by now
+func (c *idempotencyCache) expire(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, res := range c.results {
+		if now.After(res.expiresAt) {
+			delete(c.results, k)
+		}
+	}
+}
+
+// idempotencyKey returns the cache key for the call, or "" if the caller
+// sent no idempotency key. Keys are scoped to the session, so one session
+// cannot replay another's order by guessing its key.
+func idempotencyKey(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	v := md.Get(idempotencyKeyHeader)
+	if len(v) == 0 || v[0] == "" {
+		return ""
+	}
+	return sessionFromContext(ctx) + "/" + v[0]
+}
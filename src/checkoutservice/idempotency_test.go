@@ -0,0 +1,119 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	cache := newIdempotencyCache(50 * time.Millisecond)
+	resp := &pb.PlaceOrderResponse{Order: &pb.OrderResult{OrderId: "order-1"}}
+
+	if _, ok := cache.get("k"); ok {
+		t.Fatal("empty cache returned a result")
+	}
+	cache.put("k", resp, "order-token")
+	placed, ok := cache.get("k")
+	if !ok || placed.resp != resp || placed.orderToken != "order-token" {
+		t.Fatalf("get() = %+v, %v, want the cached response", placed, ok)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := cache.get("k"); ok {
+		t.Fatal("result outlived the window")
+	}
+	cache.expire(time.Now())
+	cache.mu.Lock()
+	n := len(cache.results)
+	cache.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d results left after expiry, want 0", n)
+	}
+}
+
+func TestIdempotencyKeyScopedToSession(t *testing.T) {
+	md := metadata.Pairs(idempotencyKeyHeader, "abc")
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+	if got := idempotencyKey(context.Background()); got != "" {
+		t.Errorf("idempotencyKey() without header = %q, want none", got)
+	}
+	withSession := func(session string) context.Context {
+		return context.WithValue(ctx, ctxKeyClaims{}, jwtClaimSet{SessionID: session})
+	}
+	a, b := idempotencyKey(withSession("s1")), idempotencyKey(withSession("s2"))
+	if a == "" || a == b {
+		t.Errorf("keys for two sessions = %q, %q, want distinct", a, b)
+	}
+}
+
+func TestMintOrderToken(t *testing.T) {
+	defer func(k []byte) { orderTokenKey = k }(orderTokenKey)
+	order := &pb.OrderResult{OrderId: "order-1"}
+	total := &pb.Money{CurrencyCode: "EUR", Units: 42, Nanos: 500000000}
+
+	orderTokenKey = nil
+	if token, err := mintOrderToken("cart-1", "someone@example.com", order, total); token != "" || err != nil {
+		t.Errorf("mintOrderToken() without ORDER_TOKEN_SECRET = %q, %v", token, err)
+	}
+
+	orderTokenKey = []byte("order-secret")
+	t.Setenv("ORDER_TOKEN_LIFETIME", "5m")
+	token, err := mintOrderToken("cart-1", "someone@example.com", order, total)
+	if err != nil {
+		t.Fatalf("mintOrderToken() error = %v", err)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token = %q, want a compact JWT", token)
+	}
+	mac := hmac.New(sha256.New, orderTokenKey)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if sig, _ := base64.RawURLEncoding.DecodeString(parts[2]); !hmac.Equal(sig, mac.Sum(nil)) {
+		t.Error("signature is not the HS256 MAC of the token under ORDER_TOKEN_SECRET")
+	}
+	var header map[string]string
+	if raw, _ := base64.RawURLEncoding.DecodeString(parts[0]); json.Unmarshal(raw, &header) != nil || header["alg"] != "HS256" {
+		t.Errorf("header = %s", raw)
+	}
+
+	var claims orderTokenClaims
+	raw, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		t.Fatalf("payload %s: %v", raw, err)
+	}
+	if claims.Issuer != orderTokenIssuer || claims.Subject != "cart-1" || claims.OrderID != "order-1" {
+		t.Errorf("claims = %+v", claims)
+	}
+	if claims.Amount.GetCurrencyCode() != "EUR" || claims.Amount.GetUnits() != 42 || claims.Amount.GetNanos() != 500000000 {
+		t.Errorf("amount = %+v, want the order total", claims.Amount)
+	}
+	if claims.Recipient != orderTokenRecipient(" Someone@Example.com") || claims.Recipient == orderTokenRecipient("other@example.com") {
+		t.Errorf("rcpt = %q, want the hash of the recipient", claims.Recipient)
+	}
+	if claims.ExpiresAt-claims.IssuedAt != int64((5 * time.Minute).Seconds()) {
+		t.Errorf("lifetime = %ds, want ORDER_TOKEN_LIFETIME", claims.ExpiresAt-claims.IssuedAt)
+	}
+}
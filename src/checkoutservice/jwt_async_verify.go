@@ -0,0 +1,97 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultJWTVerifyQueuePerWorker sizes the queue of a verify pool when
+// JWT_ASYNC_VERIFY_QUEUE is unset
+const defaultJWTVerifyQueuePerWorker = 4
+
+// jwtAsyncVerifyStats counts the calls of async-verified methods by how
+// their token was checked: queued to a worker, inline when the queue was
+// full, and aborted when the handler ran for a token that then failed;
+// queue_depth is the verifications waiting for a worker right now
+var jwtAsyncVerifyStats = expvar.NewMap("jwt_async_verify")
+
+// jwtVerifyPool verifies tokens on a fixed set of workers, so the handler
+// of an idempotent read runs while its caller's token is checked and the
+// call costs the longer of the two rather than their sum. The response is
+// held until the token verified and replaced by the rejection if it did
+// not, but the handler has run for a caller that may not be allowed to:
+// only methods without side effects may be verified this way. Headers the
+// handler set still go out with the rejection.
+type jwtVerifyPool struct {
+	jobs chan func()
+}
+
+// loadJWTVerifyPool reads JWT_ASYNC_VERIFY_WORKERS, the workers verifying
+// tokens for async-verified methods (unset or 0 verifies every token
+// before its handler), and JWT_ASYNC_VERIFY_QUEUE, the verifications that
+// may wait for a worker (default 4 per worker); calls beyond it are
+// verified before their handler
+func loadJWTVerifyPool() *jwtVerifyPool {
+	workers, err := strconv.Atoi(os.Getenv("JWT_ASYNC_VERIFY_WORKERS"))
+	if err != nil || workers <= 0 {
+		return nil
+	}
+	queue := workers * defaultJWTVerifyQueuePerWorker
+	if n, err := strconv.Atoi(os.Getenv("JWT_ASYNC_VERIFY_QUEUE")); err == nil && n >= 0 {
+		queue = n
+	}
+	return newJWTVerifyPool(workers, queue)
+}
+
+func newJWTVerifyPool(workers, queue int) *jwtVerifyPool {
+	p := &jwtVerifyPool{jobs: make(chan func(), queue)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	jwtAsyncVerifyStats.Set("queue_depth", expvar.Func(func() interface{} { return len(p.jobs) }))
+	return p
+}
+
+// start queues verify of the call with ctx and returns a func that waits
+// for its result, and calls accept when it passed, or nil when the queue
+// is full and the call must verify inline
+func (p *jwtVerifyPool) start(ctx context.Context, verify func(context.Context) error, accept func()) func() error {
+	result := make(chan error, 1)
+	select {
+	case p.jobs <- func() { result <- verify(ctx) }:
+		jwtAsyncVerifyStats.Add("queued", 1)
+	default:
+		jwtAsyncVerifyStats.Add("inline", 1)
+		return nil
+	}
+	return func() error {
+		defer jwtOperationLatency.ObserveSince(ctx, "async_verify_wait", time.Now())
+		if err := <-result; err != nil {
+			jwtAsyncVerifyStats.Add("aborted", 1)
+			return err
+		}
+		accept()
+		return nil
+	}
+}
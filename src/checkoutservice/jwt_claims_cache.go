@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultClaimsCacheSize bounds the sessions whose claims are kept
+const defaultClaimsCacheSize = 4096
+
+// jwtClaimsCache counts lookups of the session claims cache: hits, misses,
+// expired and evicted, and hit_rate over all lookups
+var jwtClaimsCache = func() *expvar.Map {
+	m := expvar.NewMap("jwt_claims_cache")
+	m.Set("hit_rate", expvar.Func(func() interface{} {
+		hits, _ := m.Get("hits").(*expvar.Int)
+		misses, _ := m.Get("misses").(*expvar.Int)
+		if hits == nil || misses == nil || hits.Value()+misses.Value() == 0 {
+			return 0.0
+		}
+		return float64(hits.Value()) / float64(hits.Value()+misses.Value())
+	}))
+	return m
+}()
+
+// loadClaimsCacheSize reads JWT_CLAIMS_CACHE_SIZE, the number of sessions
+// whose claims are cached (default 4096, 0 disables the cache)
+func loadClaimsCacheSize() int {
+	if n, err := strconv.Atoi(os.Getenv("JWT_CLAIMS_CACHE_SIZE")); err == nil && n >= 0 {
+		return n
+	}
+	return defaultClaimsCacheSize
+}
+
+// claimsCache maps the session component of compressed tokens, which stays
+// the same for every token of a user, to its decoded claims. Only the
+// small static and dynamic components are decoded for a cached session.
+// An entry lives as long as the latest token that used it.
+type claimsCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]cachedClaims
+}
+
+type cachedClaims struct {
+	claims  jwtClaimSet
+	expires time.Time
+}
+
+func newClaimsCache(size int) *claimsCache {
+	return &claimsCache{size: size, entries: make(map[string]cachedClaims)}
+}
+
+// claims decodes the claims of a token reassembled from components. ok is
+// false when they do not decode, as contextWithClaims leaves them out.
+func (c *claimsCache) claims(components *JWTComponents) (jwtClaimSet, bool) {
+	now := jwtClock.Now()
+	c.mu.Lock()
+	entry, hit := c.entries[components.Session]
+	c.mu.Unlock()
+	if hit && now.After(entry.expires) {
+		hit = false
+		jwtClaimsCache.Add("expired", 1)
+	}
+
+	claims := entry.claims
+	if hit {
+		jwtClaimsCache.Add("hits", 1)
+	} else {
+		jwtClaimsCache.Add("misses", 1)
+		claims = jwtClaimSet{}
+		if !decodeClaims(components.Session, &claims) {
+			return jwtClaimSet{}, false
+		}
+		entry.claims = claims
+	}
+	// The classes hold disjoint claims, so decoding the others over the
+	// session's fills in the rest
+	if !decodeClaims(components.Static, &claims) || !decodeClaims(components.Dynamic, &claims) {
+		return jwtClaimSet{}, false
+	}
+
+	if claims.ExpiresAt != nil {
+		if exp := time.Unix(int64(*claims.ExpiresAt), 0); exp.After(entry.expires) {
+			c.put(components.Session, cachedClaims{claims: entry.claims, expires: exp}, now)
+		}
+	}
+	return claims, true
+}
+
+// put stores an entry, dropping expired ones and then any one when full
+func (c *claimsCache) put(session string, entry cachedClaims, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[session]; !ok && len(c.entries) >= c.size {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+			jwtClaimsCache.Add("evicted", 1)
+		}
+	}
+	c.entries[session] = entry
+}
+
+// decodeClaims unmarshals a component into claims. As in
+// contextWithClaims, a claim of the wrong type is left empty.
+func decodeClaims(component string, claims *jwtClaimSet) bool {
+	err := json.Unmarshal([]byte(component), claims)
+	var typeErr *json.UnmarshalTypeError
+	return err == nil || errors.As(err, &typeErr)
+}
@@ -0,0 +1,26 @@
+package main
+
+import "time"
+
+// Clock is the time as token generation, validation and expiry checks see
+// it. Tests replace jwtClock to step past exp without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// jwtClock is the Clock of every JWT expiry decision
+var jwtClock Clock = systemClock{}
+
+// jwtSince is time.Since on jwtClock
+func jwtSince(t time.Time) time.Duration {
+	return jwtClock.Now().Sub(t)
+}
+
+// jwtUntil is time.Until on jwtClock
+func jwtUntil(t time.Time) time.Duration {
+	return t.Sub(jwtClock.Now())
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Codec strategy names accepted by JWT_CODEC_STRATEGY
+const (
+	jwtCodecPerClass = "per-class"
+	jwtCodecPerClaim = "per-claim"
+	// jwtCodecTicket replaces the JWT with a 64-byte session ticket, see
+	// sessionTicketCodec. Experimental: receivers lose most claims.
+	jwtCodecTicket = "session-ticket"
+	// jwtCodecDeflate sends the whole token in one header with its payload
+	// DEFLATE-compressed, see deflateCodec
+	jwtCodecDeflate = "deflate"
+	// jwtCodecZstdDict is deflate with zstd and a static dictionary, see
+	// zstdDictCodec. Experimental.
+	jwtCodecZstdDict = "zstd-dict"
+)
+
+// JWTCodec converts a compact JWT to and from gRPC metadata headers
+type JWTCodec interface {
+	// Name identifies the strategy in logs and configuration
+	Name() string
+	// Encode returns key/value pairs for metadata.AppendToOutgoingContext
+	Encode(jwtToken string) ([]string, error)
+	// Decode reassembles the JWT from md. It returns nil, nil when md does
+	// not carry a token in this codec's format.
+	Decode(md metadata.MD) (*DecodedJWT, error)
+}
+
+// DecodedJWT is a token reassembled from metadata along with the number of
+// header value bytes it occupied on the wire
+type DecodedJWT struct {
+	Token    string
+	WireSize int
+	Codec    string
+	// DetachedJWS is the verified detached signature, forwarded as-is by
+	// services that re-encode the token
+	DetachedJWS string
+	// Components are the per-class components the token was reassembled
+	// from, nil for other codecs
+	Components *JWTComponents
+}
+
+// jwtCodec is the strategy used for outgoing metadata, configured once at startup
+var jwtCodec = loadJWTCodec()
+
+// loadJWTCodec selects the outgoing codec from JWT_CODEC_STRATEGY (default
+// per-class)
+func loadJWTCodec() JWTCodec {
+	switch os.Getenv("JWT_CODEC_STRATEGY") {
+	case jwtCodecPerClaim:
+		return perClaimCodec{scheme: jwtHeaders}
+	case jwtCodecTicket:
+		return sessionTicketCodec{scheme: jwtHeaders}
+	case jwtCodecDeflate:
+		return deflateCodec{scheme: jwtHeaders}
+	case jwtCodecZstdDict:
+		return zstdDictCodec{scheme: jwtHeaders}
+	default:
+		return perClassCodec{}
+	}
+}
+
+// DecodeJWTMetadata tries every strategy and header scheme against md, so a
+// receiver understands any sender regardless of its own configuration
+func DecodeJWTMetadata(md metadata.MD) (*DecodedJWT, error) {
+	if decoded, err := (perClassCodec{}).Decode(md); decoded != nil || err != nil {
+		return decoded, err
+	}
+	for _, s := range acceptedJWTHeaderSchemes() {
+		if decoded, err := (perClaimCodec{scheme: s}).Decode(md); decoded != nil || err != nil {
+			return decoded, err
+		}
+		if decoded, err := (sessionTicketCodec{scheme: s}).Decode(md); decoded != nil || err != nil {
+			return decoded, err
+		}
+		if decoded, err := (deflateCodec{scheme: s}).Decode(md); decoded != nil || err != nil {
+			return decoded, err
+		}
+		if decoded, err := (zstdDictCodec{scheme: s}).Decode(md); decoded != nil || err != nil {
+			return decoded, err
+		}
+	}
+	return nil, nil
+}
+
+// metadataPairsSize sums the value lengths of a key/value pair list
+func metadataPairsSize(pairs []string) int {
+	n := 0
+	for i := 1; i < len(pairs); i += 2 {
+		n += len(pairs[i])
+	}
+	return n
+}
+
+// perClassCodec groups claims by cacheability (static, session, dynamic)
+// into one header each, see DecomposeJWT
+type perClassCodec struct{}
+
+func (perClassCodec) Name() string { return jwtCodecPerClass }
+
+func (perClassCodec) Encode(jwtToken string) ([]string, error) {
+	components, err := DecomposeJWT(jwtToken)
+	if err != nil {
+		return nil, err
+	}
+	return appendComponentMAC(jwtHeaders, appendJWTMeta(jwtCodecPerClass, jwtHeaders, jwtHeaders.Pairs(components))), nil
+}
+
+func (perClassCodec) Decode(md metadata.MD) (*DecodedJWT, error) {
+	components, scheme, ok := ExtractJWTComponents(md)
+	if !ok {
+		return nil, nil
+	}
+	if err := verifyJWTMeta(jwtCodecPerClass, scheme, md); err != nil {
+		return nil, err
+	}
+	if err := verifyComponentMAC(scheme, md); err != nil {
+		return nil, err
+	}
+	jws, err := verifyDetachedJWS(scheme, md)
+	if err != nil {
+		return nil, err
+	}
+	token, err := ReassembleJWT(components)
+	if err != nil {
+		return nil, err
+	}
+	return &DecodedJWT{
+		Token:       token,
+		WireSize:    GetJWTComponentSizes(components)["total"],
+		Codec:       jwtCodecPerClass,
+		DetachedJWS: jws,
+		Components:  components,
+	}, nil
+}
+
+// perClaimCodec sends the JOSE header and each claim in its own header, so
+// HPACK can index every stable claim independently. Dynamic claims use the
+// -bin suffix to stay out of the dynamic table.
+type perClaimCodec struct {
+	scheme JWTHeaderScheme
+}
+
+func (c perClaimCodec) headerKey() string { return c.scheme.Prefix + "hdr" }
+
+func (c perClaimCodec) claimPrefix() string { return c.scheme.Prefix + "claim-" }
+
+func (c perClaimCodec) Name() string { return jwtCodecPerClaim }
+
+func (c perClaimCodec) Encode(jwtToken string) ([]string, error) {
+	header, payload, signature, err := parseJWT(jwtToken)
+	if err != nil {
+		return nil, err
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal header: %w", err)
+	}
+	pairs := []string{c.headerKey(), string(headerJSON)}
+	for k, v := range payload {
+		valueJSON, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal claim %q: %w", k, err)
+		}
+		// Metadata keys are lowercase, so the claim could not be decoded
+		// under the name the token was signed with
+		if k != strings.ToLower(k) {
+			return nil, fmt.Errorf("claim %q cannot be sent per claim: metadata keys are lowercase", k)
+		}
+		key := c.claimPrefix() + k
+		if isDynamicClaim(k) {
+			key += "-bin"
+		}
+		pairs = append(pairs, key, string(valueJSON))
+	}
+	pairs = append(pairs, c.scheme.SignaturePairs(signature, IsJWTSignatureSplitEnabled(), IsJWTRawSignatureEnabled())...)
+	pairs = appendJWTMeta(jwtCodecPerClaim, c.scheme, pairs)
+	return appendComponentMAC(c.scheme, pairs), nil
+}
+
+func (c perClaimCodec) Decode(md metadata.MD) (*DecodedJWT, error) {
+	headerJSON := firstMD(md, c.headerKey())
+	if headerJSON == "" {
+		return nil, nil
+	}
+	if err := verifyJWTMeta(jwtCodecPerClaim, c.scheme, md); err != nil {
+		return nil, err
+	}
+	if err := verifyComponentMAC(c.scheme, md); err != nil {
+		return nil, err
+	}
+	jws, err := verifyDetachedJWS(c.scheme, md)
+	if err != nil {
+		return nil, err
+	}
+	size := len(headerJSON)
+
+	var header map[string]interface{}
+	if err := json.Unmarshal([]byte(headerJSON), &header); err != nil {
+		return nil, fmt.Errorf("failed to parse JWT header: %w", err)
+	}
+	payload := make(map[string]interface{})
+	for key, values := range md {
+		if !strings.HasPrefix(key, c.claimPrefix()) || len(values) == 0 {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(key, c.claimPrefix()), "-bin")
+		var v interface{}
+		if err := json.Unmarshal([]byte(values[0]), &v); err != nil {
+			return nil, fmt.Errorf("failed to parse claim %q: %w", name, err)
+		}
+		payload[name] = v
+		size += len(values[0])
+	}
+	signature := c.scheme.SignatureFrom(md)
+	size += len(signature)
+
+	token, err := assembleJWT(header, payload, signature)
+	if err != nil {
+		return nil, err
+	}
+	return &DecodedJWT{Token: token, WireSize: size, Codec: jwtCodecPerClaim, DetachedJWS: jws}, nil
+}
+
+// isDynamicClaim reports whether a claim changes on every token renewal
+func isDynamicClaim(name string) bool {
+	for _, k := range jwtDynamicClaims {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
@@ -2,156 +2,29 @@ package main
 
 import (
 	"context"
-	"strings"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 )
 
-// Context key for storing JWT token
-type ctxKeyJWT struct{}
-
-// jwtUnaryServerInterceptor extracts JWT from incoming metadata and stores in context
-func jwtUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	md, ok := metadata.FromIncomingContext(ctx)
-	if !ok {
-		// No metadata, continue without JWT
-		return handler(ctx, req)
-	}
-
-	var jwtToken string
-
-	// Check for compressed JWT format (x-jwt-* headers)
-	if staticHeaders := md.Get("x-jwt-static"); len(staticHeaders) > 0 {
-		// Compressed format detected
-		var dynamic, signature string
-		
-		// Try to get -bin headers first (gRPC auto-decodes them)
-		if dynamicBinHeaders := md.Get("x-jwt-dynamic-bin"); len(dynamicBinHeaders) > 0 {
-			// gRPC automatically base64-decodes -bin headers
-			dynamic = dynamicBinHeaders[0]
-		} else if dynamicHeaders := md.Get("x-jwt-dynamic"); len(dynamicHeaders) > 0 {
-			// Fallback to non-bin headers for backward compatibility
-			dynamic = dynamicHeaders[0]
-		}
-		
-		if sigBinHeaders := md.Get("x-jwt-sig-bin"); len(sigBinHeaders) > 0 {
-			// gRPC automatically base64-decodes -bin headers
-			signature = sigBinHeaders[0]
-		} else if sigHeaders := md.Get("x-jwt-sig"); len(sigHeaders) > 0 {
-			// Fallback to non-bin headers for backward compatibility
-			signature = sigHeaders[0]
-		}
-		
-		components := &JWTComponents{
-			Static:    staticHeaders[0],
-			Session:   md.Get("x-jwt-session")[0],
-			Dynamic:   dynamic,
-			Signature: signature,
-		}
-
-		// Calculate actual compressed size (the size on the wire)
-		compressedSize := len(components.Static) + len(components.Session) + len(components.Dynamic) + len(components.Signature)
-
-		// Reassemble JWT from components
-		reassembled, err := ReassembleJWT(components)
-		if err != nil {
-			log.Warnf("Failed to reassemble JWT: %v", err)
-			return handler(ctx, req) // Continue without JWT
-		}
-		jwtToken = reassembled
-		log.Infof("[JWT-FLOW] Checkout Service ← Frontend: Received compressed JWT (%d bytes compressed from %d bytes) via %s", compressedSize, len(jwtToken), info.FullMethod)
-
-	} else if authHeaders := md.Get("authorization"); len(authHeaders) > 0 {
-		// Standard format: "Bearer <token>"
-		jwtToken = strings.TrimPrefix(authHeaders[0], "Bearer ")
-		log.Infof("[JWT-FLOW] Checkout Service ← Frontend: Received full JWT (%d bytes) via %s", len(jwtToken), info.FullMethod)
-	}
-
-	// Store JWT in context for client interceptor to forward
-	if jwtToken != "" {
-		ctx = context.WithValue(ctx, ctxKeyJWT{}, jwtToken)
-	}
-
-	return handler(ctx, req)
-}
-
-// jwtStreamServerInterceptor extracts JWT from incoming stream metadata
-func jwtStreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-	ctx := ss.Context()
-	md, ok := metadata.FromIncomingContext(ctx)
-	if !ok {
-		return handler(srv, ss)
-	}
-
-	var jwtToken string
-
-	// Check for compressed JWT format
-	if staticHeaders := md.Get("x-jwt-static"); len(staticHeaders) > 0 {
-		var dynamic, signature string
-		
-		// Try to get -bin headers first (gRPC auto-decodes them)
-		if dynamicBinHeaders := md.Get("x-jwt-dynamic-bin"); len(dynamicBinHeaders) > 0 {
-			// gRPC automatically base64-decodes -bin headers
-			dynamic = dynamicBinHeaders[0]
-		} else if dynamicHeaders := md.Get("x-jwt-dynamic"); len(dynamicHeaders) > 0 {
-			dynamic = dynamicHeaders[0]
-		}
-		
-		if sigBinHeaders := md.Get("x-jwt-sig-bin"); len(sigBinHeaders) > 0 {
-			// gRPC automatically base64-decodes -bin headers
-			signature = sigBinHeaders[0]
-		} else if sigHeaders := md.Get("x-jwt-sig"); len(sigHeaders) > 0 {
-			signature = sigHeaders[0]
-		}
-		
-		components := &JWTComponents{
-			Static:    staticHeaders[0],
-			Session:   md.Get("x-jwt-session")[0],
-			Dynamic:   dynamic,
-			Signature: signature,
-		}
-
-		reassembled, err := ReassembleJWT(components)
-		if err != nil {
-			log.Warnf("Failed to reassemble JWT in stream: %v", err)
-			return handler(srv, ss)
-		}
-		jwtToken = reassembled
-	} else if authHeaders := md.Get("authorization"); len(authHeaders) > 0 {
-		jwtToken = strings.TrimPrefix(authHeaders[0], "Bearer ")
-	}
-
-	if jwtToken != "" {
-		ctx = context.WithValue(ctx, ctxKeyJWT{}, jwtToken)
-	}
-
-	return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
-}
-
-// wrappedServerStream wraps a grpc.ServerStream with a custom context
-type wrappedServerStream struct {
-	grpc.ServerStream
-	ctx context.Context
-}
-
-func (w *wrappedServerStream) Context() context.Context {
-	return w.ctx
-}
-
 // jwtUnaryClientInterceptor forwards JWT from incoming request to outgoing gRPC calls
 func jwtUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	log := jwtLogFromContext(ctx)
 	// Get JWT from context (set by server interceptor)
 	jwtToken, ok := ctx.Value(ctxKeyJWT{}).(string)
-	if !ok || jwtToken == "" {
+	if !ok || jwtToken == "" || skipJWTMethod(method) {
 		// No JWT in context, invoke without adding headers
 		return invoker(ctx, method, req, reply, cc, opts...)
 	}
+	jwtToken, asReceived := jwtForwarding.forwardedToken(ctx, method, jwtToken)
+	if jwtToken == "" {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
 
-	// Check if compression is enabled
-	if IsJWTCompressionEnabled() {
-		// Decompose JWT for HPACK compression
-		components, err := DecomposeJWT(jwtToken)
+	// Check if compression is enabled; reference tokens are forwarded as is
+	if IsJWTCompressionEnabled() && !isOpaqueToken(jwtToken) {
+		// Split JWT into headers for HPACK compression
+		pairs, err := jwtCodec.Encode(jwtToken)
 		if err != nil {
 			// Fallback to full JWT
 			log.Warnf("Failed to decompose JWT, using full token: %v", err)
@@ -161,18 +34,17 @@ func jwtUnaryClientInterceptor(ctx context.Context, method string, req, reply in
 			// gRPC automatically base64-encodes -bin headers, send raw string
 			
 			// Static and Session: Allow HPACK caching
-			ctx = metadata.AppendToOutgoingContext(ctx,
-				"x-jwt-static", components.Static,
-				"x-jwt-session", components.Session,
-				"x-jwt-dynamic-bin", components.Dynamic,
-				"x-jwt-sig-bin", components.Signature)
+			ctx = metadata.AppendToOutgoingContext(ctx, forwardDetachedJWS(ctx, pairs, asReceived)...)
 			
-			sizes := GetJWTComponentSizes(components)
-			log.Infof("[JWT-FLOW] Checkout Service \u2192 %s: Forwarding compressed JWT (total=%db, static/session=CACHED, dynamic/sig=NO-CACHE via -bin)", method, sizes["total"])
+			if size := metadataPairsSize(pairs); jwtFlowLog.Sample(method, jwtModeCompressed, size) {
+				jwtLogger(log, jwtToken, jwtModeCompressed, size).Infof("[JWT-FLOW] Checkout Service → %s: forwarding JWT (codec=%s)", method, jwtCodec.Name())
+			}
 		}
 	} else {
 		// JWT COMPRESSION DISABLED: Forward as standard authorization header
-		log.Infof("[JWT-FLOW] Checkout Service → %s: Forwarding full JWT in authorization header (%d bytes)", method, len(jwtToken))
+		if jwtFlowLog.Sample(method, authorizationMode(jwtToken), len(jwtToken)) {
+			jwtLogger(log, jwtToken, authorizationMode(jwtToken), len(jwtToken)).Infof("[JWT-FLOW] Checkout Service → %s: forwarding JWT", method)
+		}
 		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+jwtToken)
 	}
 
@@ -181,34 +53,53 @@ func jwtUnaryClientInterceptor(ctx context.Context, method string, req, reply in
 
 // jwtStreamClientInterceptor forwards JWT from incoming request to outgoing gRPC stream calls
 func jwtStreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	log := jwtLogFromContext(ctx)
 	// Get JWT from context
 	jwtToken, ok := ctx.Value(ctxKeyJWT{}).(string)
-	if !ok || jwtToken == "" {
+	if !ok || jwtToken == "" || skipJWTMethod(method) {
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	jwtToken, asReceived := jwtForwarding.forwardedToken(ctx, method, jwtToken)
+	if jwtToken == "" {
 		return streamer(ctx, desc, cc, method, opts...)
 	}
 
-	// Check if compression is enabled
-	if IsJWTCompressionEnabled() {
-		components, err := DecomposeJWT(jwtToken)
+	// Check if compression is enabled; reference tokens are forwarded as is
+	if IsJWTCompressionEnabled() && !isOpaqueToken(jwtToken) {
+		pairs, err := jwtCodec.Encode(jwtToken)
 		if err != nil {
 			log.Warnf("Failed to decompose JWT for stream, using full token: %v", err)
 			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+jwtToken)
 		} else {
 			// gRPC automatically base64-encodes -bin headers, send raw string
 			
-			ctx = metadata.AppendToOutgoingContext(ctx,
-				"x-jwt-static", components.Static,
-				"x-jwt-session", components.Session,
-				"x-jwt-dynamic-bin", components.Dynamic,
-				"x-jwt-sig-bin", components.Signature)
+			ctx = metadata.AppendToOutgoingContext(ctx, forwardDetachedJWS(ctx, pairs, asReceived)...)
 			
-			log.Infof("[JWT-FLOW] Checkout Service → %s (stream): Forwarding compressed JWT (static/session=CACHED, dynamic/sig=NO-CACHE via -bin)", method)
+			if size := metadataPairsSize(pairs); jwtFlowLog.Sample(method, jwtModeCompressed, size) {
+				jwtLogger(log, jwtToken, jwtModeCompressed, size).Infof("[JWT-FLOW] Checkout Service → %s (stream): forwarding JWT (codec=%s)", method, jwtCodec.Name())
+			}
 		}
 	} else {
 		// JWT COMPRESSION DISABLED: Forward as standard authorization header
-		log.Infof("[JWT-FLOW] Checkout Service → %s (stream): Forwarding full JWT in authorization header (%d bytes)", method, len(jwtToken))
+		if jwtFlowLog.Sample(method, authorizationMode(jwtToken), len(jwtToken)) {
+			jwtLogger(log, jwtToken, authorizationMode(jwtToken), len(jwtToken)).Infof("[JWT-FLOW] Checkout Service → %s (stream): forwarding JWT", method)
+		}
 		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+jwtToken)
 	}
 
 	return streamer(ctx, desc, cc, method, opts...)
 }
+
+// forwardDetachedJWS appends the detached JWS received from the frontend to
+// re-encoded pairs. It still verifies downstream as long as this service
+// encodes with the same codec and header scheme, and only covers the
+// token as received.
+func forwardDetachedJWS(ctx context.Context, pairs []string, asReceived bool) []string {
+	if !asReceived {
+		return pairs
+	}
+	if jws, ok := ctx.Value(ctxKeyDetachedJWS{}).(string); ok && jws != "" {
+		return append(pairs, jwtHeaders.Prefix+detachedJWSField, jws)
+	}
+	return pairs
+}
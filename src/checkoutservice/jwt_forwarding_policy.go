@@ -0,0 +1,200 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// What checkout sends a downstream service on the user's behalf
+const (
+	// forwardUser forwards the user's token as received
+	forwardUser = "forward"
+	// forwardExchanged forwards a fresh token from the TokenService's
+	// Exchange, which names checkout as the actor when it has an SVID
+	forwardExchanged = "exchange"
+	// forwardStripped forwards an opaque reference token: the service
+	// learns the user's claims only by introspecting it
+	forwardStripped = "strip"
+	// forwardNone sends no user token
+	forwardNone = "none"
+)
+
+const (
+	exchangeTimeout = 2 * time.Second
+	// exchangeMinLifetime is the least lifetime a cached exchanged token
+	// must have left to be forwarded again
+	exchangeMinLifetime = 15 * time.Second
+)
+
+// jwtForwardingDecisions counts decisions by "<service>:<action>"
+var jwtForwardingDecisions = expvar.NewMap("jwt_forwarding_decisions")
+
+// forwardingRule applies action to calls to target: a service such as
+// "hipstershop.PaymentService", a method such as
+// "hipstershop.PaymentService/Charge", or "*" for every call
+type forwardingRule struct {
+	target string
+	action string
+}
+
+// forwardingPolicy decides per downstream call what user token checkout
+// sends. The first matching rule wins; calls no rule matches forward the
+// user's token, as checkout always did.
+type forwardingPolicy struct {
+	rules []forwardingRule
+
+	mu        sync.Mutex
+	exchanged map[[sha256.Size]byte]exchangedToken
+}
+
+type exchangedToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// jwtForwarding is nil unless JWT_FORWARDING_POLICY is set. It is loaded
+// in main, once logging is set up.
+var jwtForwarding *forwardingPolicy
+
+// loadForwardingPolicy reads JWT_FORWARDING_POLICY, a comma-separated list
+// of target=action rules such as
+// "hipstershop.EmailService=none,hipstershop.PaymentService=strip,*=forward".
+// Invalid rules are logged and ignored.
+func loadForwardingPolicy() *forwardingPolicy {
+	v := os.Getenv("JWT_FORWARDING_POLICY")
+	if v == "" {
+		return nil
+	}
+	p, errs := parseForwardingPolicy(v)
+	for _, err := range errs {
+		jwtLog.Warnf("ignoring JWT_FORWARDING_POLICY rule: %v", err)
+	}
+	for _, r := range p.rules {
+		if (r.action == forwardExchanged || r.action == forwardStripped) && tokenService == nil {
+			jwtLog.Warnf("JWT_FORWARDING_POLICY: %s=%s needs TOKEN_SERVICE_ADDR; those calls get no user token", r.target, r.action)
+		}
+	}
+	return p
+}
+
+func parseForwardingPolicy(v string) (*forwardingPolicy, []error) {
+	p := &forwardingPolicy{exchanged: make(map[[sha256.Size]byte]exchangedToken)}
+	var errs []error
+	for _, rule := range strings.Split(v, ",") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		target, action, ok := strings.Cut(rule, "=")
+		target, action = strings.Trim(strings.TrimSpace(target), "/"), strings.TrimSpace(action)
+		switch {
+		case !ok || target == "":
+			errs = append(errs, fmt.Errorf("%q is not target=action", rule))
+		case action != forwardUser && action != forwardExchanged && action != forwardStripped && action != forwardNone:
+			errs = append(errs, fmt.Errorf("%q has unknown action %q", rule, action))
+		default:
+			p.rules = append(p.rules, forwardingRule{target: target, action: action})
+		}
+	}
+	return p, errs
+}
+
+// decide returns the action for a call to method, a full method name such
+// as "/hipstershop.PaymentService/Charge", and the rule that chose it
+func (p *forwardingPolicy) decide(method string) (action, rule string) {
+	if p == nil {
+		return forwardUser, "default"
+	}
+	method = strings.TrimPrefix(method, "/")
+	service, _, _ := strings.Cut(method, "/")
+	for _, r := range p.rules {
+		if r.target == "*" || r.target == service || r.target == method {
+			return r.action, r.target + "=" + r.action
+		}
+	}
+	return forwardUser, "default"
+}
+
+// forwardedToken applies the policy to a call to method carrying the
+// user's token. It returns the token to send, "" for none, and whether it
+// is the user's token as received, whose detached JWS may travel with it.
+func (p *forwardingPolicy) forwardedToken(ctx context.Context, method, userToken string) (string, bool) {
+	action, rule := p.decide(method)
+	service, _, _ := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	jwtForwardingDecisions.Add(service+":"+action, 1)
+	l := jwtLogFromContext(ctx).WithField("jwt.forward.action", action).WithField("jwt.forward.rule", rule)
+	switch action {
+	case forwardNone:
+		l.Infof("[JWT-FLOW] Checkout Service → %s: policy sends no user token", method)
+		return "", false
+	case forwardExchanged, forwardStripped:
+		token, err := p.exchange(ctx, userToken, action == forwardStripped)
+		if err != nil {
+			// Failing closed: the service sees an anonymous call rather than
+			// more of the user's token than the policy allows
+			l.Warnf("[JWT-FLOW] Checkout Service → %s: token exchange failed, sending no user token: %v", method, err)
+			return "", false
+		}
+		l.Infof("[JWT-FLOW] Checkout Service → %s: policy forwards an exchanged token", method)
+		return token, false
+	}
+	if p != nil {
+		l.Debugf("[JWT-FLOW] Checkout Service → %s: policy forwards the user token", method)
+	}
+	return userToken, true
+}
+
+// exchange trades userToken at the TokenService, reusing the token of an
+// earlier exchange while it has exchangeMinLifetime left
+func (p *forwardingPolicy) exchange(ctx context.Context, userToken string, opaque bool) (string, error) {
+	if tokenService == nil {
+		return "", fmt.Errorf("TOKEN_SERVICE_ADDR is not set")
+	}
+	key := sha256.Sum256([]byte(fmt.Sprintf("%t:%s", opaque, userToken)))
+	now := time.Now()
+
+	p.mu.Lock()
+	cached, ok := p.exchanged[key]
+	p.mu.Unlock()
+	if ok && cached.expiresAt.Sub(now) > exchangeMinLifetime {
+		return cached.token, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+	defer cancel()
+	resp, err := tokenService.client.Exchange(ctx, &pb.ExchangeRequest{Token: userToken, Opaque: opaque})
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	for k, v := range p.exchanged {
+		if now.After(v.expiresAt) {
+			delete(p.exchanged, k)
+		}
+	}
+	p.exchanged[key] = exchangedToken{token: resp.GetToken(), expiresAt: time.Unix(resp.GetExpiresAt(), 0)}
+	p.mu.Unlock()
+	return resp.GetToken(), nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// fakeExchanger answers Exchange with a token naming what was asked for
+type fakeExchanger struct {
+	pb.TokenServiceClient
+	calls int
+}
+
+func (f *fakeExchanger) Exchange(ctx context.Context, in *pb.ExchangeRequest, opts ...grpc.CallOption) (*pb.ExchangeResponse, error) {
+	f.calls++
+	token := "exchanged-jwt"
+	if in.GetOpaque() {
+		token = opaqueTokenPrefix + "ref"
+	}
+	return &pb.ExchangeResponse{Token: token, ExpiresAt: time.Now().Add(time.Minute).Unix()}, nil
+}
+
+// fakeIntrospector answers Introspect with its active and exp, counting
+// the calls that reached it
+type fakeIntrospector struct {
+	pb.TokenServiceClient
+	active bool
+	exp    time.Time
+	calls  int
+}
+
+func (f *fakeIntrospector) Introspect(ctx context.Context, in *pb.IntrospectRequest, opts ...grpc.CallOption) (*pb.IntrospectResponse, error) {
+	f.calls++
+	if !f.active {
+		return &pb.IntrospectResponse{Reason: "revoked"}, nil
+	}
+	return &pb.IntrospectResponse{Active: true, ExpiresAt: f.exp.Unix()}, nil
+}
+
+func TestTokenIntrospectorCache(t *testing.T) {
+	var none *tokenIntrospector
+	if err := none.introspect(context.Background(), "any"); err != nil {
+		t.Errorf("introspect() without a token service = %v", err)
+	}
+
+	fake := &fakeIntrospector{active: true, exp: time.Now().Add(time.Hour)}
+	ti := &tokenIntrospector{client: fake, cache: make(map[[sha256.Size]byte]introspection)}
+	for i := 0; i < 3; i++ {
+		if err := ti.introspect(context.Background(), "token-a"); err != nil {
+			t.Fatalf("introspect() error = %v", err)
+		}
+	}
+	if fake.calls != 1 {
+		t.Errorf("Introspect called %d times for one token, want 1", fake.calls)
+	}
+
+	// Results expire with the cache TTL
+	ti.cache[sha256.Sum256([]byte("token-a"))] = introspection{active: true, expiresAt: time.Now().Add(-time.Second)}
+	if err := ti.introspect(context.Background(), "token-a"); err != nil || fake.calls != 2 {
+		t.Errorf("introspect() after the TTL = %v with %d calls, want a second call", err, fake.calls)
+	}
+
+	// and no later than the token's exp
+	fake.exp = time.Now().Add(-time.Second)
+	ti.introspect(context.Background(), "token-b")
+	ti.introspect(context.Background(), "token-b")
+	if fake.calls != 4 {
+		t.Errorf("Introspect called %d times, want 4: a result past the token's exp is not reused", fake.calls)
+	}
+
+	// An inactive token is rejected as invalid, and that is cached too
+	fake.active = false
+	for i := 0; i < 2; i++ {
+		if err := ti.introspect(context.Background(), "token-c"); !errors.Is(err, errJWTSignatureInvalid) {
+			t.Errorf("introspect(inactive) = %v, want errJWTSignatureInvalid", err)
+		}
+	}
+	if fake.calls != 5 {
+		t.Errorf("Introspect called %d times, want 5", fake.calls)
+	}
+}
+
+func TestForwardingPolicy(t *testing.T) {
+	p, errs := parseForwardingPolicy("hipstershop.EmailService=none, hipstershop.PaymentService/Charge=strip,hipstershop.ShippingService=exchange,bogus,x=copy,*=forward")
+	if len(errs) != 2 {
+		t.Errorf("parse errors = %v, want 2", errs)
+	}
+
+	exchanger := &fakeExchanger{}
+	defer func(ts *tokenIntrospector) { tokenService = ts }(tokenService)
+	tokenService = &tokenIntrospector{client: exchanger}
+
+	const user = "user-jwt"
+	tests := []struct {
+		method     string
+		want       string
+		asReceived bool
+	}{
+		{"/hipstershop.EmailService/SendOrderConfirmation", "", false},
+		{"/hipstershop.PaymentService/Charge", opaqueTokenPrefix + "ref", false},
+		{"/hipstershop.ShippingService/GetQuote", "exchanged-jwt", false},
+		{"/hipstershop.ShippingService/ShipOrder", "exchanged-jwt", false},
+		{"/hipstershop.CartService/GetCart", user, true},
+	}
+	for _, tt := range tests {
+		got, asReceived := p.forwardedToken(context.Background(), tt.method, user)
+		if got != tt.want || asReceived != tt.asReceived {
+			t.Errorf("forwardedToken(%s) = %q, %v; want %q, %v", tt.method, got, asReceived, tt.want, tt.asReceived)
+		}
+	}
+	if exchanger.calls != 2 {
+		t.Errorf("Exchange called %d times, want 2: exchanged tokens are reused", exchanger.calls)
+	}
+
+	// Without a policy every call forwards the user's token
+	var none *forwardingPolicy
+	if got, asReceived := none.forwardedToken(context.Background(), "/hipstershop.EmailService/SendOrderConfirmation", user); got != user || !asReceived {
+		t.Errorf("forwardedToken without policy = %q, %v", got, asReceived)
+	}
+}
+
+func TestForwardingPolicySendsNothing(t *testing.T) {
+	defer func(p *forwardingPolicy) { jwtForwarding = p }(jwtForwarding)
+	jwtForwarding, _ = parseForwardingPolicy("hipstershop.EmailService=none")
+
+	ctx := context.WithValue(context.Background(), ctxKeyJWT{}, "user-jwt")
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		if len(md) != 0 {
+			t.Errorf("%s sent metadata %v", method, md)
+		}
+		return nil
+	}
+	jwtUnaryClientInterceptor(ctx, "/hipstershop.EmailService/SendOrderConfirmation", nil, nil, nil, invoker)
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// The fixtures are written by the frontend's jwt_golden_test.go. Every one
+// of them, including those of older versions, must decode with this
+// service's copy of the codec and survive being forwarded.
+const jwtGoldenDir = "../frontend/testdata/jwt-golden"
+
+type jwtGoldenFixture struct {
+	Codec     string                 `json:"codec"`
+	MACSecret string                 `json:"mac_secret,omitempty"`
+	Detached  bool                   `json:"detached_jws,omitempty"`
+	Meta      bool                   `json:"meta_header,omitempty"`
+	Token     string                 `json:"token"`
+	Claims    map[string]interface{} `json:"claims"`
+	Metadata  map[string]string      `json:"metadata"`
+}
+
+func goldenCodec(name string) JWTCodec {
+	if name == jwtCodecPerClaim {
+		return perClaimCodec{scheme: jwtHeaders}
+	}
+	return perClassCodec{}
+}
+
+// decodeGolden decodes md and checks the token carries the fixture's claims
+func decodeGolden(t *testing.T, f jwtGoldenFixture, md metadata.MD) *DecodedJWT {
+	t.Helper()
+	decoded, err := DecodeJWTMetadata(md)
+	if err != nil || decoded == nil {
+		t.Fatalf("DecodeJWTMetadata() = %v, %v", decoded, err)
+	}
+	if decoded.Codec != f.Codec {
+		t.Errorf("decoded with codec %q, want %q", decoded.Codec, f.Codec)
+	}
+	if err := checkJWTExpiry(decoded.Token); err != nil {
+		t.Errorf("checkJWTExpiry() error = %v", err)
+	}
+	_, payload, _, err := parseJWT(decoded.Token)
+	if err != nil {
+		t.Fatalf("parseJWT() error = %v", err)
+	}
+	if !reflect.DeepEqual(payload, f.Claims) {
+		t.Errorf("claims differ\n got: %v\nwant: %v", payload, f.Claims)
+	}
+	return decoded
+}
+
+func TestJWTGolden(t *testing.T) {
+	t.Setenv("JWT_PUBLIC_KEY_PATH", "../frontend/jwt_public_key.pem")
+	files, err := filepath.Glob(filepath.Join(jwtGoldenDir, "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no golden fixtures in %s: %v", jwtGoldenDir, err)
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var f jwtGoldenFixture
+			if err := json.Unmarshal(b, &f); err != nil {
+				t.Fatal(err)
+			}
+
+			defer func(key []byte) { componentMACKey = key }(componentMACKey)
+			componentMACKey = nil
+			if f.MACSecret != "" {
+				t.Setenv("JWT_COMPONENT_MAC_SECRET", f.MACSecret)
+				componentMACKey = loadComponentMACKey()
+			}
+			t.Setenv("JWT_DETACHED_SIGNATURE", "")
+			if f.Detached {
+				t.Setenv("JWT_DETACHED_SIGNATURE", "true")
+			}
+			t.Setenv("JWT_META_HEADER", "")
+			if f.Meta {
+				t.Setenv("JWT_META_HEADER", "true")
+			}
+
+			md := metadata.MD{}
+			for k, v := range f.Metadata {
+				if strings.HasSuffix(k, "-bin") {
+					raw, err := base64.StdEncoding.DecodeString(v)
+					if err != nil {
+						t.Fatalf("fixture value %s: %v", k, err)
+					}
+					v = string(raw)
+				}
+				md.Set(k, v)
+			}
+			decoded := decodeGolden(t, f, md)
+
+			// Forward the token as a service in the middle of the chain
+			// would, then decode it again
+			pairs, err := goldenCodec(f.Codec).Encode(decoded.Token)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if decoded.DetachedJWS != "" {
+				pairs = append(pairs, jwtHeaders.Prefix+detachedJWSField, decoded.DetachedJWS)
+			}
+			decodeGolden(t, f, metadata.Pairs(pairs...))
+		})
+	}
+}
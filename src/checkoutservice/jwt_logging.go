@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// JWT log fields, named the same in every service so one query follows a
+// token through the fan-out
+const (
+	logFieldJTI     = "jwt.jti"
+	logFieldSubHash = "jwt.sub_hash"
+	logFieldMode    = "jwt.mode"
+	logFieldSize    = "jwt.size_bytes"
+)
+
+// JWT metadata modes, from largest to smallest on the wire
+const (
+	jwtModeFull       = "full"
+	jwtModeCompressed = "compressed"
+	jwtModeReference  = "reference"
+)
+
+// jwtLogFields returns the standard fields for token, carried in mode and
+// taking size bytes of metadata. The subject is only ever logged hashed.
+// Reference tokens carry no claims, so they get no jti or subject.
+func jwtLogFields(token, mode string, size int) logrus.Fields {
+	fields := logrus.Fields{logFieldMode: mode, logFieldSize: size}
+	if authorizationMode(token) == jwtModeReference {
+		return fields
+	}
+	segments, err := splitJWT(token)
+	if err != nil {
+		return fields
+	}
+	// A claim of the wrong type is left empty; the others still decode
+	var claims jwtClaimSet
+	segments.DecodePayload(&claims)
+	if claims.ID != "" {
+		fields[logFieldJTI] = claims.ID
+	}
+	if claims.Subject != "" {
+		fields[logFieldSubHash] = hashSubject(claims.Subject)
+	}
+	return fields
+}
+
+// jwtLogger adds the standard JWT fields to l
+func jwtLogger(l logrus.FieldLogger, token, mode string, size int) logrus.FieldLogger {
+	return l.WithFields(jwtLogFields(token, mode, size))
+}
+
+// hashSubject is a short, stable stand-in for a subject in logs
+func hashSubject(sub string) string {
+	sum := sha256.Sum256([]byte(sub))
+	return hex.EncodeToString(sum[:8])
+}
+
+// authorizationMode is the mode of a token sent in the authorization header
+func authorizationMode(token string) string {
+	if strings.HasPrefix(token, opaqueTokenPrefix) {
+		return jwtModeReference
+	}
+	return jwtModeFull
+}
+
+// jwtFlowLog decides which per-call [JWT-FLOW] lines are written. At load
+// test rates a line per RPC buries everything else, so JWT_FLOW_LOG_RATE
+// caps the lines per method and second, and every JWT_FLOW_LOG_SUMMARY
+// (default 1m) a summary per method reports what the cap left out. 0
+// writes summaries only; unset or invalid, every call is logged, without
+// summaries.
+var jwtFlowLog = loadJWTFlowSampler()
+
+// jwtFlowSampler rate-limits per-call log lines by method and aggregates
+// the calls it sees
+type jwtFlowSampler struct {
+	// rate is the lines per method and second, -1 for every call
+	rate     int
+	interval time.Duration
+	start    sync.Once
+
+	mu      sync.Mutex
+	methods map[string]*jwtFlowStats
+}
+
+// jwtFlowStats are one method's calls since the last summary
+type jwtFlowStats struct {
+	calls, logged int64
+	bytes         int64
+	modes         map[string]int64
+	// second is the unix second lines were last counted in, and lines
+	// the lines written in it
+	second int64
+	lines  int
+	// maxSize is the largest metadata seen, kept across summaries
+	maxSize int
+}
+
+func loadJWTFlowSampler() *jwtFlowSampler {
+	s := &jwtFlowSampler{rate: -1, interval: time.Minute, methods: make(map[string]*jwtFlowStats)}
+	if v := os.Getenv("JWT_FLOW_LOG_RATE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			s.rate = n
+		}
+	}
+	if v := os.Getenv("JWT_FLOW_LOG_SUMMARY"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			s.interval = d
+		}
+	}
+	return s
+}
+
+// Sample records a call of method carrying size bytes of JWT metadata in
+// mode, and reports whether to log it. Past the rate, a call is still
+// logged when its metadata is the largest the method has seen, so header
+// growth shows up as it happens.
+func (s *jwtFlowSampler) Sample(method, mode string, size int) bool {
+	if s.rate < 0 {
+		return true
+	}
+	s.start.Do(func() { go s.run() })
+	now := jwtClock.Now().Unix()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.methods[method]
+	if st == nil {
+		st = &jwtFlowStats{modes: make(map[string]int64)}
+		s.methods[method] = st
+	}
+	st.calls++
+	st.bytes += int64(size)
+	st.modes[mode]++
+	if st.second != now {
+		st.second, st.lines = now, 0
+	}
+	grew := size > st.maxSize
+	if grew {
+		st.maxSize = size
+	}
+	if st.lines >= s.rate && !grew {
+		return false
+	}
+	st.lines++
+	st.logged++
+	return true
+}
+
+func (s *jwtFlowSampler) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.summarize(log)
+	}
+}
+
+// summarize writes a line per method called since the last summary to l,
+// and starts the next period
+func (s *jwtFlowSampler) summarize(l logrus.FieldLogger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	methods := make([]string, 0, len(s.methods))
+	for method, st := range s.methods {
+		if st.calls > 0 {
+			methods = append(methods, method)
+		}
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		st := s.methods[method]
+		l.WithFields(logrus.Fields{
+			"jwt.flow.calls":          st.calls,
+			"jwt.flow.logged":         st.logged,
+			"jwt.flow.avg_size_bytes": st.bytes / st.calls,
+			"jwt.flow.max_size_bytes": st.maxSize,
+			"jwt.flow.modes":          formatModeCounts(st.modes),
+		}).Infof("[JWT-FLOW] %s: %d calls in the last %s", method, st.calls, s.interval)
+		st.calls, st.logged, st.bytes = 0, 0, 0
+		st.modes = make(map[string]int64)
+	}
+}
+
+// formatModeCounts writes counts as "compressed=12 full=3", by mode
+func formatModeCounts(counts map[string]int64) string {
+	modes := make([]string, 0, len(counts))
+	for mode := range counts {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	for i, mode := range modes {
+		modes[i] = fmt.Sprintf("%s=%d", mode, counts[mode])
+	}
+	return strings.Join(modes, " ")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// jwtLog is the logger JWT code writes to. It writes the same JSON lines as
+// log, but at its own level, so the per-call JWT lines can be turned up or
+// down without the rest of the service's.
+var jwtLog *logrus.Logger
+
+// initLogging sets up log at LOG_LEVEL and jwtLog at JWT_LOG_LEVEL, which
+// defaults to LOG_LEVEL. Levels are logrus names (debug, info, warn,
+// error); the default is debug.
+func initLogging() {
+	log = newJSONLogger()
+	log.Level = loadLogLevel("LOG_LEVEL", logrus.DebugLevel)
+	jwtLog = newJSONLogger()
+	jwtLog.Level = loadLogLevel("JWT_LOG_LEVEL", log.Level)
+}
+
+// newJSONLogger returns a logger writing JSON lines to stdout, with the
+// field names of the frontend's logs so both go through one pipeline, and
+// tokens redacted
+func newJSONLogger() *logrus.Logger {
+	l := logrus.New()
+	l.Formatter = &logrus.JSONFormatter{
+		FieldMap: logrus.FieldMap{
+			logrus.FieldKeyTime:  "timestamp",
+			logrus.FieldKeyLevel: "severity",
+			logrus.FieldKeyMsg:   "message",
+		},
+		TimestampFormat: time.RFC3339Nano,
+	}
+	l.Out = os.Stdout
+	l.AddHook(redactionHook{})
+	return l
+}
+
+// loadLogLevel reads the level in env, or returns def when it is unset or
+// not a level
+func loadLogLevel(env string, def logrus.Level) logrus.Level {
+	v := os.Getenv(env)
+	if v == "" {
+		return def
+	}
+	level, err := logrus.ParseLevel(v)
+	if err != nil {
+		log.Warnf("ignoring invalid %s %q", env, v)
+		return def
+	}
+	return level
+}
+
+// jwtLogFromContext is logFromContext on jwtLog: the request's correlation
+// fields, at JWT_LOG_LEVEL
+func jwtLogFromContext(ctx context.Context) logrus.FieldLogger {
+	if e, ok := logFromContext(ctx).(*logrus.Entry); ok {
+		return jwtLog.WithFields(e.Data)
+	}
+	return jwtLog
+}
@@ -27,6 +27,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip" // accepts gzip-compressed calls, see MESSAGE_COMPRESSION in the frontend
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
@@ -47,18 +49,19 @@ const (
 
 var log *logrus.Logger
 
+// The JWT server interceptors of this service
+var jwtUnaryServerInterceptor, jwtStreamServerInterceptor = jwtServerInterceptors(
+	jwtAuthFlow("Checkout Service ← Frontend"),
+	jwtPropagateClaims(),
+	jwtAuthMetrics(),
+	jwtMaxSkew(loadJWTMaxSkew()),
+	jwtCacheClaims(loadClaimsCacheSize()),
+	jwtCircuitBreaker(loadJWTBreaker()),
+	jwtValidateClaims(loadJWTClaimsValidation()),
+)
+
 func init() {
-	log = logrus.New()
-	log.Level = logrus.DebugLevel
-	log.Formatter = &logrus.JSONFormatter{
-		FieldMap: logrus.FieldMap{
-			logrus.FieldKeyTime:  "timestamp",
-			logrus.FieldKeyLevel: "severity",
-			logrus.FieldKeyMsg:   "message",
-		},
-		TimestampFormat: time.RFC3339Nano,
-	}
-	log.Out = os.Stdout
+	initLogging()
 }
 
 type checkoutService struct {
@@ -113,6 +116,10 @@ func main() {
 	mustMapEnv(&svc.emailSvcAddr, "EMAIL_SERVICE_ADDR")
 	mustMapEnv(&svc.paymentSvcAddr, "PAYMENT_SERVICE_ADDR")
 
+	spiffeMTLS = loadSPIFFEConfig()
+	tokenService = newTokenIntrospector(os.Getenv("TOKEN_SERVICE_ADDR"))
+	svcTokens = loadServiceTokenSource()
+	jwtForwarding = loadForwardingPolicy()
 	mustConnGRPC(ctx, &svc.shippingSvcConn, svc.shippingSvcAddr)
 	mustConnGRPC(ctx, &svc.productCatalogSvcConn, svc.productCatalogSvcAddr)
 	mustConnGRPC(ctx, &svc.cartSvcConn, svc.cartSvcAddr)
@@ -122,6 +129,8 @@ func main() {
 
 	log.Infof("service config: %+v", svc)
 
+	go serveDebug(log)
+
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
 	if err != nil {
 		log.Fatal(err)
@@ -134,20 +143,11 @@ func main() {
 		propagation.NewCompositeTextMapPropagator(
 			propagation.TraceContext{}, propagation.Baggage{}))
 	
-	// Chain interceptors: JWT server (receives/reassembles) -> OpenTelemetry
-	// Configure HPACK table size: 256KB total (224KB HPACK table + 32KB overhead)
+	// Chain interceptors: correlation IDs -> JWT server (receives/reassembles) -> OpenTelemetry
+	// Max header list size: MAX_HEADER_LIST_SIZE, 256KB by default (224KB HPACK table + 32KB overhead)
 	// With JWT shredding, this allows caching 1052 user sessions simultaneously
-	srv = grpc.NewServer(
-		grpc.ChainUnaryInterceptor(
-			jwtUnaryServerInterceptor,
-			otelgrpc.UnaryServerInterceptor(),
-		),
-		grpc.ChainStreamInterceptor(
-			jwtStreamServerInterceptor,
-			otelgrpc.StreamServerInterceptor(),
-		),
-		grpc.MaxHeaderListSize(262144), // 256KB (224KB HPACK table + 32KB overhead)
-	)
+	// Connection recycling: GRPC_MAX_CONNECTION_AGE, never by default
+	srv = grpc.NewServer(serverOptions()...)
 
 	pb.RegisterCheckoutServiceServer(srv, svc)
 	healthpb.RegisterHealthServer(srv, svc)
@@ -220,20 +220,53 @@ func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
 	var err error
 	ctx, cancel := context.WithTimeout(ctx, time.Second*3)
 	defer cancel()
-	// Configure HPACK table size: 256KB total for high concurrency
-	*conn, err = grpc.DialContext(ctx, addr,
-		grpc.WithInsecure(),
+	*conn, err = grpc.DialContext(ctx, addr, dialOptions(addr)...)
+	if err != nil {
+		panic(errors.Wrapf(err, "grpc: failed to connect %s", addr))
+	}
+}
+
+// serverOptions are the options of the gRPC server: the interceptor chains
+// and transport settings
+func serverOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(
+			correlationUnaryServerInterceptor,
+			jwtUnaryServerInterceptor,
+			otelgrpc.UnaryServerInterceptor(),
+		),
+		grpc.ChainStreamInterceptor(
+			correlationStreamServerInterceptor,
+			jwtStreamServerInterceptor,
+			otelgrpc.StreamServerInterceptor(),
+		),
+		grpc.MaxHeaderListSize(maxHeaderListSize),
+		spiffeMTLS.serverOption(),
+		keepaliveServerOption(),
+		keepaliveEnforcementOption(),
+	}
+}
+
+// dialOptions are the options of the connection to the backend at addr,
+// which forward the caller's JWT
+func dialOptions(addr string) []grpc.DialOption {
+	// Max header list size: MAX_HEADER_LIST_SIZE, 256KB by default for high concurrency
+	return []grpc.DialOption{
+		spiffeMTLS.dialOption(addr),
 		grpc.WithChainUnaryInterceptor(
+			correlationUnaryClientInterceptor,
 			jwtUnaryClientInterceptor,
+			svcTokenUnaryClientInterceptor,
 			otelgrpc.UnaryClientInterceptor(),
 		),
 		grpc.WithChainStreamInterceptor(
+			correlationStreamClientInterceptor,
 			jwtStreamClientInterceptor,
+			svcTokenStreamClientInterceptor,
 			otelgrpc.StreamClientInterceptor(),
 		),
-		grpc.WithMaxHeaderListSize(262144)) // 256KB (224KB HPACK table + 32KB overhead)
-	if err != nil {
-		panic(errors.Wrapf(err, "grpc: failed to connect %s", addr))
+		grpc.WithMaxHeaderListSize(maxHeaderListSize),
+		keepaliveDialOption(),
 	}
 }
 
@@ -246,19 +279,50 @@ func (cs *checkoutService) Watch(req *healthpb.HealthCheckRequest, ws healthpb.H
 }
 
 func (cs *checkoutService) PlaceOrder(ctx context.Context, req *pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error) {
+	log := logFromContext(ctx)
 	log.Infof("[PlaceOrder] user_id=%q user_currency=%q", req.UserId, req.UserCurrency)
 
+	if key := placeOrderLockKey(ctx, req.UserId); key != "" {
+		release, ok := placeOrderLocks.acquire(key)
+		if !ok {
+			log.Warn("[PlaceOrder] rejecting concurrent order for the session")
+			return nil, status.Errorf(codes.AlreadyExists, "an order is already being placed for this session")
+		}
+		defer release()
+	}
+
+	// A retry of an order that was already placed gets the same answer
+	// instead of a second charge. Checked under the session lock, so a
+	// retry racing the original is turned away rather than placed twice.
+	key := idempotencyKey(ctx)
+	if key != "" {
+		if placed, ok := placeOrderResults.get(key); ok {
+			placeOrderDeduplicated.Add(1)
+			log.Infof("[PlaceOrder] replaying order %s for a retried request", placed.resp.GetOrder().GetOrderId())
+			header := metadata.Pairs(idempotentReplayHeader, "true")
+			if placed.orderToken != "" {
+				header.Set(orderTokenHeader, placed.orderToken)
+			}
+			grpc.SetHeader(ctx, header)
+			return placed.resp, nil
+		}
+	}
+
 	orderID, err := uuid.NewUUID()
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to generate order uuid")
 	}
 
-	prep, err := cs.prepareOrderItemsAndShippingQuoteFromCart(ctx, req.UserId, req.UserCurrency, req.Address)
+	currency := orderCurrency(ctx, req.UserCurrency)
+	if currency != req.UserCurrency {
+		log.Infof("[PlaceOrder] charging in %s rather than the requested %q", currency, req.UserCurrency)
+	}
+	prep, err := cs.prepareOrderItemsAndShippingQuoteFromCart(ctx, req.UserId, currency, req.Address)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
 
-	total := pb.Money{CurrencyCode: req.UserCurrency,
+	total := pb.Money{CurrencyCode: currency,
 		Units: 0,
 		Nanos: 0}
 	total = money.Must(money.Sum(total, *prep.shippingCostLocalized))
@@ -288,12 +352,24 @@ func (cs *checkoutService) PlaceOrder(ctx context.Context, req *pb.PlaceOrderReq
 		Items:              prep.orderItems,
 	}
 
-	if err := cs.sendOrderConfirmation(ctx, req.Email, orderResult); err != nil {
+	// The order token goes back to the frontend in the response headers
+	// and authorizes the confirmation email
+	orderToken, err := mintOrderToken(req.UserId, req.Email, orderResult, &total)
+	if err != nil {
+		log.Warnf("failed to mint order token for %s: %v", orderResult.OrderId, err)
+	} else if orderToken != "" {
+		grpc.SetHeader(ctx, metadata.Pairs(orderTokenHeader, orderToken))
+	}
+
+	if err := cs.sendOrderConfirmation(ctx, req.Email, orderResult, orderToken); err != nil {
 		log.Warnf("failed to send order confirmation to %q: %+v", req.Email, err)
 	} else {
 		log.Infof("order confirmation email sent to %q", req.Email)
 	}
 	resp := &pb.PlaceOrderResponse{Order: orderResult}
+	if key != "" {
+		placeOrderResults.put(key, resp, orderToken)
+	}
 	return resp, nil
 }
 
@@ -394,7 +470,10 @@ func (cs *checkoutService) chargeCard(ctx context.Context, amount *pb.Money, pay
 	return paymentResp.GetTransactionId(), nil
 }
 
-func (cs *checkoutService) sendOrderConfirmation(ctx context.Context, email string, order *pb.OrderResult) error {
+func (cs *checkoutService) sendOrderConfirmation(ctx context.Context, email string, order *pb.OrderResult, orderToken string) error {
+	if orderToken != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, orderTokenHeader, orderToken)
+	}
 	_, err := pb.NewEmailServiceClient(cs.emailSvcConn).SendOrderConfirmation(ctx, &pb.SendOrderConfirmationRequest{
 		Email: email,
 		Order: order})
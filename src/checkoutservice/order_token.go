@@ -0,0 +1,101 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+const (
+	// orderTokenHeader carries the order-confirmation token: in the
+	// PlaceOrder response headers, and on the SendOrderConfirmation call
+	orderTokenHeader = "x-order-token"
+	orderTokenIssuer = "urn:hipstershop:checkoutservice"
+
+	defaultOrderTokenLifetime = 15 * time.Minute
+)
+
+// orderTokenKey signs order-confirmation tokens (HS256). It is read from
+// ORDER_TOKEN_SECRET, which the frontend and the email service share to
+// verify them; nil disables the tokens.
+var orderTokenKey = loadOrderTokenKey()
+
+func loadOrderTokenKey() []byte {
+	if secret := os.Getenv("ORDER_TOKEN_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return nil
+}
+
+// orderTokenClaims proves who placed an order, what it cost and where its
+// confirmation goes, so the confirmation page and email can be authorized
+// without an order lookup
+type orderTokenClaims struct {
+	Issuer    string    `json:"iss"`
+	Subject   string    `json:"sub"`
+	OrderID   string    `json:"order_id"`
+	Amount    *pb.Money `json:"amount"`
+	Recipient string    `json:"rcpt"`
+	IssuedAt  int64     `json:"iat"`
+	ExpiresAt int64     `json:"exp"`
+}
+
+// orderTokenRecipient is the rcpt claim for email: a hash, so the token,
+// which the frontend keeps in a cookie, does not carry the address
+func orderTokenRecipient(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// mintOrderToken returns a compact HS256 JWT for the order placed by
+// userID and confirmed to email, or "" when order tokens are not
+// configured
+func mintOrderToken(userID, email string, order *pb.OrderResult, total *pb.Money) (string, error) {
+	if orderTokenKey == nil {
+		return "", nil
+	}
+	lifetime := defaultOrderTokenLifetime
+	if v := os.Getenv("ORDER_TOKEN_LIFETIME"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			lifetime = d
+		}
+	}
+	now := time.Now()
+	payload, err := json.Marshal(orderTokenClaims{
+		Issuer:    orderTokenIssuer,
+		Subject:   userID,
+		OrderID:   order.GetOrderId(),
+		Amount:    &pb.Money{CurrencyCode: total.GetCurrencyCode(), Units: total.GetUnits(), Nanos: total.GetNanos()},
+		Recipient: orderTokenRecipient(email),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(lifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) +
+		"." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, orderTokenKey)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
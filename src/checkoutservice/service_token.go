@@ -0,0 +1,187 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// svcAuthorizationHeader carries checkout's own token, next to the user
+// token it forwards, so downstream services can tell who is calling from
+// on whose behalf
+const svcAuthorizationHeader = "x-svc-authorization"
+
+const (
+	svcTokenFetchTimeout = 2 * time.Second
+	// svcTokenRefreshMargin is how long before expiry a token is replaced
+	svcTokenRefreshMargin = 30 * time.Second
+)
+
+// svcTokenStats counts service token fetches and failures
+var svcTokenStats = expvar.NewMap("svc_tokens")
+
+// serviceTokenSource obtains checkout's own token with the OAuth2
+// client-credentials grant, from the frontend's TokenService or from an
+// external issuer's token endpoint, and caches it until shortly before
+// it expires
+type serviceTokenSource struct {
+	clientID     string
+	clientSecret string
+	// fetch requests a new token
+	fetch func(ctx context.Context) (string, time.Time, error)
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// svcTokens is nil unless SVC_CLIENT_ID is set
+var svcTokens *serviceTokenSource
+
+// loadServiceTokenSource reads SVC_CLIENT_ID and SVC_CLIENT_SECRET. Tokens
+// come from the OAuth2 token endpoint SVC_TOKEN_URL if set (optionally
+// asking for SVC_TOKEN_AUDIENCE), otherwise from the TokenService at
+// TOKEN_SERVICE_ADDR.
+func loadServiceTokenSource() *serviceTokenSource {
+	clientID := os.Getenv("SVC_CLIENT_ID")
+	if clientID == "" {
+		return nil
+	}
+	s := &serviceTokenSource{clientID: clientID, clientSecret: os.Getenv("SVC_CLIENT_SECRET")}
+	switch tokenURL := os.Getenv("SVC_TOKEN_URL"); {
+	case tokenURL != "":
+		client := &http.Client{Timeout: svcTokenFetchTimeout}
+		audience := os.Getenv("SVC_TOKEN_AUDIENCE")
+		s.fetch = func(ctx context.Context) (string, time.Time, error) {
+			return s.fetchOAuth2(ctx, client, tokenURL, audience)
+		}
+	case tokenService != nil:
+		s.fetch = func(ctx context.Context) (string, time.Time, error) {
+			return s.fetchTokenService(ctx, tokenService.client)
+		}
+	default:
+		log.Warn("ignoring SVC_CLIENT_ID: neither SVC_TOKEN_URL nor TOKEN_SERVICE_ADDR is set")
+		return nil
+	}
+	return s
+}
+
+// Token returns a cached token, fetching a new one when it is about to
+// expire. A cached token that is still valid outlives a failed refresh.
+func (s *serviceTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.token != "" && now.Add(svcTokenRefreshMargin).Before(s.expiresAt) {
+		return s.token, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, svcTokenFetchTimeout)
+	defer cancel()
+	token, exp, err := s.fetch(ctx)
+	if err != nil {
+		svcTokenStats.Add("failed", 1)
+		if s.token != "" && now.Before(s.expiresAt) {
+			log.Warnf("service token refresh failed, using the current token: %v", err)
+			return s.token, nil
+		}
+		return "", err
+	}
+	svcTokenStats.Add("fetched", 1)
+	s.token, s.expiresAt = token, exp
+	return token, nil
+}
+
+func (s *serviceTokenSource) fetchTokenService(ctx context.Context, client pb.TokenServiceClient) (string, time.Time, error) {
+	resp, err := client.ClientCredentials(ctx, &pb.ClientCredentialsRequest{
+		ClientId:     s.clientID,
+		ClientSecret: s.clientSecret,
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("client credentials grant failed: %w", err)
+	}
+	return resp.GetAccessToken(), time.Unix(resp.GetExpiresAt(), 0), nil
+}
+
+// fetchOAuth2 runs the client-credentials grant of RFC 6749 section 4.4
+// against tokenURL
+func (s *serviceTokenSource) fetchOAuth2(ctx context.Context, client *http.Client, tokenURL, audience string) (string, time.Time, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if audience != "" {
+		form.Set("audience", audience)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(s.clientID), url.QueryEscape(s.clientSecret))
+	now := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("client credentials grant failed: %w", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("client credentials grant: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("client credentials grant failed: %s %s", resp.Status, body.Error)
+	}
+	return body.AccessToken, now.Add(time.Duration(body.ExpiresIn) * time.Second), nil
+}
+
+// withServiceToken adds checkout's token to outgoing metadata. Without one
+// the call still goes out, on the user's behalf only.
+func withServiceToken(ctx context.Context, method string) context.Context {
+	if svcTokens == nil || skipJWTMethod(method) {
+		return ctx
+	}
+	token, err := svcTokens.Token(ctx)
+	if err != nil {
+		logFromContext(ctx).Warnf("calling %s without a service token: %v", method, err)
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, svcAuthorizationHeader, "Bearer "+token)
+}
+
+// svcTokenUnaryClientInterceptor identifies checkout to the services it calls
+func svcTokenUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(withServiceToken(ctx, method), method, req, reply, cc, opts...)
+}
+
+// svcTokenStreamClientInterceptor identifies checkout on outgoing streams
+func svcTokenStreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(withServiceToken(ctx, method), desc, cc, method, opts...)
+}
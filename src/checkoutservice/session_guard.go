@@ -0,0 +1,129 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPlaceOrderLockTTL bounds how long a session's checkout lock can
+// be held, so a call that never returns cannot block the session for good
+const defaultPlaceOrderLockTTL = 30 * time.Second
+
+// Sessions many shoppers share: the one of ENABLE_SINGLE_SHARED_SESSION and
+// the synthetic users of LOADTEST_USER_POOL_SIZE at the frontend
+const (
+	sharedSessionID       = "12345678-1234-1234-1234-123456789123"
+	loadtestSessionPrefix = "loadtest-user-"
+)
+
+// sessionLocks lets one PlaceOrder at a time run per session, so a double
+// submit cannot charge the card twice. Locks expire after ttl, and expired
+// ones are swept every ttl.
+type sessionLocks struct {
+	ttl   time.Duration
+	sweep sync.Once
+
+	mu    sync.Mutex
+	next  uint64
+	locks map[string]sessionLock
+}
+
+type sessionLock struct {
+	owner     uint64
+	expiresAt time.Time
+}
+
+var placeOrderLocks = newSessionLocks(loadPlaceOrderLockTTL())
+
+func newSessionLocks(ttl time.Duration) *sessionLocks {
+	return &sessionLocks{ttl: ttl, locks: make(map[string]sessionLock)}
+}
+
+// loadPlaceOrderLockTTL reads PLACE_ORDER_LOCK_TTL
+func loadPlaceOrderLockTTL() time.Duration {
+	if v := os.Getenv("PLACE_ORDER_LOCK_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		log.Warnf("ignoring invalid PLACE_ORDER_LOCK_TTL=%q", v)
+	}
+	return defaultPlaceOrderLockTTL
+}
+
+// acquire takes the lock for session. It returns false if another call
+// holds it; otherwise release must be called once the call is done.
+// Releasing a lock that expired and was taken by someone else is a no-op.
+func (l *sessionLocks) acquire(session string) (release func(), ok bool) {
+	l.sweep.Do(func() { go l.run() })
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if held, ok := l.locks[session]; ok && now.Before(held.expiresAt) {
+		return nil, false
+	}
+	l.next++
+	owner := l.next
+	l.locks[session] = sessionLock{owner: owner, expiresAt: now.Add(l.ttl)}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.locks[session].owner == owner {
+			delete(l.locks, session)
+		}
+	}, true
+}
+
+func (l *sessionLocks) run() {
+	ticker := time.NewTicker(l.ttl)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		l.expire(now)
+	}
+}
+
+// expire drops the locks that expired by now
+func (l *sessionLocks) expire(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for s, held := range l.locks {
+		if !now.Before(held.expiresAt) {
+			delete(l.locks, s)
+		}
+	}
+}
+
+// placeOrderLockKey is what PlaceOrder calls of userID are serialized on:
+// the verified session of the call and the user, or "" when the call is
+// not guarded. Sessions shared by many shoppers are not guarded, as one
+// order in flight would turn away everybody else's.
+func placeOrderLockKey(ctx context.Context, userID string) string {
+	session := sessionFromContext(ctx)
+	if session == "" || session == sharedSessionID || strings.HasPrefix(session, loadtestSessionPrefix) {
+		return ""
+	}
+	return session + "/" + userID
+}
+
+// sessionFromContext returns the session_id claim of the verified JWT the
+// call came with, or "" for calls without one, such as reference tokens
+func sessionFromContext(ctx context.Context) string {
+	claims, _ := claimsFromContext(ctx)
+	return claims.SessionID
+}
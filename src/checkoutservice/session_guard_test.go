@@ -0,0 +1,87 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSessionLocks(t *testing.T) {
+	locks := newSessionLocks(50 * time.Millisecond)
+
+	release, ok := locks.acquire("s1")
+	if !ok {
+		t.Fatal("first acquire failed")
+	}
+	if _, ok := locks.acquire("s1"); ok {
+		t.Fatal("concurrent acquire for the same session succeeded")
+	}
+	if r, ok := locks.acquire("s2"); !ok {
+		t.Fatal("acquire for another session failed")
+	} else {
+		r()
+	}
+	release()
+	if r, ok := locks.acquire("s1"); !ok {
+		t.Fatal("acquire after release failed")
+	} else {
+		r()
+	}
+
+	// An expired lock is taken over, and its late release leaves the new
+	// holder's lock alone
+	stale, _ := locks.acquire("s1")
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := locks.acquire("s1"); !ok {
+		t.Fatal("acquire after expiry failed")
+	}
+	stale()
+	if _, ok := locks.acquire("s1"); ok {
+		t.Fatal("stale release freed the new holder's lock")
+	}
+}
+
+func TestPlaceOrderLockKey(t *testing.T) {
+	withSession := func(session string) context.Context {
+		return context.WithValue(context.Background(), ctxKeyClaims{}, jwtClaimSet{SessionID: session})
+	}
+	// An unverified token in the context is not trusted
+	unverified := context.WithValue(context.Background(), ctxKeyJWT{}, "e30.eyJzZXNzaW9uX2lkIjoiczEifQ.sig")
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{"verified session", withSession("s1"), "s1/u1"},
+		{"no claims", unverified, ""},
+		{"shared session", withSession(sharedSessionID), ""},
+		{"load test pool", withSession(loadtestSessionPrefix + "3"), ""},
+	} {
+		if got := placeOrderLockKey(tc.ctx, "u1"); got != tc.want {
+			t.Errorf("%s: placeOrderLockKey() = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSessionLocksExpire(t *testing.T) {
+	locks := newSessionLocks(time.Minute)
+	locks.acquire("s1")
+	locks.expire(time.Now().Add(2 * time.Minute))
+	if n := len(locks.locks); n != 0 {
+		t.Errorf("%d locks left after expiry, want 0", n)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffegrpc/grpccredentials"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// spiffeFetchTimeout bounds the wait for the first SVID at startup
+const spiffeFetchTimeout = 10 * time.Second
+
+// spiffeConfig authenticates gRPC peers with X.509 SVIDs from the SPIFFE
+// Workload API, whose source keeps the SVID and trust bundle rotated
+type spiffeConfig struct {
+	svids      x509svid.Source
+	bundles    x509bundle.Source
+	authorizer tlsconfig.Authorizer
+	// requireMTLS makes the gRPC server reject clients without an SVID
+	requireMTLS bool
+	// targets are the addresses dialed with mTLS
+	targets map[string]bool
+}
+
+// spiffeMTLS is nil unless SPIFFE_ENDPOINT_SOCKET is set
+var spiffeMTLS *spiffeConfig
+
+// loadSPIFFEConfig fetches the workload's SVID from the Workload API at
+// SPIFFE_ENDPOINT_SOCKET. Peers must belong to SPIFFE_TRUST_DOMAIN, by
+// default our own. SPIFFE_REQUIRE_MTLS=true requires client SVIDs on the
+// gRPC server; SPIFFE_MTLS_TARGETS lists the addresses dialed with mTLS.
+func loadSPIFFEConfig() *spiffeConfig {
+	if os.Getenv("SPIFFE_ENDPOINT_SOCKET") == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), spiffeFetchTimeout)
+	defer cancel()
+	source, err := workloadapi.NewX509Source(ctx)
+	if err != nil {
+		log.Fatalf("failed to fetch an X.509 SVID from the workload API: %v", err)
+	}
+	svid, err := source.GetX509SVID()
+	if err != nil {
+		log.Fatalf("failed to read the X.509 SVID: %v", err)
+	}
+	td := svid.ID.TrustDomain()
+	if v := os.Getenv("SPIFFE_TRUST_DOMAIN"); v != "" {
+		if td, err = spiffeid.TrustDomainFromString(v); err != nil {
+			log.Fatalf("invalid SPIFFE_TRUST_DOMAIN %q: %v", v, err)
+		}
+	}
+	c := &spiffeConfig{
+		svids:       source,
+		bundles:     source,
+		authorizer:  tlsconfig.AuthorizeMemberOf(td),
+		requireMTLS: os.Getenv("SPIFFE_REQUIRE_MTLS") == "true",
+		targets:     make(map[string]bool),
+	}
+	for _, addr := range strings.Split(os.Getenv("SPIFFE_MTLS_TARGETS"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			c.targets[addr] = true
+		}
+	}
+	log.Infof("SPIFFE identity %s, trusting peers in %s", svid.ID, td)
+	return c
+}
+
+// serverOption returns the transport credentials for the gRPC server:
+// mTLS when required, otherwise plaintext
+func (c *spiffeConfig) serverOption() grpc.ServerOption {
+	if c == nil || !c.requireMTLS {
+		return grpc.Creds(insecure.NewCredentials())
+	}
+	return grpc.Creds(grpccredentials.MTLSServerCredentials(c.svids, c.bundles, c.authorizer))
+}
+
+// dialOption returns the transport credentials for addr: mTLS if it is
+// one of the SPIFFE targets, otherwise plaintext
+func (c *spiffeConfig) dialOption(addr string) grpc.DialOption {
+	if c == nil || !c.targets[addr] {
+		return grpc.WithInsecure()
+	}
+	return grpc.WithTransportCredentials(grpccredentials.MTLSClientCredentials(c.svids, c.bundles, c.authorizer))
+}
+
+// peerSPIFFEID returns the SPIFFE ID of the peer that opened the
+// connection, if it presented an SVID
+func peerSPIFFEID(ctx context.Context) (string, bool) {
+	id, ok := grpccredentials.PeerIDFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return id.String(), true
+}
@@ -0,0 +1,170 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+const (
+	// opaqueTokenPrefix marks reference tokens issued by the TokenService
+	opaqueTokenPrefix = "hso_"
+
+	introspectTimeout  = 500 * time.Millisecond
+	introspectCacheTTL = 30 * time.Second
+)
+
+// tokenIntrospector asks the frontend's TokenService whether a forwarded
+// JWT is active. Results are cached per token until the shorter of the
+// cache TTL and the token's own expiry.
+type tokenIntrospector struct {
+	client pb.TokenServiceClient
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]introspection
+}
+
+type introspection struct {
+	active    bool
+	reason    string
+	claims    map[string]string
+	expiresAt time.Time
+}
+
+// tokenService is nil unless TOKEN_SERVICE_ADDR is set. It is dialed in
+// main, after spiffeMTLS is loaded.
+var tokenService *tokenIntrospector
+
+func newTokenIntrospector(addr string) *tokenIntrospector {
+	if addr == "" {
+		return nil
+	}
+	// The connection is not dialed through the JWT interceptors: the token
+	// under inspection travels in the request body.
+	conn, err := grpc.Dial(addr, spiffeMTLS.dialOption(addr))
+	if err != nil {
+		log.Errorf("token introspection disabled, failed to dial %s: %v", addr, err)
+		return nil
+	}
+	return &tokenIntrospector{
+		client: pb.NewTokenServiceClient(conn),
+		cache:  make(map[[sha256.Size]byte]introspection),
+	}
+}
+
+// introspect returns errJWTSignatureInvalid if the TokenService reports the
+// token as inactive. It is a no-op when introspection is not configured.
+func (ti *tokenIntrospector) introspect(ctx context.Context, jwtToken string) error {
+	if ti == nil {
+		return nil
+	}
+	key := sha256.Sum256([]byte(jwtToken))
+	now := time.Now()
+
+	ti.mu.Lock()
+	res, ok := ti.cache[key]
+	ti.mu.Unlock()
+
+	if !ok || now.After(res.expiresAt) {
+		ctx, cancel := context.WithTimeout(ctx, introspectTimeout)
+		defer cancel()
+		resp, err := ti.client.Introspect(ctx, &pb.IntrospectRequest{Token: jwtToken})
+		if err != nil {
+			return fmt.Errorf("token introspection failed: %w", err)
+		}
+		res = introspection{active: resp.GetActive(), reason: resp.GetReason(), claims: resp.GetClaims(), expiresAt: now.Add(introspectCacheTTL)}
+		if exp := time.Unix(resp.GetExpiresAt(), 0); resp.GetActive() && exp.Before(res.expiresAt) {
+			res.expiresAt = exp
+		}
+
+		ti.mu.Lock()
+		for k, v := range ti.cache {
+			if now.After(v.expiresAt) {
+				delete(ti.cache, k)
+			}
+		}
+		ti.cache[key] = res
+		ti.mu.Unlock()
+	}
+
+	if !res.active {
+		return fmt.Errorf("%w: inactive per token service: %s", errJWTSignatureInvalid, res.reason)
+	}
+	return nil
+}
+
+// resolveProfile fills in the name and market_id of claims minimized to a
+// profile_ref (JWT_INCLUDE_PII=false at the frontend) from the
+// TokenService's introspection of jwtToken, which verifying it cached.
+// Without introspection the claims stay as they are, and services fall
+// back as for tokens without them, such as to the market of the currency.
+func (ti *tokenIntrospector) resolveProfile(jwtToken string, claims jwtClaimSet) jwtClaimSet {
+	if ti == nil || claims.ProfileRef == "" {
+		return claims
+	}
+	ti.mu.Lock()
+	res, ok := ti.cache[sha256.Sum256([]byte(jwtToken))]
+	ti.mu.Unlock()
+	if !ok || !res.active {
+		return claims
+	}
+	if claims.Name == "" {
+		claims.Name = res.claims["name"]
+	}
+	if claims.MarketID == "" {
+		claims.MarketID = res.claims["market_id"]
+	}
+	return claims
+}
+
+func isOpaqueToken(token string) bool {
+	return strings.HasPrefix(token, opaqueTokenPrefix)
+}
+
+// verifyForwardedToken checks a token received from upstream. Reference
+// tokens carry no claims, so only the TokenService can vouch for them.
+// Mesh tokens are checked against the shared secret first.
+func verifyForwardedToken(ctx context.Context, token string) error {
+	return verifyForwardedTokenWithin(ctx, token, 0)
+}
+
+// verifyForwardedTokenWithin is verifyForwardedToken accepting JWTs up to
+// skew past their exp
+func verifyForwardedTokenWithin(ctx context.Context, token string, skew time.Duration) error {
+	if isOpaqueToken(token) {
+		if tokenService == nil {
+			return fmt.Errorf("%w: reference token received but TOKEN_SERVICE_ADDR is not set", errJWTMalformed)
+		}
+		return tokenService.introspect(ctx, token)
+	}
+	if IsMeshTokenEnabled() {
+		if err := verifyMeshToken(token); err != nil {
+			return err
+		}
+	}
+	if err := checkJWTExpiryWithin(token, skew); err != nil {
+		return err
+	}
+	return tokenService.introspect(ctx, token)
+}
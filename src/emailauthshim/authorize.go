@@ -0,0 +1,243 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/emailauthshim/genproto"
+)
+
+const (
+	// orderTokenHeader carries checkoutservice's order-confirmation token
+	orderTokenHeader = "x-order-token"
+	orderTokenIssuer = "urn:hipstershop:checkoutservice"
+)
+
+// Ways a confirmation can be authorized, as logged
+const (
+	authorizedByOrderToken     = "order token"
+	authorizedByOrderUserToken = "order token and user token"
+)
+
+// orderTokenKey verifies order-confirmation tokens. It is the
+// ORDER_TOKEN_SECRET checkoutservice signs them with; nil rejects every
+// confirmation.
+var orderTokenKey = loadOrderTokenKey()
+
+func loadOrderTokenKey() []byte {
+	if secret := os.Getenv("ORDER_TOKEN_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return nil
+}
+
+// validateUserClaims is whether user tokens must follow the claim schema,
+// see validateJWTClaims
+var validateUserClaims = loadJWTClaimsValidation()
+
+// authorizeOrderConfirmation accepts a confirmation request only if it
+// carries an order token minted for the very order and recipient being
+// confirmed. A user JWT sent along with it (full, decomposed or a
+// reference) must verify too and, when it carries claims, belong to the
+// customer the order token was minted for: a shopper's own token vouches
+// for their own orders only. It returns what authorized the request, and
+// the log fields of the token that did or failed to.
+func authorizeOrderConfirmation(ctx context.Context, in *pb.SendOrderConfirmationRequest) (string, logrus.Fields, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	orderToken := firstMD(md, orderTokenHeader)
+	if orderToken == "" {
+		return "", nil, fmt.Errorf("%w: no order token", errJWTMalformed)
+	}
+	fields := jwtLogFields(orderToken, jwtModeFull, len(orderToken))
+	owner, err := verifyOrderToken(orderToken, in)
+	if err != nil {
+		return "", fields, err
+	}
+
+	decoded, err := DecodeJWTMetadata(md)
+	if err != nil {
+		return "", nil, err
+	}
+	var token string
+	if decoded != nil {
+		token = decoded.Token
+		fields = jwtLogFields(token, jwtModeCompressed, decoded.WireSize)
+	} else if auth := firstMD(md, "authorization"); auth != "" {
+		token = strings.TrimPrefix(auth, "Bearer ")
+		fields = jwtLogFields(token, authorizationMode(token), len(token))
+	}
+	if token == "" {
+		return authorizedByOrderToken, fields, nil
+	}
+	// Tickets carry a hash of the subject instead of the claims
+	if validateUserClaims && !isOpaqueToken(token) && (decoded == nil || decoded.Codec != jwtCodecTicket) {
+		if err := validateJWTClaims(token); err != nil {
+			return "", fields, err
+		}
+	}
+	if err := verifyUserToken(ctx, token); err != nil {
+		return "", fields, err
+	}
+	if claims, ok := userTokenClaims(token); ok && owner != claims.CartID && owner != claims.SessionID {
+		return "", fields, fmt.Errorf("%w: user token of session %q used for an order of %q", errJWTSessionMismatch, claims.SessionID, owner)
+	}
+	return authorizedByOrderUserToken, fields, nil
+}
+
+// verifyOrderToken checks an HS256 order token and that it was minted for
+// the order and recipient of in. It returns the token's subject, the
+// customer who placed the order.
+func verifyOrderToken(token string, in *pb.SendOrderConfirmationRequest) (string, error) {
+	if orderTokenKey == nil {
+		return "", fmt.Errorf("%w: ORDER_TOKEN_SECRET is not set", errJWTSignatureInvalid)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("%w: order token: expected 3 parts, got %d", errJWTMalformed, len(parts))
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return "", fmt.Errorf("%w: order token: unsupported header", errJWTMalformed)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("%w: order token: %v", errJWTMalformed, err)
+	}
+	mac := hmac.New(sha256.New, orderTokenKey)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", fmt.Errorf("%w: order token", errJWTSignatureInvalid)
+	}
+
+	var claims struct {
+		Issuer    string `json:"iss"`
+		Subject   string `json:"sub"`
+		OrderID   string `json:"order_id"`
+		Recipient string `json:"rcpt"`
+		ExpiresAt int64  `json:"exp"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("%w: order token: %v", errJWTMalformed, err)
+	}
+	switch {
+	case claims.Issuer != orderTokenIssuer:
+		return "", fmt.Errorf("%w: order token issued by %q", errJWTSignatureInvalid, claims.Issuer)
+	case time.Now().After(time.Unix(claims.ExpiresAt, 0)):
+		return "", fmt.Errorf("%w: order token exp=%d", errJWTExpired, claims.ExpiresAt)
+	case claims.OrderID != in.GetOrder().GetOrderId():
+		return "", fmt.Errorf("%w: order token for order %q used for %q", errJWTSessionMismatch, claims.OrderID, in.GetOrder().GetOrderId())
+	case claims.Recipient != orderTokenRecipient(in.GetEmail()):
+		return "", fmt.Errorf("%w: order token used for another recipient", errJWTSessionMismatch)
+	}
+	return claims.Subject, nil
+}
+
+// orderTokenRecipient is the rcpt claim checkoutservice mints for email
+func orderTokenRecipient(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// userTokenClaims returns the claims of a user JWT, unless it is a
+// reference token or one rebuilt from a session ticket, which carry none
+func userTokenClaims(token string) (jwtClaimSet, bool) {
+	var claims jwtClaimSet
+	if isOpaqueToken(token) {
+		return claims, false
+	}
+	segments, err := splitJWT(token)
+	if err != nil {
+		return claims, false
+	}
+	var header struct {
+		Typ string `json:"typ"`
+	}
+	if segments.DecodeHeader(&header) != nil || header.Typ == sessionTicketType || segments.DecodePayload(&claims) != nil {
+		return claims, false
+	}
+	return claims, true
+}
+
+// verifyUserToken checks a user JWT. Unlike the other services, which
+// trust the caller to have verified it, the shim must check the signature
+// itself: with the mesh secret when tokens are re-signed for the mesh, by
+// introspection, which verifies it at the frontend, or else with the
+// public key of the frontend's issuer for the token's market. Tokens that
+// carry claims must also name an accepted issuer and audience.
+func verifyUserToken(ctx context.Context, token string) error {
+	claims, ok := userTokenClaims(token)
+	if ok {
+		if err := checkJWTAllowlists(claims); err != nil {
+			return err
+		}
+	}
+	if isOpaqueToken(token) || tokenService != nil || IsMeshTokenEnabled() {
+		return verifyForwardedToken(ctx, token)
+	}
+	key := jwtVerificationKeyFor(claims.Issuer)
+	if key == nil {
+		return fmt.Errorf("%w: no verification key and TOKEN_SERVICE_ADDR is not set", errJWTSignatureInvalid)
+	}
+	if err := verifyRS256(token, key); err != nil {
+		return err
+	}
+	return checkJWTExpiry(token)
+}
+
+func verifyRS256(token string, key *rsa.PublicKey) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: expected 3 parts, got %d", errJWTMalformed, len(parts))
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "RS256" {
+		return fmt.Errorf("%w: unsupported header", errJWTMalformed)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return fmt.Errorf("%w: %v", errJWTSignatureInvalid, err)
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/emailauthshim/genproto"
+)
+
+// signOrderToken mints an order token the way checkoutservice does, for
+// an order of the golden token's cart confirmed to someone@example.com
+func signOrderToken(t *testing.T, key []byte, orderID string, exp time.Time) string {
+	t.Helper()
+	return signOrderTokenFor(t, key, orderID, "cart-golden-session", "someone@example.com", exp)
+}
+
+func signOrderTokenFor(t *testing.T, key []byte, orderID, owner, email string, exp time.Time) string {
+	t.Helper()
+	payload, err := json.Marshal(map[string]interface{}{
+		"iss":      orderTokenIssuer,
+		"sub":      owner,
+		"order_id": orderID,
+		"rcpt":     orderTokenRecipient(email),
+		"exp":      exp.Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) +
+		"." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func confirmationRequest(orderID string) *pb.SendOrderConfirmationRequest {
+	return &pb.SendOrderConfirmationRequest{Email: "someone@example.com", Order: &pb.OrderResult{OrderId: orderID}}
+}
+
+func TestAuthorizeOrderToken(t *testing.T) {
+	defer func(key []byte) { orderTokenKey = key }(orderTokenKey)
+	orderTokenKey = []byte("order-secret")
+	later := time.Now().Add(time.Minute)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid", signOrderToken(t, orderTokenKey, "order-1", later), nil},
+		{"other order", signOrderToken(t, orderTokenKey, "order-2", later), errJWTSessionMismatch},
+		{"other recipient", signOrderTokenFor(t, orderTokenKey, "order-1", "cart-golden-session", "attacker@example.com", later), errJWTSessionMismatch},
+		{"expired", signOrderToken(t, orderTokenKey, "order-1", time.Now().Add(-time.Minute)), errJWTExpired},
+		{"wrong key", signOrderToken(t, []byte("forged"), "order-1", later), errJWTSignatureInvalid},
+		{"garbage", "not-a-token", errJWTMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(orderTokenHeader, tt.token))
+			by, _, err := authorizeOrderConfirmation(ctx, confirmationRequest("order-1"))
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("authorizeOrderConfirmation() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && by != authorizedByOrderToken {
+				t.Errorf("authorized by %q, want %q", by, authorizedByOrderToken)
+			}
+		})
+	}
+
+	// Without ORDER_TOKEN_SECRET nothing is confirmed
+	orderTokenKey = nil
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(orderTokenHeader, tests[0].token))
+	if _, _, err := authorizeOrderConfirmation(ctx, confirmationRequest("order-1")); !errors.Is(err, errJWTSignatureInvalid) {
+		t.Errorf("without ORDER_TOKEN_SECRET: error = %v, want %v", err, errJWTSignatureInvalid)
+	}
+}
+
+func TestAuthorizeUserToken(t *testing.T) {
+	t.Setenv("JWT_PUBLIC_KEY_PATH", "../frontend/jwt_public_key.pem")
+	defer func(key []byte) { orderTokenKey = key }(orderTokenKey)
+	orderTokenKey = []byte("order-secret")
+	b, err := os.ReadFile(filepath.Join(jwtGoldenDir, "v1-per-class.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f jwtGoldenFixture
+	if err := json.Unmarshal(b, &f); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	request := func(orderToken, userToken string) (string, error) {
+		md := metadata.Pairs("authorization", "Bearer "+userToken)
+		if orderToken != "" {
+			md.Set(orderTokenHeader, orderToken)
+		}
+		by, _, err := authorizeOrderConfirmation(metadata.NewIncomingContext(context.Background(), md), confirmationRequest("order-1"))
+		return by, err
+	}
+
+	// A user token alone authorizes nothing
+	if _, err := request("", f.Token); !errors.Is(err, errJWTMalformed) {
+		t.Fatalf("user token alone: error = %v, want %v", err, errJWTMalformed)
+	}
+	if by, err := request(signOrderToken(t, orderTokenKey, "order-1", later), f.Token); err != nil || by != authorizedByOrderUserToken {
+		t.Fatalf("authorizeOrderConfirmation() = %q, %v, want %q", by, err, authorizedByOrderUserToken)
+	}
+	// nor does it with another customer's order token
+	theirs := signOrderTokenFor(t, orderTokenKey, "order-1", "cart-someone-else", "someone@example.com", later)
+	if _, err := request(theirs, f.Token); !errors.Is(err, errJWTSessionMismatch) {
+		t.Fatalf("another customer's order: error = %v, want %v", err, errJWTSessionMismatch)
+	}
+
+	// Tampering with the signature must not get past the shim
+	forged := f.Token[:len(f.Token)-4] + "AAAA"
+	if _, err := request(signOrderToken(t, orderTokenKey, "order-1", later), forged); !errors.Is(err, errJWTSignatureInvalid) {
+		t.Fatalf("forged token: error = %v, want %v", err, errJWTSignatureInvalid)
+	}
+
+	// and neither may a token of an issuer or audience not accepted
+	defer func(issuers, audiences []string) {
+		jwtAcceptedIssuers, jwtAcceptedAudiences = issuers, audiences
+	}(jwtAcceptedIssuers, jwtAcceptedAudiences)
+	for name, set := range map[string]func(){
+		"issuer":   func() { jwtAcceptedIssuers = []string{"https://eu.auth.hipstershop.com"} },
+		"audience": func() { jwtAcceptedAudiences = []string{"urn:hipstershop:admin"} },
+	} {
+		jwtAcceptedIssuers, jwtAcceptedAudiences = loadJWTAcceptedIssuers(), loadJWTAcceptedAudiences()
+		set()
+		if _, err := request(signOrderToken(t, orderTokenKey, "order-1", later), f.Token); !errors.Is(err, errJWTClaimsInvalid) {
+			t.Errorf("%s not accepted: error = %v, want %v", name, err, errJWTClaimsInvalid)
+		}
+	}
+
+	if _, _, err := authorizeOrderConfirmation(context.Background(), confirmationRequest("order-1")); !errors.Is(err, errJWTMalformed) {
+		t.Fatalf("no token: error = %v, want %v", err, errJWTMalformed)
+	}
+}
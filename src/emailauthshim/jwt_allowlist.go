@@ -0,0 +1,85 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// defaultJWTIssuer is the iss of the frontend's tokens outside any market
+// tenant
+const defaultJWTIssuer = "https://auth.hipstershop.com"
+
+// jwtAcceptedIssuers and jwtAcceptedAudiences are the iss and aud values
+// of the user tokens the shim accepts, as the frontend's validateJWT does
+var (
+	jwtAcceptedIssuers   = loadJWTAcceptedIssuers()
+	jwtAcceptedAudiences = loadJWTAcceptedAudiences()
+)
+
+// loadJWTAcceptedIssuers reads JWT_ACCEPTED_ISSUERS, comma-separated, by
+// default the frontend's default issuer and those in JWT_ISSUER_KEYS
+func loadJWTAcceptedIssuers() []string {
+	if issuers := splitList(os.Getenv("JWT_ACCEPTED_ISSUERS")); len(issuers) > 0 {
+		return issuers
+	}
+	issuers := []string{defaultJWTIssuer}
+	for _, pair := range splitList(os.Getenv("JWT_ISSUER_KEYS")) {
+		if iss, _, ok := strings.Cut(pair, "="); ok && iss != "" {
+			issuers = append(issuers, iss)
+		}
+	}
+	return issuers
+}
+
+// loadJWTAcceptedAudiences reads JWT_ACCEPTED_AUDIENCES, comma-separated,
+// by default jwtAudience
+func loadJWTAcceptedAudiences() []string {
+	if audiences := splitList(os.Getenv("JWT_ACCEPTED_AUDIENCES")); len(audiences) > 0 {
+		return audiences
+	}
+	return []string{jwtAudience}
+}
+
+// checkJWTAllowlists returns errJWTClaimsInvalid unless claims name an
+// accepted issuer and include an accepted audience
+func checkJWTAllowlists(claims jwtClaimSet) error {
+	accepted := false
+	for _, issuer := range jwtAcceptedIssuers {
+		accepted = accepted || claims.Issuer == issuer
+	}
+	if !accepted {
+		return fmt.Errorf("%w: issuer %q is not accepted", errJWTClaimsInvalid, claims.Issuer)
+	}
+	for _, aud := range jwtAcceptedAudiences {
+		if audienceIncludes(claims.Audience, aud) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: audience %s is not accepted", errJWTClaimsInvalid, claims.Audience)
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
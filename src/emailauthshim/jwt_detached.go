@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// detachedJWSField is appended to the scheme prefix to name the header
+// carrying the detached JWS over the transmitted components
+const detachedJWSField = "jws-bin"
+
+// detachedJWSHeader is the RFC 7797 protected header. With b64=false the
+// payload is the canonical component bytes as sent, so a receiver verifies
+// exactly what it got instead of reconstructing the original JSON.
+var detachedJWSHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","b64":false,"crit":["b64"]}`))
+
+// IsDetachedSignatureEnabled reports whether the frontend signs decomposed
+// JWTs with a detached JWS and receivers require one
+func IsDetachedSignatureEnabled() bool {
+	return os.Getenv("JWT_DETACHED_SIGNATURE") == "true"
+}
+
+func detachedSigningInput(scheme JWTHeaderScheme, entries map[string]string) []byte {
+	return append([]byte(detachedJWSHeader+"."), canonicalComponents(scheme, entries)...)
+}
+
+// signDetachedJWS signs the encoded pairs and returns the compact detached
+// serialization "<header>..<signature>"
+func signDetachedJWS(scheme JWTHeaderScheme, pairs []string, key *rsa.PrivateKey) (string, error) {
+	if key == nil {
+		return "", fmt.Errorf("no signing key")
+	}
+	digest := sha256.Sum256(detachedSigningInput(scheme, pairEntries(scheme, pairs)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign components: %w", err)
+	}
+	return detachedJWSHeader + ".." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// verifyDetachedJWS checks the detached JWS in md against the components
+// found under scheme and returns it for forwarding. It is a no-op when
+// detached signatures are disabled.
+func verifyDetachedJWS(scheme JWTHeaderScheme, md metadata.MD) (string, error) {
+	if !IsDetachedSignatureEnabled() {
+		return "", nil
+	}
+	jws := firstMD(md, scheme.Prefix+detachedJWSField)
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 || parts[1] != "" {
+		return "", fmt.Errorf("%w: missing or malformed detached JWS", errJWTSignatureInvalid)
+	}
+	if parts[0] != detachedJWSHeader {
+		return "", fmt.Errorf("%w: unsupported detached JWS header", errJWTSignatureInvalid)
+	}
+	key := jwtVerificationKey()
+	if key == nil {
+		return "", fmt.Errorf("%w: no verification key for detached JWS", errJWTSignatureInvalid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errJWTSignatureInvalid, err)
+	}
+	digest := sha256.Sum256(detachedSigningInput(scheme, metadataEntries(scheme, md)))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return "", fmt.Errorf("%w: detached JWS: %v", errJWTSignatureInvalid, err)
+	}
+	return jws, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// meshTokenAlg is the algorithm of tokens forwarded inside the mesh
+const meshTokenAlg = "HS256"
+
+var (
+	meshKeyOnce  sync.Once
+	meshKeyVal   []byte
+	meshMACBytes = sha256.Size
+
+	// meshTokenStats counts mesh tokens signed and verified, the signature
+	// bytes they carried, and rejections, for the MAC truncation study
+	meshTokenStats    = expvar.NewMap("jwt_mesh_tokens")
+	meshMACBytesGauge = expvar.NewInt("jwt_mesh_mac_bytes")
+)
+
+// IsMeshTokenEnabled reports whether tokens inside the mesh are HS256
+// tokens under a shared secret instead of the frontend's RS256 token. The
+// browser cookie stays RS256 either way. A 32-byte MAC is a tenth of an
+// RS256 signature, which shrinks the signature header accordingly.
+func IsMeshTokenEnabled() bool {
+	return os.Getenv("JWT_MESH_SECRET") != "" || os.Getenv("JWT_MESH_SECRET_PATH") != ""
+}
+
+// meshKey returns the shared secret from JWT_MESH_SECRET_PATH, a mounted
+// secret file, or from JWT_MESH_SECRET. It returns nil if the file cannot
+// be read, which fails every mesh token check.
+func meshKey() []byte {
+	meshKeyOnce.Do(func() {
+		meshMACBytes = loadMeshMACBytes()
+		meshMACBytesGauge.Set(int64(meshMACBytes))
+		if path := os.Getenv("JWT_MESH_SECRET_PATH"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				log.Errorf("failed to load JWT mesh secret: %v", err)
+				return
+			}
+			meshKeyVal = []byte(strings.TrimSpace(string(data)))
+			return
+		}
+		if secret := os.Getenv("JWT_MESH_SECRET"); secret != "" {
+			meshKeyVal = []byte(secret)
+		}
+	})
+	return meshKeyVal
+}
+
+// loadMeshMACBytes reads JWT_MESH_MAC_BYTES, a research setting that
+// truncates the HS256 MAC to its first N bytes (default 32, the full MAC).
+// Every service must use the same value, and a truncated MAC only resists
+// forgery with 8*N bits of security.
+func loadMeshMACBytes() int {
+	v := os.Getenv("JWT_MESH_MAC_BYTES")
+	if v == "" {
+		return sha256.Size
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > sha256.Size {
+		log.Warnf("invalid JWT_MESH_MAC_BYTES %q, using the full %d-byte MAC", v, sha256.Size)
+		return sha256.Size
+	}
+	if n < sha256.Size {
+		log.Warnf("truncating JWT mesh MACs to %d bytes (%d-bit security); for experiments only", n, 8*n)
+	}
+	return n
+}
+
+// signMeshToken re-signs the claims of jwtToken with HS256. The header and
+// payload are serialized the way assembleJWT reassembles them, so the
+// token survives decomposition byte for byte and receivers can verify the
+// reassembled token directly.
+func signMeshToken(jwtToken string) (string, error) {
+	key := meshKey()
+	if len(key) == 0 {
+		return "", fmt.Errorf("no JWT mesh secret")
+	}
+	header, payload, _, err := parseJWT(jwtToken)
+	if err != nil {
+		return "", err
+	}
+	header["alg"] = meshTokenAlg
+	unsigned, err := assembleJWT(header, payload, "")
+	if err != nil {
+		return "", err
+	}
+	unsigned = strings.TrimSuffix(unsigned, ".")
+	signature := base64.RawURLEncoding.EncodeToString(meshMAC(key, unsigned))
+	meshTokenStats.Add("signed", 1)
+	meshTokenStats.Add("signature_bytes", int64(len(signature)))
+	return unsigned + "." + signature, nil
+}
+
+// verifyMeshToken checks the HS256 signature of a token received inside the
+// mesh. A MAC of any length other than JWT_MESH_MAC_BYTES is rejected.
+func verifyMeshToken(jwtToken string) error {
+	err := checkMeshToken(jwtToken)
+	if err != nil {
+		meshTokenStats.Add("rejected", 1)
+	} else {
+		meshTokenStats.Add("verified", 1)
+	}
+	return err
+}
+
+func checkMeshToken(jwtToken string) error {
+	key := meshKey()
+	if len(key) == 0 {
+		return fmt.Errorf("%w: no JWT mesh secret", errJWTSignatureInvalid)
+	}
+	header, _, signature, err := parseJWT(jwtToken)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+	if header["alg"] != meshTokenAlg {
+		return fmt.Errorf("%w: mesh token signed with %v, want %s", errJWTSignatureInvalid, header["alg"], meshTokenAlg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+	unsigned := jwtToken[:strings.LastIndexByte(jwtToken, '.')]
+	if !hmac.Equal(sig, meshMAC(key, unsigned)) {
+		return fmt.Errorf("%w: mesh token MAC mismatch", errJWTSignatureInvalid)
+	}
+	return nil
+}
+
+// meshMAC returns the HMAC-SHA256 of signingInput truncated to
+// JWT_MESH_MAC_BYTES; call meshKey first
+func meshMAC(key []byte, signingInput string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(signingInput))
+	return h.Sum(nil)[:meshMACBytes]
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// jwtSegments is a compact JWT sliced at its dots. Splitting copies and
+// decodes nothing, so a service forwarding a token unchanged pays only for
+// the claims it actually reads.
+type jwtSegments struct {
+	// Header, Payload and Signature are the base64url segments
+	Header    string
+	Payload   string
+	Signature string
+}
+
+// splitJWT slices token into its three segments without allocating
+func splitJWT(token string) (jwtSegments, error) {
+	header, rest, ok := strings.Cut(token, ".")
+	if !ok {
+		return jwtSegments{}, fmt.Errorf("invalid JWT format: expected 3 parts, got 1")
+	}
+	payload, signature, ok := strings.Cut(rest, ".")
+	if !ok {
+		return jwtSegments{}, fmt.Errorf("invalid JWT format: expected 3 parts, got 2")
+	}
+	if n := strings.Count(signature, "."); n > 0 {
+		return jwtSegments{}, fmt.Errorf("invalid JWT format: expected 3 parts, got %d", n+3)
+	}
+	return jwtSegments{Header: header, Payload: payload, Signature: signature}, nil
+}
+
+// SigningInput is the "header.payload" the signature covers, a slice of
+// the original token
+func (s jwtSegments) SigningInput(token string) string {
+	return token[:len(s.Header)+1+len(s.Payload)]
+}
+
+// DecodeHeader unmarshals the JOSE header into v
+func (s jwtSegments) DecodeHeader(v interface{}) error {
+	return decodeJWTSegmentInto(s.Header, v)
+}
+
+// DecodePayload unmarshals the claims into v. Decoding into a jwtClaimSet
+// skips the map parseJWT builds.
+func (s jwtSegments) DecodePayload(v interface{}) error {
+	return decodeJWTSegmentInto(s.Payload, v)
+}
+
+// decodeJWTSegmentInto base64url-decodes segment into a pooled buffer and
+// unmarshals it into v
+func decodeJWTSegmentInto(segment string, v interface{}) error {
+	b := getJWTCodecBuffers()
+	defer putJWTCodecBuffers(b)
+	var ok bool
+	if b.payload, ok = decodeJWTSegment(b.payload, &b.raw, segment); !ok {
+		return fmt.Errorf("illegal base64url data in JWT segment")
+	}
+	return json.Unmarshal(b.payload, v)
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// The vectors are written by the frontend's jwt_vectors_test.go, see
+// testdata/jwt-vectors/README.md there. Every file must reassemble with
+// this service's copy of the codec exactly as recorded.
+const jwtVectorsDir = "../frontend/testdata/jwt-vectors"
+
+type jwtVector struct {
+	Name       string `json:"name"`
+	Components struct {
+		Static    string `json:"static"`
+		Session   string `json:"session"`
+		Dynamic   string `json:"dynamic"`
+		Signature string `json:"signature"`
+	} `json:"components"`
+	Headers     map[string]string `json:"headers"`
+	Reassembled string            `json:"reassembled"`
+	Invalid     bool              `json:"invalid"`
+}
+
+func TestJWTVectors(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join(jwtVectorsDir, "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no test vectors in %s: %v", jwtVectorsDir, err)
+	}
+	defer func(key []byte) { componentMACKey = key }(componentMACKey)
+	componentMACKey = nil
+	t.Setenv("JWT_DETACHED_SIGNATURE", "")
+	t.Setenv("JWT_META_HEADER", "")
+
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var f struct {
+			Vectors []jwtVector `json:"vectors"`
+		}
+		if err := json.Unmarshal(b, &f); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		for _, v := range f.Vectors {
+			t.Run(filepath.Base(file)+"/"+v.Name, func(t *testing.T) {
+				md := metadata.MD{}
+				for k, value := range v.Headers {
+					if strings.HasSuffix(k, "-bin") {
+						raw, err := base64.StdEncoding.DecodeString(value)
+						if err != nil {
+							t.Fatalf("vector header %s: %v", k, err)
+						}
+						value = string(raw)
+					}
+					md.Set(k, value)
+				}
+				decoded, err := DecodeJWTMetadata(md)
+				if v.Invalid {
+					if err == nil {
+						t.Errorf("DecodeJWTMetadata() = %+v, want an error", decoded)
+					}
+					return
+				}
+				if err != nil || decoded == nil {
+					t.Fatalf("DecodeJWTMetadata() = %+v, %v", decoded, err)
+				}
+				if decoded.Token != v.Reassembled {
+					t.Errorf("reassembled token\n got: %s\nwant: %s", decoded.Token, v.Reassembled)
+				}
+				c := decoded.Components
+				if c.Static != v.Components.Static || c.Session != v.Components.Session || c.Dynamic != v.Components.Dynamic || c.Signature != v.Components.Signature {
+					t.Errorf("components %+v, want %+v", *c, v.Components)
+				}
+			})
+		}
+	}
+}
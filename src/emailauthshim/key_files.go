@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Keys are read from files that may be mounted from a Kubernetes Secret or
+// projected volume. The kubelet writes such a volume as a timestamped
+// directory behind a ..data symlink, with the files symlinked through it:
+//
+//	jwt_public_key.pem -> ..data/jwt_public_key.pem
+//	..data -> ..2024_06_01_12_00_00.123456789
+//
+// and rotates it by writing a new timestamped directory and renaming a new
+// ..data over the old one. A watch on a file itself goes stale with the old
+// directory, so watchKeyFiles watches the directories holding the files,
+// reloading when ..data is replaced, or when a plain file is written.
+
+// keyReloadDelay coalesces the events of one rotation or write into one
+// reload
+const keyReloadDelay = 100 * time.Millisecond
+
+// errKeyUnchanged is returned by reloads that found the key in use
+var errKeyUnchanged = errors.New("key unchanged")
+
+var (
+	// jwtKeyVersions publishes the version of each key in use, by name.
+	// Fingerprints are of the public key, so the frontend's signing key and
+	// the services' verification keys match when they are in sync.
+	jwtKeyVersions = expvar.NewMap("jwt_key_versions")
+
+	// jwtKeyReloads counts reloads after a key file changed, keyed
+	// "<name> ok" and "<name> failed"
+	jwtKeyReloads = expvar.NewMap("jwt_key_reloads")
+
+	keyVersionsMu sync.Mutex
+	keyVersions   = make(map[string]keyVersion)
+)
+
+// keyVersion identifies a key in use and where it was read from
+type keyVersion struct {
+	Fingerprint string `json:"fingerprint"`
+	// Generation is the timestamped directory of the Secret mount the key
+	// was read from, empty for plain files
+	Generation string    `json:"generation,omitempty"`
+	LoadedAt   time.Time `json:"loaded_at"`
+}
+
+// String implements expvar.Var
+func (v keyVersion) String() string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// newKeyVersion returns the version of key read from path, "" for a key
+// not read from a file
+func newKeyVersion(path string, key *rsa.PublicKey) keyVersion {
+	v := keyVersion{Fingerprint: rsaKeyFingerprint(key), LoadedAt: time.Now()}
+	if path != "" {
+		v.Generation = secretGeneration(path)
+	}
+	return v
+}
+
+// rsaKeyFingerprint is the SHA-256 of the key's PKIX encoding, shortened
+func rsaKeyFingerprint(key *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// secretGeneration returns the timestamped directory path resolves into
+// in a Secret mount, or ""
+func secretGeneration(path string) string {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return ""
+	}
+	if dir := filepath.Base(filepath.Dir(resolved)); strings.HasPrefix(dir, "..") {
+		return dir
+	}
+	return ""
+}
+
+// recordKeyVersion publishes v as the version of the key name in use
+func recordKeyVersion(name string, v keyVersion) {
+	keyVersionsMu.Lock()
+	keyVersions[name] = v
+	keyVersionsMu.Unlock()
+	jwtKeyVersions.Set(name, v)
+}
+
+// keyInUse reports whether key is the version of name in use
+func keyInUse(name string, key *rsa.PublicKey) bool {
+	keyVersionsMu.Lock()
+	defer keyVersionsMu.Unlock()
+	v, ok := keyVersions[name]
+	return ok && v.Fingerprint == rsaKeyFingerprint(key)
+}
+
+// watchKeyFiles calls reload when one of paths changes, until the returned
+// watcher is closed. reload returns errKeyUnchanged if the key it read is
+// the one in use; on any other error the key in use is kept.
+func watchKeyFiles(name string, paths []string, reload func() error) (io.Closer, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]bool)
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return nil, fmt.Errorf("watching %s: %w", dir, err)
+		}
+		files[filepath.Clean(path)] = true
+	}
+
+	var mu sync.Mutex
+	var pending *time.Timer
+	reloadSoon := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if pending != nil {
+			pending.Stop()
+		}
+		pending = time.AfterFunc(keyReloadDelay, func() {
+			switch err := reload(); {
+			case errors.Is(err, errKeyUnchanged):
+			case err != nil:
+				jwtKeyReloads.Add(name+" failed", 1)
+				log.Warnf("keeping the %s key in use, reloading failed: %v", name, err)
+			default:
+				jwtKeyReloads.Add(name+" ok", 1)
+				log.Infof("reloaded the %s key", name)
+			}
+		})
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Base(event.Name) == "..data" || files[filepath.Clean(event.Name)] {
+					reloadSoon()
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Warnf("watching the %s key: %v", name, err)
+			}
+		}
+	}()
+	return w, nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// emailauthshim runs next to emailservice, in the same pod, and only lets
+// SendOrderConfirmation calls through to it that carry a valid
+// order-confirmation token for the order and recipient.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/profiler"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/emailauthshim/genproto"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	defaultPort         = "8080"
+	defaultUpstreamAddr = "localhost:8081"
+)
+
+var log *logrus.Logger
+
+func init() {
+	log = logrus.New()
+	log.Level = logrus.DebugLevel
+	log.Formatter = &logrus.JSONFormatter{
+		FieldMap: logrus.FieldMap{
+			logrus.FieldKeyTime:  "timestamp",
+			logrus.FieldKeyLevel: "severity",
+			logrus.FieldKeyMsg:   "message",
+		},
+		TimestampFormat: time.RFC3339Nano,
+	}
+	log.Out = os.Stdout
+	log.AddHook(redactionHook{})
+}
+
+func main() {
+	if os.Getenv("DISABLE_PROFILER") == "" {
+		log.Info("Profiling enabled.")
+		go initProfiling("emailauthshim", "1.0.0")
+	} else {
+		log.Info("Profiling disabled.")
+	}
+
+	if orderTokenKey == nil {
+		log.Warn("ORDER_TOKEN_SECRET is not set: every order confirmation will be rejected")
+	}
+
+	port := defaultPort
+	if value, ok := os.LookupEnv("PORT"); ok {
+		port = value
+	}
+	port = fmt.Sprintf(":%s", port)
+
+	upstreamAddr := defaultUpstreamAddr
+	if value, ok := os.LookupEnv("EMAIL_SERVICE_UPSTREAM_ADDR"); ok {
+		upstreamAddr = value
+	}
+	// Max header list size: MAX_HEADER_LIST_SIZE, both ways, so the JWT
+	// headers forwarded to emailservice fit as they did on the way in
+	conn, err := grpc.Dial(upstreamAddr,
+		grpc.WithInsecure(),
+		grpc.WithMaxHeaderListSize(maxHeaderListSize))
+	if err != nil {
+		log.Fatalf("failed to dial emailservice at %s: %v", upstreamAddr, err)
+	}
+	defer conn.Close()
+
+	lis, err := net.Listen("tcp", port)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(correlationUnaryServerInterceptor),
+		grpc.MaxHeaderListSize(maxHeaderListSize),
+	)
+	svc := &server{
+		email:  pb.NewEmailServiceClient(conn),
+		health: healthpb.NewHealthClient(conn),
+	}
+	pb.RegisterEmailServiceServer(srv, svc)
+	healthpb.RegisterHealthServer(srv, svc)
+	log.Infof("Email auth shim listening on port %s, forwarding to %s", port, upstreamAddr)
+
+	// Register reflection service on gRPC server.
+	reflection.Register(srv)
+	if err := srv.Serve(lis); err != nil {
+		log.Fatalf("failed to serve: %v", err)
+	}
+}
+
+// server authorizes EmailService calls and forwards them to emailservice
+type server struct {
+	pb.UnimplementedEmailServiceServer
+	healthpb.UnimplementedHealthServer
+
+	email  pb.EmailServiceClient
+	health healthpb.HealthClient
+}
+
+// Check reports emailservice's health: the shim is only useful with it
+func (s *server) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	return s.health.Check(ctx, req)
+}
+
+// SendOrderConfirmation forwards the call, with the metadata it came with,
+// once authorizeOrderConfirmation has accepted it
+func (s *server) SendOrderConfirmation(ctx context.Context, in *pb.SendOrderConfirmationRequest) (*pb.Empty, error) {
+	by, fields, err := authorizeOrderConfirmation(ctx, in)
+	log := logFromContext(ctx).WithFields(fields)
+	if err != nil {
+		log.Warnf("[SendOrderConfirmation] rejecting confirmation for order %s: %v", in.GetOrder().GetOrderId(), err)
+		return nil, jwtStatusError(err)
+	}
+	log.Infof("[SendOrderConfirmation] order %s authorized by %s", in.GetOrder().GetOrderId(), by)
+	return s.email.SendOrderConfirmation(forwardMetadata(ctx), in)
+}
+
+// forwardMetadata copies the incoming metadata to the outgoing context, so
+// emailservice sees the JWT headers exactly as the shim did
+func forwardMetadata(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	out := metadata.MD{}
+	for k, v := range md {
+		if !strings.HasPrefix(k, ":") {
+			out[k] = v
+		}
+	}
+	return metadata.NewOutgoingContext(ctx, out)
+}
+
+func initProfiling(service, version string) {
+	// TODO(ahmetb) this method is duplicated in other microservices using Go
+	// since they are not sharing packages.
+	for i := 1; i <= 3; i++ {
+		if err := profiler.Start(profiler.Config{
+			Service:        service,
+			ServiceVersion: version,
+			// ProjectID must be set if not running on GCP.
+			// ProjectID: "my-project",
+		}); err != nil {
+			log.Warnf("failed to start profiler: %+v", err)
+		} else {
+			log.Info("started Stackdriver profiler")
+			return
+		}
+		d := time.Second * 10 * time.Duration(i)
+		log.Infof("sleeping %v to retry initializing Stackdriver profiler", d)
+		time.Sleep(d)
+	}
+	log.Warn("could not initialize Stackdriver profiler after retrying, giving up")
+}
@@ -0,0 +1,306 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/validator"
+)
+
+// The REST API exposes the cart and checkout flows to clients without
+// cookies. Requests authenticate with "Authorization: Bearer <jwt>", and the
+// token travels downstream through the same interceptors (and compression)
+// as browser traffic.
+const (
+	apiPrefix    = "/api/v1"
+	apiTokenPath = apiPrefix + "/token"
+)
+
+// isAPIPath reports whether the request is for the REST API, which uses
+// Bearer tokens instead of the session and JWT cookies
+func isAPIPath(path string) bool {
+	return strings.HasPrefix(path, baseUrl+apiPrefix+"/")
+}
+
+func (fe *frontendServer) registerAPIRoutes(r *mux.Router) {
+	r.HandleFunc(baseUrl+apiTokenPath, fe.apiTokenHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl+apiPrefix+"/cart", fe.apiGetCartHandler).Methods(http.MethodGet)
+	r.HandleFunc(baseUrl+apiPrefix+"/cart", fe.apiEmptyCartHandler).Methods(http.MethodDelete)
+	r.HandleFunc(baseUrl+apiPrefix+"/cart/items", fe.apiAddToCartHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl+apiPrefix+"/checkout", fe.apiCheckoutHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl+apiPrefix+"/orders/{id}", fe.apiOrderHandler).Methods(http.MethodGet)
+	r.HandleFunc(baseUrl+apiPrefix+"/orders/{id}/receipt-url", fe.apiOrderReceiptURLHandler).Methods(http.MethodPost)
+}
+
+// ensureBearerJWT is ensureJWT for API requests: the token comes from the
+// Authorization header, is never renewed silently, and its session_id claim
+// is the session for the request
+func ensureBearerJWT(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == baseUrl+apiTokenPath {
+		next.ServeHTTP(w, r)
+		return
+	}
+	tokenString, ok := bearerToken(r)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, errors.New("missing Bearer token"))
+		return
+	}
+	var (
+		claims *JWTClaims
+		err    error
+	)
+	if oidc.issued(tokenString) {
+		// Downstream services only know internal tokens
+		tokenString, claims, err = oidc.exchange(r.Context(), tokenString)
+	} else {
+		claims, err = validateJWT(tokenString)
+	}
+	if err == nil && fingerprintMismatch(r, claims) {
+		err = fmt.Errorf("%w: token bound to another client", errJWTSessionMismatch)
+	}
+	if err != nil {
+		recordInvalidJWT(r, err)
+		writeAPIError(w, jwtErrorStatus(err), err)
+		return
+	}
+	ctx := context.WithValue(r.Context(), ctxKeyJWTToken{}, tokenString)
+	ctx = context.WithValue(ctx, ctxKeyJWT{}, claims)
+	ctx = context.WithValue(ctx, ctxKeySessionID{}, claims.SessionID)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// apiClaims returns the validated claims ensureBearerJWT put in the context
+func apiClaims(r *http.Request) *JWTClaims {
+	claims, _ := getJWTFromContext(r.Context())
+	return claims
+}
+
+// apiTokenHandler issues a Bearer token. With a previously issued token
+// (expired or not) it is renewed for the same session, unless the session
+// went idle or the token is bound to another client, and a token of the
+// OIDC provider is exchanged for one of the user's session; otherwise a new
+// session is started.
+func (fe *frontendServer) apiTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		token string
+		err   error
+	)
+	if external, ok := bearerToken(r); ok && oidc.issued(external) {
+		token, _, err = oidc.exchange(r.Context(), external)
+		if err != nil {
+			writeAPIError(w, jwtErrorStatus(err), err)
+			return
+		}
+	} else if old, ok := bearerToken(r); ok {
+		claims := &JWTClaims{}
+		_, err = jwt.ParseWithClaims(old, claims, jwtKeyFunc, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}), jwt.WithoutClaimsValidation())
+		if err != nil {
+			writeAPIError(w, http.StatusUnauthorized, classifyJWTError(err))
+			return
+		}
+		if tokens.isRevoked(claims.ID) {
+			writeAPIError(w, http.StatusUnauthorized, fmt.Errorf("%w: jti=%s", errJWTRevoked, claims.ID))
+			return
+		}
+		switch {
+		case sessionIdle(claims):
+			jwtSessionRenewals.Add("idle_expired", 1)
+			u := newJWTUUID()
+			token, err = issueJWT(r.Context(), u.String(), defaultCurrency)
+		case fingerprintMismatch(r, claims):
+			u := newJWTUUID()
+			token, err = issueJWT(r.Context(), u.String(), defaultCurrency)
+		default:
+			token, err = refreshJWTContext(r.Context(), claims)
+		}
+	} else {
+		u := newJWTUUID()
+		token, err = issueJWT(r.Context(), u.String(), defaultCurrency)
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(jwtLifetime / time.Second),
+	})
+}
+
+func (fe *frontendServer) apiGetCartHandler(w http.ResponseWriter, r *http.Request) {
+	cartID := fe.cartUserID(r.Context())
+	items, err := fe.getCart(r.Context(), cartID)
+	if err != nil {
+		writeAPIGRPCError(r, w, err)
+		return
+	}
+	writeAPIProto(w, &pb.Cart{UserId: cartID, Items: items})
+}
+
+func (fe *frontendServer) apiEmptyCartHandler(w http.ResponseWriter, r *http.Request) {
+	if err := fe.emptyCart(r.Context(), fe.cartUserID(r.Context())); err != nil {
+		writeAPIGRPCError(r, w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (fe *frontendServer) apiAddToCartHandler(w http.ResponseWriter, r *http.Request) {
+	var item pb.CartItem
+	if err := readAPIProto(r, &item); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	payload := validator.AddToCartPayload{Quantity: uint64(item.GetQuantity()), ProductID: item.GetProductId()}
+	if err := payload.Validate(); err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, validator.ValidationErrorResponse(err))
+		return
+	}
+	if err := fe.insertCart(r.Context(), fe.cartUserID(r.Context()), payload.ProductID, int32(payload.Quantity)); err != nil {
+		writeAPIGRPCError(r, w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (fe *frontendServer) apiCheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	var req pb.PlaceOrderRequest
+	if err := readAPIProto(r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	payload := validator.PlaceOrderPayload{
+		Email:         req.GetEmail(),
+		StreetAddress: req.GetAddress().GetStreetAddress(),
+		ZipCode:       int64(req.GetAddress().GetZipCode()),
+		City:          req.GetAddress().GetCity(),
+		State:         req.GetAddress().GetState(),
+		Country:       req.GetAddress().GetCountry(),
+		CcNumber:      req.GetCreditCard().GetCreditCardNumber(),
+		CcMonth:       int64(req.GetCreditCard().GetCreditCardExpirationMonth()),
+		CcYear:        int64(req.GetCreditCard().GetCreditCardExpirationYear()),
+		CcCVV:         int64(req.GetCreditCard().GetCreditCardCvv()),
+	}
+	if err := payload.Validate(); err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, validator.ValidationErrorResponse(err))
+		return
+	}
+
+	// The cart and currency always come from the token
+	req.UserId, req.UserCurrency = fe.cartUserID(r.Context()), apiClaims(r).Currency
+	publishOrderEvent(r.Context(), orderEvent{Status: "pending"})
+	var header metadata.MD
+	order, err := pb.NewCheckoutServiceClient(fe.checkoutSvcConn).PlaceOrder(fe.withIdempotencyKey(r.Context(), r.Header.Get(apiIdempotencyKeyHeader)), &req, grpc.Header(&header))
+	if err != nil {
+		publishOrderEvent(r.Context(), orderEvent{Status: "failed", Error: err.Error()})
+		writeAPIGRPCError(r, w, err)
+		return
+	}
+	publishOrderEvent(r.Context(), orderEvent{
+		Status:     "placed",
+		OrderID:    order.GetOrder().GetOrderId(),
+		TrackingID: order.GetOrder().GetShippingTrackingId(),
+	})
+	noteIdempotentReplay(header)
+	if token := orderTokenFromHeader(header); token != "" {
+		w.Header().Set(orderTokenHeader, token)
+	}
+	writeAPIProto(w, order)
+}
+
+func readAPIProto(r *http.Request, m proto.Message) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if err := protojson.Unmarshal(body, m); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+func writeAPIProto(w http.ResponseWriter, m proto.Message) {
+	b, err := protojson.Marshal(m)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func writeAPIJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, code int, err error) {
+	writeAPIJSON(w, code, map[string]interface{}{
+		"error":  err.Error(),
+		"status": http.StatusText(code),
+	})
+}
+
+// writeAPIGRPCError maps a downstream gRPC error to an HTTP status
+func writeAPIGRPCError(r *http.Request, w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		code = http.StatusBadRequest
+	case codes.NotFound:
+		code = http.StatusNotFound
+	case codes.AlreadyExists:
+		code = http.StatusConflict
+	case codes.Unauthenticated:
+		code = http.StatusUnauthorized
+	case codes.PermissionDenied:
+		code = http.StatusForbidden
+	case codes.Unavailable, codes.DeadlineExceeded:
+		code = http.StatusServiceUnavailable
+	}
+	if log, ok := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger); ok {
+		log.WithField("error", err).Error("api request error")
+	}
+	writeAPIError(w, code, err)
+}
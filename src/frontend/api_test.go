@@ -0,0 +1,102 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAPITokenHandler(t *testing.T) {
+	useRSAKeys(t)
+	defer func(idle time.Duration, binding bool) {
+		sessionIdleTimeout, jwtFingerprintBinding = idle, binding
+	}(sessionIdleTimeout, jwtFingerprintBinding)
+	sessionIdleTimeout, jwtFingerprintBinding = 10*time.Minute, true
+
+	fe := &frontendServer{}
+	handler := ensureSessionID(ensureJWT(http.HandlerFunc(fe.apiTokenHandler)))
+	// request asks for a token from the client userAgent, renewing bearer
+	// when set, and returns the status and the claims of the token issued
+	request := func(userAgent, bearer string) (int, *JWTClaims) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, apiTokenPath, nil)
+		r.Header.Set("User-Agent", userAgent)
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		var body struct {
+			AccessToken string `json:"access_token"`
+		}
+		json.NewDecoder(w.Body).Decode(&body)
+		claims, _ := validateJWT(body.AccessToken)
+		return w.Code, claims
+	}
+	// token signs claims for the session "api" of the client with the
+	// fingerprint fph, issued at iat
+	token := func(fph string, iat time.Time) string {
+		t.Helper()
+		claims := jwtGoldenClaims()
+		claims.SessionID, claims.FingerprintHash = "api", fph
+		claims.Audience = jwt.ClaimStrings{jwtAudience}
+		claims.IssuedAt, claims.ExpiresAt = jwt.NewNumericDate(iat), jwt.NewNumericDate(iat.Add(jwtLifetime))
+		s, err := generateJWTFromClaims(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	r := httptest.NewRequest(http.MethodPost, apiTokenPath, nil)
+	r.Header.Set("User-Agent", "Client/1.0")
+	fph := browserFingerprint(r)
+	now := time.Now()
+
+	code, issued := request("Client/1.0", "")
+	if code != http.StatusOK || issued == nil || issued.SessionID == "" || issued.FingerprintHash != fph {
+		t.Fatalf("token without a bearer: status %d, claims %+v", code, issued)
+	}
+
+	// An expired token of an active session is renewed for the session
+	if code, renewed := request("Client/1.0", token(fph, now.Add(-3*time.Minute))); code != http.StatusOK || renewed.SessionID != "api" {
+		t.Errorf("recently expired token: status %d, session %q, want api", code, renewed.SessionID)
+	}
+
+	// The session of a token issued longer than the idle timeout ago ended
+	idle := expvarInt(jwtSessionRenewals, "idle_expired")
+	if code, renewed := request("Client/1.0", token(fph, now.Add(-time.Hour))); code != http.StatusOK || renewed.SessionID == "api" {
+		t.Errorf("token of an idle session: status %d, session %q, want a new one", code, renewed.SessionID)
+	}
+	if expvarInt(jwtSessionRenewals, "idle_expired") != idle+1 {
+		t.Error("idle session not counted")
+	}
+
+	// Another client gets a session of its own
+	if code, renewed := request("Thief/1.0", token(fph, now.Add(-3*time.Minute))); code != http.StatusOK || renewed.SessionID == "api" {
+		t.Errorf("token of another client: status %d, session %q, want a new one", code, renewed.SessionID)
+	}
+
+	tampered := token(fph, now)
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+	if code, _ := request("Client/1.0", tampered); code != http.StatusUnauthorized {
+		t.Errorf("tampered token: status %d, want %d", code, http.StatusUnauthorized)
+	}
+}
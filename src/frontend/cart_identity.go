@@ -0,0 +1,188 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// cartMigratedTTL is how long a cart is remembered as migrated; its legacy
+// cart is checked again by the first request after that
+const cartMigratedTTL = time.Hour
+
+var (
+	// cartMigrated remembers cart IDs whose legacy session-keyed cart has
+	// already been checked, so the check costs one GetCart per cart and hour
+	cartMigrated  = newMigratedCarts(cartMigratedTTL)
+	cartMigration singleflight.Group
+
+	// cartIDCutover is when carts started being keyed by cart_id
+	cartIDCutover = time.Now()
+
+	cartMigrations = expvar.NewMap("cart_migrations")
+)
+
+// loadCartIDCutover reads CART_ID_CUTOVER, the RFC 3339 time the frontend
+// started keying carts by the cart_id claim. It defaults to when this
+// process started, which is never earlier than the actual cutover, so at
+// worst migration is checked for longer than needed.
+func loadCartIDCutover() time.Time {
+	v := os.Getenv("CART_ID_CUTOVER")
+	if v == "" {
+		return cartIDCutover
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		log.Warnf("ignoring invalid CART_ID_CUTOVER=%q", v)
+		return cartIDCutover
+	}
+	return t
+}
+
+// migratedCarts is a set of cart IDs whose entries expire after ttl, and
+// are swept every ttl
+type migratedCarts struct {
+	ttl   time.Duration
+	sweep sync.Once
+
+	mu    sync.Mutex
+	carts map[string]time.Time
+}
+
+func newMigratedCarts(ttl time.Duration) *migratedCarts {
+	return &migratedCarts{ttl: ttl, carts: make(map[string]time.Time)}
+}
+
+// contains reports whether cartID was added less than ttl ago
+func (m *migratedCarts) contains(cartID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expiresAt, ok := m.carts[cartID]
+	return ok && time.Now().Before(expiresAt)
+}
+
+func (m *migratedCarts) add(cartID string) {
+	m.sweep.Do(func() { go m.run() })
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.carts[cartID] = time.Now().Add(m.ttl)
+}
+
+func (m *migratedCarts) run() {
+	ticker := time.NewTicker(m.ttl)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		m.expire(now)
+	}
+}
+
+// expire drops the carts that expired by now
+func (m *migratedCarts) expire(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, expiresAt := range m.carts {
+		if !now.Before(expiresAt) {
+			delete(m.carts, id)
+		}
+	}
+}
+
+// mayHaveLegacyCart reports whether the session of claims may have started
+// before the cutover, and so have a cart keyed by its session ID. Session
+// cookies are not renewed, so such a session sends no request later than
+// one cookie lifetime after the cutover.
+func mayHaveLegacyCart(claims *JWTClaims) bool {
+	return claims.IssuedAt == nil || claims.IssuedAt.Time.Before(cartIDCutover.Add(cookieMaxAge*time.Second))
+}
+
+// cartUserID returns the cartservice key for the request: the cart_id claim
+// of its JWT, so the token is the one source of identity downstream.
+// Requests without claims fall back to the session ID, which is also where
+// carts created before the claim was used live; those are moved over the
+// first time a session's cart_id is seen.
+func (fe *frontendServer) cartUserID(ctx context.Context) string {
+	legacyID, _ := ctx.Value(ctxKeySessionID{}).(string)
+	claims, ok := getJWTFromContext(ctx)
+	if !ok || claims == nil || claims.CartID == "" {
+		return legacyID
+	}
+	if legacyID != "" && legacyID != claims.CartID && mayHaveLegacyCart(claims) {
+		fe.migrateCart(ctx, legacyID, claims.CartID)
+	}
+	return claims.CartID
+}
+
+// migrateCart moves the items of the cart keyed by legacyID into cartID.
+// Failures are logged and retried on a later request; the shopper sees the
+// cart_id cart meanwhile. AddItem adds to the quantity already in a cart,
+// so only what cartID lacks of each item is added: a retry after a
+// partial move adds the rest rather than doubling what already moved.
+func (fe *frontendServer) migrateCart(ctx context.Context, legacyID, cartID string) {
+	if cartMigrated.contains(cartID) {
+		return
+	}
+	// Concurrent requests wait on one migration, which must not be cut
+	// short by the first request finishing
+	ctx = context.WithoutCancel(ctx)
+	cartMigration.Do(cartID, func() (interface{}, error) {
+		if cartMigrated.contains(cartID) {
+			return nil, nil
+		}
+		items, err := fe.getCart(ctx, legacyID)
+		if err != nil {
+			cartMigrations.Add("errors", 1)
+			log.WithField("error", err).Warnf("failed to read legacy cart %s", legacyID)
+			return nil, err
+		}
+		moved, err := fe.getCart(ctx, cartID)
+		if err != nil {
+			cartMigrations.Add("errors", 1)
+			log.WithField("error", err).Warnf("failed to read cart %s", cartID)
+			return nil, err
+		}
+		have := make(map[string]int32, len(moved))
+		for _, item := range moved {
+			have[item.GetProductId()] += item.GetQuantity()
+		}
+		for _, item := range items {
+			missing := item.GetQuantity() - have[item.GetProductId()]
+			if missing <= 0 {
+				continue
+			}
+			if err := fe.insertCart(ctx, cartID, item.GetProductId(), missing); err != nil {
+				cartMigrations.Add("errors", 1)
+				log.WithField("error", err).Warnf("failed to move legacy cart %s to %s", legacyID, cartID)
+				return nil, err
+			}
+		}
+		if len(items) > 0 {
+			if err := fe.emptyCart(ctx, legacyID); err != nil {
+				// The items are already in the new cart; a leftover legacy
+				// cart would only be merged in again, so don't retry
+				log.WithField("error", err).Warnf("failed to empty legacy cart %s", legacyID)
+			}
+			cartMigrations.Add("migrated", 1)
+			log.Infof("moved %d items from legacy cart %s to %s", len(items), legacyID, cartID)
+		}
+		cartMigrated.add(cartID)
+		return nil, nil
+	})
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// fakeCartService keeps carts in memory and counts GetCart calls. Like
+// cartservice, AddItem adds to the quantity of an item already in the cart;
+// it fails for the products in failAdds
+type fakeCartService struct {
+	pb.UnimplementedCartServiceServer
+
+	mu       sync.Mutex
+	carts    map[string][]*pb.CartItem
+	reads    int
+	failAdds map[string]bool
+}
+
+func (c *fakeCartService) GetCart(_ context.Context, req *pb.GetCartRequest) (*pb.Cart, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reads++
+	return &pb.Cart{UserId: req.UserId, Items: c.carts[req.UserId]}, nil
+}
+
+func (c *fakeCartService) AddItem(_ context.Context, req *pb.AddItemRequest) (*pb.Empty, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failAdds[req.Item.GetProductId()] {
+		return nil, status.Error(codes.Unavailable, "cart store unavailable")
+	}
+	for _, item := range c.carts[req.UserId] {
+		if item.ProductId == req.Item.GetProductId() {
+			item.Quantity += req.Item.GetQuantity()
+			return &pb.Empty{}, nil
+		}
+	}
+	c.carts[req.UserId] = append(c.carts[req.UserId], req.Item)
+	return &pb.Empty{}, nil
+}
+
+func (c *fakeCartService) EmptyCart(_ context.Context, req *pb.EmptyCartRequest) (*pb.Empty, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.carts, req.UserId)
+	return &pb.Empty{}, nil
+}
+
+func (c *fakeCartService) items(userID string) []*pb.CartItem {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.carts[userID]
+}
+
+func (c *fakeCartService) getCartCalls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reads
+}
+
+// newFakeCartFrontend serves a fakeCartService and returns a frontend
+// connected to it
+func newFakeCartFrontend(t *testing.T) (*frontendServer, *fakeCartService) {
+	t.Helper()
+	carts := &fakeCartService{carts: make(map[string][]*pb.CartItem)}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterCartServiceServer(srv, carts)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := newClientConn(lis.Addr().String())
+	if err != nil {
+		t.Fatalf("newClientConn() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &frontendServer{cartSvcConn: conn}, carts
+}
+
+func TestLegacyCartMigration(t *testing.T) {
+	fe, carts := newFakeCartFrontend(t)
+
+	defer func(m *migratedCarts, cutover time.Time) { cartMigrated, cartIDCutover = m, cutover }(cartMigrated, cartIDCutover)
+	cartMigrated = newMigratedCarts(time.Minute)
+	cartIDCutover = time.Now()
+	request := func(session string, issuedAt time.Time) context.Context {
+		claims := &JWTClaims{SessionID: session, CartID: "cart-" + session}
+		claims.IssuedAt = jwt.NewNumericDate(issuedAt)
+		ctx := context.WithValue(context.Background(), ctxKeySessionID{}, session)
+		return context.WithValue(ctx, ctxKeyJWT{}, claims)
+	}
+
+	carts.mu.Lock()
+	carts.carts["old-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	carts.mu.Unlock()
+	if got := fe.cartUserID(request("old-session", time.Now())); got != "cart-old-session" {
+		t.Errorf("cartUserID() = %q, want the cart_id claim", got)
+	}
+	if items := carts.items("cart-old-session"); len(items) != 1 || items[0].ProductId != "OLJCESPC7Z" || carts.items("old-session") != nil {
+		t.Errorf("cart-old-session holds %v after migration, want the legacy cart's items", items)
+	}
+	// The cart is remembered as migrated until the entry expires
+	reads := carts.getCartCalls()
+	fe.cartUserID(request("old-session", time.Now()))
+	if n := carts.getCartCalls(); n != reads {
+		t.Errorf("legacy cart read again, %d GetCart calls after %d", n, reads)
+	}
+	cartMigrated.expire(time.Now().Add(2 * time.Minute))
+	if n := len(cartMigrated.carts); n != 0 {
+		t.Errorf("%d migrated carts left after expiry, want 0", n)
+	}
+
+	// A token issued a session cookie lifetime after the cutover is of a
+	// session that started after it, which has no legacy cart to look for
+	reads = carts.getCartCalls()
+	fe.cartUserID(request("new-session", cartIDCutover.Add(cookieMaxAge*time.Second+time.Minute)))
+	if carts.getCartCalls() != reads {
+		t.Error("legacy cart read for a session started after the cutover")
+	}
+}
+
+func TestLegacyCartMigrationRetry(t *testing.T) {
+	fe, carts := newFakeCartFrontend(t)
+
+	defer func(m *migratedCarts, cutover time.Time) { cartMigrated, cartIDCutover = m, cutover }(cartMigrated, cartIDCutover)
+	cartMigrated = newMigratedCarts(time.Minute)
+	cartIDCutover = time.Now()
+	claims := &JWTClaims{SessionID: "old-session", CartID: "cart-old-session"}
+	claims.IssuedAt = jwt.NewNumericDate(time.Now())
+	ctx := context.WithValue(context.Background(), ctxKeySessionID{}, "old-session")
+	ctx = context.WithValue(ctx, ctxKeyJWT{}, claims)
+
+	carts.mu.Lock()
+	carts.carts["old-session"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}, {ProductId: "66VCHSJNUP", Quantity: 3}}
+	carts.failAdds = map[string]bool{"66VCHSJNUP": true}
+	carts.mu.Unlock()
+	fe.cartUserID(ctx)
+	if n := len(carts.items("old-session")); n != 2 {
+		t.Fatalf("legacy cart holds %d items after a failed move, want 2", n)
+	}
+
+	// The retry adds what the first attempt did not move
+	carts.mu.Lock()
+	carts.failAdds = nil
+	carts.mu.Unlock()
+	fe.cartUserID(ctx)
+	got := make(map[string]int32)
+	for _, item := range carts.items("cart-old-session") {
+		got[item.ProductId] += item.Quantity
+	}
+	if got["OLJCESPC7Z"] != 2 || got["66VCHSJNUP"] != 3 || len(got) != 2 {
+		t.Errorf("cart-old-session holds %v after the retry, want the legacy cart's quantities", got)
+	}
+	if items := carts.items("old-session"); items != nil {
+		t.Errorf("legacy cart holds %v after the retry, want it emptied", items)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// catalogSessionStats counts the product catalog calls sent with the
+// session component, and those sent without for lack of a usable token
+var catalogSessionStats = expvar.NewMap("catalog_session")
+
+// IsCatalogSessionEnabled reports whether calls to the product catalog,
+// which otherwise carry no JWT, carry the session component of the user's
+// token so the catalog can localize prices (JWT_CATALOG_SESSION=true)
+func IsCatalogSessionEnabled() bool {
+	return os.Getenv("JWT_CATALOG_SESSION") == "true"
+}
+
+// appendCatalogSession adds the session component of the request's token to
+// a product catalog call. Only that header is sent: the catalog reads the
+// currency and market from it, and without the other components and the
+// signature it holds nothing it could pass on as a credential.
+func appendCatalogSession(ctx context.Context, method string) context.Context {
+	if !IsCatalogSessionEnabled() || !strings.Contains(method, "ProductCatalogService") {
+		return ctx
+	}
+	tokenStr, _ := ctx.Value(ctxKeyJWTToken{}).(string)
+	if tokenStr == "" {
+		catalogSessionStats.Add("no_token", 1)
+		return ctx
+	}
+	components, err := DecomposeJWT(tokenStr)
+	if err != nil {
+		catalogSessionStats.Add("invalid_token", 1)
+		return ctx
+	}
+	catalogSessionStats.Add("sent", 1)
+	return metadata.AppendToOutgoingContext(ctx, jwtHeaders.Session, components.Session)
+}
@@ -0,0 +1,263 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// Injected claims let experimenters grow tokens at runtime, to see how
+// header compression copes with 1-8 KB payloads. They are unlisted in the
+// schema, so they ride in the dynamic component.
+const (
+	adminClaimsPath = "/admin/claims/inject"
+
+	maxInjectedClaimSize = 16 << 10
+	maxInjectedClaims    = 32
+)
+
+var (
+	// jwtInjectedClaimBytes is the size of the values currently injected
+	jwtInjectedClaimBytes = expvar.NewInt("jwt_injected_claim_bytes")
+	// jwtInjectedTokens counts tokens issued with injected claims
+	jwtInjectedTokens = expvar.NewInt("jwt_injected_tokens")
+)
+
+// injectedClaim is a custom claim added to every newly issued token. Without
+// a value, one of size random characters is generated.
+type injectedClaim struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+	Size  int    `json:"size,omitempty"`
+}
+
+// claimInjector holds the injected claims in the order they were added
+type claimInjector struct {
+	mu     sync.RWMutex
+	claims []injectedClaim
+}
+
+var claimInjections = &claimInjector{}
+
+// reservedClaim reports whether name is a claim the frontend sets itself,
+// or a header field the static component carries
+func reservedClaim(name string) bool {
+	switch name {
+	case "alg", "typ", "kid", tokenShapePadClaim:
+		return true
+	}
+	return containsString(jwtStaticClaims, name) ||
+		containsString(jwtSessionClaims, name) ||
+		containsString(jwtDynamicClaims, name)
+}
+
+// set adds c, replacing an injected claim of the same name
+func (ci *claimInjector) set(c injectedClaim) error {
+	switch {
+	case c.Name == "":
+		return errors.New("claim needs a name")
+	case reservedClaim(c.Name):
+		return fmt.Errorf("%q is a schema claim", c.Name)
+	case c.Name != strings.ToLower(c.Name):
+		return fmt.Errorf("%q is not lowercase, as per-claim metadata keys are", c.Name)
+	case c.Size < 0 || c.Size > maxInjectedClaimSize || len(c.Value) > maxInjectedClaimSize:
+		return fmt.Errorf("claim values are limited to %d bytes", maxInjectedClaimSize)
+	case c.Value == "" && c.Size == 0:
+		return errors.New("claim needs a value or a size")
+	}
+	if c.Value == "" {
+		b := make([]byte, base64.RawURLEncoding.DecodedLen(c.Size)+1)
+		if _, err := io.ReadFull(jwtRand, b); err != nil {
+			return fmt.Errorf("failed to generate claim value: %w", err)
+		}
+		c.Value = base64.RawURLEncoding.EncodeToString(b)[:c.Size]
+	}
+	c.Size = len(c.Value)
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	// Copy on write, so snapshots stay valid while tokens are signed
+	claims := append([]injectedClaim(nil), ci.claims...)
+	replaced := false
+	for i := range claims {
+		if claims[i].Name == c.Name {
+			claims[i], replaced = c, true
+		}
+	}
+	if !replaced {
+		if len(claims) >= maxInjectedClaims {
+			return fmt.Errorf("at most %d claims can be injected", maxInjectedClaims)
+		}
+		claims = append(claims, c)
+	}
+	ci.claims = claims
+	ci.publishLocked()
+	return nil
+}
+
+// remove drops the injected claim name, or all of them if name is empty.
+// It reports whether anything was removed.
+func (ci *claimInjector) remove(name string) bool {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	n := len(ci.claims)
+	var kept []injectedClaim
+	for _, c := range ci.claims {
+		if name != "" && c.Name != name {
+			kept = append(kept, c)
+		}
+	}
+	ci.claims = kept
+	ci.publishLocked()
+	return len(ci.claims) != n
+}
+
+func (ci *claimInjector) publishLocked() {
+	var size int64
+	for _, c := range ci.claims {
+		size += int64(c.Size)
+	}
+	jwtInjectedClaimBytes.Set(size)
+}
+
+// snapshot returns the injected claims; callers must not modify them
+func (ci *claimInjector) snapshot() []injectedClaim {
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+	return ci.claims
+}
+
+// list returns the injected claims without their values
+func (ci *claimInjector) list() []injectedClaim {
+	claims := ci.snapshot()
+	out := make([]injectedClaim, len(claims))
+	for i, c := range claims {
+		out[i] = injectedClaim{Name: c.Name, Size: c.Size}
+	}
+	return out
+}
+
+// injectedJWTClaims are JWTClaims with the injected claims appended to
+// the payload
+type injectedJWTClaims struct {
+	*JWTClaims
+	extra []injectedClaim
+}
+
+// withInjectedClaims returns the claims to sign for claims, with the
+// injected claims and padding of the token shape
+func withInjectedClaims(claims *JWTClaims) jwt.Claims {
+	extra := shapeExtraClaims(activeTokenShape())
+	if len(extra) == 0 {
+		return claims
+	}
+	jwtInjectedTokens.Add(1)
+	return injectedJWTClaims{JWTClaims: claims, extra: extra}
+}
+
+// MarshalJSON implements json.Marshaler
+func (c injectedJWTClaims) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(c.JWTClaims)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(b[:len(b)-1])
+	for _, e := range c.extra {
+		name, _ := json.Marshal(e.Name)
+		value, _ := json.Marshal(e.Value)
+		buf.WriteByte(',')
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// registerAdminRoutes serves the claim injection API, which is only
+// enabled when ADMIN_TOKEN is set. Requests authenticate with it in the
+// X-Admin-Token header:
+//
+//	POST   /admin/claims/inject  {"name": "pad", "size": 4096}
+//	GET    /admin/claims/inject
+//	DELETE /admin/claims/inject?name=pad
+//	GET    /admin/token-shape
+//	PUT    /admin/token-shape    {"name": "realistic"}
+func registerAdminRoutes(r *mux.Router) {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		return
+	}
+	admin := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(token)) != 1 {
+				writeAPIError(w, http.StatusUnauthorized, errors.New("missing or invalid X-Admin-Token"))
+				return
+			}
+			h(w, r)
+		}
+	}
+	r.HandleFunc(baseUrl+adminClaimsPath, admin(injectClaimHandler)).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl+adminClaimsPath, admin(listInjectedClaimsHandler)).Methods(http.MethodGet)
+	r.HandleFunc(baseUrl+adminClaimsPath, admin(removeInjectedClaimsHandler)).Methods(http.MethodDelete)
+	r.HandleFunc(baseUrl+adminTokenShapePath, admin(tokenShapeHandler)).Methods(http.MethodGet, http.MethodPut)
+}
+
+func injectClaimHandler(w http.ResponseWriter, r *http.Request) {
+	var c injectedClaim
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxInjectedClaimSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := claimInjections.set(c); err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	log.WithField("claim", c.Name).Info("injecting claim into new tokens")
+	listInjectedClaimsHandler(w, r)
+}
+
+func listInjectedClaimsHandler(w http.ResponseWriter, _ *http.Request) {
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"claims": claimInjections.list(),
+		"bytes":  jwtInjectedClaimBytes.Value(),
+	})
+}
+
+func removeInjectedClaimsHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if !claimInjections.remove(name) && name != "" {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("claim %q is not injected", name))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestInjectedClaimsGrowNewTokens(t *testing.T) {
+	loadTestRSAKeys(t)
+	t.Setenv("ADMIN_TOKEN", "s3cret")
+	r := mux.NewRouter()
+	registerAdminRoutes(r)
+	defer claimInjections.remove("")
+
+	admin := func(method, target, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-Admin-Token", token)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := admin(http.MethodPost, adminClaimsPath, `{"name":"pad","size":4096}`, "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("POST with a wrong admin token = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := admin(http.MethodPost, adminClaimsPath, `{"name":"session_id","value":"x"}`, "s3cret"); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("POST of a schema claim = %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+	if rec := admin(http.MethodPost, adminClaimsPath, `{"name":"pad","size":4096}`, "s3cret"); rec.Code != http.StatusOK {
+		t.Fatalf("POST = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := admin(http.MethodPost, adminClaimsPath, `{"name":"tag","value":"experiment-7"}`, "s3cret"); rec.Code != http.StatusOK {
+		t.Fatalf("POST = %d: %s", rec.Code, rec.Body)
+	}
+
+	token, err := generateJWT("inject-session", "USD", claimsProfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateJWT(token); err != nil {
+		t.Fatalf("validateJWT(token with injected claims) error = %v", err)
+	}
+	var payload map[string]interface{}
+	parts := strings.Split(token, ".")
+	raw, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if pad, _ := payload["pad"].(string); len(pad) != 4096 {
+		t.Errorf("len(pad) = %d, want 4096", len(pad))
+	}
+	if payload["tag"] != "experiment-7" || payload["session_id"] != "inject-session" {
+		t.Errorf("payload = %v", payload)
+	}
+	// Injected claims are unlisted, so they ride in the dynamic component
+	components, err := DecomposeJWT(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(components.Dynamic, "experiment-7") || strings.Contains(components.Session, "experiment-7") {
+		t.Errorf("components = %+v, want tag in the dynamic component", components)
+	}
+
+	if rec := admin(http.MethodDelete, adminClaimsPath+"?name=pad", "", "s3cret"); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE = %d", rec.Code)
+	}
+	if rec := admin(http.MethodDelete, adminClaimsPath+"?name=pad", "", "s3cret"); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE of a removed claim = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	rec := admin(http.MethodGet, adminClaimsPath, "", "s3cret")
+	var list struct {
+		Claims []injectedClaim `json:"claims"`
+		Bytes  int64           `json:"bytes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Claims) != 1 || list.Claims[0].Name != "tag" || list.Bytes != int64(len("experiment-7")) {
+		t.Errorf("GET = %s", rec.Body)
+	}
+}
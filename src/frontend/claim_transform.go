@@ -0,0 +1,162 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtClaimTransforms counts the outgoing tokens claim transformers changed,
+// left as they were or failed on
+var jwtClaimTransforms = expvar.NewMap("jwt_claim_transforms")
+
+// ClaimTransformer rewrites the claims of the token sent on an outgoing
+// call, for per-deployment tweaks such as renaming a claim a downstream
+// knows under another name, normalizing a value or dropping experimental
+// claims. It changes what one call sends, not the session's token.
+type ClaimTransformer interface {
+	// TransformClaims edits claims in place for a call to method
+	TransformClaims(ctx context.Context, method string, claims jwt.MapClaims) error
+}
+
+// ClaimTransformerFunc adapts a function to ClaimTransformer
+type ClaimTransformerFunc func(ctx context.Context, method string, claims jwt.MapClaims) error
+
+// TransformClaims implements ClaimTransformer
+func (f ClaimTransformerFunc) TransformClaims(ctx context.Context, method string, claims jwt.MapClaims) error {
+	return f(ctx, method, claims)
+}
+
+// claimTransformers are the transformers configured by
+// loadClaimTransformers, for the connections to the backends
+var claimTransformers []ClaimTransformer
+
+// renameClaims moves each claim named by a key of renames to its value
+func renameClaims(renames map[string]string) ClaimTransformer {
+	return ClaimTransformerFunc(func(_ context.Context, _ string, claims jwt.MapClaims) error {
+		for from, to := range renames {
+			if v, ok := claims[from]; ok {
+				delete(claims, from)
+				claims[to] = v
+			}
+		}
+		return nil
+	})
+}
+
+// dropClaims removes the claims names, where a name ending in * matches
+// every claim with that prefix
+func dropClaims(names []string) ClaimTransformer {
+	return ClaimTransformerFunc(func(_ context.Context, _ string, claims jwt.MapClaims) error {
+		for k := range claims {
+			for _, name := range names {
+				if prefix, ok := strings.CutSuffix(name, "*"); ok && strings.HasPrefix(k, prefix) || k == name {
+					delete(claims, k)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// loadClaimTransformers reads JWT_CLAIM_RENAME, comma-separated old=new
+// claim names, and JWT_CLAIM_DROP, comma-separated claims to leave out of
+// the tokens sent downstream, a trailing * matching a prefix. Claims the
+// schema requires are needed to verify the token and are never touched.
+func loadClaimTransformers() []ClaimTransformer {
+	required := make(map[string]bool)
+	for _, r := range jwtClaimRules {
+		required[r.Name] = r.Required
+	}
+	var transformers []ClaimTransformer
+	renames := make(map[string]string)
+	for _, pair := range splitList(os.Getenv("JWT_CLAIM_RENAME")) {
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" || required[from] || required[to] {
+			log.Warnf("ignoring JWT_CLAIM_RENAME entry %q", pair)
+			continue
+		}
+		renames[from] = to
+	}
+	if len(renames) > 0 {
+		transformers = append(transformers, renameClaims(renames))
+	}
+	var drop []string
+	for _, name := range splitList(os.Getenv("JWT_CLAIM_DROP")) {
+		if dropsRequiredClaim(name) {
+			log.Warnf("ignoring JWT_CLAIM_DROP entry %q", name)
+			continue
+		}
+		drop = append(drop, name)
+	}
+	if len(drop) > 0 {
+		transformers = append(transformers, dropClaims(drop))
+	}
+	return transformers
+}
+
+// dropsRequiredClaim reports whether the JWT_CLAIM_DROP entry name would
+// remove a claim the schema requires
+func dropsRequiredClaim(name string) bool {
+	prefix, wildcard := strings.CutSuffix(name, "*")
+	for _, r := range jwtClaimRules {
+		if r.Required && (r.Name == name || wildcard && strings.HasPrefix(r.Name, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// transformJWT returns tokenStr with the claims rewritten by transformers
+// for a call to method, re-signed by its issuer's key. Each changed token
+// costs an RSA signature per call. A transformer that fails leaves the
+// token as it was.
+func transformJWT(ctx context.Context, transformers []ClaimTransformer, method, tokenStr string) string {
+	if len(transformers) == 0 || strings.HasPrefix(tokenStr, opaqueTokenPrefix) {
+		return tokenStr
+	}
+	_, payload, _, err := parseJWT(tokenStr)
+	if err != nil {
+		return tokenStr
+	}
+	before, _ := json.Marshal(payload)
+	claims := jwt.MapClaims(payload)
+	for _, t := range transformers {
+		if err := t.TransformClaims(ctx, method, claims); err != nil {
+			jwtClaimTransforms.Add("failed", 1)
+			log.Warnf("Claim transformer failed for %s, sending the JWT unchanged: %v", method, err)
+			return tokenStr
+		}
+	}
+	if after, _ := json.Marshal(claims); string(after) == string(before) {
+		jwtClaimTransforms.Add("unchanged", 1)
+		return tokenStr
+	}
+	signed, err := signJWT(ctx, claims)
+	if err != nil {
+		jwtClaimTransforms.Add("failed", 1)
+		log.Warnf("Failed to re-sign transformed JWT for %s, sending it unchanged: %v", method, err)
+		return tokenStr
+	}
+	jwtClaimTransforms.Add("transformed", 1)
+	return signed
+}
@@ -0,0 +1,147 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultClaimsProviderTimeout  = 200 * time.Millisecond
+	defaultClaimsProviderCacheTTL = 5 * time.Minute
+
+	// claimsProviderFailureTTL is how long a failed lookup is cached, so an
+	// unhealthy provider is not called on every token issue
+	claimsProviderFailureTTL = 10 * time.Second
+)
+
+// claimsProfile holds the per-user claims a provider supplies
+type claimsProfile struct {
+	Name        string `json:"name"`
+	MarketID    string `json:"market_id"`
+	LoyaltyTier string `json:"loyalty_tier"`
+}
+
+// defaultClaimsProfile is used when no provider is configured or it fails
+var defaultClaimsProfile = claimsProfile{Name: "Jane Doe", MarketID: "US"}
+
+var (
+	claimsProviderHits   = expvar.NewInt("claims_provider_cache_hits")
+	claimsProviderMisses = expvar.NewInt("claims_provider_cache_misses")
+	claimsProviderErrors = expvar.NewInt("claims_provider_errors")
+)
+
+type cachedProfile struct {
+	profile   claimsProfile
+	expiresAt time.Time
+}
+
+// claimsProvider looks up profiles over HTTP at
+// GET <CLAIMS_PROVIDER_URL>/v1/profiles/<session_id>, caching results per
+// session. A nil provider always returns defaultClaimsProfile.
+type claimsProvider struct {
+	baseURL string
+	client  *http.Client
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedProfile
+}
+
+var profiles = newClaimsProvider(os.Getenv("CLAIMS_PROVIDER_URL"))
+
+func newClaimsProvider(baseURL string) *claimsProvider {
+	if baseURL == "" {
+		return nil
+	}
+	return &claimsProvider{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: durationEnv("CLAIMS_PROVIDER_TIMEOUT", defaultClaimsProviderTimeout)},
+		ttl:     durationEnv("CLAIMS_PROVIDER_CACHE_TTL", defaultClaimsProviderCacheTTL),
+		cache:   make(map[string]cachedProfile),
+	}
+}
+
+// durationEnv parses key as a time.Duration, falling back to def
+func durationEnv(key string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// lookup returns the profile for sessionID. Failures are logged and fall
+// back to the default profile; token issuance never fails because of them.
+func (p *claimsProvider) lookup(ctx context.Context, sessionID string) claimsProfile {
+	if p == nil {
+		return defaultClaimsProfile
+	}
+	now := time.Now()
+	p.mu.Lock()
+	cached, ok := p.cache[sessionID]
+	p.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		claimsProviderHits.Add(1)
+		return cached.profile
+	}
+	claimsProviderMisses.Add(1)
+
+	profile, ttl := defaultClaimsProfile, claimsProviderFailureTTL
+	if fetched, err := p.fetch(ctx, sessionID); err != nil {
+		claimsProviderErrors.Add(1)
+		log.WithField("session", sessionID).Warnf("claims provider lookup failed, using defaults: %v", err)
+	} else {
+		profile, ttl = fetched, p.ttl
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, v := range p.cache {
+		if now.After(v.expiresAt) {
+			delete(p.cache, k)
+		}
+	}
+	p.cache[sessionID] = cachedProfile{profile: profile, expiresAt: now.Add(ttl)}
+	return profile
+}
+
+func (p *claimsProvider) fetch(ctx context.Context, sessionID string) (claimsProfile, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.baseURL+"/v1/profiles/"+url.PathEscape(sessionID), nil)
+	if err != nil {
+		return claimsProfile{}, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return claimsProfile{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return claimsProfile{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	profile := defaultClaimsProfile
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		return claimsProfile{}, fmt.Errorf("failed to decode profile: %w", err)
+	}
+	return profile, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	// svcTokenAudience is the audience of service identity tokens, so they
+	// can never pass for a user's token
+	svcTokenAudience = "urn:hipstershop:services"
+	svcTokenLifetime = 10 * time.Minute
+)
+
+// svcTokenStats counts ClientCredentials outcomes: issued and rejected
+var svcTokenStats = expvar.NewMap("svc_tokens")
+
+// serviceClients maps the client IDs allowed to request a service token to
+// the SHA-256 of their secret. It is empty unless SERVICE_CLIENTS is set.
+var serviceClients map[string][sha256.Size]byte
+
+// loadServiceClients reads SERVICE_CLIENTS, comma-separated id=secret pairs
+// such as "checkoutservice=s3cret"
+func loadServiceClients() map[string][sha256.Size]byte {
+	clients := make(map[string][sha256.Size]byte)
+	for _, pair := range strings.Split(os.Getenv("SERVICE_CLIENTS"), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(pair, "=")
+		if !ok || id == "" || secret == "" {
+			log.Warnf("ignoring SERVICE_CLIENTS entry without id=secret")
+			continue
+		}
+		clients[id] = sha256.Sum256([]byte(secret))
+	}
+	return clients
+}
+
+// serviceClaims are the claims of a service identity token. The subject is
+// the calling service, not a user, and there is no session.
+type serviceClaims struct {
+	ClientID string    `json:"client_id"`
+	Actor    *jwtActor `json:"act,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// authenticateClient checks a client's secret in constant time
+func authenticateClient(id, secret string) bool {
+	want, ok := serviceClients[id]
+	got := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(want[:], got[:]) == 1 && ok
+}
+
+// generateServiceToken mints an identity token for the service clientID
+func generateServiceToken(ctx context.Context, clientID string) (string, time.Time, error) {
+	now := time.Now()
+	exp := now.Add(svcTokenLifetime)
+	jti := newJWTUUID()
+	claims := &serviceClaims{
+		ClientID: clientID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   fmt.Sprintf("urn:hipstershop:service:%s", clientID),
+			Audience:  jwt.ClaimStrings{svcTokenAudience},
+			ExpiresAt: jwt.NewNumericDate(exp),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwtNotBefore(now),
+			ID:        jti.String(),
+		},
+	}
+	if spiffeID, ok := peerSPIFFEID(ctx); ok {
+		claims.Actor = &jwtActor{Subject: spiffeID}
+	}
+	token, err := signJWT(ctx, claims)
+	return token, exp, err
+}
+
+// ClientCredentials is the OAuth2 client-credentials grant over gRPC: a
+// service trades its ID and secret for a token saying who is calling
+func (ts *tokenServer) ClientCredentials(ctx context.Context, req *pb.ClientCredentialsRequest) (*pb.ClientCredentialsResponse, error) {
+	if !authenticateClient(req.GetClientId(), req.GetClientSecret()) {
+		svcTokenStats.Add("rejected", 1)
+		log.WithField("client_id", req.GetClientId()).Warn("client credentials rejected")
+		return nil, status.Error(codes.Unauthenticated, "invalid client credentials")
+	}
+	token, exp, err := generateServiceToken(ctx, req.GetClientId())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mint token: %v", err)
+	}
+	svcTokenStats.Add("issued", 1)
+	return &pb.ClientCredentialsResponse{AccessToken: token, TokenType: "Bearer", ExpiresAt: exp.Unix()}, nil
+}
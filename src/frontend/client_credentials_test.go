@@ -0,0 +1,64 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestClientCredentialsIssuesServiceTokens(t *testing.T) {
+	loadTestRSAKeys(t)
+	defer func(c map[string][sha256.Size]byte) { serviceClients = c }(serviceClients)
+	t.Setenv("SERVICE_CLIENTS", "checkoutservice=s3cret, broken")
+	serviceClients = loadServiceClients()
+
+	ts := &tokenServer{}
+	if _, err := ts.ClientCredentials(context.Background(), &pb.ClientCredentialsRequest{ClientId: "checkoutservice", ClientSecret: "wrong"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("wrong secret: err = %v, want Unauthenticated", err)
+	}
+	if _, err := ts.ClientCredentials(context.Background(), &pb.ClientCredentialsRequest{ClientId: "broken"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("unknown client: err = %v, want Unauthenticated", err)
+	}
+
+	resp, err := ts.ClientCredentials(context.Background(), &pb.ClientCredentialsRequest{ClientId: "checkoutservice", ClientSecret: "s3cret"})
+	if err != nil {
+		t.Fatalf("ClientCredentials() error = %v", err)
+	}
+	if resp.GetTokenType() != "Bearer" || time.Until(time.Unix(resp.GetExpiresAt(), 0)) > svcTokenLifetime {
+		t.Errorf("response = %+v", resp)
+	}
+	var claims serviceClaims
+	if _, err := jwt.ParseWithClaims(resp.GetAccessToken(), &claims, func(*jwt.Token) (interface{}, error) {
+		return publicKey, nil
+	}, jwt.WithAudience(svcTokenAudience)); err != nil {
+		t.Fatalf("service token does not verify: %v", err)
+	}
+	if claims.ClientID != "checkoutservice" {
+		t.Errorf("client_id = %q", claims.ClientID)
+	}
+	// A service token must never pass for a user's
+	if _, err := validateJWT(resp.GetAccessToken()); err == nil {
+		t.Error("validateJWT accepted a service token")
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// claimsgen generates the JWT claim structs, the per-class claim lists, the
+// claim rules and the header names of a service from the canonical claim
+// schema, so the services cannot disagree on which claims exist, what they
+// hold or where they travel.
+// The frontend runs it for every service:
+//
+//	go run ./cmd/claimsgen -schema jwt_claims.yaml -issuer -out jwt_claims_gen.go
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	schemaFlag = flag.String("schema", "jwt_claims.yaml", "claim schema")
+	outFlag    = flag.String("out", "jwt_claims_gen.go", "generated file")
+	issuerFlag = flag.Bool("issuer", false, "also generate JWTClaims, the issuer's struct for the JWT library")
+)
+
+// Claim classes, as in JWTComponents
+var claimClasses = []string{"static", "session", "dynamic"}
+
+// goTypes maps schema types to the field types of jwtClaimSet
+var goTypes = map[string]string{
+	"string":      "string",
+	"numericdate": "*float64",
+	"audience":    "json.RawMessage",
+	"actor":       "*jwtActor",
+}
+
+type schema struct {
+	Audience string `yaml:"audience"`
+	Headers  struct {
+		Prefixes []struct {
+			Name  string `yaml:"name"`
+			Value string `yaml:"value"`
+		} `yaml:"prefixes"`
+		Fields struct {
+			Static    string `yaml:"static"`
+			Session   string `yaml:"session"`
+			Dynamic   string `yaml:"dynamic"`
+			Signature string `yaml:"signature"`
+		} `yaml:"fields"`
+	} `yaml:"headers"`
+	Claims []claim `yaml:"claims"`
+}
+
+type claim struct {
+	Name       string `yaml:"name"`
+	Field      string `yaml:"field"`
+	Type       string `yaml:"type"`
+	Class      string `yaml:"class"`
+	Required   bool   `yaml:"required"`
+	Registered bool   `yaml:"registered"`
+	OmitEmpty  bool   `yaml:"omitempty"`
+	Doc        string `yaml:"doc"`
+}
+
+func (c claim) GoType() string { return goTypes[c.Type] }
+
+func (c claim) Tag() string { return jsonTag(c.Name, c.OmitEmpty) }
+
+// jsonTag returns the struct tag of a JSON field
+func jsonTag(name string, omitEmpty bool) string {
+	if omitEmpty {
+		return fmt.Sprintf("`json:\"%s,omitempty\"`", name)
+	}
+	return fmt.Sprintf("`json:\"%s\"`", name)
+}
+
+var identifier = regexp.MustCompile(`^[A-Z][A-Za-z0-9]*$`)
+
+// loadSchema reads and checks the schema at path
+func loadSchema(path string) (*schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s schema
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if s.Audience == "" {
+		return nil, fmt.Errorf("%s: missing audience", path)
+	}
+	names, fields := make(map[string]bool), make(map[string]bool)
+	for _, c := range s.Claims {
+		switch {
+		case c.Name == "" || names[c.Name]:
+			return nil, fmt.Errorf("%s: missing or duplicate claim name %q", path, c.Name)
+		case !identifier.MatchString(c.Field) || fields[c.Field]:
+			return nil, fmt.Errorf("%s: claim %q: invalid or duplicate field %q", path, c.Name, c.Field)
+		case goTypes[c.Type] == "":
+			return nil, fmt.Errorf("%s: claim %q: unknown type %q", path, c.Name, c.Type)
+		case !contains(claimClasses, c.Class):
+			return nil, fmt.Errorf("%s: claim %q: class %q is not one of %s", path, c.Name, c.Class, strings.Join(claimClasses, ", "))
+		case !c.Registered && c.Type != "string" && c.Type != "actor":
+			return nil, fmt.Errorf("%s: claim %q: only registered claims may be of type %s", path, c.Name, c.Type)
+		case c.Required && c.OmitEmpty:
+			return nil, fmt.Errorf("%s: claim %q: required claims cannot be omitempty", path, c.Name)
+		}
+		names[c.Name], fields[c.Field] = true, true
+	}
+	return &s, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+var genTemplate = template.Must(template.New("gen").Funcs(template.FuncMap{
+	"title":   func(s string) string { return strings.ToUpper(s[:1]) + s[1:] },
+	"jsonTag": jsonTag,
+}).Parse(`// Code generated by claimsgen from {{.Schema}}. DO NOT EDIT.
+
+package main
+
+import (
+{{- if .JSON}}
+	"encoding/json"
+{{- end}}
+{{- if .Issuer}}
+
+	"github.com/golang-jwt/jwt/v5"
+{{- end}}
+)
+
+// jwtAudience is the aud of the user tokens the frontend issues
+const jwtAudience = {{printf "%q" .S.Audience}}
+
+// Known header prefixes for decomposed JWTs
+const (
+{{- range .S.Headers.Prefixes}}
+	jwtHeaderPrefix{{title .Name}} = {{printf "%q" .Value}}
+{{- end}}
+)
+
+// defaultJWTHeaderFields are the component names appended to the prefix.
+// Dynamic and signature use -bin so they bypass HPACK indexing.
+var defaultJWTHeaderFields = [4]string{ {{- with .S.Headers.Fields}}{{printf "%q" .Static}}, {{printf "%q" .Session}}, {{printf "%q" .Dynamic}}, {{printf "%q" .Signature}}{{end -}} }
+
+// jwtStaticClaims are the payload claims that are the same in every token;
+// the header's alg and typ travel with them
+var jwtStaticClaims = []string{ {{- .Lists.static -}} }
+
+// jwtSessionClaims are the claims that stay the same for a session
+var jwtSessionClaims = []string{ {{- .Lists.session -}} }
+
+// jwtDynamicClaims are the claims that change on every token renewal and are
+// therefore sent in headers excluded from HPACK indexing
+var jwtDynamicClaims = []string{ {{- .Lists.dynamic -}} }
+
+{{- if .Actor}}
+
+// jwtActor is the RFC 8693 act claim: who is acting for the subject
+type jwtActor struct {
+	Subject string {{jsonTag "sub" false}}
+}
+{{- end}}
+
+// jwtClaimRule is a claim of the schema, as validateJWTClaims checks it
+type jwtClaimRule struct {
+	Name     string
+	Type     string
+	Required bool
+}
+
+// jwtClaimRules are the claims of the schema. Type is string, numericdate
+// (seconds since the epoch), audience (a string or a list of strings) or
+// actor (an object with a sub).
+var jwtClaimRules = []jwtClaimRule{
+{{- range .S.Claims}}
+	{ {{- printf "%q" .Name}}, {{printf "%q" .Type}}, {{.Required -}} },
+{{- end}}
+}
+
+// jwtClaimSet holds every claim in the schema, for reading tokens without
+// the JWT library. Decode only what you need into it with
+// jwtSegments.DecodePayload.
+type jwtClaimSet struct {
+{{- range .S.Claims}}
+	{{.Field}} {{.GoType}} {{.Tag}}
+{{- end}}
+}
+{{- if .Issuer}}
+
+// JWTClaims are the claims the frontend issues
+type JWTClaims struct {
+{{- range .S.Claims}}{{if not .Registered}}
+	{{.Field}} {{.GoType}} {{.Tag}}{{if .Doc}} // {{.Doc}}{{end}}
+{{- end}}{{end}}
+	jwt.RegisteredClaims
+}
+{{- end}}
+`))
+
+// generate renders the Go file for the schema at schemaPath
+func generate(schemaPath string, issuer bool) ([]byte, error) {
+	s, err := loadSchema(schemaPath)
+	if err != nil {
+		return nil, err
+	}
+	usesJSON, usesActor := false, false
+	for _, c := range s.Claims {
+		usesJSON = usesJSON || strings.HasPrefix(c.GoType(), "json.")
+		usesActor = usesActor || c.Type == "actor"
+	}
+	lists := make(map[string]string)
+	for _, class := range claimClasses {
+		var quoted []string
+		for _, c := range s.Claims {
+			if c.Class == class {
+				quoted = append(quoted, fmt.Sprintf("%q", c.Name))
+			}
+		}
+		lists[class] = strings.Join(quoted, ", ")
+	}
+	var buf bytes.Buffer
+	err = genTemplate.Execute(&buf, map[string]interface{}{
+		"Schema": filepath.Base(schemaPath),
+		"Issuer": issuer,
+		"JSON":   usesJSON,
+		"Actor":  usesActor,
+		"S":      s,
+		"Lists":  lists,
+	})
+	if err != nil {
+		return nil, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %w\n%s", err, buf.Bytes())
+	}
+	return src, nil
+}
+
+func main() {
+	flag.Parse()
+	src, err := generate(*schemaFlag, *issuerFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "claimsgen:", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*outFlag, src, 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, "claimsgen:", err)
+		os.Exit(1)
+	}
+}
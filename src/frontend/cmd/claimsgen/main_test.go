@@ -0,0 +1,75 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestGeneratedUpToDate fails when a service's jwt_claims_gen.go was edited
+// by hand or the schema changed without running go generate
+func TestGeneratedUpToDate(t *testing.T) {
+	const frontend = "../.."
+	schema := filepath.Join(frontend, "jwt_claims.yaml")
+	generated := map[string]bool{
+		"jwt_claims_gen.go":                    true,
+		"cmd/jwtbench/jwt_claims_gen.go":       false,
+		"cmd/jwtctl/jwt_claims_gen.go":         false,
+		"../checkoutservice/jwt_claims_gen.go": false,
+		"../shippingservice/jwt_claims_gen.go": false,
+		"../emailauthshim/jwt_claims_gen.go":   false,
+	}
+	for path, issuer := range generated {
+		want, err := generate(schema, issuer)
+		if err != nil {
+			t.Fatalf("generate() error = %v", err)
+		}
+		got, err := os.ReadFile(filepath.Join(frontend, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s is stale; run go generate in src/frontend", path)
+		}
+	}
+}
+
+func TestLoadSchemaRejectsInvalidClaims(t *testing.T) {
+	tests := map[string]string{
+		"duplicate name":     "audience: a\nclaims:\n  - {name: sub, field: A, type: string, class: session}\n  - {name: sub, field: B, type: string, class: session}\n",
+		"unknown class":      "audience: a\nclaims:\n  - {name: sub, field: A, type: string, class: sometimes}\n",
+		"unknown type":       "audience: a\nclaims:\n  - {name: sub, field: A, type: uuid, class: session}\n",
+		"bad field":          "audience: a\nclaims:\n  - {name: sub, field: sub, type: string, class: session}\n",
+		"private date":       "audience: a\nclaims:\n  - {name: seen, field: Seen, type: numericdate, class: dynamic}\n",
+		"unknown setting":    "audience: a\nclaims:\n  - {name: sub, field: A, type: string, class: session, secret: true}\n",
+		"required omitempty": "audience: a\nclaims:\n  - {name: sub, field: A, type: string, class: session, required: true, omitempty: true}\n",
+		"no audience":        "claims:\n  - {name: sub, field: A, type: string, class: session}\n",
+	}
+	for name, yaml := range tests {
+		path := filepath.Join(t.TempDir(), "claims.yaml")
+		if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadSchema(path); err == nil {
+			t.Errorf("%s: loadSchema() error = nil", name)
+		} else if !strings.Contains(err.Error(), path) {
+			t.Errorf("%s: error %q does not name the schema", name, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// jwtErrorDomain is reported in the ErrorInfo detail of rejected calls
+const jwtErrorDomain = "auth.hipstershop.com"
+
+// Sentinel errors for the ways a forwarded JWT can be rejected
+var (
+	errJWTExpired          = errors.New("jwt expired")
+	errJWTMalformed        = errors.New("jwt malformed")
+	errJWTSignatureInvalid = errors.New("jwt signature invalid")
+	errJWTSessionMismatch  = errors.New("jwt session mismatch")
+)
+
+// checkJWTExpiry decodes the payload of a JWT (without verifying the
+// signature, which is the frontend's job) and rejects it if exp has passed
+func checkJWTExpiry(jwtToken string) error {
+	return checkJWTExpiryWithin(jwtToken, 0)
+}
+
+// checkJWTExpiryWithin is checkJWTExpiry accepting tokens up to skew past
+// their exp
+func checkJWTExpiryWithin(jwtToken string, skew time.Duration) error {
+	segments, err := splitJWT(jwtToken)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+	var claims jwtClaimSet
+	if err := segments.DecodePayload(&claims); err != nil {
+		return fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+	if claims.ExpiresAt != nil && jwtClock.Now().Add(-skew).After(time.Unix(int64(*claims.ExpiresAt), 0)) {
+		return fmt.Errorf("%w: exp=%d", errJWTExpired, int64(*claims.ExpiresAt))
+	}
+	return nil
+}
+
+// jwtStatusError converts a JWT error into a gRPC status carrying an
+// ErrorInfo detail whose Reason identifies the failure class
+func jwtStatusError(err error) error {
+	code, reason := codes.Unauthenticated, "JWT_INVALID"
+	switch {
+	case errors.Is(err, errJWTExpired):
+		reason = "JWT_EXPIRED"
+	case errors.Is(err, errJWTMalformed):
+		code, reason = codes.InvalidArgument, "JWT_MALFORMED"
+	case errors.Is(err, errJWTSignatureInvalid):
+		reason = "JWT_SIGNATURE_INVALID"
+	case errors.Is(err, errJWTSessionMismatch):
+		code, reason = codes.PermissionDenied, "JWT_SESSION_MISMATCH"
+	}
+	st, detailErr := status.New(code, err.Error()).WithDetails(&errdetails.ErrorInfo{
+		Reason: reason,
+		Domain: jwtErrorDomain,
+	})
+	if detailErr != nil {
+		return status.Error(code, err.Error())
+	}
+	return st.Err()
+}
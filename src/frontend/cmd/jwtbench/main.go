@@ -0,0 +1,374 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// jwtbench measures what each signing algorithm costs the JWT pipeline:
+// generating and validating tokens, splitting them into headers and
+// reassembling them, and the HPACK-encoded header bytes per request for a
+// given number of concurrent users. It uses the same copy of the codec the
+// services do.
+//
+//	go run ./cmd/jwtbench -algs RS256,ES256,EdDSA,HS256 -claim-sizes 0,512 -users 1,100,1000 -markdown summary.md > results.csv
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2/hpack"
+	"google.golang.org/grpc/metadata"
+)
+
+// log is used by the codec files shared with the services
+var log = logrus.New()
+
+var (
+	algsFlag       = flag.String("algs", "RS256,ES256,EdDSA,HS256", "comma-separated signing algorithms")
+	claimSizesFlag = flag.String("claim-sizes", "0,256,1024", "comma-separated bytes of extra claim data per token")
+	usersFlag      = flag.String("users", "1,100,1000", "comma-separated numbers of distinct users sharing a connection")
+	iterations     = flag.Int("iterations", 1000, "operations timed per measurement")
+	requests       = flag.Int("requests", 10000, "requests replayed through the HPACK encoder per measurement")
+	hpackTable     = flag.Uint("hpack-table", 4096, "HPACK dynamic table size in bytes")
+	format         = flag.String("format", "csv", "output format: csv or json")
+	markdown       = flag.String("markdown", "", "also write a markdown summary to this file")
+)
+
+// signer is an algorithm and the keys to use it
+type signer struct {
+	method jwt.SigningMethod
+	sign   interface{}
+	verify interface{}
+}
+
+// result is one measurement: an algorithm at a claim size and user count
+type result struct {
+	Alg            string  `json:"alg"`
+	ClaimBytes     int     `json:"claim_bytes"`
+	Users          int     `json:"users"`
+	TokenBytes     int     `json:"token_bytes"`
+	SignatureBytes int     `json:"signature_bytes"`
+	GenerateNs     float64 `json:"generate_ns"`
+	ValidateNs     float64 `json:"validate_ns"`
+	SplitNs        float64 `json:"split_ns"`
+	ReassembleNs   float64 `json:"reassemble_ns"`
+	// Header bytes per request after HPACK, sending the full token in
+	// authorization and sending it split into x-jwt-* headers
+	FullHeaderBytes  float64 `json:"full_header_bytes"`
+	SplitHeaderBytes float64 `json:"split_header_bytes"`
+	// TicketHeaderBytes sends a session ticket instead, the lower bound
+	// any token format could reach
+	TicketHeaderBytes float64 `json:"ticket_header_bytes"`
+	// DeflateHeaderBytes sends the whole token with its payload
+	// DEFLATE-compressed, the alternative to splitting it
+	DeflateHeaderBytes float64 `json:"deflate_header_bytes"`
+	// ZstdDictHeaderBytes compresses the payload with zstd and a static
+	// dictionary instead
+	ZstdDictHeaderBytes float64 `json:"zstd_dict_header_bytes"`
+}
+
+func main() {
+	flag.Parse()
+	log.Out = os.Stderr
+	if componentMACKey == nil {
+		// Session tickets are always measured and need a key
+		componentMACKey = []byte("jwtbench")
+	}
+
+	claimSizes, err := parseInts(*claimSizesFlag)
+	if err != nil {
+		log.Fatalf("-claim-sizes: %v", err)
+	}
+	userCounts, err := parseInts(*usersFlag)
+	if err != nil {
+		log.Fatalf("-users: %v", err)
+	}
+
+	var results []result
+	for _, alg := range strings.Split(*algsFlag, ",") {
+		s, err := newSigner(strings.TrimSpace(alg))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, size := range claimSizes {
+			for _, users := range userCounts {
+				log.Infof("benchmarking %s with %d claim bytes and %d users", s.method.Alg(), size, users)
+				r, err := benchmark(s, size, users)
+				if err != nil {
+					log.Fatalf("%s: %v", s.method.Alg(), err)
+				}
+				results = append(results, r)
+			}
+		}
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(results)
+	default:
+		err = writeCSV(os.Stdout, results)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *markdown != "" {
+		var buf bytes.Buffer
+		writeMarkdown(&buf, results)
+		if err := os.WriteFile(*markdown, buf.Bytes(), 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func parseInts(s string) ([]int, error) {
+	var out []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid number %q", f)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// newSigner generates a fresh key pair, or secret, for alg
+func newSigner(alg string) (signer, error) {
+	switch alg {
+	case "RS256":
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return signer{}, err
+		}
+		return signer{jwt.SigningMethodRS256, key, &key.PublicKey}, nil
+	case "ES256":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return signer{}, err
+		}
+		return signer{jwt.SigningMethodES256, key, &key.PublicKey}, nil
+	case "EdDSA":
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return signer{}, err
+		}
+		return signer{jwt.SigningMethodEdDSA, key, pub}, nil
+	case "HS256":
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return signer{}, err
+		}
+		return signer{jwt.SigningMethodHS256, secret, secret}, nil
+	}
+	return signer{}, fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// userClaims are the frontend's claims for user i, padded with claimBytes
+// of extra data. Map claims marshal with sorted keys, as the codec
+// reassembles them, so split tokens still verify.
+func userClaims(i, claimBytes int) jwt.MapClaims {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":          "online-boutique-frontend",
+		"aud":          []string{"online-boutique-services"},
+		"sub":          fmt.Sprintf("urn:hipstershop:user:bench-%d", i),
+		"session_id":   fmt.Sprintf("bench-%d", i),
+		"name":         "Jane Doe",
+		"market_id":    "US",
+		"currency":     "USD",
+		"cart_id":      fmt.Sprintf("cart-bench-%d", i),
+		"loyalty_tier": "gold",
+		"iat":          now.Unix(),
+		"exp":          now.Add(2 * time.Minute).Unix(),
+		"jti":          fmt.Sprintf("00000000-0000-4000-8000-%012d", i),
+	}
+	if claimBytes > 0 {
+		claims["x_pad"] = strings.Repeat("x", claimBytes)
+	}
+	return claims
+}
+
+func benchmark(s signer, claimBytes, users int) (result, error) {
+	r := result{Alg: s.method.Alg(), ClaimBytes: claimBytes, Users: users}
+	codec := perClassCodec{}
+	keyFunc := func(*jwt.Token) (interface{}, error) { return s.verify, nil }
+
+	tokens := make([]string, users)
+	for i := range tokens {
+		token, err := jwt.NewWithClaims(s.method, userClaims(i, claimBytes)).SignedString(s.sign)
+		if err != nil {
+			return r, err
+		}
+		tokens[i] = token
+	}
+	r.TokenBytes = len(tokens[0])
+	r.SignatureBytes = len(tokens[0]) - strings.LastIndexByte(tokens[0], '.') - 1
+
+	claims := userClaims(0, claimBytes)
+	r.GenerateNs = timeOp(func() error {
+		_, err := jwt.NewWithClaims(s.method, claims).SignedString(s.sign)
+		return err
+	})
+	r.ValidateNs = timeOp(func() error {
+		_, err := jwt.Parse(tokens[0], keyFunc)
+		return err
+	})
+	var pairs []string
+	r.SplitNs = timeOp(func() (err error) {
+		pairs, err = codec.Encode(tokens[0])
+		return err
+	})
+	md := metadata.Pairs(pairs...)
+	var reassembled string
+	r.ReassembleNs = timeOp(func() error {
+		decoded, err := codec.Decode(md)
+		if err == nil {
+			reassembled = decoded.Token
+		}
+		return err
+	})
+	if _, err := jwt.Parse(reassembled, keyFunc); err != nil {
+		return r, fmt.Errorf("reassembled token does not verify: %w", err)
+	}
+
+	full, split, err := headerBytes(codec, tokens)
+	if err != nil {
+		return r, err
+	}
+	r.FullHeaderBytes, r.SplitHeaderBytes = full, split
+	if r.TicketHeaderBytes, err = codecHeaderBytes(sessionTicketCodec{scheme: jwtHeaders}, tokens); err != nil {
+		return r, err
+	}
+	if r.DeflateHeaderBytes, err = codecHeaderBytes(deflateCodec{scheme: jwtHeaders}, tokens); err != nil {
+		return r, err
+	}
+	r.ZstdDictHeaderBytes, err = codecHeaderBytes(zstdDictCodec{scheme: jwtHeaders}, tokens)
+	return r, err
+}
+
+// timeOp returns the mean nanoseconds per call of op
+func timeOp(op func() error) float64 {
+	start := time.Now()
+	for i := 0; i < *iterations; i++ {
+		if err := op(); err != nil {
+			log.Fatalf("benchmarked operation failed: %v", err)
+		}
+	}
+	return float64(time.Since(start).Nanoseconds()) / float64(*iterations)
+}
+
+// headerBytes replays requests from the users in turn through one HPACK
+// encoder per mode, as they would share a connection, and returns the mean
+// encoded bytes per request for the full and the split token
+func headerBytes(codec JWTCodec, tokens []string) (full, split float64, err error) {
+	full, err = hpackBytes(tokens, func(token string) ([]hpack.HeaderField, error) {
+		return []hpack.HeaderField{{Name: "authorization", Value: "Bearer " + token}}, nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	split, err = codecHeaderBytes(codec, tokens)
+	return full, split, err
+}
+
+// codecHeaderBytes is the mean HPACK-encoded bytes per request of the
+// headers codec sends
+func codecHeaderBytes(codec JWTCodec, tokens []string) (float64, error) {
+	return hpackBytes(tokens, func(token string) ([]hpack.HeaderField, error) {
+		pairs, err := codec.Encode(token)
+		if err != nil {
+			return nil, err
+		}
+		fields := make([]hpack.HeaderField, 0, len(pairs)/2)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			v := pairs[i+1]
+			if strings.HasSuffix(pairs[i], "-bin") {
+				v = base64.RawStdEncoding.EncodeToString([]byte(v))
+			}
+			fields = append(fields, hpack.HeaderField{Name: pairs[i], Value: v})
+		}
+		return fields, nil
+	})
+}
+
+// hpackBytes replays the users' requests through one encoder
+func hpackBytes(tokens []string, fieldsFor func(token string) ([]hpack.HeaderField, error)) (float64, error) {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	enc.SetMaxDynamicTableSizeLimit(uint32(*hpackTable))
+	enc.SetMaxDynamicTableSize(uint32(*hpackTable))
+	for i := 0; i < *requests; i++ {
+		fields, err := fieldsFor(tokens[i%len(tokens)])
+		if err != nil {
+			return 0, err
+		}
+		for _, f := range fields {
+			if err := enc.WriteField(f); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return float64(buf.Len()) / float64(*requests), nil
+}
+
+func writeCSV(w io.Writer, results []result) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"alg", "claim_bytes", "users", "token_bytes", "signature_bytes",
+		"generate_ns", "validate_ns", "split_ns", "reassemble_ns", "full_header_bytes", "split_header_bytes", "ticket_header_bytes", "deflate_header_bytes", "zstd_dict_header_bytes"})
+	for _, r := range results {
+		cw.Write([]string{r.Alg, strconv.Itoa(r.ClaimBytes), strconv.Itoa(r.Users),
+			strconv.Itoa(r.TokenBytes), strconv.Itoa(r.SignatureBytes),
+			fmt.Sprintf("%.0f", r.GenerateNs), fmt.Sprintf("%.0f", r.ValidateNs),
+			fmt.Sprintf("%.0f", r.SplitNs), fmt.Sprintf("%.0f", r.ReassembleNs),
+			fmt.Sprintf("%.1f", r.FullHeaderBytes), fmt.Sprintf("%.1f", r.SplitHeaderBytes),
+			fmt.Sprintf("%.1f", r.TicketHeaderBytes), fmt.Sprintf("%.1f", r.DeflateHeaderBytes),
+			fmt.Sprintf("%.1f", r.ZstdDictHeaderBytes)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeMarkdown(w io.Writer, results []result) {
+	fmt.Fprintf(w, "# JWT signing algorithm benchmark\n\n")
+	fmt.Fprintf(w, "%d operations per timing, %d requests per header measurement, %d-byte HPACK table.\n\n",
+		*iterations, *requests, *hpackTable)
+	fmt.Fprintf(w, "| Algorithm | Claim bytes | Users | Token (B) | Signature (B) | Generate (µs) | Validate (µs) | Split (µs) | Reassemble (µs) | Full headers (B/req) | Split headers (B/req) | Saved | Ticket (B/req) | Deflate (B/req) | zstd-dict (B/req) |\n")
+	fmt.Fprintf(w, "|---|---:|---:|---:|---:|---:|---:|---:|---:|---:|---:|---:|---:|---:|---:|\n")
+	for _, r := range results {
+		saved := 0.0
+		if r.FullHeaderBytes > 0 {
+			saved = 100 * (1 - r.SplitHeaderBytes/r.FullHeaderBytes)
+		}
+		fmt.Fprintf(w, "| %s | %d | %d | %d | %d | %.1f | %.1f | %.1f | %.1f | %.0f | %.0f | %.0f%% | %.0f | %.0f | %.0f |\n",
+			r.Alg, r.ClaimBytes, r.Users, r.TokenBytes, r.SignatureBytes,
+			r.GenerateNs/1e3, r.ValidateNs/1e3, r.SplitNs/1e3, r.ReassembleNs/1e3,
+			r.FullHeaderBytes, r.SplitHeaderBytes, saved, r.TicketHeaderBytes, r.DeflateHeaderBytes, r.ZstdDictHeaderBytes)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// JWTComponents represents the decomposed parts of a JWT for compression
+type JWTComponents struct {
+	Static    string // Highly cacheable: alg, typ, iss, aud
+	Session   string // Session-cacheable: sub, session_id, name, market_id, loyalty_tier, currency, cart_id
+	Dynamic   string // Not cacheable: exp, iat, jti, random_value and unlisted claims
+	Signature string // Not compressible: cryptographic signature
+}
+
+// IsJWTCompressionEnabled checks if JWT compression is enabled via environment variable
+func IsJWTCompressionEnabled() bool {
+	return os.Getenv("ENABLE_JWT_COMPRESSION") == "true"
+}
+
+// DecomposeJWT splits a JWT into cacheable components for HPACK optimization
+// Input: "header.payload.signature" JWT string
+// Output: JWTComponents with split JSON objects
+func DecomposeJWT(jwtToken string) (*JWTComponents, error) {
+	defer jwtOperationLatency.ObserveSince(context.Background(), "decompose", time.Now())
+	if components, ok := decomposeJWTFast(jwtToken); ok {
+		return components, nil
+	}
+	return decomposeJWTGeneric(jwtToken)
+}
+
+// decomposeJWTGeneric is DecomposeJWT for any token, decoding the claims
+// into maps
+func decomposeJWTGeneric(jwtToken string) (*JWTComponents, error) {
+	header, payload, signature, err := parseJWT(jwtToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build static claims (highly cacheable - same across all requests).
+	// typ is optional (RFC 7519, section 5.1), so it is only sent when
+	// the token has one
+	static := map[string]interface{}{
+		"alg": header["alg"],
+	}
+	if typ, ok := header["typ"]; ok {
+		static["typ"] = typ
+	}
+	
+	// Add static payload claims if they exist
+	for _, key := range jwtStaticClaims {
+		if val, ok := payload[key]; ok {
+			static[key] = val
+		}
+	}
+
+	// Build session claims (cacheable per user session)
+	session := make(map[string]interface{})
+	for _, key := range jwtSessionClaims {
+		if val, ok := payload[key]; ok {
+			session[key] = val
+		}
+	}
+
+	// Build dynamic claims (changes frequently, not cacheable)
+	dynamic := make(map[string]interface{})
+	for _, key := range jwtDynamicClaims {
+		if val, ok := payload[key]; ok {
+			dynamic[key] = val
+		}
+	}
+
+	// Claims no class lists ride in the dynamic component, so a service
+	// whose lists are older than the issuer's still forwards every claim.
+	// Payload alg and typ stay shadowed by the header's, present or not.
+	for key, val := range payload {
+		_, inStatic := static[key]
+		_, inSession := session[key]
+		if !inStatic && !inSession && key != "alg" && key != "typ" {
+			dynamic[key] = val
+		}
+	}
+
+	// Serialize components to JSON
+	staticJSON, _ := json.Marshal(static)
+	sessionJSON, _ := json.Marshal(session)
+	dynamicJSON, _ := json.Marshal(dynamic)
+
+	return &JWTComponents{
+		Static:    string(staticJSON),
+		Session:   string(sessionJSON),
+		Dynamic:   string(dynamicJSON),
+		Signature: signature, // Keep signature as-is (base64url encoded)
+	}, nil
+}
+
+// parseJWT decodes the header and payload of a compact JWT into maps and
+// returns the signature segment unchanged
+func parseJWT(jwtToken string) (header, payload map[string]interface{}, signature string, err error) {
+	segments, err := splitJWT(jwtToken)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	// Decode header (base64url)
+	headerJSON, err := base64.RawURLEncoding.DecodeString(segments.Header)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to decode JWT header: %w", err)
+	}
+
+	// Decode payload (base64url)
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(segments.Payload)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to decode JWT payload: %w", err)
+	}
+
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, nil, "", fmt.Errorf("failed to parse JWT header: %w", err)
+	}
+
+	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+		return nil, nil, "", fmt.Errorf("failed to parse JWT payload: %w", err)
+	}
+
+	return header, payload, segments.Signature, nil
+}
+
+// ReassembleJWT reconstructs a JWT from its decomposed components
+// Input: JWTComponents
+// Output: "header.payload.signature" JWT string
+func ReassembleJWT(components *JWTComponents) (string, error) {
+	defer jwtOperationLatency.ObserveSince(context.Background(), "reassemble", time.Now())
+	if token, ok := reassembleJWTFast(components); ok {
+		return token, nil
+	}
+	return reassembleJWTGeneric(components)
+}
+
+// reassembleJWTGeneric is ReassembleJWT for any components, decoding them
+// into maps
+func reassembleJWTGeneric(components *JWTComponents) (string, error) {
+	var staticMap, sessionMap, dynamicMap map[string]interface{}
+
+	if err := json.Unmarshal([]byte(components.Static), &staticMap); err != nil {
+		return "", fmt.Errorf("failed to parse static claims: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(components.Session), &sessionMap); err != nil {
+		return "", fmt.Errorf("failed to parse session claims: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(components.Dynamic), &dynamicMap); err != nil {
+		return "", fmt.Errorf("failed to parse dynamic claims: %w", err)
+	}
+
+	// Rebuild header
+	header := map[string]interface{}{
+		"alg": staticMap["alg"],
+	}
+	if typ, ok := staticMap["typ"]; ok {
+		header["typ"] = typ
+	}
+
+	// Rebuild payload (merge all claims)
+	payload := make(map[string]interface{})
+	
+	// Add static claims (except alg and typ which go in header)
+	for k, v := range staticMap {
+		if k != "alg" && k != "typ" {
+			payload[k] = v
+		}
+	}
+	
+	// Add session claims
+	for k, v := range sessionMap {
+		payload[k] = v
+	}
+	
+	// Add dynamic claims
+	for k, v := range dynamicMap {
+		payload[k] = v
+	}
+
+	return assembleJWT(header, payload, components.Signature)
+}
+
+// assembleJWT serializes a header and payload and joins them with the
+// signature. It is the single reassembly path shared by all codecs.
+func assembleJWT(header, payload map[string]interface{}, signature string) (string, error) {
+	// Encode header and payload to JSON
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal header: %w", err)
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	// Base64url encode header and payload
+	headerB64 := base64.RawURLEncoding.EncodeToString(headerJSON)
+	payloadB64 := base64.RawURLEncoding.EncodeToString(payloadJSON)
+
+	// Reconstruct JWT: header.payload.signature
+	return fmt.Sprintf("%s.%s.%s", headerB64, payloadB64, signature), nil
+}
+
+// GetJWTComponentSizes returns the byte sizes of each component for logging/metrics
+func GetJWTComponentSizes(components *JWTComponents) map[string]int {
+	return map[string]int{
+		"static":    len(components.Static),
+		"session":   len(components.Session),
+		"dynamic":   len(components.Dynamic),
+		"signature": len(components.Signature),
+		"total":     len(components.Static) + len(components.Session) + len(components.Dynamic) + len(components.Signature),
+	}
+}
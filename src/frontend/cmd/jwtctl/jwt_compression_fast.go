@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"sync"
+)
+
+// The fast path splits and rebuilds per-class components without decoding
+// claims into maps. It copies each claim's JSON as-is, so it only takes
+// tokens whose JSON is already what json.Marshal would write: compact, no
+// escapes, integers that survive a float64, and arrays and objects of such
+// values.
+// Anything else falls back to the generic path. Either way the output is
+// byte-identical.
+
+// jsonMember is a key and raw value of a flat JSON object, both slices of
+// the decoded input
+type jsonMember struct {
+	key   []byte
+	value []byte
+	// rank orders duplicate keys on reassembly: the highest wins
+	rank int
+}
+
+// jwtCodecBuffers are the scratch buffers of one decompose or reassemble
+type jwtCodecBuffers struct {
+	raw     []byte
+	header  []byte
+	payload []byte
+	out     bytes.Buffer
+	members []jsonMember
+	classes [3][]jsonMember
+}
+
+var jwtCodecBufferPool = sync.Pool{New: func() interface{} { return new(jwtCodecBuffers) }}
+
+func getJWTCodecBuffers() *jwtCodecBuffers {
+	return jwtCodecBufferPool.Get().(*jwtCodecBuffers)
+}
+
+func putJWTCodecBuffers(b *jwtCodecBuffers) {
+	b.out.Reset()
+	b.members = b.members[:0]
+	for i := range b.classes {
+		b.classes[i] = b.classes[i][:0]
+	}
+	jwtCodecBufferPool.Put(b)
+}
+
+var (
+	jsonNull   = []byte("null")
+	jsonKeyAlg = []byte("alg")
+	jsonKeyTyp = []byte("typ")
+)
+
+// decomposeJWTFast is DecomposeJWT without maps; ok is false when the token
+// needs the generic path
+func decomposeJWTFast(jwtToken string) (*JWTComponents, bool) {
+	segments, err := splitJWT(jwtToken)
+	if err != nil {
+		return nil, false
+	}
+
+	b := getJWTCodecBuffers()
+	defer putJWTCodecBuffers(b)
+	var ok bool
+	if b.header, ok = decodeJWTSegment(b.header, &b.raw, segments.Header); !ok {
+		return nil, false
+	}
+	if b.payload, ok = decodeJWTSegment(b.payload, &b.raw, segments.Payload); !ok {
+		return nil, false
+	}
+	if b.members, ok = scanJSONObject(b.header, b.members); !ok {
+		return nil, false
+	}
+	alg, typ := memberValue(b.members, "alg"), memberValue(b.members, "typ")
+	if alg == nil {
+		alg = jsonNull
+	}
+	b.members = b.members[:0]
+	if b.members, ok = scanJSONObject(b.payload, b.members); !ok {
+		return nil, false
+	}
+
+	static, session, dynamic := b.classes[0], b.classes[1], b.classes[2]
+	static = append(static, jsonMember{key: jsonKeyAlg, value: alg})
+	if typ != nil {
+		static = append(static, jsonMember{key: jsonKeyTyp, value: typ})
+	}
+	for _, m := range b.members {
+		switch k := string(m.key); {
+		case k == "alg" || k == "typ":
+			// Shadowed by the header's, as in the generic path
+		case containsString(jwtStaticClaims, k):
+			static = append(static, m)
+		case containsString(jwtSessionClaims, k):
+			session = append(session, m)
+		default:
+			dynamic = append(dynamic, m)
+		}
+	}
+	b.classes[0], b.classes[1], b.classes[2] = static, session, dynamic
+
+	return &JWTComponents{
+		Static:    writeJSONObject(&b.out, static),
+		Session:   writeJSONObject(&b.out, session),
+		Dynamic:   writeJSONObject(&b.out, dynamic),
+		Signature: segments.Signature,
+	}, true
+}
+
+// reassembleJWTFast is ReassembleJWT without maps; ok is false when the
+// components need the generic path
+func reassembleJWTFast(components *JWTComponents) (string, bool) {
+	b := getJWTCodecBuffers()
+	defer putJWTCodecBuffers(b)
+
+	// The members slice into one copy of the components, so the scan
+	// allocates nothing
+	b.payload = append(append(append(b.payload[:0], components.Static...), components.Session...), components.Dynamic...)
+	off := 0
+	for rank, n := range [3]int{len(components.Static), len(components.Session), len(components.Dynamic)} {
+		start := len(b.members)
+		var ok bool
+		if b.members, ok = scanJSONObject(b.payload[off:off+n], b.members); !ok {
+			return "", false
+		}
+		for i := start; i < len(b.members); i++ {
+			b.members[i].rank = rank
+		}
+		off += n
+	}
+
+	alg, typ := jsonNull, []byte(nil)
+	payload := b.classes[0]
+	for _, m := range b.members {
+		if m.rank == 0 && string(m.key) == "alg" {
+			alg = m.value
+		} else if m.rank == 0 && string(m.key) == "typ" {
+			typ = m.value
+		} else {
+			payload = append(payload, m)
+		}
+	}
+	payload = dedupeMembers(payload)
+	b.classes[0] = payload
+	header := [2]jsonMember{{key: jsonKeyAlg, value: alg}, {key: jsonKeyTyp, value: typ}}
+	headerMembers := header[:]
+	if typ == nil {
+		headerMembers = header[:1]
+	}
+
+	headerLen, payloadLen := jsonObjectLen(headerMembers), jsonObjectLen(payload)
+	enc := base64.RawURLEncoding
+	b.out.Grow(headerLen + payloadLen)
+	writeJSONObjectTo(&b.out, headerMembers)
+	writeJSONObjectTo(&b.out, payload)
+	raw := b.out.Bytes()
+
+	var token strings.Builder
+	token.Grow(enc.EncodedLen(headerLen) + 1 + enc.EncodedLen(payloadLen) + 1 + len(components.Signature))
+	writeBase64(&token, raw[:headerLen])
+	token.WriteByte('.')
+	writeBase64(&token, raw[headerLen:])
+	token.WriteByte('.')
+	token.WriteString(components.Signature)
+	return token.String(), true
+}
+
+// decodeJWTSegment base64url-decodes s into dst's storage, copying s through
+// scratch rather than converting it
+func decodeJWTSegment(dst []byte, scratch *[]byte, s string) ([]byte, bool) {
+	enc := base64.RawURLEncoding
+	if n := enc.DecodedLen(len(s)); cap(dst) < n {
+		dst = make([]byte, n)
+	} else {
+		dst = dst[:n]
+	}
+	*scratch = append((*scratch)[:0], s...)
+	n, err := enc.Decode(dst, *scratch)
+	if err != nil {
+		return dst[:0], false
+	}
+	return dst[:n], true
+}
+
+// writeBase64 base64url-encodes src into sb in chunks, without an
+// intermediate string
+func writeBase64(sb *strings.Builder, src []byte) {
+	var chunk [96]byte
+	enc := base64.RawURLEncoding
+	for len(src) > 0 {
+		n := len(src)
+		// Whole 3-byte groups until the last chunk, so no padding
+		// bits land mid-token
+		if n > 72 {
+			n = 72
+		}
+		enc.Encode(chunk[:], src[:n])
+		sb.Write(chunk[:enc.EncodedLen(n)])
+		src = src[n:]
+	}
+}
+
+// memberValue returns the raw value of key, or nil when it is missing
+func memberValue(members []jsonMember, key string) []byte {
+	for _, m := range members {
+		if string(m.key) == key {
+			return m.value
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sortMembers sorts by key as json.Marshal sorts map keys, then by rank.
+// Objects are small, so insertion sort beats sort.Slice and allocates
+// nothing.
+func sortMembers(members []jsonMember) {
+	for i := 1; i < len(members); i++ {
+		for j := i; j > 0 && memberLess(members[j], members[j-1]); j-- {
+			members[j], members[j-1] = members[j-1], members[j]
+		}
+	}
+}
+
+func memberLess(a, b jsonMember) bool {
+	if c := bytes.Compare(a.key, b.key); c != 0 {
+		return c < 0
+	}
+	return a.rank < b.rank
+}
+
+// dedupeMembers sorts members and keeps the highest ranked of each key, as
+// later components overwrite earlier ones in ReassembleJWT
+func dedupeMembers(members []jsonMember) []jsonMember {
+	sortMembers(members)
+	out := members[:0]
+	for i, m := range members {
+		if i+1 < len(members) && bytes.Equal(m.key, members[i+1].key) {
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// jsonObjectLen is the length writeJSONObjectTo writes for sorted members
+func jsonObjectLen(members []jsonMember) int {
+	n := 2
+	for i, m := range members {
+		if i > 0 {
+			n++
+		}
+		n += len(m.key) + 3 + len(m.value)
+	}
+	return n
+}
+
+// writeJSONObject writes members sorted by key and returns the object
+func writeJSONObject(buf *bytes.Buffer, members []jsonMember) string {
+	sortMembers(members)
+	buf.Reset()
+	writeJSONObjectTo(buf, members)
+	return buf.String()
+}
+
+func writeJSONObjectTo(buf *bytes.Buffer, members []jsonMember) {
+	buf.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('"')
+		buf.Write(m.key)
+		buf.WriteString(`":`)
+		buf.Write(m.value)
+	}
+	buf.WriteByte('}')
+}
+
+// scanJSONObject appends the members of a JSON object to dst. It returns
+// false for anything json.Marshal would not have written byte for byte:
+// whitespace, escapes, non-ASCII, nested objects, non-integer or imprecise
+// numbers and duplicate keys.
+func scanJSONObject(data []byte, dst []jsonMember) ([]jsonMember, bool) {
+	start := len(dst)
+	if len(data) < 2 || data[0] != '{' || data[len(data)-1] != '}' {
+		return dst, false
+	}
+	i := 1
+	if data[i] == '}' {
+		return dst, i+1 == len(data)
+	}
+	for {
+		n := canonicalJSONString(data[i:])
+		if n < 0 || i+n >= len(data) || data[i+n] != ':' {
+			return dst, false
+		}
+		key := data[i+1 : i+n-1]
+		for _, m := range dst[start:] {
+			if bytes.Equal(m.key, key) {
+				return dst, false
+			}
+		}
+		i += n + 1
+		n = canonicalJSONValue(data[i:], true)
+		if n < 0 || i+n >= len(data) {
+			return dst, false
+		}
+		dst = append(dst, jsonMember{key: key, value: data[i : i+n]})
+		i += n
+		switch data[i] {
+		case ',':
+			i++
+		case '}':
+			return dst, i+1 == len(data)
+		default:
+			return dst, false
+		}
+	}
+}
+
+// canonicalJSONValue returns the length of the value at the start of data,
+// or -1 if json.Marshal could write it differently. Arrays and objects may
+// hold scalars only, and object keys must be sorted as json.Marshal sorts
+// map keys.
+func canonicalJSONValue(data []byte, allowContainer bool) int {
+	if len(data) == 0 {
+		return -1
+	}
+	switch c := data[0]; {
+	case c == '"':
+		return canonicalJSONString(data)
+	case c == '-' || c >= '0' && c <= '9':
+		return canonicalJSONInt(data)
+	case c == 't':
+		return literalLen(data, "true")
+	case c == 'f':
+		return literalLen(data, "false")
+	case c == 'n':
+		return literalLen(data, "null")
+	case c == '[' && allowContainer:
+		i := 1
+		if i < len(data) && data[i] == ']' {
+			return i + 1
+		}
+		for i < len(data) {
+			n := canonicalJSONValue(data[i:], false)
+			if n < 0 || i+n >= len(data) {
+				return -1
+			}
+			i += n
+			switch data[i] {
+			case ',':
+				i++
+			case ']':
+				return i + 1
+			default:
+				return -1
+			}
+		}
+	case c == '{' && allowContainer:
+		i := 1
+		if i < len(data) && data[i] == '}' {
+			return i + 1
+		}
+		var prev []byte
+		for i < len(data) {
+			n := canonicalJSONString(data[i:])
+			if n < 0 || i+n >= len(data) || data[i+n] != ':' {
+				return -1
+			}
+			key := data[i : i+n]
+			if prev != nil && bytes.Compare(prev, key) >= 0 {
+				return -1
+			}
+			prev = key
+			i += n + 1
+			n = canonicalJSONValue(data[i:], false)
+			if n < 0 || i+n >= len(data) {
+				return -1
+			}
+			i += n
+			switch data[i] {
+			case ',':
+				i++
+			case '}':
+				return i + 1
+			default:
+				return -1
+			}
+		}
+	}
+	return -1
+}
+
+// canonicalJSONString returns the length of the quoted string at the start
+// of data, or -1 if it holds bytes json.Marshal escapes
+func canonicalJSONString(data []byte) int {
+	if len(data) == 0 || data[0] != '"' {
+		return -1
+	}
+	for i := 1; i < len(data); i++ {
+		switch c := data[i]; {
+		case c == '"':
+			return i + 1
+		case c == '\\' || c < 0x20 || c >= 0x80 || c == '<' || c == '>' || c == '&':
+			return -1
+		}
+	}
+	return -1
+}
+
+// canonicalJSONInt returns the length of the integer at the start of data,
+// or -1 for fractions, exponents, leading zeros, negative zero, or more
+// digits than a float64 holds exactly
+func canonicalJSONInt(data []byte) int {
+	i := 0
+	if data[0] == '-' {
+		i++
+	}
+	digits := i
+	for i < len(data) && data[i] >= '0' && data[i] <= '9' {
+		i++
+	}
+	n := i - digits
+	if n == 0 || n > 15 || n > 1 && data[digits] == '0' || data[0] == '-' && data[digits] == '0' {
+		return -1
+	}
+	if i < len(data) && (data[i] == '.' || data[i] == 'e' || data[i] == 'E') {
+		return -1
+	}
+	return i
+}
+
+func literalLen(data []byte, lit string) int {
+	if len(data) >= len(lit) && string(data[:len(lit)]) == lit {
+		return len(lit)
+	}
+	return -1
+}
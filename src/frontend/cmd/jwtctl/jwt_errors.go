@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// jwtErrorDomain is reported in the ErrorInfo detail of rejected calls
+const jwtErrorDomain = "auth.hipstershop.com"
+
+// Sentinel errors for the ways a forwarded JWT can be rejected
+var (
+	errJWTExpired          = errors.New("jwt expired")
+	errJWTNotYetValid      = errors.New("jwt not yet valid")
+	errJWTMalformed        = errors.New("jwt malformed")
+	errJWTSignatureInvalid = errors.New("jwt signature invalid")
+	errJWTSessionMismatch  = errors.New("jwt session mismatch")
+	errJWTClaimsInvalid    = errors.New("jwt claims invalid")
+)
+
+// checkJWTExpiry decodes the payload of a JWT (without verifying the
+// signature, which is the frontend's job) and rejects it if exp has passed
+// or nbf has not yet come
+func checkJWTExpiry(jwtToken string) error {
+	return checkJWTExpiryWithin(jwtToken, 0)
+}
+
+// checkJWTExpiryWithin is checkJWTExpiry accepting tokens up to skew past
+// their exp or before their nbf
+func checkJWTExpiryWithin(jwtToken string, skew time.Duration) error {
+	segments, err := splitJWT(jwtToken)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+	var claims jwtClaimSet
+	if err := segments.DecodePayload(&claims); err != nil {
+		return fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+	if claims.ExpiresAt != nil && jwtClock.Now().Add(-skew).After(time.Unix(int64(*claims.ExpiresAt), 0)) {
+		return fmt.Errorf("%w: exp=%d", errJWTExpired, int64(*claims.ExpiresAt))
+	}
+	if claims.NotBefore != nil && jwtClock.Now().Add(skew).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return fmt.Errorf("%w: nbf=%d", errJWTNotYetValid, int64(*claims.NotBefore))
+	}
+	return nil
+}
+
+// jwtStatusError converts a JWT error into a gRPC status carrying an
+// ErrorInfo detail whose Reason identifies the failure class. Claims that
+// break the schema are named in the ErrorInfo's claims metadata and
+// described one by one in a BadRequest detail.
+func jwtStatusError(err error) error {
+	code, reason := codes.Unauthenticated, "JWT_INVALID"
+	switch {
+	case errors.Is(err, errJWTExpired):
+		reason = "JWT_EXPIRED"
+	case errors.Is(err, errJWTNotYetValid):
+		reason = "JWT_NOT_YET_VALID"
+	case errors.Is(err, errJWTMalformed):
+		code, reason = codes.InvalidArgument, "JWT_MALFORMED"
+	case errors.Is(err, errJWTSignatureInvalid):
+		reason = "JWT_SIGNATURE_INVALID"
+	case errors.Is(err, errJWTSessionMismatch):
+		code, reason = codes.PermissionDenied, "JWT_SESSION_MISMATCH"
+	case errors.Is(err, errJWTClaimsInvalid):
+		reason = "JWT_CLAIMS_INVALID"
+	}
+	info := &errdetails.ErrorInfo{
+		Reason: reason,
+		Domain: jwtErrorDomain,
+	}
+	st, detailErr := status.New(code, err.Error()).WithDetails(info)
+	var schemaErr *claimsSchemaError
+	if errors.As(err, &schemaErr) {
+		info.Metadata = map[string]string{"claims": schemaErr.claims()}
+		st, detailErr = status.New(code, err.Error()).WithDetails(info, schemaErr.badRequest())
+	}
+	if detailErr != nil {
+		return status.Error(code, err.Error())
+	}
+	return st.Err()
+}
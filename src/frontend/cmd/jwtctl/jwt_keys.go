@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	verificationKeyOnce sync.Once
+	verificationKey     *rsa.PublicKey
+)
+
+// jwtVerificationKey returns the frontend's public key, loaded on first use
+// from JWT_PUBLIC_KEY_PATH (default jwt_public_key.pem). It returns nil if
+// the key cannot be loaded, which fails every detached JWS check.
+func jwtVerificationKey() *rsa.PublicKey {
+	verificationKeyOnce.Do(func() {
+		path := os.Getenv("JWT_PUBLIC_KEY_PATH")
+		if path == "" {
+			path = "jwt_public_key.pem"
+		}
+		key, err := loadRSAPublicKey(path)
+		if err != nil {
+			log.Errorf("failed to load JWT verification key: %v", err)
+			return
+		}
+		verificationKey = key
+	})
+	return verificationKey
+}
+
+// loadRSAPublicKey reads a PKIX or PKCS#1 PEM-encoded RSA public key
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block", path)
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA public key", path)
+	}
+	return key, nil
+}
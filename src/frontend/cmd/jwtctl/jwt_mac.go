@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// componentMACField is appended to the scheme prefix to name the header
+// carrying the component HMAC
+const componentMACField = "mac-bin"
+
+// componentMACKey authenticates the decomposed JWT headers. The RS256
+// signature covers the original payload bytes, which a receiver cannot
+// reconstruct exactly, so without this MAC a hop could alter a component
+// undetected. nil disables MACs.
+var componentMACKey = loadComponentMACKey()
+
+// loadComponentMACKey derives the MAC key from JWT_COMPONENT_MAC_SECRET,
+// which must be distributed to every service that encodes or decodes
+// compressed JWTs
+func loadComponentMACKey() []byte {
+	secret := os.Getenv("JWT_COMPONENT_MAC_SECRET")
+	if secret == "" {
+		return nil
+	}
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte("hipstershop/jwt-component-mac/v1"))
+	return h.Sum(nil)
+}
+
+// IsComponentMACEnabled reports whether outgoing components are MACed and
+// incoming ones must carry a valid MAC
+func IsComponentMACEnabled() bool {
+	return componentMACKey != nil
+}
+
+// jwtNegotiationHeaders are the mode negotiation headers, x-jwt-mode and
+// x-jwt-modes. They fall under the default scheme prefix but are added
+// next to the components after the integrity headers are computed, so
+// neither the meta header nor the MAC and detached JWS cover them.
+var jwtNegotiationHeaders = map[string]bool{"x-jwt-mode": true, "x-jwt-modes": true}
+
+// pairEntries collects the outgoing pairs under the scheme prefix, keyed
+// without their -bin suffix
+func pairEntries(scheme JWTHeaderScheme, pairs []string) map[string]string {
+	entries := make(map[string]string, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if strings.HasPrefix(pairs[i], scheme.Prefix) {
+			entries[strings.TrimSuffix(pairs[i], "-bin")] = pairs[i+1]
+		}
+	}
+	return entries
+}
+
+// metadataEntries is pairEntries for incoming metadata
+func metadataEntries(scheme JWTHeaderScheme, md metadata.MD) map[string]string {
+	entries := make(map[string]string)
+	for k, v := range md {
+		if strings.HasPrefix(k, scheme.Prefix) && len(v) > 0 {
+			entries[strings.TrimSuffix(k, "-bin")] = v[0]
+		}
+	}
+	return entries
+}
+
+// canonicalComponents serializes the component entries in key order,
+// leaving out the RS256 signature, whole or split, the integrity headers
+// themselves and the negotiation headers. Both the component MAC and the detached JWS cover
+// these bytes.
+func canonicalComponents(scheme JWTHeaderScheme, entries map[string]string) []byte {
+	skip := map[string]bool{
+		strings.TrimSuffix(scheme.Signature, "-bin"):                true,
+		strings.TrimSuffix(scheme.SignaturePart(1), "-bin"):         true,
+		strings.TrimSuffix(scheme.SignaturePart(2), "-bin"):         true,
+		strings.TrimSuffix(scheme.Prefix+componentMACField, "-bin"): true,
+		strings.TrimSuffix(scheme.Prefix+detachedJWSField, "-bin"):  true,
+	}
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		if !skip[k] && !jwtNegotiationHeaders[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%d:%s%d:%s", len(k), k, len(entries[k]), entries[k])
+	}
+	return b.Bytes()
+}
+
+func componentMAC(scheme JWTHeaderScheme, entries map[string]string) []byte {
+	mac := hmac.New(sha256.New, componentMACKey)
+	mac.Write(canonicalComponents(scheme, entries))
+	return mac.Sum(nil)
+}
+
+// appendComponentMAC adds the MAC header to encoded pairs when enabled
+func appendComponentMAC(scheme JWTHeaderScheme, pairs []string) []string {
+	if !IsComponentMACEnabled() {
+		return pairs
+	}
+	return append(pairs, scheme.Prefix+componentMACField, string(componentMAC(scheme, pairEntries(scheme, pairs))))
+}
+
+// verifyComponentMAC checks the MAC header in md for the scheme the
+// components were found under. It is a no-op when MACs are disabled.
+func verifyComponentMAC(scheme JWTHeaderScheme, md metadata.MD) error {
+	if !IsComponentMACEnabled() {
+		return nil
+	}
+	got := firstMD(md, scheme.Prefix+componentMACField)
+	if got == "" {
+		return fmt.Errorf("%w: missing component MAC", errJWTSignatureInvalid)
+	}
+	if !hmac.Equal([]byte(got), componentMAC(scheme, metadataEntries(scheme, md))) {
+		return fmt.Errorf("%w: component MAC mismatch", errJWTSignatureInvalid)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// jwtMetaField is appended to the scheme prefix to name the header
+// describing the components sent alongside it
+const jwtMetaField = "meta"
+
+// jwtMetaVersion is the format of the meta header value
+const jwtMetaVersion = 1
+
+// IsJWTMetaEnabled reports whether outgoing components carry a meta header
+// and incoming ones must. Receivers check a meta header whenever one is
+// present, so senders can enable it first.
+func IsJWTMetaEnabled() bool {
+	return os.Getenv("JWT_META_HEADER") == "true"
+}
+
+// metaComponentKeys returns the sorted component keys the meta header
+// covers: every entry under the scheme prefix except the integrity headers,
+// which are added after it or checked on their own, and the negotiation
+// headers
+func metaComponentKeys(scheme JWTHeaderScheme, entries map[string]string) []string {
+	skip := map[string]bool{
+		scheme.Prefix + jwtMetaField:                                true,
+		strings.TrimSuffix(scheme.Prefix+componentMACField, "-bin"): true,
+		strings.TrimSuffix(scheme.Prefix+detachedJWSField, "-bin"):  true,
+	}
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		if !skip[k] && !jwtNegotiationHeaders[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jwtMeta formats the meta header value, "v=1;codec=per-class;n=4;crc=…",
+// with the number of components and a CRC-32 over each component's key
+// and value. A proxy that drops a header changes n; one that swaps values
+// between headers changes the CRC.
+func jwtMeta(codec string, scheme JWTHeaderScheme, entries map[string]string) string {
+	keys := metaComponentKeys(scheme, entries)
+	crc := crc32.NewIEEE()
+	for _, k := range keys {
+		fmt.Fprintf(crc, "%d:%s%d:%s", len(k), k, len(entries[k]), entries[k])
+	}
+	return fmt.Sprintf("v=%d;codec=%s;n=%d;crc=%08x", jwtMetaVersion, codec, len(keys), crc.Sum32())
+}
+
+// appendJWTMeta adds the meta header to encoded pairs when enabled
+func appendJWTMeta(codec string, scheme JWTHeaderScheme, pairs []string) []string {
+	if !IsJWTMetaEnabled() {
+		return pairs
+	}
+	return append(pairs, scheme.Prefix+jwtMetaField, jwtMeta(codec, scheme, pairEntries(scheme, pairs)))
+}
+
+// verifyJWTMeta checks the components in md against their meta header
+// before they are reassembled, so headers lost or rearranged in transit
+// are reported as such rather than as a malformed or unverifiable token
+func verifyJWTMeta(codec string, scheme JWTHeaderScheme, md metadata.MD) error {
+	got := firstMD(md, scheme.Prefix+jwtMetaField)
+	if got == "" {
+		if IsJWTMetaEnabled() {
+			return fmt.Errorf("%w: missing %s header", errJWTMalformed, scheme.Prefix+jwtMetaField)
+		}
+		return nil
+	}
+	fields := make(map[string]string)
+	for _, f := range strings.Split(got, ";") {
+		if k, v, ok := strings.Cut(f, "="); ok {
+			fields[k] = v
+		}
+	}
+	if fields["v"] != strconv.Itoa(jwtMetaVersion) {
+		return fmt.Errorf("%w: unsupported %s version %q", errJWTMalformed, jwtMetaField, fields["v"])
+	}
+	if fields["codec"] != codec {
+		return fmt.Errorf("%w: components sent with codec %q, found %q", errJWTMalformed, fields["codec"], codec)
+	}
+	want := jwtMeta(codec, scheme, metadataEntries(scheme, md))
+	if got == want {
+		return nil
+	}
+	n := len(metaComponentKeys(scheme, metadataEntries(scheme, md)))
+	if fields["n"] != strconv.Itoa(n) {
+		return fmt.Errorf("%w: %s components sent, %d received", errJWTMalformed, fields["n"], n)
+	}
+	return fmt.Errorf("%w: component checksum mismatch, headers altered or reordered in transit", errJWTMalformed)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+)
+
+// Reasons a claim breaks the schema, as reported in the BadRequest detail
+// of rejected calls
+const (
+	claimMissing         = "CLAIM_MISSING"
+	claimWrongType       = "CLAIM_WRONG_TYPE"
+	claimExpNotAfterIat  = "EXP_NOT_AFTER_IAT"
+	claimAudienceInvalid = "AUDIENCE_MISMATCH"
+)
+
+// claimViolation is a claim breaking the schema
+type claimViolation struct {
+	Claim  string
+	Reason string
+	Detail string
+}
+
+// claimsSchemaError lists every claim of a token that breaks the schema. It
+// matches errJWTClaimsInvalid.
+type claimsSchemaError struct {
+	Violations []claimViolation
+}
+
+func (e *claimsSchemaError) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = v.Claim + " " + v.Detail
+	}
+	return fmt.Sprintf("%v: %s", errJWTClaimsInvalid, strings.Join(parts, "; "))
+}
+
+func (e *claimsSchemaError) Unwrap() error { return errJWTClaimsInvalid }
+
+func (e *claimsSchemaError) add(claim, reason, detail string) {
+	e.Violations = append(e.Violations, claimViolation{Claim: claim, Reason: reason, Detail: detail})
+}
+
+// claims returns the names of the offending claims, comma-separated
+func (e *claimsSchemaError) claims() string {
+	names := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		names[i] = v.Claim
+	}
+	return strings.Join(names, ",")
+}
+
+// badRequest describes the violations as a BadRequest detail, one field
+// violation per claim
+func (e *claimsSchemaError) badRequest() *errdetails.BadRequest {
+	br := &errdetails.BadRequest{}
+	for _, v := range e.Violations {
+		br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       v.Claim,
+			Description: v.Detail,
+			Reason:      v.Reason,
+		})
+	}
+	return br
+}
+
+// loadJWTClaimsValidation reads JWT_VALIDATE_CLAIMS, whether user tokens
+// must follow the claim schema of jwt_claims.yaml
+func loadJWTClaimsValidation() bool {
+	return os.Getenv("JWT_VALIDATE_CLAIMS") == "true"
+}
+
+// validateJWTClaims checks the claims of a reassembled user token against
+// jwtClaimRules: required claims are present, every claim has its type, exp
+// is after iat and aud includes jwtAudience. It returns a
+// *claimsSchemaError listing every violation. The signature is not checked.
+func validateJWTClaims(jwtToken string) error {
+	segments, err := splitJWT(jwtToken)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+	var payload map[string]json.RawMessage
+	if err := segments.DecodePayload(&payload); err != nil {
+		return fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+	e := &claimsSchemaError{}
+	typed := make(map[string]bool, len(jwtClaimRules))
+	for _, rule := range jwtClaimRules {
+		raw, ok := payload[rule.Name]
+		if !ok || string(raw) == "null" {
+			if rule.Required {
+				e.add(rule.Name, claimMissing, "is required")
+			}
+			continue
+		}
+		if !claimHasType(raw, rule.Type) {
+			e.add(rule.Name, claimWrongType, "is not of type "+rule.Type)
+			continue
+		}
+		typed[rule.Name] = true
+	}
+	if typed["exp"] && typed["iat"] {
+		var exp, iat float64
+		json.Unmarshal(payload["exp"], &exp)
+		json.Unmarshal(payload["iat"], &iat)
+		if exp <= iat {
+			e.add("exp", claimExpNotAfterIat, fmt.Sprintf("%d is not after iat %d", int64(exp), int64(iat)))
+		}
+	}
+	if typed["aud"] && !audienceIncludes(payload["aud"], jwtAudience) {
+		e.add("aud", claimAudienceInvalid, "does not include "+jwtAudience)
+	}
+	if len(e.Violations) > 0 {
+		return e
+	}
+	return nil
+}
+
+// claimHasType reports whether the JSON value raw is of the schema type typ
+func claimHasType(raw json.RawMessage, typ string) bool {
+	switch typ {
+	case "string":
+		var s string
+		return json.Unmarshal(raw, &s) == nil
+	case "numericdate":
+		var f float64
+		return json.Unmarshal(raw, &f) == nil
+	case "audience":
+		var s string
+		var list []string
+		return json.Unmarshal(raw, &s) == nil || json.Unmarshal(raw, &list) == nil
+	case "actor":
+		var act struct {
+			Subject *string `json:"sub"`
+		}
+		return json.Unmarshal(raw, &act) == nil && act.Subject != nil
+	}
+	return false
+}
+
+// audienceIncludes reports whether the aud claim raw is or lists aud
+func audienceIncludes(raw json.RawMessage, aud string) bool {
+	var list []string
+	if json.Unmarshal(raw, &list) != nil {
+		var s string
+		json.Unmarshal(raw, &s)
+		list = []string{s}
+	}
+	for _, a := range list {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// The session ticket is an in-house format standing in for the JWT, the
+// lower bound on what a token can cost: a fixed 64-byte structure in a
+// single header. Only the subject hash, expiry and a few flags survive, so
+// receivers get a stand-in JWT rebuilt from the ticket (sessionTicketType),
+// without session_id, currency or any other claim.
+//
+//	offset  size  field
+//	0       1     version (sessionTicketVersion)
+//	1       1     flags (sessionTicketFlag*)
+//	2       6     reserved, zero
+//	8       8     exp, Unix seconds, big-endian
+//	16      16    sub hash, SHA-256 truncated
+//	32      32    HMAC-SHA256 over bytes 0-31
+const (
+	sessionTicketSize    = 64
+	sessionTicketVersion = 1
+	sessionTicketField   = "ticket"
+	// sessionTicketType is the typ of the JWTs rebuilt from tickets. Their
+	// sub is the hex subject hash, which re-encodes as is.
+	sessionTicketType = "session-ticket"
+
+	// sessionTicketFlagExchanged marks a token issued to a service (act)
+	sessionTicketFlagExchanged = 1 << 0
+	// sessionTicketFlagBound marks a token bound to a client fingerprint (fph)
+	sessionTicketFlagBound = 1 << 1
+)
+
+// sessionTicketKey derives the ticket HMAC key from the component MAC
+// secret, so no further secret has to be distributed
+func sessionTicketKey() ([]byte, error) {
+	if componentMACKey == nil {
+		return nil, fmt.Errorf("session tickets need JWT_COMPONENT_MAC_SECRET")
+	}
+	h := hmac.New(sha256.New, componentMACKey)
+	h.Write([]byte("hipstershop/session-ticket/v1"))
+	return h.Sum(nil), nil
+}
+
+// sessionTicketCodec sends a session ticket in place of the JWT
+type sessionTicketCodec struct {
+	scheme JWTHeaderScheme
+}
+
+func (c sessionTicketCodec) headerKey() string { return c.scheme.Prefix + sessionTicketField }
+
+func (c sessionTicketCodec) Name() string { return jwtCodecTicket }
+
+func (c sessionTicketCodec) Encode(jwtToken string) ([]string, error) {
+	key, err := sessionTicketKey()
+	if err != nil {
+		return nil, err
+	}
+	header, payload, _, err := parseJWT(jwtToken)
+	if err != nil {
+		return nil, err
+	}
+	exp, ok := payload["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("session ticket needs an exp claim")
+	}
+
+	var ticket [sessionTicketSize]byte
+	ticket[0] = sessionTicketVersion
+	if _, ok := payload["act"]; ok {
+		ticket[1] |= sessionTicketFlagExchanged
+	}
+	if _, ok := payload["fph"]; ok {
+		ticket[1] |= sessionTicketFlagBound
+	}
+	binary.BigEndian.PutUint64(ticket[8:16], uint64(exp))
+	if header["typ"] == sessionTicketType {
+		sub, _ := payload["sub"].(string)
+		if len(sub) != 32 {
+			return nil, fmt.Errorf("session ticket JWT has an invalid sub")
+		}
+		if _, err := hex.Decode(ticket[16:32], []byte(sub)); err != nil {
+			return nil, fmt.Errorf("session ticket JWT has an invalid sub: %w", err)
+		}
+	} else {
+		subject, _ := payload["sub"].(string)
+		if subject == "" {
+			subject, _ = payload["session_id"].(string)
+		}
+		sum := sha256.Sum256([]byte(subject))
+		copy(ticket[16:32], sum[:16])
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(ticket[:32])
+	copy(ticket[32:], mac.Sum(nil))
+
+	return []string{c.headerKey(), base64.RawURLEncoding.EncodeToString(ticket[:])}, nil
+}
+
+func (c sessionTicketCodec) Decode(md metadata.MD) (*DecodedJWT, error) {
+	value := firstMD(md, c.headerKey())
+	if value == "" {
+		return nil, nil
+	}
+	ticket, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(ticket) != sessionTicketSize {
+		return nil, fmt.Errorf("session ticket is not %d bytes of base64url", sessionTicketSize)
+	}
+	if ticket[0] != sessionTicketVersion {
+		return nil, fmt.Errorf("unsupported session ticket version %d", ticket[0])
+	}
+	key, err := sessionTicketKey()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(ticket[:32])
+	if !hmac.Equal(ticket[32:], mac.Sum(nil)) {
+		return nil, fmt.Errorf("%w: session ticket HMAC mismatch", errJWTSignatureInvalid)
+	}
+
+	header := map[string]interface{}{"alg": "none", "typ": sessionTicketType}
+	payload := map[string]interface{}{
+		"sub":          hex.EncodeToString(ticket[16:32]),
+		"exp":          int64(binary.BigEndian.Uint64(ticket[8:16])),
+		"ticket_flags": ticket[1],
+	}
+	token, err := assembleJWT(header, payload, "")
+	if err != nil {
+		return nil, err
+	}
+	return &DecodedJWT{Token: token, WireSize: len(value), Codec: jwtCodecTicket}, nil
+}
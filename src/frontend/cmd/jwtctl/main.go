@@ -0,0 +1,339 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// jwtctl inspects demo tokens captured during experiments, with the same
+// copy of the codec the services use. A token is read from the last
+// argument, or from stdin when there is none or it is "-"; a "Bearer "
+// prefix is ignored.
+//
+//	jwtctl decode [token]
+//	jwtctl split [-codec per-claim] [token]
+//	jwtctl reassemble [headers.txt]
+//	jwtctl verify -key jwt_public_key.pem | -jwks https://host/jwks.json [token]
+//	jwtctl size-report [token]
+//
+// split prints headers as "key: value" lines, with -bin values in base64 as
+// on the wire, and reassemble reads them back. The codec settings come
+// from the same environment as the services' (JWT_HEADER_PREFIX,
+// JWT_COMPONENT_MAC_SECRET, JWT_META_HEADER, ...).
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2/hpack"
+	"google.golang.org/grpc/metadata"
+)
+
+// log is used by the codec files shared with the services
+var log = logrus.New()
+
+// commands are the subcommands by name
+var commands = map[string]func(args []string) error{
+	"decode":      decodeCommand,
+	"split":       splitCommand,
+	"reassemble":  reassembleCommand,
+	"verify":      verifyCommand,
+	"size-report": sizeReportCommand,
+}
+
+func main() {
+	log.Out = os.Stderr
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Fprintln(os.Stderr, "usage: jwtctl decode|split|reassemble|verify|size-report [flags] [token]")
+		os.Exit(2)
+	}
+	if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "jwtctl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// readToken returns the token in args, or read from stdin
+func readToken(args []string) (string, error) {
+	var token string
+	if len(args) > 0 && args[len(args)-1] != "-" {
+		token = args[len(args)-1]
+	} else {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", err
+		}
+		token = string(b)
+	}
+	token = strings.TrimSpace(token)
+	token = strings.TrimSpace(strings.TrimPrefix(token, "Bearer "))
+	if _, err := splitJWT(token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// codecByName returns the codec of a JWT_CODEC_STRATEGY value, the
+// configured one for ""
+func codecByName(name string) (JWTCodec, error) {
+	switch name {
+	case "":
+		return jwtCodec, nil
+	case jwtCodecPerClass:
+		return perClassCodec{}, nil
+	case jwtCodecPerClaim:
+		return perClaimCodec{scheme: jwtHeaders}, nil
+	case jwtCodecTicket:
+		return sessionTicketCodec{scheme: jwtHeaders}, nil
+	case jwtCodecDeflate:
+		return deflateCodec{scheme: jwtHeaders}, nil
+	case jwtCodecZstdDict:
+		return zstdDictCodec{scheme: jwtHeaders}, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+// decodedToken is what decode prints: the JOSE header and claims, with the
+// time claims also as timestamps
+type decodedToken struct {
+	Header         map[string]interface{} `json:"header"`
+	Claims         map[string]interface{} `json:"claims"`
+	Times          map[string]time.Time   `json:"times,omitempty"`
+	SignatureBytes int                    `json:"signature_bytes"`
+}
+
+func decodeCommand(args []string) error {
+	token, err := readToken(args)
+	if err != nil {
+		return err
+	}
+	header, claims, signature, err := parseJWT(token)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not base64url: %w", err)
+	}
+	out := decodedToken{Header: header, Claims: claims, Times: make(map[string]time.Time), SignatureBytes: len(sig)}
+	for _, k := range []string{"exp", "iat", "nbf"} {
+		if v, ok := claims[k].(float64); ok {
+			out.Times[k] = time.Unix(int64(v), 0).UTC()
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+func splitCommand(args []string) error {
+	fs := flag.NewFlagSet("split", flag.ContinueOnError)
+	codecName := fs.String("codec", "", "codec to split with (default JWT_CODEC_STRATEGY or per-class)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	codec, err := codecByName(*codecName)
+	if err != nil {
+		return err
+	}
+	token, err := readToken(fs.Args())
+	if err != nil {
+		return err
+	}
+	pairs, err := codec.Encode(token)
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		fmt.Printf("%s: %s\n", pairs[i], wireValue(pairs[i], pairs[i+1]))
+	}
+	return nil
+}
+
+// wireValue is the value of key as sent: -bin values are base64
+func wireValue(key, value string) string {
+	if strings.HasSuffix(key, "-bin") {
+		return base64.RawStdEncoding.EncodeToString([]byte(value))
+	}
+	return value
+}
+
+func reassembleCommand(args []string) error {
+	in := io.Reader(os.Stdin)
+	if len(args) > 0 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	md, err := readHeaders(in)
+	if err != nil {
+		return err
+	}
+	decoded, err := DecodeJWTMetadata(md)
+	if err != nil {
+		return err
+	}
+	if decoded == nil {
+		return fmt.Errorf("no split JWT headers found")
+	}
+	log.Infof("reassembled from %s headers, %d value bytes", decoded.Codec, decoded.WireSize)
+	fmt.Println(decoded.Token)
+	return nil
+}
+
+// readHeaders parses "key: value" lines as split prints them, or as copied
+// from a request dump. Blank lines and lines starting with # are skipped.
+func readHeaders(r io.Reader) (metadata.MD, error) {
+	md := metadata.MD{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: not a key: value header", n)
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		if strings.HasSuffix(key, "-bin") {
+			b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s is not base64: %w", n, key, err)
+			}
+			value = string(b)
+		}
+		md.Append(key, value)
+	}
+	return md, scanner.Err()
+}
+
+// codecSize is how one codec sends a token
+type codecSize struct {
+	headers    int
+	valueBytes int
+	// hpackFirst and hpackRepeat are the HPACK-encoded bytes of the
+	// headers on a new connection and when the same token is sent again
+	hpackFirst  int
+	hpackRepeat int
+}
+
+func sizeReportCommand(args []string) error {
+	token, err := readToken(args)
+	if err != nil {
+		return err
+	}
+	segments, _ := splitJWT(token)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "segment\tbytes\t\n")
+	fmt.Fprintf(w, "header\t%d\t\n", len(segments.Header))
+	fmt.Fprintf(w, "payload\t%d\t\n", len(segments.Payload))
+	fmt.Fprintf(w, "signature\t%d\t\n", len(segments.Signature))
+	fmt.Fprintf(w, "token\t%d\t\n", len(token))
+	if components, err := DecomposeJWT(token); err == nil {
+		sizes := GetJWTComponentSizes(components)
+		classes := make([]string, 0, len(sizes))
+		for k := range sizes {
+			if k != "total" {
+				classes = append(classes, k)
+			}
+		}
+		sort.Strings(classes)
+		for _, k := range classes {
+			fmt.Fprintf(w, "component %s\t%d\t\n", k, sizes[k])
+		}
+	}
+	fmt.Fprintf(w, "\t\t\n")
+
+	fmt.Fprintf(w, "codec\theaders\tvalue bytes\thpack first\thpack repeat\t\n")
+	full, err := measureHeaders([]string{"authorization", "Bearer " + token})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "authorization\t%d\t%d\t%d\t%d\t\n", full.headers, full.valueBytes, full.hpackFirst, full.hpackRepeat)
+	for _, name := range []string{jwtCodecPerClass, jwtCodecPerClaim, jwtCodecDeflate, jwtCodecZstdDict, jwtCodecTicket} {
+		codec, _ := codecByName(name)
+		pairs, err := codec.Encode(token)
+		if err != nil {
+			log.Warnf("skipping %s: %v", name, err)
+			continue
+		}
+		s, err := measureHeaders(pairs)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t\n", name, s.headers, s.valueBytes, s.hpackFirst, s.hpackRepeat)
+	}
+	// per-class with the signature sent as JWT_SIGNATURE_SPLIT (one more
+	// header, none as large) and JWT_BINARY_METADATA=raw (raw bytes rather
+	// than base64url text) send it
+	if components, err := DecomposeJWT(token); err == nil {
+		for _, v := range []struct {
+			name       string
+			split, raw bool
+		}{
+			{"text-sig", false, false},
+			{"raw-sig", false, true},
+			{"split-sig", true, false},
+			{"split-raw-sig", true, true},
+		} {
+			pairs := []string{
+				jwtHeaders.Static, components.Static,
+				jwtHeaders.Session, components.Session,
+				jwtHeaders.Dynamic, components.Dynamic,
+			}
+			s, err := measureHeaders(append(pairs, jwtHeaders.SignaturePairs(components.Signature, v.split, v.raw)...))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s %s\t%d\t%d\t%d\t%d\t\n", jwtCodecPerClass, v.name, s.headers, s.valueBytes, s.hpackFirst, s.hpackRepeat)
+		}
+	}
+	return w.Flush()
+}
+
+// measureHeaders sizes the key/value pairs a codec sends, with -bin values
+// base64-encoded as on the wire
+func measureHeaders(pairs []string) (codecSize, error) {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	write := func() (int, error) {
+		buf.Reset()
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if err := enc.WriteField(hpack.HeaderField{Name: pairs[i], Value: wireValue(pairs[i], pairs[i+1])}); err != nil {
+				return 0, err
+			}
+		}
+		return buf.Len(), nil
+	}
+	s := codecSize{headers: len(pairs) / 2, valueBytes: metadataPairsSize(pairs)}
+	var err error
+	if s.hpackFirst, err = write(); err != nil {
+		return s, err
+	}
+	s.hpackRepeat, err = write()
+	return s, err
+}
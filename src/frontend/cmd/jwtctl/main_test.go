@@ -0,0 +1,57 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestReadHeadersReadsSplitOutput reassembles tokens from headers printed
+// as split prints them, -bin values included
+func TestReadHeadersReadsSplitOutput(t *testing.T) {
+	enc := base64.RawURLEncoding
+	token := enc.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." +
+		enc.EncodeToString([]byte(`{"exp":1700000000,"iat":1699999880,"iss":"https://auth.hipstershop.com","session_id":"s1"}`)) + "." +
+		enc.EncodeToString([]byte("signature"))
+	for _, name := range []string{jwtCodecPerClaim, jwtCodecDeflate, jwtCodecZstdDict} {
+		codec, _ := codecByName(name)
+		pairs, err := codec.Encode(token)
+		if err != nil {
+			t.Fatalf("%s: Encode() error = %v", name, err)
+		}
+		var printed strings.Builder
+		printed.WriteString("# captured\n\n")
+		for i := 0; i+1 < len(pairs); i += 2 {
+			fmt.Fprintf(&printed, "%s: %s\n", strings.ToUpper(pairs[i]), wireValue(pairs[i], pairs[i+1]))
+		}
+		md, err := readHeaders(strings.NewReader(printed.String()))
+		if err != nil {
+			t.Fatalf("%s: readHeaders() error = %v", name, err)
+		}
+		decoded, err := DecodeJWTMetadata(md)
+		if err != nil || decoded == nil {
+			t.Fatalf("%s: DecodeJWTMetadata() = %+v, %v", name, decoded, err)
+		}
+		if decoded.Codec != name {
+			t.Errorf("%s: decoded with %s", name, decoded.Codec)
+		}
+	}
+	if _, err := readHeaders(strings.NewReader("x-jwt-sig-bin: %%%\n")); err == nil {
+		t.Error("readHeaders() accepted a -bin value that is not base64")
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func verifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	keyPath := fs.String("key", "", "PEM public key (RSA, EC or Ed25519)")
+	jwksSource := fs.String("jwks", "", "JWKS file or http(s) URL")
+	audience := fs.String("audience", jwtAudience, "audience the token must include, empty to skip")
+	schema := fs.Bool("schema", true, "also check the claims against jwt_claims.yaml")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*keyPath == "") == (*jwksSource == "") {
+		return errors.New("exactly one of -key and -jwks is required")
+	}
+	token, err := readToken(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	var keyFunc jwt.Keyfunc
+	if *keyPath != "" {
+		key, err := loadPEMPublicKey(*keyPath)
+		if err != nil {
+			return err
+		}
+		keyFunc = func(*jwt.Token) (interface{}, error) { return key, nil }
+	} else {
+		keys, err := loadJWKS(*jwksSource)
+		if err != nil {
+			return err
+		}
+		keyFunc = keys.keyFunc
+	}
+	opts := []jwt.ParserOption{jwt.WithExpirationRequired(), jwt.WithTimeFunc(jwtClock.Now)}
+	if *audience != "" {
+		opts = append(opts, jwt.WithAudience(*audience))
+	}
+
+	failed := false
+	if _, err := jwt.Parse(token, keyFunc, opts...); err != nil {
+		fmt.Printf("token: invalid: %v\n", err)
+		failed = true
+	} else {
+		fmt.Println("token: valid")
+	}
+	if *schema {
+		var schemaErr *claimsSchemaError
+		switch err := validateJWTClaims(token); {
+		case errors.As(err, &schemaErr):
+			for _, v := range schemaErr.Violations {
+				fmt.Printf("claims: %s %s (%s)\n", v.Claim, v.Detail, v.Reason)
+			}
+			failed = true
+		case err != nil:
+			fmt.Printf("claims: %v\n", err)
+			failed = true
+		default:
+			fmt.Println("claims: follow the schema")
+		}
+	}
+	if failed {
+		return errors.New("verification failed")
+	}
+	return nil
+}
+
+// loadPEMPublicKey reads an RSA, EC or Ed25519 public key
+func loadPEMPublicKey(path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: no RSA, EC or Ed25519 public key", path)
+}
+
+// jwks are the keys of a JWKS by kid
+type jwks map[string]interface{}
+
+// keyFunc picks the key named by the token's kid, or the only key when the
+// token has none
+func (k jwks) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := k[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(k) == 1 {
+		for _, key := range k {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no JWKS key for kid %q", kid)
+}
+
+// loadJWKS reads the RSA and EC keys of a JWKS file or URL
+func loadJWKS(source string) (jwks, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		data, err = fetchJWKS(source)
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("JWKS: %w", err)
+	}
+	keys := make(jwks)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warnf("skipping JWKS key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+func fetchJWKS(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// jsonWebKey is an RSA or EC public key from a JWKS (RFC 7517)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent out of range")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid key parameter %q", s)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// HPACK savings last only as long as the connection whose dynamic table
+// holds the cached headers. The frontend counts the transports dialed to
+// each downstream, its generations, and the header metrics of
+// ENABLE_HPACK_STATS carry the generation, so savings can be seen to reset
+// whenever connections churn.
+
+// connGenerationsKept is how many generations' header metrics are kept
+// per target
+const connGenerationsKept = 8
+
+// grpcConnections holds a map per target: dials (the generation),
+// reconnects, state=<state> transition counts and age_seconds, the time
+// since the connection last became ready
+var grpcConnections = expvar.NewMap("grpc_connections")
+
+// connLifecycle tracks the connection to one target
+type connLifecycle struct {
+	stats      *expvar.Map
+	generation atomic.Int64
+
+	mu         sync.Mutex
+	everReady  bool
+	readySince time.Time
+}
+
+var (
+	connLifecyclesMu sync.Mutex
+	connLifecycles   = map[string]*connLifecycle{}
+)
+
+// connLifecycleFor returns the tracker for target, creating it on first use
+func connLifecycleFor(target string) *connLifecycle {
+	connLifecyclesMu.Lock()
+	defer connLifecyclesMu.Unlock()
+	if l, ok := connLifecycles[target]; ok {
+		return l
+	}
+	l := &connLifecycle{stats: new(expvar.Map).Init()}
+	l.stats.Set("age_seconds", expvar.Func(l.ageSeconds))
+	grpcConnections.Set(target, l.stats)
+	connLifecycles[target] = l
+	return l
+}
+
+// connGeneration is the number of transports dialed to target so far, 0
+// without withConnLifecycle
+func connGeneration(target string) int64 {
+	connLifecyclesMu.Lock()
+	l, ok := connLifecycles[target]
+	connLifecyclesMu.Unlock()
+	if !ok {
+		return 0
+	}
+	return l.generation.Load()
+}
+
+// withConnLifecycle counts the dials to a downstream and watches its
+// connectivity state. It must come before withHPACKStats, whose
+// connections take the generation of the dial.
+func withConnLifecycle() Feature {
+	return func(c *clientConnConfig) {
+		c.connWrappers = append(c.connWrappers, func(conn net.Conn, target string) net.Conn {
+			l := connLifecycleFor(target)
+			l.generation.Add(1)
+			l.stats.Add("dials", 1)
+			return conn
+		})
+		c.onDial = append(c.onDial, func(conn *grpc.ClientConn, target string) {
+			go connLifecycleFor(target).watch(conn)
+		})
+	}
+}
+
+// watch records the state changes of conn until it is closed
+func (l *connLifecycle) watch(conn *grpc.ClientConn) {
+	for {
+		state := conn.GetState()
+		l.observe(state)
+		if state == connectivity.Shutdown || !conn.WaitForStateChange(context.Background(), state) {
+			return
+		}
+	}
+}
+
+func (l *connLifecycle) observe(state connectivity.State) {
+	l.stats.Add("state="+state.String(), 1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if state != connectivity.Ready {
+		l.readySince = time.Time{}
+		return
+	}
+	if l.everReady {
+		l.stats.Add("reconnects", 1)
+	}
+	l.everReady, l.readySince = true, time.Now()
+}
+
+func (l *connLifecycle) ageSeconds() interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.readySince.IsZero() {
+		return 0
+	}
+	return int64(time.Since(l.readySince) / time.Second)
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+// In claim mode the JWT's currency claim is the one source of the currency
+// for everything downstream of ensureJWT: price conversions, shipping
+// quotes and orders all read it, and no x-override-currency header is
+// sent. The currency cookie only records the user's pick until ensureJWT
+// folds it into the claim by re-issuing the token, which is also how
+// sessions started in cookie mode migrate. Turning the mode off again
+// falls back to the cookie, which claim mode keeps setting.
+
+// IsCurrencyClaimEnabled reports whether the currency comes from the JWT's
+// currency claim rather than the cookie (JWT_CURRENCY_FROM_CLAIM=true).
+// JWT_CURRENCY_OVERRIDE is ignored then, as the override would be a second
+// source.
+func IsCurrencyClaimEnabled() bool {
+	return os.Getenv("JWT_CURRENCY_FROM_CLAIM") == "true"
+}
+
+// selectedCurrency is the currency the user last picked: the currency
+// cookie, else the default
+func selectedCurrency(r *http.Request) string {
+	c, _ := r.Cookie(cookieCurrency)
+	if c != nil {
+		return c.Value
+	}
+	return defaultCurrency
+}
+
+// claimCurrency returns the currency claim of the request's token, if it
+// has a valid one. Tokens without, such as those minted before the claim
+// existed, leave the currency to the cookie.
+func claimCurrency(r *http.Request) (string, bool) {
+	claims, ok := getJWTFromContext(r.Context())
+	if !ok || claims == nil || !validCurrencyCode(claims.Currency) {
+		return "", false
+	}
+	return claims.Currency, true
+}
+
+// validCurrencyCode reports whether code looks like an ISO 4217 code
+func validCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for i := 0; i < len(code); i++ {
+		if code[i] < 'A' || code[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
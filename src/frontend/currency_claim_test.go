@@ -0,0 +1,76 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestCurrencyFromClaim(t *testing.T) {
+	useRSAKeys(t)
+	t.Setenv("JWT_CURRENCY_FROM_CLAIM", "true")
+	// Ignored in claim mode
+	t.Setenv("JWT_CURRENCY_OVERRIDE", "true")
+	token, err := generateJWT(jwtSessionFor("claim-currency-session"), "USD", defaultClaimsProfile)
+	if err != nil {
+		t.Fatalf("generateJWT() error = %v", err)
+	}
+
+	var currency string
+	var md metadata.MD
+	handler := ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		currency = currentCurrency(r)
+		md, _ = metadata.FromOutgoingContext(appendCorrelationMetadata(r.Context()))
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeySessionID{}, "claim-currency-session"))
+	r.AddCookie(&http.Cookie{Name: cookieJWT, Value: token})
+	r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "EUR"})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	var reissued string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == cookieJWT {
+			reissued = c.Value
+		}
+	}
+	if reissued == "" {
+		t.Fatal("token not re-issued for the currency in the cookie")
+	}
+	if claims, err := validateJWT(reissued); err != nil || claims.Currency != "EUR" {
+		t.Errorf("re-issued token currency = %v (%v), want EUR", claims, err)
+	}
+	if currency != "EUR" {
+		t.Errorf("currentCurrency() = %s, want the claim's EUR", currency)
+	}
+	if got := md.Get(currencyOverrideHeader); len(got) != 0 {
+		t.Errorf("%s = %v, want no override in claim mode", currencyOverrideHeader, got)
+	}
+
+	// Once the claim is set the cookie is no longer read downstream
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	claims, _ := validateJWT(reissued)
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeyJWT{}, claims))
+	r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "JPY"})
+	if got := currentCurrency(r); got != "EUR" {
+		t.Errorf("currentCurrency() = %s, want the claim's EUR over the cookie", got)
+	}
+}
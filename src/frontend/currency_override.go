@@ -0,0 +1,48 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"os"
+)
+
+// currencyOverrideHeader carries the currency of the current request when
+// the JWT's currency claim is stale. Checkoutservice charges in it ahead of
+// the claim.
+const currencyOverrideHeader = "x-override-currency"
+
+// currencyOverrides counts requests sent with a currency override instead
+// of a token re-issued for the new currency
+var currencyOverrides = expvar.NewInt("currency_overrides")
+
+type ctxKeyCurrencyOverride struct{}
+
+// IsCurrencyOverrideEnabled reports whether a currency change is forwarded
+// as x-override-currency rather than by re-issuing the JWT
+// (JWT_CURRENCY_OVERRIDE=true). The token, and the HPACK-cached session
+// header, then stay the same until the token is renewed anyway.
+func IsCurrencyOverrideEnabled() bool {
+	return os.Getenv("JWT_CURRENCY_OVERRIDE") == "true"
+}
+
+// withCurrencyOverride makes downstream calls of r carry currency over the
+// JWT's currency claim
+func withCurrencyOverride(r *http.Request, currency string) *http.Request {
+	currencyOverrides.Add(1)
+	return r.WithContext(context.WithValue(r.Context(), ctxKeyCurrencyOverride{}, currency))
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestCurrencyOverride(t *testing.T) {
+	useRSAKeys(t)
+	token, err := generateJWT(jwtSessionFor("override-session"), "USD", defaultClaimsProfile)
+	if err != nil {
+		t.Fatalf("generateJWT() error = %v", err)
+	}
+
+	serve := func() (reissued bool, md metadata.MD) {
+		handler := ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			md, _ = metadata.FromOutgoingContext(appendCorrelationMetadata(r.Context()))
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeySessionID{}, "override-session"))
+		r.AddCookie(&http.Cookie{Name: cookieJWT, Value: token})
+		r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "EUR"})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		for _, c := range w.Result().Cookies() {
+			reissued = reissued || strings.HasPrefix(c.Name, cookieJWT)
+		}
+		return reissued, md
+	}
+
+	if reissued, md := serve(); !reissued || len(md.Get(currencyOverrideHeader)) != 0 {
+		t.Errorf("currency change: reissued = %v, override = %v; want a new token and no override", reissued, md.Get(currencyOverrideHeader))
+	}
+	t.Setenv("JWT_CURRENCY_OVERRIDE", "true")
+	reissued, md := serve()
+	if reissued {
+		t.Error("JWT_CURRENCY_OVERRIDE: token re-issued for the currency change")
+	}
+	if got := md.Get(currencyOverrideHeader); len(got) != 1 || got[0] != "EUR" {
+		t.Errorf("JWT_CURRENCY_OVERRIDE: %s = %v, want [EUR]", currencyOverrideHeader, got)
+	}
+}
@@ -31,6 +31,7 @@ func initializeLogger() {
 		TimestampFormat: time.RFC3339Nano,
 	}
 	log.Out = os.Stdout
+	log.AddHook(redactionHook{})
 }
 
 func loadDeploymentDetails() {
@@ -0,0 +1,357 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// The e2e fixtures chain the services' tests into one checkout flow,
+// frontend → checkout → shipping, over in-memory gRPC. This test drives
+// the flow through the frontend's middleware and client interceptors and
+// records what reaches the backends in testdata/e2e. checkoutservice's
+// e2e_test.go replays the PlaceOrder call through checkout's interceptors
+// and records what checkout sends on, which shippingservice's e2e_test.go
+// replays in turn. testdata/e2e/README.md describes the files. Regenerate
+// after an intended change with
+//
+//	go test -run TestE2ECheckoutFlow -update
+//
+// here, then the same in checkoutservice.
+
+const (
+	e2eFixtureDir     = "testdata/e2e"
+	e2eFixtureVersion = 1
+)
+
+// e2eNow is when the flow runs, so that the recorded tokens are valid at a
+// known time for the hops replaying them
+var e2eNow = time.Unix(1767225600, 0)
+
+// e2eFixture is what one hop sent downstream in a compression mode
+type e2eFixture struct {
+	Version int    `json:"version"`
+	Mode    string `json:"mode"`
+	// Now is the time, in Unix seconds, the calls were made at
+	Now int64 `json:"now"`
+	// Claims are those of the user's token as the frontend issued it
+	Claims map[string]interface{} `json:"claims"`
+	Calls  []e2eCall              `json:"calls"`
+}
+
+type e2eCall struct {
+	Method string `json:"method"`
+	// Metadata is what the call carried, without the keys gRPC sets
+	// itself; -bin values are standard base64 as on the wire
+	Metadata map[string][]string `json:"metadata"`
+}
+
+// shape lists each call's method and metadata keys, which stay the same
+// from run to run while token values do not
+func (f e2eFixture) shape() []string {
+	var out []string
+	for _, c := range f.Calls {
+		keys := make([]string, 0, len(c.Metadata))
+		for k := range c.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out = append(out, c.Method+" "+strings.Join(keys, ","))
+	}
+	return out
+}
+
+// newE2ECall records md as a fixture call
+func newE2ECall(method string, md metadata.MD) e2eCall {
+	c := e2eCall{Method: method, Metadata: make(map[string][]string)}
+	for k, values := range md {
+		if k == ":authority" || k == "content-type" || k == "user-agent" || strings.HasPrefix(k, "grpc-") {
+			continue
+		}
+		for _, v := range values {
+			if strings.HasSuffix(k, "-bin") {
+				v = base64.StdEncoding.EncodeToString([]byte(v))
+			}
+			c.Metadata[k] = append(c.Metadata[k], v)
+		}
+	}
+	return c
+}
+
+// e2eBackend stands in for every backend service: it records the
+// metadata of each call and answers with an empty message
+type e2eBackend struct {
+	conn *grpc.ClientConn
+
+	mu    sync.Mutex
+	calls []e2eCall
+	md    []metadata.MD
+}
+
+// newE2EBackend serves the stand-in over bufconn, with a client connection
+// set up the way the frontend's connection to checkout is
+func newE2EBackend(t *testing.T) *e2eBackend {
+	t.Helper()
+	b := &e2eBackend{}
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(b.record))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	bufnet := func(c *clientConnConfig) {
+		c.dialOpts = append(c.dialOpts, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}))
+	}
+	conn, err := newClientConn("bufnet", append(downstreamFeatures("CHECKOUT_SERVICE"), bufnet)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	b.conn = conn
+	return b
+}
+
+func (b *e2eBackend) record(_ interface{}, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	b.mu.Lock()
+	b.calls = append(b.calls, newE2ECall(method, md))
+	b.md = append(b.md, md)
+	b.mu.Unlock()
+	if err := stream.RecvMsg(new(emptypb.Empty)); err != nil {
+		return err
+	}
+	return stream.SendMsg(new(emptypb.Empty))
+}
+
+// e2eShopper is a browser keeping the cookies the frontend sets
+type e2eShopper struct {
+	cookies map[string]*http.Cookie
+}
+
+// visit sends a request through the frontend's session and JWT middleware
+// to a handler making the page's backend calls
+func (s *e2eShopper) visit(t *testing.T, method, path string, calls func(ctx context.Context) error) {
+	t.Helper()
+	var callErr error
+	handler := ensureSessionID(ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callErr = calls(r.Context())
+	})))
+	r := httptest.NewRequest(method, path, nil)
+	for _, c := range s.cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s %s: status %d: %s", method, path, w.Code, w.Body)
+	}
+	if callErr != nil {
+		t.Fatalf("%s %s: %v", method, path, callErr)
+	}
+	if s.cookies == nil {
+		s.cookies = make(map[string]*http.Cookie)
+	}
+	for _, c := range w.Result().Cookies() {
+		s.cookies[c.Name] = c
+	}
+}
+
+func TestE2ECheckoutFlow(t *testing.T) {
+	useRSAKeys(t)
+	clock := useFakeClock(t)
+
+	for _, mode := range []string{jwtModeFull, jwtModeCompressed} {
+		t.Run(mode, func(t *testing.T) {
+			t.Setenv("ENABLE_JWT_COMPRESSION", strconv.FormatBool(mode == jwtModeCompressed))
+			clock.Advance(e2eNow.Sub(clock.Now()))
+			backend := newE2EBackend(t)
+
+			var shopper e2eShopper
+			var token string
+			shopper.visit(t, http.MethodGet, "/product/OLJCESPC7Z", func(ctx context.Context) error {
+				if _, err := pb.NewProductCatalogServiceClient(backend.conn).GetProduct(ctx, &pb.GetProductRequest{Id: "OLJCESPC7Z"}); err != nil {
+					return err
+				}
+				_, err := pb.NewCurrencyServiceClient(backend.conn).Convert(ctx, &pb.CurrencyConversionRequest{
+					From: &pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 990000000}, ToCode: "EUR"})
+				return err
+			})
+			clock.Advance(5 * time.Second)
+			shopper.visit(t, http.MethodPost, "/cart", func(ctx context.Context) error {
+				_, err := pb.NewCartServiceClient(backend.conn).AddItem(ctx, &pb.AddItemRequest{
+					UserId: ctx.Value(ctxKeySessionID{}).(string),
+					Item:   &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1}})
+				return err
+			})
+			clock.Advance(5 * time.Second)
+			shopper.visit(t, http.MethodPost, "/cart/checkout", func(ctx context.Context) error {
+				token, _ = ctx.Value(ctxKeyJWTToken{}).(string)
+				_, err := pb.NewCheckoutServiceClient(backend.conn).PlaceOrder(ctx, &pb.PlaceOrderRequest{
+					UserId:       ctx.Value(ctxKeySessionID{}).(string),
+					UserCurrency: "USD",
+					Email:        "someone@example.com",
+					Address:      &pb.Address{StreetAddress: "1600 Amphitheatre Parkway", City: "Mountain View", State: "CA", Country: "United States", ZipCode: 94043},
+					CreditCard:   &pb.CreditCardInfo{CreditCardNumber: "4432-8015-6152-0454", CreditCardCvv: 672, CreditCardExpirationYear: 2030, CreditCardExpirationMonth: 1},
+				})
+				return err
+			})
+
+			_, claims, _, err := parseJWT(token)
+			if err != nil {
+				t.Fatalf("checkout request token: %v", err)
+			}
+			session := shopper.cookies[cookieSessionID].Value
+			for i, md := range backend.md {
+				method := backend.calls[i].Method
+				if shouldSkipJWT(method) {
+					for _, k := range e2eJWTKeys() {
+						if len(md.Get(k)) > 0 {
+							t.Errorf("%s: carries %s, want no JWT", method, k)
+						}
+					}
+					continue
+				}
+				checkE2EHeaders(t, mode, method, md)
+				// Every call of the session carries the token the checkout
+				// request had
+				if got := e2eClaims(t, method, md); !reflect.DeepEqual(got, claims) {
+					t.Errorf("%s: claims = %v, want %v", method, got, claims)
+				}
+				if got := md.Get(headerSessionID); len(got) != 1 || got[0] != session {
+					t.Errorf("%s: %s = %q, want %q", method, headerSessionID, got, session)
+				}
+			}
+
+			got := e2eFixture{Version: e2eFixtureVersion, Mode: mode, Now: clock.Now().Unix(), Claims: claims, Calls: backend.calls}
+			path := filepath.Join(e2eFixtureDir, mode+".json")
+			if *updateGolden {
+				b, err := json.MarshalIndent(got, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, append(b, '\n'), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("missing fixture, run with -update: %v", err)
+			}
+			var want e2eFixture
+			if err := json.Unmarshal(b, &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.shape(), want.shape()) {
+				t.Errorf("calls changed, run with -update if intended\n got: %q\nwant: %q", got.shape(), want.shape())
+			}
+		})
+	}
+}
+
+// e2eJWTKeys are the keys a JWT travels in, in either mode
+func e2eJWTKeys() []string {
+	return []string{"authorization", jwtHeaders.Static, jwtHeaders.Session, jwtHeaders.Dynamic, jwtHeaders.Signature}
+}
+
+// checkE2EHeaders checks that md carries the token in the headers of mode,
+// and only in those
+func checkE2EHeaders(t *testing.T, mode, method string, md metadata.MD) {
+	t.Helper()
+	for _, k := range e2eJWTKeys() {
+		want := 0
+		if (k == "authorization") == (mode == jwtModeFull) {
+			want = 1
+		}
+		if n := len(md.Get(k)); n != want {
+			t.Errorf("%s: %d %s headers in %s mode, want %d", method, n, k, mode, want)
+		}
+	}
+	if mode == jwtModeFull {
+		if v := md.Get("authorization"); len(v) == 1 && !strings.HasPrefix(v[0], "Bearer ") {
+			t.Errorf("%s: authorization = %q, want a Bearer token", method, v[0])
+		}
+		return
+	}
+	static := append([]string{"alg", "typ"}, jwtStaticClaims...)
+	checkE2EComponent(t, method, md, jwtHeaders.Static, func(claim string) bool { return slices.Contains(static, claim) })
+	checkE2EComponent(t, method, md, jwtHeaders.Session, func(claim string) bool { return slices.Contains(jwtSessionClaims, claim) })
+	checkE2EComponent(t, method, md, jwtHeaders.Dynamic, func(claim string) bool {
+		return !slices.Contains(static, claim) && !slices.Contains(jwtSessionClaims, claim)
+	})
+}
+
+// checkE2EComponent checks that the component in key is a JSON object of
+// claims of its class
+func checkE2EComponent(t *testing.T, method string, md metadata.MD, key string, inClass func(claim string) bool) {
+	t.Helper()
+	v := md.Get(key)
+	if len(v) != 1 {
+		return
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal([]byte(v[0]), &claims); err != nil {
+		t.Errorf("%s: %s is not a JSON object: %v", method, key, err)
+		return
+	}
+	for claim := range claims {
+		if !inClass(claim) {
+			t.Errorf("%s: %s carries %q of another class", method, key, claim)
+		}
+	}
+}
+
+// e2eClaims decodes the claims of the token md carries
+func e2eClaims(t *testing.T, method string, md metadata.MD) map[string]interface{} {
+	t.Helper()
+	decoded, err := DecodeJWTMetadata(md)
+	if err != nil {
+		t.Fatalf("%s: DecodeJWTMetadata() error = %v", method, err)
+	}
+	var token string
+	if decoded != nil {
+		token = decoded.Token
+	} else if v := md.Get("authorization"); len(v) > 0 {
+		token = strings.TrimPrefix(v[0], "Bearer ")
+	}
+	_, claims, _, err := parseJWT(token)
+	if err != nil {
+		t.Fatalf("%s: token does not parse: %v", method, err)
+	}
+	return claims
+}
@@ -0,0 +1,147 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+)
+
+// defaultMaxHeaderListSize is 256KB (224KB HPACK table + 32KB overhead)
+const defaultMaxHeaderListSize = 262144
+
+// clientConnConfig accumulates what each Feature contributes to a dial.
+// Interceptors run in the order their features were passed.
+type clientConnConfig struct {
+	// target is the address being dialed
+	target       string
+	unary        []grpc.UnaryClientInterceptor
+	stream       []grpc.StreamClientInterceptor
+	dialOpts     []grpc.DialOption
+	connWrappers []connWrapper
+	// onDial runs for each connection once it is dialed
+	onDial []func(conn *grpc.ClientConn, target string)
+}
+
+// Feature adds interceptors or dial options to a client connection
+type Feature func(*clientConnConfig)
+
+// withJWT attaches the session JWT (and correlation IDs) to outgoing calls
+func withJWT(opts ...jwtClientOption) Feature {
+	return func(c *clientConnConfig) {
+		c.unary = append(c.unary, jwtUnaryClientInterceptor(opts...))
+		c.stream = append(c.stream, jwtStreamClientInterceptor(opts...))
+		if IsJWTCallCredentialsEnabled() {
+			c.dialOpts = append(c.dialOpts, grpc.WithPerRPCCredentials(newJWTCallCredentials(c.target)))
+		}
+	}
+}
+
+// withTracing records OpenTelemetry spans for outgoing calls
+func withTracing() Feature {
+	return func(c *clientConnConfig) {
+		c.unary = append(c.unary, otelgrpc.UnaryClientInterceptor())
+		c.stream = append(c.stream, otelgrpc.StreamClientInterceptor())
+	}
+}
+
+// withMaxHeaderListSize caps the size of response headers accepted from the
+// downstream, replacing defaultMaxHeaderListSize. The limit on what is sent
+// is the one the server advertises, which grpc-go enforces before sending.
+func withMaxHeaderListSize(size uint32) Feature {
+	return func(c *clientConnConfig) {
+		c.dialOpts = append(c.dialOpts, grpc.WithMaxHeaderListSize(size))
+	}
+}
+
+// downstreamFeatures returns the features enabled for the connection to a
+// backend service, based on environment flags. service is the env prefix of
+// the downstream, e.g. CHECKOUT_SERVICE.
+func downstreamFeatures(service string) []Feature {
+	features := []Feature{withJWT(withClaimTransformers(claimTransformers...)), withConnLifecycle(), withMessageCompression(messageCompressionFor(service))}
+	if os.Getenv("ENABLE_TRACING") == "1" {
+		features = append(features, withTracing())
+	}
+	if IsHPACKStatsEnabled() {
+		features = append(features, withHPACKStats())
+	}
+	if IsHPACKWarmupEnabled() && IsJWTCompressionEnabled() {
+		features = append(features, withHPACKWarmup())
+	}
+	if size, ok := hpackTableSizeFor(service); ok {
+		features = append(features, withHeaderTableSize(size))
+	}
+	if size, ok := maxHeaderListSizeFor(service); ok {
+		features = append(features, withMaxHeaderListSize(size))
+	}
+	return features
+}
+
+// newClientConn dials addr with the common transport settings and the
+// interceptor chains built from features
+func newClientConn(addr string, features ...Feature) (*grpc.ClientConn, error) {
+	cfg := clientConnConfig{target: addr}
+	for _, f := range features {
+		f(&cfg)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// Configure HPACK table size: 256KB total (224KB HPACK table + 32KB overhead)
+	// Default is 4KB (~18 users), increased 64x for high-concurrency scenarios
+	// With JWT shredding + indexing control, 256KB supports:
+	//   - 1 static header (156 bytes, shared by all)
+	//   - 1052 session headers (213 bytes each)
+	//   - Dynamic/signature headers are NOT cached (0 bytes in table)
+	opts := []grpc.DialOption{
+		spiffeMTLS.dialOption(addr),
+		grpc.WithChainUnaryInterceptor(cfg.unary...),
+		grpc.WithChainStreamInterceptor(cfg.stream...),
+		grpc.WithInitialWindowSize(65535),
+		grpc.WithInitialConnWindowSize(65535),
+		grpc.WithMaxHeaderListSize(defaultMaxHeaderListSize),
+		keepaliveDialOption(),
+	}
+	if len(cfg.connWrappers) > 0 {
+		// Wrappers are applied in order, so the first one sits closest to
+		// the socket and sees exactly what goes on the wire.
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, target string) (net.Conn, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", target)
+			if err != nil {
+				return nil, err
+			}
+			for _, wrap := range cfg.connWrappers {
+				conn = wrap(conn, target)
+			}
+			return conn, nil
+		}))
+	}
+	opts = append(opts, cfg.dialOpts...)
+	conn, err := grpc.DialContext(ctx, addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range cfg.onDial {
+		f(conn, addr)
+	}
+	return conn, nil
+}
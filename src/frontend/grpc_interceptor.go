@@ -16,14 +16,95 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"strings"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 )
 
+const (
+	headerRequestID = "x-request-id"
+	headerSessionID = "x-session-id"
+
+	// jwtRefreshBackoff is the pause before retrying a call rejected for an expired JWT
+	jwtRefreshBackoff = 50 * time.Millisecond
+)
+
+// jwtDownstreamRejections counts calls a downstream service rejected for
+// their JWT, keyed by the ErrorInfo reason
+var jwtDownstreamRejections = expvar.NewMap("jwt_downstream_rejections")
+
+// jwtDownstreamReceipts sums what downstream targets reported receiving in
+// their JWT receipt trailers, keyed "<target> calls", "<target>
+// received_bytes" and "<target> mode=<mode>"
+var jwtDownstreamReceipts = expvar.NewMap("jwt_downstream_receipts")
+
+// jwtClaimsDrift counts calls whose claims hash downstream targets echoed,
+// keyed "<target> checked", and those whose hash differed from the
+// frontend's, keyed "<target> drift"
+var jwtClaimsDrift = expvar.NewMap("jwt_claims_drift")
+
+// What the client interceptors did with the JWT of each call, see
+// jwtAttachDecisions
+const (
+	jwtDecisionSkipped     = "skipped"
+	jwtDecisionAttached    = "attached"
+	jwtDecisionFallback    = "fallback"
+	jwtDecisionRegenerated = "regenerated-from-claims"
+)
+
+// jwtAttachDecisions counts client calls keyed "<method> <decision>": skipped
+// by shouldSkipJWT, attached, sent without a JWT (fallback) for lack of one
+// in the context, or attached with a JWT regenerated from the claims. Calls
+// with a user that are skipped, or services that fall back, point at
+// misclassified methods.
+var jwtAttachDecisions = expvar.NewMap("jwt_attach_decisions")
+
+// grpcClientLatency times unary calls end to end, retries included, by the
+// mode their JWT was sent in, none for calls without one
+var grpcClientLatency = newLatencyHistogram("grpc_client_latency_seconds",
+	"Latency of unary gRPC calls by JWT mode.", "jwt_mode")
+
+const jwtModeNone = "none"
+
+type ctxKeyJWTModeSent struct{}
+
+// withJWTModeSent returns ctx in which writeJWT records the mode it sends
+// the JWT in, from the interceptor or from call credentials
+func withJWTModeSent(ctx context.Context) (context.Context, *string) {
+	mode := jwtModeNone
+	return context.WithValue(ctx, ctxKeyJWTModeSent{}, &mode), &mode
+}
+
+func recordJWTDecision(method, decision string) {
+	jwtAttachDecisions.Add(method+" "+decision, 1)
+}
+
+// appendCorrelationMetadata adds the request and session IDs from the HTTP
+// request context to outgoing metadata so downstream logs can be correlated,
+// and the currency override if there is one. Unlike the JWT these are sent
+// to every service.
+func appendCorrelationMetadata(ctx context.Context) context.Context {
+	if v, ok := ctx.Value(ctxKeyRequestID{}).(string); ok && v != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, headerRequestID, v)
+	}
+	if v, ok := ctx.Value(ctxKeySessionID{}).(string); ok && v != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, headerSessionID, v)
+	}
+	if v, ok := ctx.Value(ctxKeyCurrencyOverride{}).(string); ok && v != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, currencyOverrideHeader, v)
+	}
+	return ctx
+}
+
 // shouldSkipJWT checks if the method doesn't need JWT (public/anonymous services)
 func shouldSkipJWT(method string) bool {
+	if skipJWTMethod(method) {
+		return true
+	}
 	// Product Catalog Service - public product data, no user context needed
 	if strings.Contains(method, "ProductCatalogService") {
 		return true
@@ -43,8 +124,32 @@ func shouldSkipJWT(method string) bool {
 	return false
 }
 
+// jwtClientConfig is how the JWT client interceptors send the token
+type jwtClientConfig struct {
+	transformers []ClaimTransformer
+}
+
+// jwtClientOption configures jwtUnaryClientInterceptor and
+// jwtStreamClientInterceptor
+type jwtClientOption func(*jwtClientConfig)
+
+// withClaimTransformers rewrites the claims of the token sent on each call
+// with transformers, in order, see transformJWT
+func withClaimTransformers(transformers ...ClaimTransformer) jwtClientOption {
+	return func(c *jwtClientConfig) { c.transformers = append(c.transformers, transformers...) }
+}
+
+func newJWTClientConfig(opts []jwtClientOption) *jwtClientConfig {
+	c := &jwtClientConfig{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
 // jwtUnaryClientInterceptor adds JWT to outgoing gRPC calls
-func jwtUnaryClientInterceptor() grpc.UnaryClientInterceptor {
+func jwtUnaryClientInterceptor(opts ...jwtClientOption) grpc.UnaryClientInterceptor {
+	c := newJWTClientConfig(opts)
 	return func(
 		ctx context.Context,
 		method string,
@@ -53,62 +158,176 @@ func jwtUnaryClientInterceptor() grpc.UnaryClientInterceptor {
 		invoker grpc.UnaryInvoker,
 		opts ...grpc.CallOption,
 	) error {
+		ctx, mode := withJWTModeSent(ctx)
+		defer func(start time.Time) { grpcClientLatency.ObserveSince(ctx, *mode, start) }(time.Now())
+		ctx = appendCorrelationMetadata(ctx)
+
 		// Skip JWT for services that don't need it (performance optimization)
 		if shouldSkipJWT(method) {
-			return invoker(ctx, method, req, reply, cc, opts...)
+			recordJWTDecision(method, jwtDecisionSkipped)
+			return invoker(appendCatalogSession(ctx, method), method, req, reply, cc, opts...)
 		}
 
+		decision := jwtDecisionAttached
 		tokenStr, ok := ctx.Value(ctxKeyJWTToken{}).(string)
 		if !ok || tokenStr == "" {
 			// Fallback for safety, though should not happen in normal flow
 			if claims, ok := getJWTFromContext(ctx); ok && claims != nil {
 				var err error
-				tokenStr, err = generateJWTFromClaims(claims)
+				tokenStr, err = regenerateJWT(ctx, claims)
 				if err != nil {
+					recordJWTDecision(method, jwtDecisionFallback)
 					log.Warnf("No JWT token string in context and failed to regenerate from claims for method %s. Proceeding without JWT.", method)
 					return invoker(ctx, method, req, reply, cc, opts...)
 				}
+				decision = jwtDecisionRegenerated
 			} else {
+				recordJWTDecision(method, jwtDecisionFallback)
 				log.Warnf("No JWT token string or claims in context for method %s. Proceeding without JWT.", method)
 				return invoker(ctx, method, req, reply, cc, opts...)
 			}
 		}
+		recordJWTDecision(method, decision)
+		tokenStr = transformJWT(ctx, c.transformers, method, tokenStr)
 
-		// Check if JWT compression is enabled.
-		if IsJWTCompressionEnabled() {
-			// JWT COMPRESSION ENABLED: Decompose JWT into cacheable components
-			components, err := DecomposeJWT(tokenStr)
-			if err != nil {
-				// Fallback to full JWT if decomposition fails
-				log.Warnf("Failed to decompose JWT, using full token: %v", err)
-				md := metadata.Pairs("authorization", "Bearer "+tokenStr)
-				ctx = metadata.NewOutgoingContext(ctx, md)
-			} else {
-				// Add compressed JWT headers with -bin suffix for dynamic components
-				md := metadata.Pairs(
-					"x-jwt-static", components.Static,
-					"x-jwt-session", components.Session,
-					"x-jwt-dynamic-bin", components.Dynamic,
-					"x-jwt-sig-bin", components.Signature,
-				)
-				ctx = metadata.NewOutgoingContext(ctx, md)
-				sizes := GetJWTComponentSizes(components)
-				log.Infof("[JWT-FLOW] Frontend → %s: Sending DECOMPOSED JWT (total=%db)", method, sizes["total"])
-			}
-		} else {
-			// JWT COMPRESSION DISABLED: Send full JWT in authorization header
-			log.Infof("[JWT-FLOW] Frontend → %s: Sending FULL JWT in authorization header (%d bytes)", method, len(tokenStr))
-			md := metadata.Pairs("authorization", "Bearer "+tokenStr)
-			ctx = metadata.NewOutgoingContext(ctx, md)
+		// Invoke the RPC with the JWT attached, learning the JWT modes the
+		// target accepts from the trailer
+		var trailer metadata.MD
+		opts = append(opts, grpc.Trailer(&trailer))
+		err := invoker(attachJWT(ctx, method, cc.Target(), tokenStr), method, req, reply, cc, opts...)
+		jwtModes.learn(cc.Target(), trailer)
+		recordJWTReceipt(ctx, cc.Target(), method, trailer)
+		checkJWTClaimsDrift(ctx, cc.Target(), method, tokenStr, trailer)
+		if reason, ok := jwtRejectionReason(err); ok {
+			jwtDownstreamRejections.Add(reason, 1)
+		}
+		if !isJWTExpiredStatus(err) {
+			return err
+		}
+
+		// The token expired while the request was in flight (tokens only
+		// live 2 minutes). Mint a fresh one from the claims and retry once.
+		claims, ok := getJWTFromContext(ctx)
+		if !ok || claims == nil {
+			return err
 		}
+		fresh, refreshErr := refreshJWTContext(ctx, claims)
+		if refreshErr != nil {
+			log.Warnf("Failed to refresh expired JWT for method %s: %v", method, refreshErr)
+			return err
+		}
+		fresh = transformJWT(ctx, c.transformers, method, fresh)
+		jwtLogger(requestLogger(ctx), fresh, jwtModeFull, len(fresh)).Infof("[JWT-FLOW] Frontend → %s: JWT expired downstream, retrying with refreshed token", method)
+		select {
+		case <-time.After(jwtRefreshBackoff):
+		case <-ctx.Done():
+			return err
+		}
+		return invoker(attachJWT(ctx, method, cc.Target(), fresh), method, req, reply, cc, opts...)
+	}
+}
+
+// attachJWT adds tokenStr to the outgoing metadata for a call to target,
+// or with JWT_CALL_CREDENTIALS=true leaves it in ctx for the connection's
+// jwtCallCredentials to send
+func attachJWT(ctx context.Context, method, target, tokenStr string) context.Context {
+	if IsJWTCallCredentialsEnabled() {
+		return withCallJWT(ctx, method, tokenStr)
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	writeJWT(ctx, metadataCarrier(md), method, target, tokenStr)
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// writeJWT writes the headers carrying tokenStr on a call to target into c:
+// decomposed if JWT compression is enabled and target accepts it, and
+// downgraded if it exceeds the header budget
+func writeJWT(ctx context.Context, c JWTCarrier, method, target, tokenStr string) {
+	tokenStr = meshToken(tokenStr)
+	pairs, mode := jwtMetadata(method, target, tokenStr)
+	if sent, ok := ctx.Value(ctxKeyJWTModeSent{}).(*string); ok {
+		*sent = mode
+	}
+	if size := metadataPairsSize(pairs); jwtFlowLog.Sample(method, mode, size) {
+		jwtLogger(requestLogger(ctx), tokenStr, mode, size).Infof("[JWT-FLOW] Frontend → %s: sending JWT", method)
+	}
+	setJWTPairs(c, chaos.inject(method, pairs))
+	setJWTPairs(c, envoyClaimHeaders(tokenStr))
+}
+
+// recordJWTReceipt records the size and mode a downstream reported
+// receiving the JWT in, when it echoes them
+func recordJWTReceipt(ctx context.Context, target, method string, trailer metadata.MD) {
+	mode, size, ok := parseJWTReceipt(trailer)
+	if !ok {
+		return
+	}
+	jwtDownstreamReceipts.Add(target+" calls", 1)
+	jwtDownstreamReceipts.Add(target+" received_bytes", int64(size))
+	jwtDownstreamReceipts.Add(target+" mode="+mode, 1)
+	requestLogger(ctx).WithFields(logrus.Fields{
+		"jwt.received_bytes": size,
+		"jwt.mode_seen":      mode,
+	}).Debugf("[JWT-FLOW] %s received JWT", method)
+}
+
+// checkJWTClaimsDrift compares the claims hash a downstream echoed with
+// the hash of the claims sent, catching claims that decomposition and
+// reassembly lost or altered
+func checkJWTClaimsDrift(ctx context.Context, target, method, tokenStr string, trailer metadata.MD) {
+	echoed := trailer.Get(jwtClaimsHashHeader)
+	if len(echoed) == 0 {
+		return
+	}
+	sent, err := jwtClaimsHash(tokenStr)
+	if err != nil {
+		return
+	}
+	jwtClaimsDrift.Add(target+" checked", 1)
+	if echoed[0] == sent {
+		return
+	}
+	jwtClaimsDrift.Add(target+" drift", 1)
+	requestLogger(ctx).WithFields(logrus.Fields{
+		"jwt.claims_hash":          sent,
+		"jwt.claims_hash_received": echoed[0],
+	}).Warnf("[JWT-FLOW] %s reassembled different claims than were sent", method)
+}
+
+// meshToken returns the token to forward downstream: the RS256 token
+// itself, or its HS256 re-signing when a JWT mesh secret is configured
+func meshToken(tokenStr string) string {
+	if !IsMeshTokenEnabled() {
+		return tokenStr
+	}
+	signed, err := signMeshToken(tokenStr)
+	if err != nil {
+		log.Warnf("Failed to re-sign JWT for the mesh, sending the RS256 token: %v", err)
+		return tokenStr
+	}
+	return signed
+}
 
-		// Invoke the RPC with the modified context
-		return invoker(ctx, method, req, reply, cc, opts...)
+// withDetachedJWS appends a detached JWS over the encoded components when
+// JWT_DETACHED_SIGNATURE is enabled, letting downstream services verify
+// the headers they receive without byte-exact reassembly
+func withDetachedJWS(pairs []string) []string {
+	if !IsDetachedSignatureEnabled() {
+		return pairs
+	}
+	priv, _ := rsaKeys()
+	jws, err := signDetachedJWS(jwtHeaders, pairs, priv)
+	if err != nil {
+		log.Warnf("Failed to sign JWT components, sending without detached JWS: %v", err)
+		return pairs
 	}
+	return append(pairs, jwtHeaders.Prefix+detachedJWSField, jws)
 }
 
 // jwtStreamClientInterceptor adds JWT to outgoing streaming gRPC calls
-func jwtStreamClientInterceptor() grpc.StreamClientInterceptor {
+func jwtStreamClientInterceptor(opts ...jwtClientOption) grpc.StreamClientInterceptor {
+	c := newJWTClientConfig(opts)
 	return func(
 		ctx context.Context,
 		desc *grpc.StreamDesc,
@@ -117,43 +336,24 @@ func jwtStreamClientInterceptor() grpc.StreamClientInterceptor {
 		streamer grpc.Streamer,
 		opts ...grpc.CallOption,
 	) (grpc.ClientStream, error) {
+		ctx = appendCorrelationMetadata(ctx)
+
 		// Skip JWT for services that don't need it
 		if shouldSkipJWT(method) {
+			recordJWTDecision(method, jwtDecisionSkipped)
 			return streamer(ctx, desc, cc, method, opts...)
 		}
 
 		tokenStr, ok := ctx.Value(ctxKeyJWTToken{}).(string)
 		if !ok || tokenStr == "" {
+			recordJWTDecision(method, jwtDecisionFallback)
 			log.Warnf("No JWT token string in context for stream method %s. Proceeding without JWT.", method)
 			return streamer(ctx, desc, cc, method, opts...)
 		}
 
-		// Check if JWT compression is enabled
-		if IsJWTCompressionEnabled() {
-			// Decompose JWT into cacheable components
-			components, err := DecomposeJWT(tokenStr)
-			if err != nil {
-				// Fallback to full JWT if decomposition fails
-				log.Warnf("Failed to decompose JWT for stream, using full token: %v", err)
-				md := metadata.Pairs("authorization", "Bearer "+tokenStr)
-				ctx = metadata.NewOutgoingContext(ctx, md)
-			} else {
-				// Add compressed JWT headers
-				md := metadata.Pairs(
-					"x-jwt-static", components.Static,
-					"x-jwt-session", components.Session,
-					"x-jwt-dynamic-bin", components.Dynamic,
-					"x-jwt-sig-bin", components.Signature,
-				)
-				ctx = metadata.NewOutgoingContext(ctx, md)
-				log.Infof("[JWT-FLOW] Frontend → %s (stream): Sending DECOMPOSED JWT", method)
-			}
-		} else {
-			// JWT COMPRESSION DISABLED: Send full JWT in authorization header
-			log.Infof("[JWT-FLOW] Frontend → %s (stream): Sending FULL JWT in authorization header (%d bytes)", method, len(tokenStr))
-			md := metadata.Pairs("authorization", "Bearer "+tokenStr)
-			ctx = metadata.NewOutgoingContext(ctx, md)
-		}
+		recordJWTDecision(method, jwtDecisionAttached)
+		tokenStr = transformJWT(ctx, c.transformers, method, tokenStr)
+		ctx = attachJWT(ctx, method+" (stream)", cc.Target(), tokenStr)
 
 		// Invoke the streaming RPC with the modified context
 		return streamer(ctx, desc, cc, method, opts...)
@@ -0,0 +1,176 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	// jwtHeaderBudget caps the header list size of the JWT metadata on
+	// outgoing calls, read from JWT_HEADER_BUDGET in bytes. 0 disables the
+	// guard.
+	jwtHeaderBudget = loadJWTHeaderBudget()
+
+	// jwtHeaderDowngrades counts calls sent in a smaller mode than
+	// configured, keyed "from->to"; "over_budget" counts calls that did not
+	// fit even as a reference token
+	jwtHeaderDowngrades = expvar.NewMap("jwt_header_downgrades")
+
+	// jwtModes caches the JWT modes each downstream target advertised
+	jwtModes = newJWTModeCache()
+
+	// jwtNegotiatedModes counts calls by the wire mode sent when
+	// JWT_MODE_NEGOTIATION is enabled
+	jwtNegotiatedModes = expvar.NewMap("jwt_negotiated_modes")
+)
+
+func loadJWTHeaderBudget() int {
+	v := os.Getenv("JWT_HEADER_BUDGET")
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Warnf("ignoring invalid JWT_HEADER_BUDGET=%q", v)
+		return 0
+	}
+	return n
+}
+
+// headerListSize is the size pairs count towards a peer's
+// max_header_list_size, which uses the same per-entry overhead as the HPACK
+// table. -bin values are base64-encoded on the wire.
+func headerListSize(pairs []string) int {
+	n := 0
+	for i := 0; i+1 < len(pairs); i += 2 {
+		v := len(pairs[i+1])
+		if strings.HasSuffix(pairs[i], "-bin") {
+			v = base64.RawStdEncoding.EncodedLen(v)
+		}
+		n += len(pairs[i]) + v + hpackEntryOverhead
+	}
+	return n
+}
+
+// jwtMetadata returns the metadata carrying tokenStr to target and the
+// mode used. It starts from the configured mode, limited to what target
+// advertised when modes are negotiated, and, when a header budget is set
+// and exceeded, falls back to compressed headers and then to a reference
+// token the downstream resolves through the TokenService.
+func jwtMetadata(method, target, tokenStr string) ([]string, string) {
+	mode, codec := jwtModeFull, jwtCodec
+	if IsJWTCompressionEnabled() {
+		mode = jwtModeCompressed
+		if IsJWTModeNegotiationEnabled() {
+			if codec = jwtModes.negotiate(target, jwtCodec); codec == nil {
+				mode, codec = jwtModeFull, jwtCodec
+			}
+		}
+	}
+	pairs, mode := budgetJWTMetadata(method, target, mode, codec, tokenStr)
+	if IsJWTModeNegotiationEnabled() {
+		wire := jwtWireFull
+		if mode == jwtModeCompressed {
+			wire = jwtWireMode(codec)
+		}
+		jwtNegotiatedModes.Add(wire, 1)
+		pairs = append(pairs, jwtModeHeader, wire)
+	}
+	return pairs, mode
+}
+
+func budgetJWTMetadata(method, target, mode string, codec JWTCodec, tokenStr string) ([]string, string) {
+	configured := mode
+	pairs, err := encodeJWTMetadata(mode, codec, tokenStr)
+	if err != nil {
+		log.Warnf("Failed to decompose JWT, using full token: %v", err)
+		mode = jwtModeFull
+		pairs, _ = encodeJWTMetadata(mode, codec, tokenStr)
+	}
+	if jwtHeaderBudget == 0 {
+		return pairs, mode
+	}
+
+	for size := headerListSize(pairs); size > jwtHeaderBudget; size = headerListSize(pairs) {
+		next := nextJWTMode(mode)
+		if next == jwtModeCompressed && IsJWTModeNegotiationEnabled() && !jwtModes.accepts(target, jwtWireMode(codec)) {
+			next = nextJWTMode(next)
+		}
+		if next == "" {
+			jwtHeaderDowngrades.Add("over_budget", 1)
+			log.Warnf("[JWT-FLOW] Frontend → %s: JWT metadata (%db) exceeds header budget %db in every mode", method, size, jwtHeaderBudget)
+			break
+		}
+		nextPairs, err := encodeJWTMetadata(next, codec, tokenStr)
+		if err != nil {
+			log.Warnf("Cannot send JWT as %s for %s: %v", next, method, err)
+			break
+		}
+		log.Infof("[JWT-FLOW] Frontend → %s: JWT metadata (%db, %s) exceeds header budget %db, falling back to %s", method, size, mode, jwtHeaderBudget, next)
+		pairs, mode = nextPairs, next
+	}
+	if mode != configured {
+		jwtHeaderDowngrades.Add(configured+"->"+mode, 1)
+	}
+	return pairs, mode
+}
+
+// nextJWTMode is the next smaller mode to try. Reference tokens only verify
+// downstream where TOKEN_SERVICE_ADDR is set.
+func nextJWTMode(mode string) string {
+	switch mode {
+	case jwtModeFull:
+		return jwtModeCompressed
+	case jwtModeCompressed:
+		return jwtModeReference
+	}
+	return ""
+}
+
+func encodeJWTMetadata(mode string, codec JWTCodec, tokenStr string) ([]string, error) {
+	switch mode {
+	case jwtModeCompressed:
+		pairs, err := codec.Encode(tokenStr)
+		if err != nil {
+			return nil, err
+		}
+		return withDetachedJWS(pairs), nil
+	case jwtModeReference:
+		claims := &JWTClaims{}
+		if _, _, err := jwt.NewParser().ParseUnverified(tokenStr, claims); err != nil {
+			return nil, err
+		}
+		exp := jwtClock.Now().Add(jwtLifetime)
+		if claims.ExpiresAt != nil {
+			exp = claims.ExpiresAt.Time
+		}
+		ref, err := tokens.newOpaque(tokenStr, exp)
+		if err != nil {
+			return nil, err
+		}
+		return []string{"authorization", "Bearer " + ref}, nil
+	case jwtModeFull:
+		return []string{"authorization", "Bearer " + tokenStr}, nil
+	}
+	return nil, fmt.Errorf("unknown JWT metadata mode %q", mode)
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// debugHPACKPath serves what the frontend believes each downstream's HPACK
+// dynamic table holds, to show why repeated headers do or do not shrink
+const debugHPACKPath = "/debug/hpack"
+
+var (
+	hpackConnsMu sync.Mutex
+	hpackConns   = map[*hpackStatsConn]bool{}
+)
+
+// trackHPACKConn makes c visible to hpackTableSnapshots until it is closed
+func trackHPACKConn(c *hpackStatsConn) {
+	hpackConnsMu.Lock()
+	defer hpackConnsMu.Unlock()
+	hpackConns[c] = true
+}
+
+func untrackHPACKConn(c *hpackStatsConn) {
+	hpackConnsMu.Lock()
+	defer hpackConnsMu.Unlock()
+	delete(hpackConns, c)
+}
+
+// hpackConnSnapshot is the modelled dynamic table of one open connection.
+// Entries are newest first, so the first has index 62, as in HPACK.
+type hpackConnSnapshot struct {
+	Target     string `json:"target"`
+	Generation int64  `json:"generation,omitempty"`
+	RemoteAddr string `json:"remote_addr"`
+	AgeSeconds int64  `json:"age_seconds"`
+	// Stale is set once a header block could not be decoded; the table
+	// is as it was before
+	Stale   bool                 `json:"stale,omitempty"`
+	MaxSize uint64               `json:"max_size"`
+	Size    uint64               `json:"size"`
+	Entries []hpackEntrySnapshot `json:"entries"`
+}
+
+// hpackEntrySnapshot is a header field the peer can be sent as an index.
+// Hits counts how many times it was; an entry without hits cost its full
+// size once and saved nothing.
+type hpackEntrySnapshot struct {
+	Index      int    `json:"index"`
+	Name       string `json:"name"`
+	Value      string `json:"value"`
+	Size       uint64 `json:"size"`
+	AgeSeconds int64  `json:"age_seconds"`
+	Hits       int64  `json:"hits"`
+}
+
+// hpackTableSnapshots returns the tables of the open connections, by
+// target and generation
+func hpackTableSnapshots() []hpackConnSnapshot {
+	hpackConnsMu.Lock()
+	conns := make([]*hpackStatsConn, 0, len(hpackConns))
+	for c := range hpackConns {
+		conns = append(conns, c)
+	}
+	hpackConnsMu.Unlock()
+
+	now := time.Now()
+	snapshots := make([]hpackConnSnapshot, 0, len(conns))
+	for _, c := range conns {
+		snapshots = append(snapshots, c.snapshot(now))
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].Target != snapshots[j].Target {
+			return snapshots[i].Target < snapshots[j].Target
+		}
+		return snapshots[i].Generation < snapshots[j].Generation
+	})
+	return snapshots
+}
+
+func (c *hpackStatsConn) snapshot(now time.Time) hpackConnSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := hpackConnSnapshot{
+		Target:     c.target,
+		Generation: c.gen,
+		RemoteAddr: c.RemoteAddr().String(),
+		AgeSeconds: int64(now.Sub(c.opened) / time.Second),
+		Stale:      c.failed,
+		MaxSize:    c.table.maxSize,
+		Size:       c.table.size,
+		Entries:    make([]hpackEntrySnapshot, 0, len(c.table.entries)),
+	}
+	for i := len(c.table.entries) - 1; i >= 0; i-- {
+		e := c.table.entries[i]
+		s.Entries = append(s.Entries, hpackEntrySnapshot{
+			Index:      hpackStaticTableLen + len(s.Entries) + 1,
+			Name:       e.name,
+			Value:      snapshotHeaderValue(e.name, e.value),
+			Size:       e.size(),
+			AgeSeconds: int64(now.Sub(e.added) / time.Second),
+			Hits:       e.hits,
+		})
+	}
+	return s
+}
+
+// snapshotHeaderValue returns what may be shown of a header value. Tokens
+// and JWT components are replaced by their length and a hash, enough to
+// see whether two entries hold the same value, unless LOG_REDACTION_LEVEL
+// is none.
+func snapshotHeaderValue(name, value string) string {
+	if logRedactionLevel == redactionNone {
+		return value
+	}
+	if name == "authorization" || strings.Contains(name, "jwt") || strings.Contains(name, "token") {
+		sum := sha256.Sum256([]byte(value))
+		return fmt.Sprintf("[%d bytes, sha256:%x]", len(value), sum[:4])
+	}
+	return redactString(value)
+}
+
+// registerHPACKDebugRoutes serves, with ENABLE_JWT_DEBUG=true and
+// ENABLE_HPACK_STATS=true, the dynamic tables of the downstream
+// connections:
+//
+//	GET /debug/hpack
+//
+// The tables are modelled from the header blocks the frontend wrote, not
+// read from the peers.
+func registerHPACKDebugRoutes(r *mux.Router) {
+	if !IsJWTDebugEnabled() || !IsHPACKStatsEnabled() {
+		return
+	}
+	r.HandleFunc(baseUrl+debugHPACKPath, debugHPACKHandler).Methods(http.MethodGet)
+}
+
+func debugHPACKHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"connections": hpackTableSnapshots(),
+	})
+}
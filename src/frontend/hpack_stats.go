@@ -0,0 +1,385 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	// hpackEntryOverhead is the per-entry size overhead from RFC 7541 4.1
+	hpackEntryOverhead = 32
+	// hpackStaticTableLen is the number of entries of the static table;
+	// dynamic table indexes follow it (RFC 7541 2.3.3)
+	hpackStaticTableLen = 61
+)
+
+var (
+	hpackHeaderBlockBytes = newHistogram("hpack_header_block_bytes", 64, 128, 256, 512, 1024, 2048, 4096, 8192)
+	hpackBlockEvictions   = newHistogram("hpack_block_evictions", 0, 1, 2, 4, 8, 16, 32)
+	hpackConnections      = expvar.NewMap("hpack_connections")
+
+	// Header blocks of the first request on each connection and of the
+	// requests after it, health checks aside, to show what HPACK_WARMUP
+	// saves
+	hpackFirstRequestBlockBytes = newHistogram("hpack_first_request_block_bytes", 64, 128, 256, 512, 1024, 2048, 4096, 8192)
+	hpackSteadyBlockBytes       = newHistogram("hpack_steady_block_bytes", 64, 128, 256, 512, 1024, 2048, 4096, 8192)
+)
+
+// IsHPACKStatsEnabled reports whether outgoing HTTP/2 connections are
+// instrumented (ENABLE_HPACK_STATS=true)
+func IsHPACKStatsEnabled() bool {
+	return os.Getenv("ENABLE_HPACK_STATS") == "true"
+}
+
+// withHPACKStats wraps each dialed connection so the HEADERS frames the
+// frontend writes are decoded and counted per downstream target
+func withHPACKStats() Feature {
+	return func(c *clientConnConfig) {
+		c.connWrappers = append(c.connWrappers, func(conn net.Conn, target string) net.Conn {
+			return newHPACKStatsConn(conn, target)
+		})
+	}
+}
+
+// hpackStatsConn sniffs the HTTP/2 frames written to a connection. Header
+// blocks are run through an HPACK decoder that mirrors the peer's view of
+// the dynamic table, so evictions caused by each block can be counted.
+type hpackStatsConn struct {
+	net.Conn
+	stats  *expvar.Map
+	writes http2FrameSniffer
+	block  []byte // header block accumulated until END_HEADERS
+
+	decoder *hpack.Decoder
+	failed  bool
+	// requests counts header blocks of calls other than health checks
+	requests int
+	// generation prefixes the per-generation keys, see connGeneration
+	generation string
+
+	target string
+	gen    int64
+	opened time.Time
+
+	// mu guards table and the writes of failed, which
+	// hpackTableSnapshots reads while the connection writes
+	mu    sync.Mutex
+	table hpackTableModel
+}
+
+func newHPACKStatsConn(conn net.Conn, target string) *hpackStatsConn {
+	stats, ok := hpackConnections.Get(target).(*expvar.Map)
+	if !ok {
+		stats = new(expvar.Map).Init()
+		hpackConnections.Set(target, stats)
+	}
+	stats.Add("connections", 1)
+	c := &hpackStatsConn{
+		Conn:   conn,
+		stats:  stats,
+		target: target,
+		gen:    connGeneration(target),
+		opened: time.Now(),
+		table:  hpackTableModel{maxSize: http2DefaultHeaderTableSize},
+	}
+	if gen := c.gen; gen > 0 {
+		c.generation = fmt.Sprintf("gen=%d ", gen)
+		if old := gen - connGenerationsKept; old > 0 {
+			for _, key := range []string{"header_blocks", "header_block_bytes"} {
+				stats.Delete(fmt.Sprintf("gen=%d %s", old, key))
+			}
+		}
+	}
+	c.writes = http2FrameSniffer{
+		preface: len(http2ClientPreface),
+		want: func(typ byte) bool {
+			return typ == http2FrameHeaders || typ == http2FrameContinuation
+		},
+		onFrame: c.headerFrame,
+	}
+	c.decoder = hpack.NewDecoder(http2DefaultHeaderTableSize, nil)
+	// The decoder only mirrors what the encoder chose, so accept any size
+	// update the peer's SETTINGS allowed.
+	c.decoder.SetAllowedMaxDynamicTableSize(1 << 30)
+	trackHPACKConn(c)
+	return c
+}
+
+func (c *hpackStatsConn) Close() error {
+	untrackHPACKConn(c)
+	return c.Conn.Close()
+}
+
+func (c *hpackStatsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if !c.failed {
+		c.writes.consume(b[:n])
+	}
+	return n, err
+}
+
+// headerFrame collects HEADERS and CONTINUATION fragments into a block
+func (c *hpackStatsConn) headerFrame(typ, flags byte, payload []byte) {
+	if c.failed {
+		return
+	}
+	fragment := payload
+	if typ == http2FrameHeaders {
+		c.stats.Add("headers_frames", 1)
+		var padLen int
+		if flags&http2FlagPadded != 0 && len(fragment) > 0 {
+			padLen = int(fragment[0])
+			fragment = fragment[1:]
+		}
+		if flags&http2FlagPriority != 0 && len(fragment) >= 5 {
+			fragment = fragment[5:]
+		}
+		if padLen > len(fragment) {
+			c.fail(errors.New("invalid padding"))
+			return
+		}
+		fragment = fragment[:len(fragment)-padLen]
+		c.block = c.block[:0]
+	}
+	c.block = append(c.block, fragment...)
+	if flags&http2FlagEndHeaders != 0 {
+		c.headerBlock(c.block)
+	}
+}
+
+// headerBlock decodes one complete header block and updates the counters
+func (c *hpackStatsConn) headerBlock(block []byte) {
+	c.stats.Add("header_block_bytes", int64(len(block)))
+	if c.generation != "" {
+		c.stats.Add(c.generation+"header_blocks", 1)
+		c.stats.Add(c.generation+"header_block_bytes", int64(len(block)))
+	}
+	hpackHeaderBlockBytes.Observe(int64(len(block)))
+
+	reps, err := scanHPACKBlock(block)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	fields, err := c.decoder.DecodeFull(block)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+
+	var evictions int64
+	f := 0
+	now := time.Now()
+	c.mu.Lock()
+	for _, r := range reps {
+		switch r.kind {
+		case hpackRepSizeUpdate:
+			c.stats.Add("table_size_updates", 1)
+			evictions += c.table.resize(r.size)
+		case hpackRepIncremental:
+			if f < len(fields) {
+				evictions += c.table.insert(hpackTableEntry{name: fields[f].Name, value: fields[f].Value, added: now})
+			}
+			f++
+		case hpackRepIndexed:
+			c.table.hit(r.index)
+			f++
+		default:
+			f++
+		}
+	}
+	c.mu.Unlock()
+	c.stats.Add("evictions", evictions)
+	hpackBlockEvictions.Observe(evictions)
+
+	var path string
+	for _, f := range fields {
+		if f.Name == ":path" {
+			path = f.Value
+		}
+	}
+	size := int64(len(block))
+	switch {
+	case strings.HasPrefix(path, "/grpc.health.v1.Health/"):
+		c.stats.Add("health_blocks", 1)
+	case c.requests == 0:
+		c.requests++
+		c.stats.Add("first_request_block_bytes", size)
+		hpackFirstRequestBlockBytes.Observe(size)
+	default:
+		c.requests++
+		c.stats.Add("steady_blocks", 1)
+		c.stats.Add("steady_block_bytes", size)
+		hpackSteadyBlockBytes.Observe(size)
+	}
+}
+
+func (c *hpackStatsConn) fail(err error) {
+	c.mu.Lock()
+	c.failed = true
+	c.mu.Unlock()
+	c.stats.Add("decode_errors", 1)
+	log.Warnf("HPACK stats disabled for connection to %s: %v", c.RemoteAddr(), err)
+}
+
+// hpackTableModel tracks the entries in the peer's dynamic table
+type hpackTableModel struct {
+	maxSize uint64
+	size    uint64
+	entries []hpackTableEntry // oldest first
+}
+
+// hpackTableEntry is a header field in the dynamic table, with when it was
+// inserted and how many times it was sent as an index since
+type hpackTableEntry struct {
+	name, value string
+	added       time.Time
+	hits        int64
+}
+
+func (e hpackTableEntry) size() uint64 {
+	return uint64(len(e.name) + len(e.value) + hpackEntryOverhead)
+}
+
+func (t *hpackTableModel) insert(entry hpackTableEntry) int64 {
+	t.entries = append(t.entries, entry)
+	t.size += entry.size()
+	return t.evict()
+}
+
+// hit counts a reference to the entry at HPACK index i, if it is dynamic
+func (t *hpackTableModel) hit(i uint64) {
+	if i <= hpackStaticTableLen || i-hpackStaticTableLen > uint64(len(t.entries)) {
+		return
+	}
+	t.entries[uint64(len(t.entries))-(i-hpackStaticTableLen)].hits++
+}
+
+func (t *hpackTableModel) resize(maxSize uint64) int64 {
+	t.maxSize = maxSize
+	return t.evict()
+}
+
+func (t *hpackTableModel) evict() int64 {
+	var n int64
+	for t.size > t.maxSize && len(t.entries) > 0 {
+		t.size -= t.entries[0].size()
+		t.entries = t.entries[1:]
+		n++
+	}
+	return n
+}
+
+type hpackRepKind int
+
+const (
+	hpackRepIndexed hpackRepKind = iota
+	hpackRepIncremental
+	hpackRepLiteral
+	hpackRepSizeUpdate
+)
+
+type hpackRep struct {
+	kind  hpackRepKind
+	size  uint64 // new max size for hpackRepSizeUpdate
+	index uint64 // table index for hpackRepIndexed
+}
+
+// scanHPACKBlock classifies each representation in a header block without
+// decoding strings (RFC 7541 section 6)
+func scanHPACKBlock(b []byte) ([]hpackRep, error) {
+	var reps []hpackRep
+	for len(b) > 0 {
+		var (
+			rep    hpackRep
+			prefix byte
+			err    error
+		)
+		switch {
+		case b[0]&0x80 != 0:
+			rep.kind, prefix = hpackRepIndexed, 7
+		case b[0]&0xc0 == 0x40:
+			rep.kind, prefix = hpackRepIncremental, 6
+		case b[0]&0xe0 == 0x20:
+			rep.kind, prefix = hpackRepSizeUpdate, 5
+		default:
+			rep.kind, prefix = hpackRepLiteral, 4
+		}
+		var idx uint64
+		if idx, b, err = hpackReadInt(b, prefix); err != nil {
+			return nil, err
+		}
+		switch rep.kind {
+		case hpackRepIndexed:
+			rep.index = idx
+		case hpackRepSizeUpdate:
+			rep.size = idx
+		case hpackRepIncremental, hpackRepLiteral:
+			if idx == 0 {
+				if b, err = hpackSkipString(b); err != nil {
+					return nil, err
+				}
+			}
+			if b, err = hpackSkipString(b); err != nil {
+				return nil, err
+			}
+		}
+		reps = append(reps, rep)
+	}
+	return reps, nil
+}
+
+var errHPACKTruncated = errors.New("truncated HPACK block")
+
+// hpackReadInt decodes an HPACK integer with an n-bit prefix
+func hpackReadInt(b []byte, n byte) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, b, errHPACKTruncated
+	}
+	mask := byte(1<<n - 1)
+	v := uint64(b[0] & mask)
+	b = b[1:]
+	if v < uint64(mask) {
+		return v, b, nil
+	}
+	u, k := binary.Uvarint(b)
+	if k <= 0 {
+		return 0, b, errHPACKTruncated
+	}
+	return v + u, b[k:], nil
+}
+
+// hpackSkipString skips a length-prefixed (possibly Huffman) string literal
+func hpackSkipString(b []byte) ([]byte, error) {
+	length, b, err := hpackReadInt(b, 7)
+	if err != nil {
+		return b, err
+	}
+	if uint64(len(b)) < length {
+		return b, errHPACKTruncated
+	}
+	return b[length:], nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// hpackWarmupTimeout bounds the warm-up call, which waits for the
+// connection to come up
+const hpackWarmupTimeout = 10 * time.Second
+
+// hpackWarmups counts warm-up calls, keyed "<target> ok" and "<target>
+// failed"
+var hpackWarmups = expvar.NewMap("hpack_warmups")
+
+var (
+	hpackWarmupOnce  sync.Once
+	hpackWarmupPair  []string
+	hpackWarmupError error
+)
+
+// IsHPACKWarmupEnabled reports whether new downstream connections are
+// primed with the static JWT component before user traffic
+// (HPACK_WARMUP=true). It only matters with JWT compression.
+func IsHPACKWarmupEnabled() bool {
+	return os.Getenv("HPACK_WARMUP") == "true"
+}
+
+// withHPACKWarmup sends a health check carrying the static JWT component
+// as soon as a connection is dialed, so the first user request finds it in
+// the downstream's HPACK dynamic table. With ENABLE_HPACK_STATS the
+// hpack_connections counters compare first requests with later ones.
+func withHPACKWarmup() Feature {
+	return func(c *clientConnConfig) {
+		c.onDial = append(c.onDial, func(conn *grpc.ClientConn, target string) {
+			go warmHPACK(conn, target)
+		})
+	}
+}
+
+// warmHPACK primes conn. Health checks are never sent a JWT by the
+// interceptors, so the static component goes out on its own. A downstream
+// without the health service still received the headers.
+func warmHPACK(conn *grpc.ClientConn, target string) {
+	pair, err := hpackWarmupMetadata()
+	if err != nil {
+		log.Debugf("not priming HPACK for %s: %v", target, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hpackWarmupTimeout)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, pair...)
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+	if err != nil && status.Code(err) != codes.Unimplemented && status.Code(err) != codes.NotFound {
+		hpackWarmups.Add(target+" failed", 1)
+		log.Warnf("failed to prime HPACK for %s: %v", target, err)
+		return
+	}
+	hpackWarmups.Add(target+" ok", 1)
+}
+
+// hpackWarmupMetadata is the static component pair of the tokens the
+// default tenant issues. The static class holds only the JOSE header, iss
+// and aud, so an unsigned token with those claims has the same one.
+func hpackWarmupMetadata() ([]string, error) {
+	hpackWarmupOnce.Do(func() {
+		claims := &JWTClaims{RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   issuerFor(defaultClaimsProfile.MarketID),
+			Audience: jwt.ClaimStrings{jwtAudience},
+		}}
+		unsigned, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SigningString()
+		if err != nil {
+			hpackWarmupError = err
+			return
+		}
+		pairs, err := jwtCodec.Encode(unsigned + ".")
+		if err != nil {
+			hpackWarmupError = err
+			return
+		}
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if pairs[i] == jwtHeaders.Static {
+				hpackWarmupPair = pairs[i : i+2]
+				return
+			}
+		}
+		hpackWarmupError = errors.New("the JWT codec sends no static component")
+	})
+	return hpackWarmupPair, hpackWarmupError
+}
@@ -0,0 +1,269 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"expvar"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	http2ClientPreface  = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	http2FrameHeaderLen = 9
+
+	http2FrameHeaders      = 0x1
+	http2FrameSettings     = 0x4
+	http2FrameContinuation = 0x9
+
+	http2FlagAck        = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	http2FlagPriority   = 0x20
+
+	http2SettingHeaderTableSize = 0x1
+	http2SettingLen             = 6
+
+	// http2DefaultHeaderTableSize is the RFC 7540 initial value, and also
+	// the most grpc-go's HPACK encoder will ever use
+	http2DefaultHeaderTableSize = 4096
+)
+
+// connWrapper wraps a freshly dialed connection to target
+type connWrapper func(conn net.Conn, target string) net.Conn
+
+// http2FrameSniffer incrementally parses one direction of an HTTP/2 byte
+// stream. Frames for which want returns true are buffered and passed whole
+// to onFrame; all others are skipped without copying.
+type http2FrameSniffer struct {
+	preface int // preface bytes still to skip
+	want    func(typ byte) bool
+	onFrame func(typ, flags byte, payload []byte)
+
+	hdr     []byte // partial frame header
+	skip    int    // payload bytes of an unwanted frame still to skip
+	payload []byte // payload of the current wanted frame
+	need    int    // payload bytes still to read into payload
+	typ     byte
+	flags   byte
+}
+
+func (s *http2FrameSniffer) consume(b []byte) {
+	for len(b) > 0 {
+		switch {
+		case s.preface > 0:
+			k := min(s.preface, len(b))
+			s.preface -= k
+			b = b[k:]
+		case s.skip > 0:
+			k := min(s.skip, len(b))
+			s.skip -= k
+			b = b[k:]
+		case s.need > 0:
+			k := min(s.need, len(b))
+			s.payload = append(s.payload, b[:k]...)
+			s.need -= k
+			b = b[k:]
+			if s.need == 0 {
+				s.onFrame(s.typ, s.flags, s.payload)
+			}
+		default:
+			k := min(http2FrameHeaderLen-len(s.hdr), len(b))
+			s.hdr = append(s.hdr, b[:k]...)
+			b = b[k:]
+			if len(s.hdr) == http2FrameHeaderLen {
+				s.frameStart()
+			}
+		}
+	}
+}
+
+func (s *http2FrameSniffer) frameStart() {
+	length := int(s.hdr[0])<<16 | int(s.hdr[1])<<8 | int(s.hdr[2])
+	s.typ, s.flags = s.hdr[3], s.hdr[4]
+	s.hdr = s.hdr[:0]
+	if !s.want(s.typ) {
+		s.skip = length
+		return
+	}
+	s.payload = s.payload[:0]
+	s.need = length
+	if length == 0 {
+		s.onFrame(s.typ, s.flags, s.payload)
+	}
+}
+
+var hpackTableSizes = expvar.NewMap("hpack_table_size")
+
+// hpackTableSizeFor returns the SETTINGS_HEADER_TABLE_SIZE to advertise to
+// a downstream, from <SERVICE>_HPACK_TABLE_SIZE or else HPACK_TABLE_SIZE.
+// ok is false when neither is set and the transport default applies.
+func hpackTableSizeFor(service string) (size uint32, ok bool) {
+	return downstreamSetting(service, "HPACK_TABLE_SIZE")
+}
+
+// maxHeaderListSizeFor returns the SETTINGS_MAX_HEADER_LIST_SIZE to
+// advertise to a downstream, from <SERVICE>_MAX_HEADER_LIST_SIZE or else
+// MAX_HEADER_LIST_SIZE. ok is false when neither is set.
+func maxHeaderListSizeFor(service string) (size uint32, ok bool) {
+	return downstreamSetting(service, "MAX_HEADER_LIST_SIZE")
+}
+
+// downstreamSetting reads an HTTP/2 setting for a downstream from
+// <SERVICE>_<NAME>, falling back to <NAME>
+func downstreamSetting(service, name string) (uint32, bool) {
+	for _, key := range []string{service + "_" + name, name} {
+		if v := os.Getenv(key); v != "" {
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				log.Warnf("ignoring invalid %s=%q: %v", key, v, err)
+				continue
+			}
+			return uint32(n), true
+		}
+	}
+	return 0, false
+}
+
+// withHeaderTableSize advertises size as SETTINGS_HEADER_TABLE_SIZE on the
+// connection and records what the peer advertises in return. grpc-go has no
+// dial option for this, so the client's initial SETTINGS frame is rewritten
+// on the wire.
+func withHeaderTableSize(size uint32) Feature {
+	return func(c *clientConnConfig) {
+		c.connWrappers = append(c.connWrappers, func(conn net.Conn, target string) net.Conn {
+			return newTableSizeConn(conn, target, size)
+		})
+	}
+}
+
+// tableSizeConn rewrites the first SETTINGS frame it writes and watches the
+// SETTINGS frames it reads
+type tableSizeConn struct {
+	net.Conn
+	size  uint32
+	stats *expvar.Map
+
+	mu        sync.Mutex
+	pending   []byte
+	rewritten bool
+	reads     http2FrameSniffer
+	peerSeen  bool
+}
+
+func newTableSizeConn(conn net.Conn, target string, size uint32) *tableSizeConn {
+	stats := new(expvar.Map).Init()
+	hpackTableSizes.Set(target, stats)
+	c := &tableSizeConn{Conn: conn, size: size, stats: stats}
+	c.reads = http2FrameSniffer{
+		want:    func(typ byte) bool { return typ == http2FrameSettings },
+		onFrame: c.peerSettings,
+	}
+	stats.Add("advertised", int64(size))
+	return c
+}
+
+func (c *tableSizeConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rewritten {
+		return c.Conn.Write(b)
+	}
+	c.pending = append(c.pending, b...)
+	out, ok := rewriteInitialSettings(c.pending, c.size)
+	if !ok {
+		// Preface and first SETTINGS not complete yet. grpc-go writes them
+		// back to back, so this only buffers briefly.
+		return len(b), nil
+	}
+	c.rewritten, c.pending = true, nil
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *tableSizeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.reads.consume(b[:n])
+	return n, err
+}
+
+// peerSettings records the peer's header table size, which bounds the
+// dynamic table the frontend's encoder may use for requests
+func (c *tableSizeConn) peerSettings(_, flags byte, payload []byte) {
+	if flags&http2FlagAck != 0 {
+		return
+	}
+	peer, found := uint32(0), false
+	for p := payload; len(p) >= http2SettingLen; p = p[http2SettingLen:] {
+		if binary.BigEndian.Uint16(p) == http2SettingHeaderTableSize {
+			peer, found = binary.BigEndian.Uint32(p[2:]), true
+		}
+	}
+	if !found {
+		if c.peerSeen {
+			return
+		}
+		peer = http2DefaultHeaderTableSize
+	}
+	c.peerSeen = true
+	peerVar := new(expvar.Int)
+	peerVar.Set(int64(peer))
+	c.stats.Set("peer_advertised", peerVar)
+	effective := new(expvar.Int)
+	effective.Set(int64(min(peer, http2DefaultHeaderTableSize)))
+	c.stats.Set("effective_encoder", effective)
+	log.Infof("HPACK table size for %s: advertised=%d peer=%d", c.RemoteAddr(), c.size, peer)
+}
+
+// rewriteInitialSettings sets SETTINGS_HEADER_TABLE_SIZE in the first
+// SETTINGS frame following the client preface in buf. It returns false
+// until buf holds the whole frame.
+func rewriteInitialSettings(buf []byte, size uint32) ([]byte, bool) {
+	start := len(http2ClientPreface)
+	if len(buf) < start+http2FrameHeaderLen {
+		return nil, false
+	}
+	hdr := buf[start : start+http2FrameHeaderLen]
+	length := int(hdr[0])<<16 | int(hdr[1])<<8 | int(hdr[2])
+	end := start + http2FrameHeaderLen + length
+	if len(buf) < end {
+		return nil, false
+	}
+	if hdr[3] != http2FrameSettings {
+		// Not what the protocol requires; leave the stream untouched.
+		return buf, true
+	}
+
+	payload := make([]byte, 0, length+http2SettingLen)
+	for p := buf[start+http2FrameHeaderLen : end]; len(p) >= http2SettingLen; p = p[http2SettingLen:] {
+		if binary.BigEndian.Uint16(p) != http2SettingHeaderTableSize {
+			payload = append(payload, p[:http2SettingLen]...)
+		}
+	}
+	payload = binary.BigEndian.AppendUint16(payload, http2SettingHeaderTableSize)
+	payload = binary.BigEndian.AppendUint32(payload, size)
+
+	out := make([]byte, 0, len(buf)+http2SettingLen)
+	out = append(out, buf[:start]...)
+	out = append(out, byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)))
+	out = append(out, hdr[3:]...)
+	out = append(out, payload...)
+	return append(out, buf[end:]...), true
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"sort"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// idempotencyKeyHeader identifies a PlaceOrder attempt to checkoutservice
+	idempotencyKeyHeader = "x-idempotency-key"
+	// idempotentReplayHeader marks a PlaceOrder response replayed from
+	// checkoutservice's cache
+	idempotentReplayHeader = "x-idempotent-replay"
+
+	// checkoutAttemptField is the checkout form field carrying the nonce
+	// of the cart page the order is placed from
+	checkoutAttemptField = "checkout_attempt"
+	// apiIdempotencyKeyHeader is the REST API request header naming a
+	// checkout attempt, chosen by the client
+	apiIdempotencyKeyHeader = "Idempotency-Key"
+)
+
+// placeOrderReplays counts orders checkoutservice answered from its
+// idempotency cache rather than placing again
+var placeOrderReplays = expvar.NewInt("place_order_replays")
+
+// newCheckoutAttempt returns a nonce for a rendering of the checkout form,
+// or "" if none could be drawn
+func newCheckoutAttempt() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// withIdempotencyKey adds an idempotency key for a PlaceOrder call of the
+// checkout attempt to ctx. The key is derived from the attempt and the
+// cart's contents, so a double submit of one form and the retry
+// interceptor's resend are recognized as the same order, while a new
+// attempt or a changed cart is a new one. Calls without an attempt get no
+// key.
+func (fe *frontendServer) withIdempotencyKey(ctx context.Context, attempt string) context.Context {
+	if attempt == "" {
+		return ctx
+	}
+	items, err := fe.getCart(ctx, fe.cartUserID(ctx))
+	if err != nil {
+		requestLogger(ctx).Warnf("placing order without idempotency key, cart unavailable: %v", err)
+		return ctx
+	}
+	lines := make([]string, 0, len(items))
+	for _, it := range items {
+		lines = append(lines, fmt.Sprintf("%s:%d", it.GetProductId(), it.GetQuantity()))
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%v", attempt, lines)
+	return metadata.AppendToOutgoingContext(ctx, idempotencyKeyHeader, hex.EncodeToString(h.Sum(nil)[:16]))
+}
+
+// noteIdempotentReplay counts a PlaceOrder response that was a replay
+func noteIdempotentReplay(header metadata.MD) {
+	if v := header.Get(idempotentReplayHeader); len(v) > 0 && v[0] == "true" {
+		placeOrderReplays.Add(1)
+	}
+}
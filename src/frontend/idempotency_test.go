@@ -0,0 +1,57 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestIdempotencyKeyPerCheckoutAttempt(t *testing.T) {
+	fe, carts := newFakeCartFrontend(t)
+	carts.mu.Lock()
+	carts.carts["s1"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	carts.mu.Unlock()
+	ctx := context.WithValue(context.Background(), ctxKeySessionID{}, "s1")
+	key := func(attempt string) string {
+		md, _ := metadata.FromOutgoingContext(fe.withIdempotencyKey(ctx, attempt))
+		if v := md.Get(idempotencyKeyHeader); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	attempt := newCheckoutAttempt()
+	first := key(attempt)
+	if first == "" || key(attempt) != first {
+		t.Errorf("resubmitting one attempt gave keys %q and %q, want the same", first, key(attempt))
+	}
+	if other := key(newCheckoutAttempt()); other == first {
+		t.Error("a new checkout attempt reused the key of the previous one")
+	}
+	carts.mu.Lock()
+	carts.carts["s1"] = append(carts.carts["s1"], &pb.CartItem{ProductId: "66VCHSJNUP", Quantity: 1})
+	carts.mu.Unlock()
+	if changed := key(attempt); changed == first {
+		t.Error("the attempt kept its key after the cart changed")
+	}
+	if k := key(""); k != "" {
+		t.Errorf("call without an attempt got key %q", k)
+	}
+}
@@ -16,175 +16,414 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
 	"crypto/rsa"
-	"encoding/base64"
+	"errors"
+	"expvar"
 	"fmt"
+	"hash/fnv"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/google/uuid"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
 	cookieJWT = cookiePrefix + "jwt"
 	jwtIssuer = "https://auth.hipstershop.com"
-	jwtAudience = "urn:hipstershop:api"
+	jwtLifetime = 2 * time.Minute // Load test: 2 min expiration
 )
 
 var (
 	privateKey *rsa.PrivateKey
 	publicKey  *rsa.PublicKey
+
+	// jwtClaimRefreshes counts tokens re-issued because a claim went stale,
+	// keyed by claim
+	jwtClaimRefreshes = expvar.NewMap("jwt_claim_refreshes")
+
+	jwtIssuance       singleflight.Group
+	jwtIssuanceShared = expvar.NewInt("jwt_issuance_shared")
 )
 
-type JWTClaims struct {
-	SessionID   string `json:"session_id"`
-	Name        string `json:"name"`
-	MarketID    string `json:"market_id"`
-	Currency    string `json:"currency"`
-	CartID      string `json:"cart_id"`
-	RandomValue string `json:"random_value"` // Added random value to ensure uniqueness
-	jwt.RegisteredClaims
-}
+// JWTClaims, the claim class lists and the JWT header names are generated
+// from jwt_claims.yaml, for the frontend and every service it calls
+//go:generate go run ./cmd/claimsgen -issuer -out jwt_claims_gen.go
+//go:generate go run ./cmd/claimsgen -out cmd/jwtbench/jwt_claims_gen.go
+//go:generate go run ./cmd/claimsgen -out cmd/jwtctl/jwt_claims_gen.go
+//go:generate go run ./cmd/claimsgen -out ../checkoutservice/jwt_claims_gen.go
+//go:generate go run ./cmd/claimsgen -out ../shippingservice/jwt_claims_gen.go
+//go:generate go run ./cmd/claimsgen -out ../emailauthshim/jwt_claims_gen.go
 
 type ctxKeyJWT struct{}
 type ctxKeyJWTToken struct{}
 
-// loadRSAKeys loads the RSA private and public keys from PEM files
-func loadRSAKeys() error {
-	// Load private key
-	privateKeyData, err := os.ReadFile("jwt_private_key.pem")
-	if err != nil {
-		return fmt.Errorf("failed to read private key: %w", err)
+// jwtNotBefore returns the nbf of a token issued at now. With
+// JWT_NBF_PREDATE set, it lies that long before now, so verifiers whose
+// clocks run behind the frontend's by up to as much accept the token at
+// once; unset, tokens carry no nbf.
+func jwtNotBefore(now time.Time) *jwt.NumericDate {
+	v := os.Getenv("JWT_NBF_PREDATE")
+	if v == "" {
+		return nil
 	}
+	predate, err := time.ParseDuration(v)
+	if err != nil || predate < 0 {
+		log.Warnf("ignoring invalid JWT_NBF_PREDATE=%q", v)
+		return nil
+	}
+	return jwt.NewNumericDate(now.Add(-predate))
+}
 
-	privateKey, err = jwt.ParseRSAPrivateKeyFromPEM(privateKeyData)
+// loadRSAKeys loads the RSA private and public keys from PEM files, or
+// generates them with JWT_AUTOGEN_KEYS=true
+func loadRSAKeys() error {
+	var err error
+	if IsJWTAutogenKeysEnabled() {
+		err = loadAutogenRSAKeys()
+	} else {
+		err = loadRSAKeyFiles()
+	}
 	if err != nil {
-		return fmt.Errorf("failed to parse private key: %w", err)
+		return err
+	}
+	if err := loadJWTTenants(); err != nil {
+		return err
 	}
+	return loadJWTAllowlists()
+}
 
-	// Load public key
-	publicKeyData, err := os.ReadFile("jwt_public_key.pem")
-	if err != nil {
-		return fmt.Errorf("failed to read public key: %w", err)
+// loadtestUserPoolSize is read from LOADTEST_USER_POOL_SIZE. When positive,
+// tokens are issued for one of that many synthetic users instead of the
+// real session, so load tests control how many distinct session headers
+// the HPACK dynamic table has to hold.
+var loadtestUserPoolSize = loadLoadtestUserPoolSize()
+
+func loadLoadtestUserPoolSize() int {
+	n, err := strconv.Atoi(os.Getenv("LOADTEST_USER_POOL_SIZE"))
+	if err != nil || n < 0 {
+		return 0
 	}
+	return n
+}
 
-	publicKey, err = jwt.ParseRSAPublicKeyFromPEM(publicKeyData)
-	if err != nil {
-		return fmt.Errorf("failed to parse public key: %w", err)
+// jwtSessionFor maps a session ID to the session the JWT is issued for.
+// Without a user pool this is the session itself; with one, sessions are
+// hashed onto the pool so a session keeps the same synthetic user.
+func jwtSessionFor(sessionID string) string {
+	if loadtestUserPoolSize == 0 {
+		return sessionID
 	}
+	h := fnv.New32a()
+	h.Write([]byte(sessionID))
+	return fmt.Sprintf("loadtest-user-%d", h.Sum32()%uint32(loadtestUserPoolSize))
+}
+
+// jwtVerificationKey returns the key receivers of a detached JWS verify
+// against; the frontend uses its own public key
+func jwtVerificationKey() *rsa.PublicKey {
+	_, pub := rsaKeys()
+	return pub
+}
 
-	return nil
+// generateJWT creates a new JWT token with the given session ID, currency
+// and profile claims
+func generateJWT(sessionID, currency string, profile claimsProfile) (string, error) {
+	return generateJWTContext(context.Background(), sessionID, currency, profile)
 }
 
-// generateJWT creates a new JWT token with the given session ID and currency
-func generateJWT(sessionID, currency string) (string, error) {
-	now := time.Now()
-	jti, _ := uuid.NewRandom()
+// generateJWTContext is generateJWT giving up once ctx is done
+func generateJWTContext(ctx context.Context, sessionID, currency string, profile claimsProfile) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("token minting abandoned: %w", err)
+	}
+	defer jwtOperationLatency.ObserveSince(ctx, "generate", time.Now())
+	sessionID = jwtSessionFor(sessionID)
+	now := jwtClock.Now()
+	jti := newJWTUUID()
 
-	// Generate a random value to ensure each JWT is unique (for dynamic header)
-	// This goes into x-jwt-dynamic and changes with every JWT renewal
-	randomBytes := make([]byte, 16)
-	_, err := rand.Read(randomBytes)
+	// Unless the token shape leaves it out, a random value makes each
+	// session's JWT unique (for dynamic header). It goes into x-jwt-dynamic.
+	randomValue, err := shapeRandomValue(activeTokenShape(), "")
 	if err != nil {
-		return "", fmt.Errorf("failed to generate random value: %w", err)
+		return "", err
 	}
-	randomValue := base64.StdEncoding.EncodeToString(randomBytes)
 
 	// Session-related fields remain stable for HPACK caching
 	// These go into x-jwt-session and should NOT change during JWT renewal
 	claims := JWTClaims{
-		SessionID:   sessionID,  // Stable: matches shop_session-id cookie
-		Name:        "Jane Doe",
-		MarketID:    "US",
-		Currency:    currency,
-		CartID:      fmt.Sprintf("cart-%s", sessionID), // Stable: derived from session ID
-		RandomValue: randomValue, // Dynamic: changes with each JWT renewal
+		SessionID:       sessionID,  // Stable: matches shop_session-id cookie
+		Name:            profile.Name,
+		MarketID:        profile.MarketID,
+		LoyaltyTier:     profile.LoyaltyTier,
+		Currency:        currency,
+		CartID:          fmt.Sprintf("cart-%s", sessionID), // Stable: derived from session ID
+		FingerprintHash: fingerprintFromContext(ctx),       // Stable: the browser's, if bound
+		RandomValue:     randomValue, // Dynamic: changes with each JWT renewal
 		RegisteredClaims: jwt.RegisteredClaims{
-			Issuer:    jwtIssuer,
+			Issuer:    issuerFor(profile.MarketID), // Stable: per market tenant
 			Subject:   fmt.Sprintf("urn:hipstershop:user:%s", sessionID), // Stable: based on session ID
 			Audience:  jwt.ClaimStrings{jwtAudience},
-			ExpiresAt: jwt.NewNumericDate(now.Add(2 * time.Minute)), // Load test: 2 min expiration
+			ExpiresAt: jwt.NewNumericDate(now.Add(jwtLifetime)),
 			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwtNotBefore(now),
 			ID:        jti.String(),
 		},
 	}
+	minimizeClaims(&claims)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	tokenString, err := token.SignedString(privateKey)
+	tokenString, err := signJWT(ctx, withInjectedClaims(&claims))
 	if err != nil {
-		return "", fmt.Errorf("failed to sign token: %w", err)
+		return "", err
 	}
 
+	tokens.recordIssued(&claims, tokenString)
 	return tokenString, nil
 }
 
+// signJWT signs claims with RS256 unless ctx is done first. An RSA
+// signature cannot be interrupted, so a caller that gives up leaves it to
+// finish in the background rather than waiting on it.
+func signJWT(ctx context.Context, claims jwt.Claims) (string, error) {
+	issuer, _ := claims.GetIssuer()
+	key, err := signingKeyFor(issuer)
+	if err != nil {
+		return "", err
+	}
+	sign := func() (string, error) {
+		tokenString, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+		if err != nil {
+			return "", fmt.Errorf("failed to sign token: %w", err)
+		}
+		return tokenString, nil
+	}
+	if ctx.Done() == nil {
+		return sign()
+	}
+
+	type result struct {
+		token string
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		tokenString, err := sign()
+		done <- result{tokenString, err}
+	}()
+	select {
+	case r := <-done:
+		return r.token, r.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("token minting abandoned: %w", ctx.Err())
+	}
+}
+
 // validateJWT validates a JWT token and returns the claims if valid
 func validateJWT(tokenString string) (*JWTClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Verify the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return publicKey, nil
-	})
+	return validateJWTContext(context.Background(), tokenString)
+}
+
+// validateJWTContext is validateJWT timed with the trace of ctx as exemplar
+func validateJWTContext(ctx context.Context, tokenString string) (*JWTClaims, error) {
+	defer jwtOperationLatency.ObserveSince(ctx, "validate", time.Now())
+	// The audience keeps out service tokens, see generateServiceToken
+	opts := append(jwtAllowlistOptions(), jwt.WithTimeFunc(jwtClock.Now))
+	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, jwtKeyFunc, opts...)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse token: %w", err)
+		return nil, classifyJWTError(err)
 	}
 
 	if claims, ok := token.Claims.(*JWTClaims); ok && token.Valid {
+		if err := checkJWTIssuer(claims.Issuer); err != nil {
+			return nil, err
+		}
+		if tokens.isRevoked(claims.ID) {
+			return nil, fmt.Errorf("%w: jti=%s", errJWTRevoked, claims.ID)
+		}
 		return claims, nil
 	}
 
-	return nil, fmt.Errorf("invalid token")
+	return nil, fmt.Errorf("%w: invalid token", errJWTMalformed)
+}
+
+// validateMeshJWT validates an HS256 mesh token, see signMeshToken. Only
+// introspection accepts these; the browser cookie must be RS256. The MAC
+// may be truncated, so it is checked by verifyMeshToken rather than by the
+// jwt library.
+func validateMeshJWT(tokenString string) (*JWTClaims, error) {
+	if err := verifyMeshToken(tokenString); err != nil {
+		return nil, err
+	}
+	claims := &JWTClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, claims); err != nil {
+		return nil, classifyJWTError(err)
+	}
+	if claims.ExpiresAt == nil || jwtClock.Now().After(claims.ExpiresAt.Time) {
+		return nil, fmt.Errorf("%w: mesh token expired", errJWTExpired)
+	}
+	if tokens.isRevoked(claims.ID) {
+		return nil, fmt.Errorf("%w: jti=%s", errJWTRevoked, claims.ID)
+	}
+	return claims, nil
 }
 
 // generateJWTFromClaims regenerates a JWT token from existing claims
 func generateJWTFromClaims(claims *JWTClaims) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	tokenString, err := token.SignedString(privateKey)
+	return generateJWTFromClaimsContext(context.Background(), claims)
+}
+
+// generateJWTFromClaimsContext is generateJWTFromClaims giving up once ctx
+// is done
+func generateJWTFromClaimsContext(ctx context.Context, claims *JWTClaims) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("token minting abandoned: %w", err)
+	}
+	defer jwtOperationLatency.ObserveSince(ctx, "generate", time.Now())
+	tokenString, err := signJWT(ctx, withInjectedClaims(claims))
 	if err != nil {
-		return "", fmt.Errorf("failed to sign token: %w", err)
+		return "", err
 	}
+	tokens.recordIssued(claims, tokenString)
 	return tokenString, nil
 }
 
+// refreshJWT re-signs claims with a new ID and validity window. Session
+// claims are kept so the HPACK-cached session header stays the same.
+func refreshJWT(claims *JWTClaims) (string, error) {
+	return refreshJWTContext(context.Background(), claims)
+}
+
+// refreshJWTContext is refreshJWT giving up once ctx is done
+func refreshJWTContext(ctx context.Context, claims *JWTClaims) (string, error) {
+	now := jwtClock.Now()
+	jti := newJWTUUID()
+
+	fresh := *claims
+	fresh.IssuedAt = jwt.NewNumericDate(now)
+	fresh.NotBefore = jwtNotBefore(now)
+	fresh.ExpiresAt = jwt.NewNumericDate(now.Add(jwtLifetime))
+	fresh.ID = jti.String()
+	var err error
+	if fresh.RandomValue, err = shapeRandomValue(activeTokenShape(), fresh.RandomValue); err != nil {
+		return "", err
+	}
+	return generateJWTFromClaimsContext(ctx, &fresh)
+}
+
 // ensureJWT middleware ensures that a valid JWT exists for the request
 func ensureJWT(next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Probes must answer even while the keys are still loading
+		if isProbePath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !ready.keysLoaded.Load() {
+			renderJWTError(w, r, errJWTKeysUnavailable)
+			return
+		}
+		r = withFingerprint(r)
+		if isAPIPath(r.URL.Path) {
+			ensureBearerJWT(next, w, r)
+			return
+		}
+		if isHeaderOnlyClient(r) {
+			ensureHeaderJWT(next, w, r)
+			return
+		}
+
 		var tokenString string
 		var claims *JWTClaims
 		var needNewToken bool = false
 
-		// Try to get JWT from cookie
-		c, err := r.Cookie(cookieJWT)
+		// Try to get JWT from cookie (reassembled if chunked)
+		cookieToken, err := readJWTCookie(r)
 		if err == http.ErrNoCookie {
+			if idleCookieSession(r) {
+				jwtSessionRenewals.Add("idle_expired", 1)
+				r = restartSession(w, r)
+			}
 			needNewToken = true
 		} else if err != nil {
-			http.Error(w, "Error reading JWT cookie", http.StatusInternalServerError)
+			renderJWTError(w, r, err)
 			return
 		} else {
-			tokenString = c.Value
+			tokenString = cookieToken
 			// Validate existing token
-			claims, err = validateJWT(tokenString)
-			if err != nil {
-				// Token is invalid or expired, need new one
+			claims, err = validateJWTContext(r.Context(), tokenString)
+			if errors.Is(err, errJWTExpired) {
+				// Expired tokens are routine (2 min lifetime), silently renew
+				// unless the session went idle or belongs to another browser
+				if expired, err := expiredJWTClaims(tokenString); err == nil && sessionIdle(expired) {
+					jwtSessionRenewals.Add("idle_expired", 1)
+					r = restartSession(w, r)
+				} else if err == nil && fingerprintMismatch(r, expired) {
+					r = restartSession(w, r)
+				}
+				needNewToken = true
+			} else if err != nil {
+				renderJWTError(w, r, err)
+				return
+			} else if fingerprintMismatch(r, claims) {
+				r = restartSession(w, r)
 				needNewToken = true
+			} else if claims.SessionID != jwtSessionFor(sessionID(r)) && oidcIdentityFromContext(r.Context()) != nil {
+				// The user signed in at the IdP since the token was
+				// issued, which moved them to their own session
+				needNewToken = true
+			} else if claims.SessionID != jwtSessionFor(sessionID(r)) && sessionMigrated(r) {
+				// The session moved after ENABLE_SINGLE_SHARED_SESSION
+				// changed; the token still names the old one
+				needNewToken = true
+			} else if claims.SessionID != jwtSessionFor(sessionID(r)) {
+				renderJWTError(w, r, fmt.Errorf("%w: token issued for session %q", errJWTSessionMismatch, claims.SessionID))
+				return
+			} else if currency := selectedCurrency(r); claims.Currency != currency && IsCurrencyOverrideEnabled() && !IsCurrencyClaimEnabled() {
+				r = withCurrencyOverride(r, currency)
+			} else if claims.Currency != currency {
+				// The currency cookie changed since the token was issued
+				// (setCurrencyHandler). Re-issue with the new claim; this
+				// also changes the HPACK-cached session header.
+				updated := *claims
+				updated.Currency = currency
+				if tokenString, err = refreshJWTContext(r.Context(), &updated); err != nil {
+					renderJWTError(w, r, err)
+					return
+				}
+				claims, _ = validateJWT(tokenString)
+				if err := setJWTCookie(w, r, tokenString); err != nil {
+					renderJWTError(w, r, err)
+					return
+				}
+				jwtClaimRefreshes.Add("currency", 1)
+			} else if needsSlidingRenewal(claims) {
+				// Replace the token before it expires, keeping its
+				// session claims and so the HPACK-cached session header
+				if tokenString, err = refreshJWTContext(r.Context(), claims); err != nil {
+					renderJWTError(w, r, err)
+					return
+				}
+				claims, _ = validateJWT(tokenString)
+				if err := setJWTCookie(w, r, tokenString); err != nil {
+					renderJWTError(w, r, err)
+					return
+				}
+				jwtSessionRenewals.Add("sliding", 1)
 			}
 		}
 
 		// Generate new JWT if needed
 		if needNewToken {
-			sessionID := sessionID(r)
-			currency := currentCurrency(r)
-			
-			newToken, err := generateJWT(sessionID, currency)
-			if err != nil {
-				http.Error(w, "Failed to generate JWT", http.StatusInternalServerError)
-				return
+			newToken, ok := pooledJWT(r)
+			if !ok {
+				newToken, err = issueJWT(r.Context(), sessionID(r), selectedCurrency(r))
+				if err != nil {
+					renderJWTError(w, r, err)
+					return
+				}
 			}
 
 			tokenString = newToken
@@ -192,14 +431,11 @@ func ensureJWT(next http.Handler) http.HandlerFunc {
 			// Validate to get claims
 			claims, _ = validateJWT(tokenString)
 
-			// Set JWT cookie
-			http.SetCookie(w, &http.Cookie{
-				Name:     cookieJWT,
-				Value:    tokenString,
-				MaxAge:   120, // 2 minutes (same as JWT expiration) - Load test config
-				HttpOnly: true,
-				SameSite: http.SameSiteStrictMode,
-			})
+			// Set JWT cookie, chunked if the token is too large for one
+			if err := setJWTCookie(w, r, tokenString); err != nil {
+				renderJWTError(w, r, err)
+				return
+			}
 		}
 
 		// Add JWT token string and claims to context for use in gRPC calls
@@ -211,6 +447,39 @@ func ensureJWT(next http.Handler) http.HandlerFunc {
 	}
 }
 
+// issueJWT mints a token for the session. Concurrent calls for the same
+// session and currency share one token, so parallel first requests from a
+// browser (several tabs, or a page and its assets) don't each mint their
+// own and race on the cookie. Each caller stops waiting when its own ctx is
+// done.
+func issueJWT(ctx context.Context, sessionID, currency string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("token minting abandoned: %w", err)
+	}
+	// The first caller's request may finish before the others, so don't let
+	// its cancellation cut short the profile lookup and signing they all
+	// depend on
+	mintCtx := context.WithoutCancel(ctx)
+	ch := jwtIssuance.DoChan(sessionID+"|"+currency+"|"+fingerprintFromContext(ctx), func() (interface{}, error) {
+		// Profile claims are looked up per JWT subject, which is the
+		// synthetic user when a load-test pool is configured, unless the
+		// IdP supplied them
+		return generateJWTContext(mintCtx, sessionID, currency, profileFor(mintCtx, sessionID))
+	})
+	select {
+	case res := <-ch:
+		if res.Shared {
+			jwtIssuanceShared.Add(1)
+		}
+		if res.Err != nil {
+			return "", res.Err
+		}
+		return res.Val.(string), nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("token minting abandoned: %w", ctx.Err())
+	}
+}
+
 // getJWTFromContext retrieves JWT claims from context
 func getJWTFromContext(ctx context.Context) (*JWTClaims, bool) {
 	claims, ok := ctx.Value(ctxKeyJWT{}).(*JWTClaims)
@@ -219,9 +488,9 @@ func getJWTFromContext(ctx context.Context) (*JWTClaims, bool) {
 
 // Helper function to get current JWT token from request
 func getJWTToken(r *http.Request) string {
-	c, err := r.Cookie(cookieJWT)
+	token, err := readJWTCookie(r)
 	if err != nil {
 		return ""
 	}
-	return c.Value
+	return token
 }
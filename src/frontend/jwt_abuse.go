@@ -0,0 +1,344 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultJWTAbuseWindow     = time.Minute
+	defaultJWTAbuseCooldown   = 5 * time.Minute
+	defaultJWTAbuseMaxSources = 100000
+)
+
+var (
+	errJWTAbuse = errors.New("too many invalid tokens")
+
+	// jwtInvalidAttempts counts the tokens clients sent that were not just
+	// expired, by reason
+	jwtInvalidAttempts = expvar.NewMap("jwt_invalid_attempts")
+
+	// jwtAbuseStats counts the sources flagged for sending too many invalid
+	// tokens, the requests refused from them and the invalid tokens from
+	// sources not tracked because the detector was full; flagged_sources is
+	// the number flagged right now
+	jwtAbuseStats = expvar.NewMap("jwt_abuse")
+)
+
+type ctxKeyJWTAbuse struct{}
+
+// jwtAbuseDetector flags a source, a client IP or a session, once it sent
+// threshold invalid tokens within window: it writes a security event to the
+// audit log and, when blocking, refuses the source's requests until
+// cooldown has passed. Expired tokens are routine and not counted. At most
+// maxSources sources are tracked; sources whose window and cooldown are
+// over are forgotten at most once per window. The client IP is read from
+// X-Forwarded-For only behind trustedProxies.
+type jwtAbuseDetector struct {
+	threshold      int
+	window         time.Duration
+	cooldown       time.Duration
+	block          bool
+	maxSources     int
+	trustedProxies []*net.IPNet
+
+	mu        sync.Mutex
+	sources   map[string]*jwtAbuseSource
+	lastPrune time.Time
+}
+
+type jwtAbuseSource struct {
+	windowStart  time.Time
+	failures     int
+	flaggedUntil time.Time
+}
+
+// loadJWTAbuseDetector reads JWT_ABUSE_THRESHOLD, the invalid tokens from
+// one source that flag it (unset or 0 disables the detector),
+// JWT_ABUSE_WINDOW, the time they are counted over (default 1m),
+// JWT_ABUSE_COOLDOWN, how long the source stays flagged (default 5m),
+// JWT_ABUSE_MAX_SOURCES, the sources tracked at once (default 100000),
+// JWT_ABUSE_BLOCK=true to refuse its requests meanwhile, and
+// JWT_ABUSE_TRUSTED_PROXIES, the comma-separated IPs or CIDRs of the
+// proxies whose X-Forwarded-For names the client
+func loadJWTAbuseDetector() *jwtAbuseDetector {
+	v := os.Getenv("JWT_ABUSE_THRESHOLD")
+	if v == "" {
+		return nil
+	}
+	threshold, err := strconv.Atoi(v)
+	if err != nil || threshold < 0 {
+		log.Warnf("ignoring invalid JWT_ABUSE_THRESHOLD=%q", v)
+		return nil
+	}
+	if threshold == 0 {
+		return nil
+	}
+	d := newJWTAbuseDetector(threshold, defaultJWTAbuseWindow, defaultJWTAbuseCooldown)
+	if v, err := time.ParseDuration(os.Getenv("JWT_ABUSE_WINDOW")); err == nil && v > 0 {
+		d.window = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("JWT_ABUSE_COOLDOWN")); err == nil && v > 0 {
+		d.cooldown = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("JWT_ABUSE_MAX_SOURCES")); err == nil && v > 0 {
+		d.maxSources = v
+	}
+	d.block = os.Getenv("JWT_ABUSE_BLOCK") == "true"
+	for _, v := range strings.Split(os.Getenv("JWT_ABUSE_TRUSTED_PROXIES"), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		_, proxy, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Warnf("ignoring invalid JWT_ABUSE_TRUSTED_PROXIES entry %q", v)
+			continue
+		}
+		d.trustedProxies = append(d.trustedProxies, proxy)
+	}
+	return d
+}
+
+func newJWTAbuseDetector(threshold int, window, cooldown time.Duration) *jwtAbuseDetector {
+	d := &jwtAbuseDetector{threshold: threshold, window: window, cooldown: cooldown, maxSources: defaultJWTAbuseMaxSources, sources: make(map[string]*jwtAbuseSource)}
+	jwtAbuseStats.Set("flagged_sources", expvar.Func(func() interface{} { return d.flaggedSources() }))
+	return d
+}
+
+// detectJWTAbuse tracks the invalid tokens the requests below it are
+// rejected for, see jwtAbuseDetector. It runs after ensureSessionID, so a
+// request's session is one of its sources.
+func detectJWTAbuse(next http.Handler) http.Handler {
+	detector := loadJWTAbuseDetector()
+	if detector == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Verifying the session's token is only worth it when blocking
+		if !detector.block {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyJWTAbuse{}, detector)))
+			return
+		}
+		if retryAfter, ok := detector.refused(detector.requestSources(r)); ok {
+			jwtAbuseStats.Add("refused", 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			if isAPIPath(r.URL.Path) {
+				writeAPIError(w, http.StatusTooManyRequests, errJWTAbuse)
+			} else {
+				http.Error(w, errJWTAbuse.Error(), http.StatusTooManyRequests)
+			}
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyJWTAbuse{}, detector)))
+	})
+}
+
+// requestSources are the sources a request is counted against: its client IP,
+// and the session of the token it sent if the token's signature verifies.
+// The session cookie alone is the client's to choose, so it is not counted.
+func (d *jwtAbuseDetector) requestSources(r *http.Request) []string {
+	sources := []string{"ip:" + d.clientIP(r)}
+	if session, ok := verifiedJWTSession(r); ok {
+		sources = append(sources, "session:"+session)
+	}
+	return sources
+}
+
+// clientIP returns the peer address of r or, when the peer is a trusted
+// proxy, the last X-Forwarded-For hop not added by a trusted proxy
+func (d *jwtAbuseDetector) clientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0 && d.trustedProxy(ip); i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+func (d *jwtAbuseDetector) trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, proxy := range d.trustedProxies {
+		if parsed != nil && proxy.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifiedJWTSession returns the session_id claim of the token r sent, from
+// its headers or cookie, if the token's signature verifies. The token may
+// be otherwise invalid, as the tokens counted as abuse are.
+func verifiedJWTSession(r *http.Request) (string, bool) {
+	token, ok := headerJWT(r)
+	if !ok {
+		var err error
+		if token, err = readJWTCookie(r); err != nil {
+			return "", false
+		}
+	}
+	claims, err := expiredJWTClaims(token)
+	if err != nil || claims.SessionID == "" {
+		return "", false
+	}
+	return claims.SessionID, true
+}
+
+// invalidJWTReason names what was wrong with a rejected token, or reports
+// false for rejections that say nothing about the client, such as an
+// expired token or signing keys that are not loaded
+func invalidJWTReason(err error) (string, bool) {
+	switch {
+	case errors.Is(err, errJWTMalformed):
+		return "malformed", true
+	case errors.Is(err, errJWTSignatureInvalid):
+		return "signature_invalid", true
+	case errors.Is(err, errJWTSessionMismatch):
+		return "session_mismatch", true
+	case errors.Is(err, errJWTRevoked):
+		return "revoked", true
+	case errors.Is(err, errJWTWrongPurpose):
+		return "wrong_purpose", true
+	case errors.Is(err, errJWTIssuerMismatch):
+		return "issuer_mismatch", true
+	case errors.Is(err, errJWTAudienceMismatch):
+		return "audience_mismatch", true
+	}
+	return "", false
+}
+
+// recordInvalidJWT counts a token r was rejected for
+func recordInvalidJWT(r *http.Request, err error) {
+	reason, ok := invalidJWTReason(err)
+	if !ok {
+		return
+	}
+	jwtInvalidAttempts.Add(reason, 1)
+	if d, ok := r.Context().Value(ctxKeyJWTAbuse{}).(*jwtAbuseDetector); ok {
+		for _, source := range d.requestSources(r) {
+			d.failure(source, reason, r.URL.Path)
+		}
+	}
+}
+
+// refused returns how long the first flagged source of sources stays
+// flagged, when the detector blocks
+func (d *jwtAbuseDetector) refused(sources []string) (time.Duration, bool) {
+	if !d.block {
+		return 0, false
+	}
+	now := jwtClock.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, source := range sources {
+		if s := d.sources[source]; s != nil && now.Before(s.flaggedUntil) {
+			return s.flaggedUntil.Sub(now), true
+		}
+	}
+	return 0, false
+}
+
+// failure records an invalid token from source, flagging the source at
+// the threshold. A new source is not tracked while maxSources are.
+func (d *jwtAbuseDetector) failure(source, reason, path string) {
+	now := jwtClock.Now()
+	d.mu.Lock()
+	s := d.sources[source]
+	if s == nil {
+		if now.Sub(d.lastPrune) > d.window {
+			d.pruneLocked(now)
+			d.lastPrune = now
+		}
+		if len(d.sources) >= d.maxSources {
+			d.mu.Unlock()
+			jwtAbuseStats.Add("untracked", 1)
+			return
+		}
+		s = &jwtAbuseSource{windowStart: now}
+		d.sources[source] = s
+	}
+	if now.Sub(s.windowStart) > d.window {
+		s.windowStart, s.failures = now, 0
+	}
+	s.failures++
+	if s.failures < d.threshold {
+		d.mu.Unlock()
+		return
+	}
+	failures := s.failures
+	until := now.Add(d.cooldown)
+	s.flaggedUntil = until
+	s.windowStart, s.failures = until, 0
+	d.mu.Unlock()
+
+	jwtAbuseStats.Add("flagged", 1)
+	auditSecurityEvent("jwt_abuse_flagged", logrus.Fields{
+		"source":        source,
+		"reason":        reason,
+		"http.req.path": path,
+		"failures":      failures,
+		"window":        d.window.String(),
+		"blocked":       d.block,
+		"flagged_until": until.UTC().Format(time.RFC3339),
+	})
+}
+
+// pruneLocked forgets sources whose window and cooldown are over
+func (d *jwtAbuseDetector) pruneLocked(now time.Time) {
+	for k, s := range d.sources {
+		if now.After(s.flaggedUntil) && now.Sub(s.windowStart) > d.window {
+			delete(d.sources, k)
+		}
+	}
+}
+
+func (d *jwtAbuseDetector) flaggedSources() int {
+	now := jwtClock.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, s := range d.sources {
+		if now.Before(s.flaggedUntil) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,215 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDetectJWTAbuse(t *testing.T) {
+	loadTestRSAKeys(t)
+	t.Setenv("JWT_ABUSE_THRESHOLD", "3")
+	t.Setenv("JWT_ABUSE_BLOCK", "true")
+	var audit bytes.Buffer
+	defer func(prev io.Writer) { auditLog.Out = prev }(auditLog.Out)
+	auditLog.Out = &audit
+
+	handler := detectJWTAbuse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/expired":
+			renderJWTError(w, r, fmt.Errorf("%w: token is expired", errJWTExpired))
+		case "/forged":
+			renderJWTError(w, r, fmt.Errorf("%w: bad signature", errJWTSignatureInvalid))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	// Sessions are counted by the token the request sent
+	tokens := map[string]string{}
+	request := func(ip, session, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = ip + ":40000"
+		if _, ok := tokens[session]; !ok {
+			token, err := generateJWT(session, defaultCurrency, defaultClaimsProfile)
+			if err != nil {
+				t.Fatalf("generateJWT() error = %v", err)
+			}
+			tokens[session] = token
+		}
+		r.AddCookie(&http.Cookie{Name: cookieJWT, Value: tokens[session]})
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeySessionID{}, session))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Expired tokens are routine
+	for i := 0; i < 5; i++ {
+		request("10.1.0.1", "s-expired", "/expired")
+	}
+	if w := request("10.1.0.1", "s-expired", "/"); w.Code != http.StatusNoContent {
+		t.Fatalf("after expired tokens: status %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	before := expvarInt(jwtInvalidAttempts, "signature_invalid")
+	for i := 0; i < 3; i++ {
+		request("10.1.0.2", "s-forger", "/forged")
+	}
+	if got := expvarInt(jwtInvalidAttempts, "signature_invalid"); got != before+3 {
+		t.Errorf("jwt_invalid_attempts[signature_invalid] = %d, want %d", got, before+3)
+	}
+	w := request("10.1.0.2", "s-other", "/")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("flagged IP: status %d, Retry-After %q; want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := request("10.1.0.3", "s-forger", "/"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("flagged session from another IP: status %d, want 429", w.Code)
+	}
+	if w := request("10.1.0.3", "s-fresh", "/"); w.Code != http.StatusNoContent {
+		t.Errorf("unflagged source: status %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	// A session cookie without a token signed for it is not a source
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/forged", nil)
+		r.RemoteAddr = "10.1.0.4:40000"
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeySessionID{}, "s-cookie-only"))
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	events := map[string]bool{}
+	dec := json.NewDecoder(&audit)
+	for dec.More() {
+		var event map[string]interface{}
+		if err := dec.Decode(&event); err != nil {
+			t.Fatalf("audit log: %v", err)
+		}
+		if event["event"] != "jwt_abuse_flagged" || event["reason"] != "signature_invalid" || event["blocked"] != true {
+			t.Errorf("audit event = %v", event)
+		}
+		events[event["source"].(string)] = true
+	}
+	forger, err := validateJWT(tokens["s-forger"])
+	if err != nil {
+		t.Fatalf("validateJWT() error = %v", err)
+	}
+	if !events["ip:10.1.0.2"] || !events["session:"+forger.SessionID] || !events["ip:10.1.0.4"] || len(events) != 3 {
+		t.Errorf("audited sources = %v, want ip:10.1.0.2, session:%s and ip:10.1.0.4", events, forger.SessionID)
+	}
+}
+
+func TestJWTAbuseClientIP(t *testing.T) {
+	t.Setenv("JWT_ABUSE_THRESHOLD", "3")
+	t.Setenv("JWT_ABUSE_TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.1")
+	d := loadJWTAbuseDetector()
+	for _, tc := range []struct {
+		peer, forwarded, want string
+	}{
+		{"203.0.113.5", "198.51.100.7", "203.0.113.5"},
+		{"10.0.0.1", "", "10.0.0.1"},
+		{"10.0.0.1", "198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		{"192.168.1.1", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{"10.0.0.1", "not-an-ip", "10.0.0.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.peer + ":40000"
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := d.clientIP(r); got != tc.want {
+			t.Errorf("clientIP() from %s forwarding %q = %s, want %s", tc.peer, tc.forwarded, got, tc.want)
+		}
+	}
+}
+
+func TestJWTAbuseDetectorCooldown(t *testing.T) {
+	clock := &fakeClock{now: time.Now().Truncate(time.Second)}
+	defer func(prev Clock) { jwtClock = prev }(jwtClock)
+	jwtClock = clock
+	defer func(prev io.Writer) { auditLog.Out = prev }(auditLog.Out)
+	auditLog.Out = io.Discard
+
+	d := newJWTAbuseDetector(2, time.Minute, 5*time.Minute)
+	d.block = true
+	sources := []string{"ip:10.1.1.1"}
+	d.failure(sources[0], "malformed", "/")
+	clock.now = clock.now.Add(2 * time.Minute)
+	d.failure(sources[0], "malformed", "/")
+	if _, ok := d.refused(sources); ok {
+		t.Error("failures further apart than the window flagged the source")
+	}
+	d.failure(sources[0], "malformed", "/")
+	if retry, ok := d.refused(sources); !ok || retry != 5*time.Minute {
+		t.Errorf("refused() = %v, %v; want 5m, true", retry, ok)
+	}
+	if got := d.flaggedSources(); got != 1 {
+		t.Errorf("flaggedSources() = %d, want 1", got)
+	}
+	clock.now = clock.now.Add(5*time.Minute + time.Second)
+	if _, ok := d.refused(sources); ok {
+		t.Error("source still refused after the cooldown")
+	}
+}
+
+func TestJWTAbuseDetectorPruneAndCap(t *testing.T) {
+	clock := &fakeClock{now: time.Now().Truncate(time.Second)}
+	defer func(prev Clock) { jwtClock = prev }(jwtClock)
+	jwtClock = clock
+	start := clock.now
+	at := func(d time.Duration, source string, det *jwtAbuseDetector) {
+		clock.now = start.Add(d)
+		det.failure(source, "malformed", "/")
+	}
+	tracked := func(det *jwtAbuseDetector, source string) bool {
+		_, ok := det.sources[source]
+		return ok
+	}
+
+	d := newJWTAbuseDetector(10, time.Minute, 5*time.Minute)
+	d.maxSources = 2
+	at(0, "ip:10.0.0.1", d)
+	at(0, "ip:10.0.0.2", d)
+	at(0, "ip:10.0.0.3", d)
+	if tracked(d, "ip:10.0.0.3") || len(d.sources) != 2 {
+		t.Errorf("tracking %d sources past maxSources 2", len(d.sources))
+	}
+	// Once their window is over, sources make room for new ones
+	at(2*time.Minute, "ip:10.0.0.3", d)
+	if !tracked(d, "ip:10.0.0.3") || tracked(d, "ip:10.0.0.1") {
+		t.Errorf("after the window, tracking %v, want only the new source", d.sources)
+	}
+
+	// The sources are swept at most once per window
+	d = newJWTAbuseDetector(10, time.Minute, 5*time.Minute)
+	at(0, "ip:10.0.0.1", d) // swept
+	at(30*time.Second, "ip:10.0.0.2", d)
+	at(70*time.Second, "ip:10.0.0.3", d)  // swept, 10.0.0.2 still in its window
+	at(100*time.Second, "ip:10.0.0.4", d) // 10.0.0.2's window is over
+	if tracked(d, "ip:10.0.0.1") || !tracked(d, "ip:10.0.0.2") {
+		t.Errorf("sources %v, want 10.0.0.1 swept and 10.0.0.2 kept until the next sweep", d.sources)
+	}
+	at(131*time.Second, "ip:10.0.0.5", d)
+	if tracked(d, "ip:10.0.0.2") {
+		t.Error("10.0.0.2 kept after the next sweep")
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	// jwtAcceptedIssuers and jwtAcceptedAudiences are the iss and aud
+	// values validateJWT accepts, set by loadJWTAllowlists once the keys
+	// and tenants are loaded
+	jwtAcceptedIssuers   []string
+	jwtAcceptedAudiences = []string{jwtAudience}
+)
+
+// loadJWTAllowlists reads JWT_ACCEPTED_ISSUERS, by default the default
+// issuer and every tenant's, and JWT_ACCEPTED_AUDIENCES, by default
+// jwtAudience, both comma-separated. Narrowing the issuers lets a
+// multi-tenant deployment keep signing keys for markets whose tokens it no
+// longer takes. An accepted issuer needs a key its tokens are verified
+// with.
+func loadJWTAllowlists() error {
+	issuers := splitList(os.Getenv("JWT_ACCEPTED_ISSUERS"))
+	if len(issuers) == 0 {
+		issuers = append(issuers, jwtIssuer)
+		for issuer := range jwtTenantsByIssuer {
+			issuers = append(issuers, issuer)
+		}
+	}
+	for _, issuer := range issuers {
+		if _, err := verificationKeyFor(issuer); err != nil {
+			return fmt.Errorf("JWT_ACCEPTED_ISSUERS: no key for issuer %q", issuer)
+		}
+	}
+	audiences := splitList(os.Getenv("JWT_ACCEPTED_AUDIENCES"))
+	if len(audiences) == 0 {
+		audiences = []string{jwtAudience}
+	}
+	jwtAcceptedIssuers, jwtAcceptedAudiences = issuers, audiences
+	return nil
+}
+
+// jwtAllowlistOptions are the parser options validateJWT enforces the
+// allowlists with. A token needs one of the accepted audiences. A single
+// accepted issuer is checked by the parser; several by checkJWTIssuer.
+func jwtAllowlistOptions() []jwt.ParserOption {
+	opts := []jwt.ParserOption{jwt.WithAudience(jwtAcceptedAudiences...)}
+	if len(jwtAcceptedIssuers) == 1 {
+		opts = append(opts, jwt.WithIssuer(jwtAcceptedIssuers[0]))
+	}
+	return opts
+}
+
+// checkJWTIssuer returns errJWTIssuerMismatch unless issuer is accepted
+func checkJWTIssuer(issuer string) error {
+	if len(jwtAcceptedIssuers) == 0 {
+		return nil
+	}
+	for _, accepted := range jwtAcceptedIssuers {
+		if issuer == accepted {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: issuer %q is not accepted", errJWTIssuerMismatch, issuer)
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// With JWT_AUTOGEN_KEYS=true the frontend generates its key pair in memory
+// at startup instead of reading jwt_private_key.pem and jwt_public_key.pem,
+// so it runs locally without key files. The public key is logged as PEM
+// and as a JWKS. With JWT_AUTOGEN_KEYS_DIR set, it is also written there
+// as jwt_public_key.pem and jwks.json, so services mounting the same
+// volume verify with JWT_PUBLIC_KEY_PATH pointing into it. The private key
+// never leaves the process: tokens do not survive a restart, and the pair
+// is only meant for development. Tokens are RS256 throughout, so the pair
+// is RSA.
+
+const (
+	autogenKeyBits      = 2048
+	autogenPublicKeyPEM = "jwt_public_key.pem"
+	autogenJWKS         = "jwks.json"
+)
+
+// IsJWTAutogenKeysEnabled checks if the key pair is generated at startup
+func IsJWTAutogenKeysEnabled() bool {
+	return os.Getenv("JWT_AUTOGEN_KEYS") == "true"
+}
+
+var (
+	autogenKeysOnce sync.Once
+	autogenKey      *rsa.PrivateKey
+	autogenKeysErr  error
+)
+
+// loadAutogenRSAKeys makes a pair generated on the first call the signing
+// pair, so readiness retries keep the same pair
+func loadAutogenRSAKeys() error {
+	autogenKeysOnce.Do(func() {
+		autogenKey, autogenKeysErr = rsa.GenerateKey(rand.Reader, autogenKeyBits)
+		if autogenKeysErr != nil {
+			autogenKeysErr = fmt.Errorf("failed to generate key pair: %w", autogenKeysErr)
+			return
+		}
+		autogenKeysErr = publishAutogenPublicKey(&autogenKey.PublicKey)
+	})
+	if autogenKeysErr != nil {
+		return autogenKeysErr
+	}
+	setRSAKeys(autogenKey, &autogenKey.PublicKey, newKeyVersion("", &autogenKey.PublicKey))
+	return nil
+}
+
+// publishAutogenPublicKey logs key, and writes it to JWT_AUTOGEN_KEYS_DIR
+// if set
+func publishAutogenPublicKey(key *rsa.PublicKey) error {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return err
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []rsaJWK{newRSAJWK(key)}})
+	if err != nil {
+		return err
+	}
+	log.WithField("jwks", string(jwks)).Warnf("JWT_AUTOGEN_KEYS: signing with an ephemeral key pair, public key:\n%s", pemData)
+
+	dir := os.Getenv("JWT_AUTOGEN_KEYS_DIR")
+	if dir == "" {
+		return nil
+	}
+	if err := writeFileAtomic(filepath.Join(dir, autogenPublicKeyPEM), pemData); err != nil {
+		return fmt.Errorf("failed to write public key: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, autogenJWKS), append(jwks, '\n')); err != nil {
+		return fmt.Errorf("failed to write JWKS: %w", err)
+	}
+	log.Infof("wrote the public key to %s", dir)
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file renamed over path, so
+// services polling the shared volume never read half a key
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// rsaJWK is an RSA signing key as a JSON Web Key (RFC 7517)
+type rsaJWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// newRSAJWK returns key as a JWK, with its RFC 7638 thumbprint as kid
+func newRSAJWK(key *rsa.PublicKey) rsaJWK {
+	n := base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+	e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	thumbprint := sha256.Sum256([]byte(`{"e":"` + e + `","kty":"RSA","n":"` + n + `"}`))
+	return rsaJWK{Kty: "RSA", Use: "sig", Alg: "RS256", Kid: base64.RawURLEncoding.EncodeToString(thumbprint[:]), N: n, E: e}
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TestJWTNotBeforePredate issues nbf JWT_NBF_PREDATE before iat and
+// rejects tokens presented before their nbf
+func TestJWTAutogenKeys(t *testing.T) {
+	// Cleanups run last first: the key files are loaded back once the
+	// environment is restored
+	t.Cleanup(func() {
+		autogenKeysOnce = sync.Once{}
+		if err := loadRSAKeys(); err != nil {
+			t.Errorf("loadRSAKeys() error = %v", err)
+		}
+	})
+	dir := t.TempDir()
+	t.Setenv("JWT_AUTOGEN_KEYS", "true")
+	t.Setenv("JWT_AUTOGEN_KEYS_DIR", dir)
+	autogenKeysOnce = sync.Once{}
+
+	loadTestRSAKeys(t)
+	generated := privateKey
+	fileKey, err := jwt.ParseRSAPrivateKeyFromPEM(mustReadFile(t, "jwt_private_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generated.Equal(fileKey) {
+		t.Fatal("JWT_AUTOGEN_KEYS=true loaded jwt_private_key.pem")
+	}
+	// Readiness retries load the keys again, which must keep the pair
+	if err := loadRSAKeys(); err != nil || privateKey != generated {
+		t.Fatalf("second loadRSAKeys() = %v, replaced the key pair: %v", err, privateKey != generated)
+	}
+	token, err := generateJWT("autogen-session", "USD", claimsProfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateJWT(token); err != nil {
+		t.Fatalf("validateJWT() error = %v", err)
+	}
+
+	// Services sharing the volume verify with the written key
+	written, err := jwt.ParseRSAPublicKeyFromPEM(mustReadFile(t, filepath.Join(dir, autogenPublicKeyPEM)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwt.Parse(token, func(*jwt.Token) (interface{}, error) { return written, nil }); err != nil {
+		t.Errorf("token does not verify with %s: %v", autogenPublicKeyPEM, err)
+	}
+	var jwks struct {
+		Keys []rsaJWK `json:"keys"`
+	}
+	if err := json.Unmarshal(mustReadFile(t, filepath.Join(dir, autogenJWKS)), &jwks); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 1 || jwks.Keys[0] != newRSAJWK(&generated.PublicKey) {
+		t.Fatalf("%s = %+v", autogenJWKS, jwks)
+	}
+	n, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[0].N)
+	if new(big.Int).SetBytes(n).Cmp(generated.N) != 0 || jwks.Keys[0].E != "AQAB" {
+		t.Errorf("JWK does not hold the generated key: %+v", jwks.Keys[0])
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// defaultJWTBypassPaths serve the same response to everyone, so minting
+// and verifying a token for them is wasted RSA work
+var defaultJWTBypassPaths = []string{"/static/", "/robots.txt", "/_healthz", "/_readyz"}
+
+// jwtBypassedRequests counts requests served without a session or JWT
+var jwtBypassedRequests = expvar.NewInt("jwt_bypassed_requests")
+
+// loadJWTBypassPaths reads JWT_BYPASS_PATHS, a comma-separated list of
+// paths below BASE_URL. Paths ending in "/" match everything below them.
+// An empty value bypasses nothing.
+func loadJWTBypassPaths() []string {
+	paths := append([]string(nil), defaultJWTBypassPaths...)
+	if v, ok := os.LookupEnv("JWT_BYPASS_PATHS"); ok {
+		paths = nil
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				paths = append(paths, p)
+			}
+		}
+	}
+	for i, p := range paths {
+		paths[i] = baseUrl + p
+	}
+	return paths
+}
+
+// bypassJWT sends requests for the bypass paths straight to bypass, which
+// is next without the session, JWT and rate limiting middleware. Signed
+// URLs always go there: their token is checked by requireSignedURL.
+func bypassJWT(next, bypass http.Handler) http.Handler {
+	paths := loadJWTBypassPaths()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if matchPathList(paths, r.URL.Path) || isSignedURLPath(r.URL.Path) {
+			jwtBypassedRequests.Add(1)
+			bypass.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func matchPathList(paths []string, path string) bool {
+	for _, p := range paths {
+		if path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
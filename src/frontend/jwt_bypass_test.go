@@ -0,0 +1,59 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBypassPathsSkipSessionAndJWT(t *testing.T) {
+	useRSAKeys(t)
+
+	var sawJWT bool
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, sawJWT = getJWTFromContext(r.Context())
+	})
+	get := func(handler http.Handler, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	handler := bypassJWT(ensureSessionID(ensureJWT(inner)), inner)
+	for path, bypassed := range map[string]bool{
+		"/static/styles/styles.css": true,
+		"/robots.txt":               true,
+		"/_healthz":                 true,
+		"/":                         false,
+		"/static":                   false,
+		"/robots.txt/x":             false,
+	} {
+		w := get(handler, path)
+		if sawJWT == bypassed || (len(w.Result().Cookies()) == 0) != bypassed {
+			t.Errorf("%s: JWT %v, cookies %v, want bypassed = %v", path, sawJWT, w.Result().Cookies(), bypassed)
+		}
+	}
+
+	t.Setenv("JWT_BYPASS_PATHS", "/assets/, /favicon.ico")
+	handler = bypassJWT(ensureSessionID(ensureJWT(inner)), inner)
+	if get(handler, "/assets/app.js"); sawJWT {
+		t.Error("/assets/app.js got a JWT with JWT_BYPASS_PATHS=/assets/")
+	}
+	if get(handler, "/static/styles/styles.css"); !sawJWT {
+		t.Error("/static/ is still bypassed after JWT_BYPASS_PATHS replaced the defaults")
+	}
+}
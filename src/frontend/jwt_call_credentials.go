@@ -0,0 +1,74 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+
+	"google.golang.org/grpc/credentials"
+)
+
+type ctxKeyCallJWT struct{}
+
+// callJWT is the token the client interceptors chose for a call, left in
+// the call's context for jwtCallCredentials
+type callJWT struct {
+	method string
+	token  string
+}
+
+// IsJWTCallCredentialsEnabled reports whether the JWT is sent by gRPC
+// per-RPC credentials rather than written into the outgoing metadata by
+// the client interceptors (JWT_CALL_CREDENTIALS=true)
+func IsJWTCallCredentialsEnabled() bool {
+	return os.Getenv("JWT_CALL_CREDENTIALS") == "true"
+}
+
+// withCallJWT leaves tokenStr in ctx for the credentials of the call
+func withCallJWT(ctx context.Context, method, tokenStr string) context.Context {
+	return context.WithValue(ctx, ctxKeyCallJWT{}, callJWT{method: method, token: tokenStr})
+}
+
+// jwtCallCredentials sends the JWT the client interceptors chose for each
+// call, full or split with the configured codec exactly as attachJWT
+// would write it. The interceptors still decide whether a call carries a
+// JWT and which, and refresh it on expiry; gRPC asks the credentials for
+// the headers of every attempt. Calls without a token in their context get
+// none.
+type jwtCallCredentials struct {
+	target string
+	// requireTLS refuses to send the JWT over a plaintext connection
+	requireTLS bool
+}
+
+// newJWTCallCredentials returns the credentials of the connection to
+// target. They require transport security when target is dialed with mTLS,
+// so a misconfigured dial fails instead of leaking tokens in plaintext.
+func newJWTCallCredentials(target string) credentials.PerRPCCredentials {
+	return &jwtCallCredentials{target: target, requireTLS: spiffeMTLS.secures(target)}
+}
+
+func (c *jwtCallCredentials) GetRequestMetadata(ctx context.Context, _ ...string) (map[string]string, error) {
+	call, ok := ctx.Value(ctxKeyCallJWT{}).(callJWT)
+	if !ok {
+		return nil, nil
+	}
+	md := mapCarrier{}
+	writeJWT(ctx, md, call.method, c.target, call.token)
+	return md, nil
+}
+
+func (c *jwtCallCredentials) RequireTransportSecurity() bool { return c.requireTLS }
@@ -0,0 +1,131 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// JWTCarrier is where the JWT headers a codec produces are written and read
+// back, so the same codec serves gRPC calls, the REST gateway and WebSocket
+// upgrades. Keys are lowercase, as in gRPC metadata, and values are raw:
+// carriers that cannot hold binary values encode -bin keys themselves.
+type JWTCarrier interface {
+	// Get returns the first value of key, or "" when it is absent
+	Get(key string) string
+	// Set replaces every value of key, so a token written twice into the
+	// same carrier, as on a retried call, is still sent once
+	Set(key, value string)
+	// Keys lists the keys present
+	Keys() []string
+}
+
+// metadataCarrier carries the JWT in gRPC metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string { return firstMD(metadata.MD(c), key) }
+
+func (c metadataCarrier) Set(key, value string) { metadata.MD(c).Set(key, value) }
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// headerCarrier carries the JWT in HTTP headers. Values of -bin keys are
+// base64 on the wire, as gRPC sends them, since HTTP headers are text.
+type headerCarrier http.Header
+
+func (c headerCarrier) Get(key string) string {
+	v := http.Header(c).Get(key)
+	if v == "" || !strings.HasSuffix(strings.ToLower(key), "-bin") {
+		return v
+	}
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(v, "="))
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func (c headerCarrier) Set(key, value string) {
+	if strings.HasSuffix(strings.ToLower(key), "-bin") {
+		value = base64.RawStdEncoding.EncodeToString([]byte(value))
+	}
+	http.Header(c).Set(key, value)
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, strings.ToLower(k))
+	}
+	return keys
+}
+
+// mapCarrier carries the JWT in the map gRPC per-RPC credentials return,
+// which gRPC sends as metadata, encoding -bin values itself
+type mapCarrier map[string]string
+
+func (c mapCarrier) Get(key string) string { return c[key] }
+
+func (c mapCarrier) Set(key, value string) { c[strings.ToLower(key)] = value }
+
+func (c mapCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// setJWTPairs writes a codec's key/value pairs into c
+func setJWTPairs(c JWTCarrier, pairs []string) {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		c.Set(pairs[i], pairs[i+1])
+	}
+}
+
+// InjectJWT writes tokenStr into c with the configured codec
+func InjectJWT(c JWTCarrier, tokenStr string) error {
+	pairs, err := jwtCodec.Encode(tokenStr)
+	if err != nil {
+		return err
+	}
+	setJWTPairs(c, pairs)
+	return nil
+}
+
+// ExtractJWT reassembles the token carried by c with whichever codec it was
+// written in. It returns nil, nil when c carries no split JWT.
+func ExtractJWT(c JWTCarrier) (*DecodedJWT, error) {
+	md := metadata.MD{}
+	for _, k := range c.Keys() {
+		v := c.Get(k)
+		if v == "" && strings.HasSuffix(k, "-bin") {
+			return nil, fmt.Errorf("%s is not base64", k)
+		}
+		md.Set(k, v)
+	}
+	return DecodeJWTMetadata(md)
+}
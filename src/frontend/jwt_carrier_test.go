@@ -0,0 +1,80 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestJWTCarriers(t *testing.T) {
+	loadTestRSAKeys(t)
+	token, err := generateJWTFromClaims(jwtGoldenClaims())
+	if err != nil {
+		t.Fatalf("generateJWTFromClaims() error = %v", err)
+	}
+
+	for name, c := range map[string]JWTCarrier{
+		"metadata":    metadataCarrier(metadata.MD{}),
+		"http.Header": headerCarrier(http.Header{}),
+	} {
+		if err := InjectJWT(c, token); err != nil {
+			t.Fatalf("%s: InjectJWT() error = %v", name, err)
+		}
+		decoded, err := ExtractJWT(c)
+		if err != nil || decoded == nil {
+			t.Fatalf("%s: ExtractJWT() = %v, %v", name, decoded, err)
+		}
+		if got, want := mustClaimsHash(t, decoded.Token), mustClaimsHash(t, token); got != want {
+			t.Errorf("%s: ExtractJWT() claims hash = %s, want %s", name, got, want)
+		}
+	}
+
+	h := http.Header{}
+	if err := InjectJWT(headerCarrier(h), token); err != nil {
+		t.Fatalf("InjectJWT() error = %v", err)
+	}
+	for k, v := range h {
+		if strings.HasSuffix(strings.ToLower(k), "-bin") && strings.ContainsAny(v[0], "\x00\r\n") {
+			t.Errorf("header %s carries raw binary", k)
+		}
+	}
+
+	// Attaching twice, as a retried call does, still sends each header once
+	ctx := attachJWT(context.Background(), "/hipstershop.CartService/GetCart", "cartservice:7070", token)
+	ctx = attachJWT(ctx, "/hipstershop.CartService/GetCart", "cartservice:7070", token)
+	md, _ := metadata.FromOutgoingContext(ctx)
+	for k, v := range md {
+		if len(v) != 1 {
+			t.Errorf("%s sent %d times, want once", k, len(v))
+		}
+	}
+	if len(md) == 0 {
+		t.Error("attachJWT() sent no metadata")
+	}
+}
+
+func mustClaimsHash(t *testing.T, token string) string {
+	t.Helper()
+	h, err := jwtClaimsHash(token)
+	if err != nil {
+		t.Fatalf("jwtClaimsHash() error = %v", err)
+	}
+	return h
+}
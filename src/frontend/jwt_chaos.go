@@ -0,0 +1,191 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JWT chaos faults accepted by JWT_CHAOS_FAULTS
+const (
+	chaosDropHeader        = "drop-header"
+	chaosTruncateSignature = "truncate-signature"
+	chaosSkewExp           = "skew-exp"
+)
+
+// jwtChaos injects faults into outgoing JWT metadata so the downstream
+// interceptors' failure handling, and the metrics that should notice it,
+// can be exercised. It is off unless JWT_CHAOS_RATE is set.
+type jwtChaos struct {
+	rate   float64
+	faults []string
+	skew   time.Duration
+}
+
+var (
+	chaos = loadJWTChaos()
+
+	// jwtChaosInjected counts injected faults, keyed by fault
+	jwtChaosInjected = expvar.NewMap("jwt_chaos_injected")
+)
+
+// loadJWTChaos reads JWT_CHAOS_RATE (fraction of calls, 0 to 1),
+// JWT_CHAOS_FAULTS (comma-separated, default all) and JWT_CHAOS_EXP_SKEW
+// (how far skew-exp moves exp back, default 10m)
+func loadJWTChaos() jwtChaos {
+	c := jwtChaos{
+		faults: []string{chaosDropHeader, chaosTruncateSignature, chaosSkewExp},
+		skew:   durationEnv("JWT_CHAOS_EXP_SKEW", 10*time.Minute),
+	}
+	if v := os.Getenv("JWT_CHAOS_RATE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			log.Warnf("ignoring invalid JWT_CHAOS_RATE=%q", v)
+		} else {
+			c.rate = rate
+		}
+	}
+	if v := os.Getenv("JWT_CHAOS_FAULTS"); v != "" {
+		c.faults = nil
+		for _, f := range strings.Split(v, ",") {
+			switch f = strings.TrimSpace(f); f {
+			case chaosDropHeader, chaosTruncateSignature, chaosSkewExp:
+				c.faults = append(c.faults, f)
+			default:
+				log.Warnf("ignoring unknown JWT chaos fault %q", f)
+			}
+		}
+	}
+	if c.rate > 0 && len(c.faults) > 0 {
+		log.Warnf("JWT chaos enabled: corrupting %.0f%% of outgoing tokens with %v", c.rate*100, c.faults)
+	}
+	return c
+}
+
+// inject corrupts pairs with one randomly chosen fault at the configured
+// rate. Faults that don't apply to the pairs (skewing a reference token)
+// leave them unchanged.
+func (c jwtChaos) inject(method string, pairs []string) []string {
+	if c.rate == 0 || len(c.faults) == 0 || rand.Float64() >= c.rate {
+		return pairs
+	}
+	fault := c.faults[rand.Intn(len(c.faults))]
+	corrupted := append([]string(nil), pairs...)
+	var ok bool
+	switch fault {
+	case chaosDropHeader:
+		corrupted, ok = chaosDrop(corrupted)
+	case chaosTruncateSignature:
+		ok = chaosTruncate(corrupted)
+	case chaosSkewExp:
+		ok = chaosSkew(corrupted, c.skew)
+	}
+	if !ok {
+		return pairs
+	}
+	jwtChaosInjected.Add(fault, 1)
+	log.Infof("[JWT-CHAOS] Frontend → %s: injected %s", method, fault)
+	return corrupted
+}
+
+// chaosDrop removes one JWT header. With a single header (the full or
+// reference token) that means sending no token at all.
+func chaosDrop(pairs []string) ([]string, bool) {
+	var idx []int
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i] == "authorization" || strings.HasPrefix(pairs[i], jwtHeaders.Prefix) {
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) == 0 {
+		return pairs, false
+	}
+	i := idx[rand.Intn(len(idx))]
+	return append(pairs[:i], pairs[i+2:]...), true
+}
+
+// chaosTruncate cuts the signature in half, or its second part when split
+func chaosTruncate(pairs []string) bool {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		switch {
+		case pairs[i] == jwtHeaders.Signature, pairs[i] == jwtHeaders.SignaturePart(2):
+			pairs[i+1] = pairs[i+1][:len(pairs[i+1])/2]
+			return true
+		case pairs[i] == "authorization":
+			token := pairs[i+1]
+			if dot := strings.LastIndexByte(token, '.'); dot >= 0 {
+				token = token[:dot+1+(len(token)-dot-1)/2]
+			} else {
+				token = token[:len(token)/2]
+			}
+			pairs[i+1] = token
+			return true
+		}
+	}
+	return false
+}
+
+// chaosSkew moves exp back by skew wherever it is carried, leaving the
+// signature as it was
+func chaosSkew(pairs []string, skew time.Duration) bool {
+	skewExp := func(claims map[string]interface{}) bool {
+		exp, ok := claims["exp"].(float64)
+		if ok {
+			claims["exp"] = int64(exp) - int64(skew/time.Second)
+		}
+		return ok
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		switch {
+		case pairs[i] == jwtHeaders.Dynamic:
+			var dynamic map[string]interface{}
+			if json.Unmarshal([]byte(pairs[i+1]), &dynamic) != nil || !skewExp(dynamic) {
+				return false
+			}
+			b, _ := json.Marshal(dynamic)
+			pairs[i+1] = string(b)
+			return true
+		case pairs[i] == jwtHeaders.Prefix+"claim-exp-bin":
+			exp, err := strconv.ParseInt(pairs[i+1], 10, 64)
+			if err != nil {
+				return false
+			}
+			pairs[i+1] = strconv.FormatInt(exp-int64(skew/time.Second), 10)
+			return true
+		case pairs[i] == "authorization":
+			parts := strings.Split(strings.TrimPrefix(pairs[i+1], "Bearer "), ".")
+			if len(parts) != 3 {
+				return false
+			}
+			var payload map[string]interface{}
+			raw, err := base64.RawURLEncoding.DecodeString(parts[1])
+			if err != nil || json.Unmarshal(raw, &payload) != nil || !skewExp(payload) {
+				return false
+			}
+			b, _ := json.Marshal(payload)
+			parts[1] = base64.RawURLEncoding.EncodeToString(b)
+			pairs[i+1] = "Bearer " + strings.Join(parts, ".")
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"expvar"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// jwtClaimHeadersEnvoy emits claims as Envoy's jwt_authn filter does
+	// with claim_to_headers
+	jwtClaimHeadersEnvoy = "envoy"
+	// envoyClaimHeaderPrefix is the header name convention meshes expect
+	// for claims, as in x-jwt-claim-session-id
+	envoyClaimHeaderPrefix = "x-jwt-claim-"
+)
+
+// jwtClaimHeadersSent counts the claim headers sent, and those left out
+// because their value has no header form, keyed "sent" and "skipped"
+var jwtClaimHeadersSent = expvar.NewMap("jwt_claim_headers")
+
+var (
+	jwtClaimHeadersOnce   sync.Once
+	jwtClaimHeaderClaims  []string
+	jwtClaimHeadersActive bool
+)
+
+// loadJWTClaimHeaders reads JWT_CLAIM_HEADERS, the claim header mode
+// ("envoy" or empty for none), and JWT_CLAIM_HEADER_CLAIMS, the claims to
+// send, by default the static and session ones. The per-claim codec under
+// the x-jwt- prefix uses the same header names, so the two exclude each
+// other. Under that prefix receivers would also take the claim headers
+// for components, so they are not sent with the meta header, component
+// MAC or detached JWS, which count and cover every component.
+func loadJWTClaimHeaders() (claims []string, active bool) {
+	switch v := os.Getenv("JWT_CLAIM_HEADERS"); v {
+	case "":
+		return nil, false
+	case jwtClaimHeadersEnvoy:
+	default:
+		log.Warnf("ignoring invalid JWT_CLAIM_HEADERS=%q: want %q", v, jwtClaimHeadersEnvoy)
+		return nil, false
+	}
+	if jwtCodec.Name() == jwtCodecPerClaim && (perClaimCodec{scheme: jwtHeaders}).claimPrefix() == envoyClaimHeaderPrefix {
+		log.Warnf("JWT_CLAIM_HEADERS=%s conflicts with the per-claim codec's %s headers; not sending claim headers", jwtClaimHeadersEnvoy, envoyClaimHeaderPrefix)
+		return nil, false
+	}
+	if strings.HasPrefix(envoyClaimHeaderPrefix, jwtHeaders.Prefix) && (IsJWTMetaEnabled() || IsComponentMACEnabled() || IsDetachedSignatureEnabled()) {
+		log.Warnf("JWT_CLAIM_HEADERS=%s would break the meta header, component MAC and detached JWS, which cover every %s header; not sending claim headers", jwtClaimHeadersEnvoy, jwtHeaders.Prefix)
+		return nil, false
+	}
+	claims = append(append([]string(nil), jwtStaticClaims...), jwtSessionClaims...)
+	if v := os.Getenv("JWT_CLAIM_HEADER_CLAIMS"); v != "" {
+		claims = nil
+		for _, c := range strings.Split(v, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				claims = append(claims, c)
+			}
+		}
+	}
+	return claims, true
+}
+
+// envoyClaimHeaders returns the claims of tokenStr as x-jwt-claim-<name>
+// pairs, sent alongside the token in whatever mode it travels and not
+// counted against JWT_HEADER_BUDGET. Underscores in claim names become
+// hyphens. Strings are sent as they are, numbers and booleans in their JSON
+// form and lists of strings joined with commas, as Envoy does; objects and
+// values that are not printable ASCII are left out.
+func envoyClaimHeaders(tokenStr string) []string {
+	jwtClaimHeadersOnce.Do(func() { jwtClaimHeaderClaims, jwtClaimHeadersActive = loadJWTClaimHeaders() })
+	if !jwtClaimHeadersActive || strings.HasPrefix(tokenStr, opaqueTokenPrefix) {
+		return nil
+	}
+	_, payload, _, err := parseJWT(tokenStr)
+	if err != nil {
+		return nil
+	}
+	var pairs []string
+	for _, name := range jwtClaimHeaderClaims {
+		v, ok := payload[name]
+		if !ok {
+			continue
+		}
+		value, ok := envoyClaimValue(v)
+		if !ok {
+			jwtClaimHeadersSent.Add("skipped", 1)
+			continue
+		}
+		pairs = append(pairs, envoyClaimHeaderPrefix+strings.ReplaceAll(strings.ToLower(name), "_", "-"), value)
+		jwtClaimHeadersSent.Add("sent", 1)
+	}
+	return pairs
+}
+
+func envoyClaimValue(v interface{}) (string, bool) {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		s = strconv.FormatBool(v)
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, e := range v {
+			str, ok := e.(string)
+			if !ok {
+				return "", false
+			}
+			parts = append(parts, str)
+		}
+		s = strings.Join(parts, ",")
+	default:
+		return "", false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return "", false
+		}
+	}
+	return s, s != ""
+}
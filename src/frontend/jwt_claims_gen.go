@@ -0,0 +1,106 @@
+// Code generated by claimsgen from jwt_claims.yaml. DO NOT EDIT.
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtAudience is the aud of the user tokens the frontend issues
+const jwtAudience = "urn:hipstershop:api"
+
+// Known header prefixes for decomposed JWTs
+const (
+	jwtHeaderPrefixDefault = "x-jwt-"
+	jwtHeaderPrefixAuth    = "auth-jwt-"
+)
+
+// defaultJWTHeaderFields are the component names appended to the prefix.
+// Dynamic and signature use -bin so they bypass HPACK indexing.
+var defaultJWTHeaderFields = [4]string{"static", "session", "dynamic-bin", "sig-bin"}
+
+// jwtStaticClaims are the payload claims that are the same in every token;
+// the header's alg and typ travel with them
+var jwtStaticClaims = []string{"iss", "aud"}
+
+// jwtSessionClaims are the claims that stay the same for a session
+var jwtSessionClaims = []string{"sub", "session_id", "name", "market_id", "profile_ref", "currency", "cart_id", "loyalty_tier", "act", "fph"}
+
+// jwtDynamicClaims are the claims that change on every token renewal and are
+// therefore sent in headers excluded from HPACK indexing
+var jwtDynamicClaims = []string{"exp", "iat", "nbf", "jti", "random_value"}
+
+// jwtActor is the RFC 8693 act claim: who is acting for the subject
+type jwtActor struct {
+	Subject string `json:"sub"`
+}
+
+// jwtClaimRule is a claim of the schema, as validateJWTClaims checks it
+type jwtClaimRule struct {
+	Name     string
+	Type     string
+	Required bool
+}
+
+// jwtClaimRules are the claims of the schema. Type is string, numericdate
+// (seconds since the epoch), audience (a string or a list of strings) or
+// actor (an object with a sub).
+var jwtClaimRules = []jwtClaimRule{
+	{"iss", "string", true},
+	{"aud", "audience", true},
+	{"sub", "string", true},
+	{"exp", "numericdate", true},
+	{"iat", "numericdate", true},
+	{"nbf", "numericdate", false},
+	{"jti", "string", true},
+	{"session_id", "string", true},
+	{"name", "string", false},
+	{"market_id", "string", false},
+	{"profile_ref", "string", false},
+	{"currency", "string", false},
+	{"cart_id", "string", false},
+	{"loyalty_tier", "string", false},
+	{"act", "actor", false},
+	{"fph", "string", false},
+	{"random_value", "string", false},
+}
+
+// jwtClaimSet holds every claim in the schema, for reading tokens without
+// the JWT library. Decode only what you need into it with
+// jwtSegments.DecodePayload.
+type jwtClaimSet struct {
+	Issuer          string          `json:"iss"`
+	Audience        json.RawMessage `json:"aud"`
+	Subject         string          `json:"sub"`
+	ExpiresAt       *float64        `json:"exp"`
+	IssuedAt        *float64        `json:"iat"`
+	NotBefore       *float64        `json:"nbf,omitempty"`
+	ID              string          `json:"jti"`
+	SessionID       string          `json:"session_id"`
+	Name            string          `json:"name,omitempty"`
+	MarketID        string          `json:"market_id,omitempty"`
+	ProfileRef      string          `json:"profile_ref,omitempty"`
+	Currency        string          `json:"currency"`
+	CartID          string          `json:"cart_id"`
+	LoyaltyTier     string          `json:"loyalty_tier,omitempty"`
+	Actor           *jwtActor       `json:"act,omitempty"`
+	FingerprintHash string          `json:"fph,omitempty"`
+	RandomValue     string          `json:"random_value,omitempty"`
+}
+
+// JWTClaims are the claims the frontend issues
+type JWTClaims struct {
+	SessionID       string    `json:"session_id"`
+	Name            string    `json:"name,omitempty"`
+	MarketID        string    `json:"market_id,omitempty"`
+	ProfileRef      string    `json:"profile_ref,omitempty"` // Reference to the profile, sent in place of name and market_id with JWT_INCLUDE_PII=false
+	Currency        string    `json:"currency"`
+	CartID          string    `json:"cart_id"`
+	LoyaltyTier     string    `json:"loyalty_tier,omitempty"`
+	Actor           *jwtActor `json:"act,omitempty"`          // SPIFFE ID of the service a token was exchanged for
+	FingerprintHash string    `json:"fph,omitempty"`          // Hash of the User-Agent and Accept-Language the token was issued to
+	RandomValue     string    `json:"random_value,omitempty"` // Added random value to ensure uniqueness, left out in the realistic token shape
+	jwt.RegisteredClaims
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when told to
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// useFakeClock makes a fakeClock, on a whole second, the jwtClock for the
+// rest of the test
+func useFakeClock(t *testing.T) *fakeClock {
+	t.Helper()
+	clock := &fakeClock{now: time.Now().Truncate(time.Second)}
+	prev := jwtClock
+	jwtClock = clock
+	t.Cleanup(func() { jwtClock = prev })
+	return clock
+}
+
+func TestFakeClockCrossesExpiry(t *testing.T) {
+	useRSAKeys(t)
+	defer func(sliding bool) { jwtSlidingSession = sliding }(jwtSlidingSession)
+	jwtSlidingSession = false
+	clock := useFakeClock(t)
+
+	token, err := generateJWT("clock-session", defaultCurrency, defaultClaimsProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(jwtLifetime - time.Second)
+	if _, err := validateJWT(token); err != nil {
+		t.Fatalf("a second before exp: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+	if _, err := validateJWT(token); !errors.Is(err, errJWTExpired) {
+		t.Fatalf("a second after exp: err = %v, want %v", err, errJWTExpired)
+	}
+
+	// The middleware re-issues the expired token for the same session,
+	// valid from the clock's now
+	var got *JWTClaims
+	handler := ensureSessionID(ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = getJWTFromContext(r.Context())
+	})))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: "clock-session"})
+	r.AddCookie(&http.Cookie{Name: cookieJWT, Value: token})
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if got == nil || got.SessionID != "clock-session" || !got.IssuedAt.Time.Equal(clock.Now()) {
+		t.Fatalf("re-issued claims = %+v, want session clock-session issued at %v", got, clock.Now())
+	}
+
+	// Sliding renewal starts exactly at the last quarter of the lifetime
+	jwtSlidingSession = true
+	clock.Advance(jwtLifetime - jwtLifetime/jwtRenewalFraction)
+	if needsSlidingRenewal(got) {
+		t.Error("renewal due before the last quarter of the lifetime")
+	}
+	clock.Advance(time.Second)
+	if !needsSlidingRenewal(got) {
+		t.Error("renewal not due within the last quarter of the lifetime")
+	}
+}
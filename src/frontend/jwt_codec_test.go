@@ -0,0 +1,36 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestPerClaimCodecRejectsUppercaseClaims(t *testing.T) {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "u1", "tenantID": "t1"}).SignedString([]byte("codec-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Metadata keys are lowercase, so the claim would decode as tenantid
+	if _, err := (perClaimCodec{scheme: jwtHeaders}).Encode(token); err == nil {
+		t.Error("Encode() sent a claim with an uppercase name")
+	}
+	if err := claimInjections.set(injectedClaim{Name: "Tag", Value: "experiment-7"}); err == nil {
+		defer claimInjections.remove("")
+		t.Error("set() accepted a claim with an uppercase name")
+	}
+}
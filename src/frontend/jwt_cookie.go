@@ -0,0 +1,164 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// jwtCookieChunkedPrefix marks a shop_jwt cookie whose value is the
+	// manifest "chunked:<count>:<digest>" rather than the token itself
+	jwtCookieChunkedPrefix = "chunked:"
+
+	// defaultJWTCookieChunkSize keeps each cookie, name and attributes
+	// included, under the 4KB most browsers allow
+	defaultJWTCookieChunkSize = 3800
+
+	// maxJWTCookieChunks bounds how many chunk cookies a request may claim
+	maxJWTCookieChunks = 16
+
+	jwtCookieMaxAge = 120 // 2 minutes (same as JWT expiration) - Load test config
+)
+
+var (
+	jwtCookieChunkSize   = loadJWTCookieChunkSize()
+	jwtCookieChunks      = newHistogram("jwt_cookie_chunks", 1, 2, 3, 4, 8, maxJWTCookieChunks)
+	jwtCookieChunkErrors = expvar.NewInt("jwt_cookie_chunk_errors")
+)
+
+func loadJWTCookieChunkSize() int {
+	if n, err := strconv.Atoi(os.Getenv("JWT_COOKIE_CHUNK_SIZE")); err == nil && n > 0 {
+		return n
+	}
+	return defaultJWTCookieChunkSize
+}
+
+func jwtChunkCookieName(i int) string {
+	return fmt.Sprintf("%s_%d", cookieJWT, i)
+}
+
+// jwtDigest is the integrity check stored in the chunk manifest
+func jwtDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// setJWTCookie stores token in shop_jwt, splitting it across shop_jwt_0..n
+// when it is larger than one cookie can hold. Chunks left over from a
+// previous, larger token are expired. A token needing more than
+// maxJWTCookieChunks chunks could not be read back, so it is refused and
+// no cookie is set.
+func setJWTCookie(w http.ResponseWriter, r *http.Request, token string) error {
+	var chunks []string
+	if len(token) > jwtCookieChunkSize {
+		for rest := token; len(rest) > 0; {
+			n := min(jwtCookieChunkSize, len(rest))
+			chunks = append(chunks, rest[:n])
+			rest = rest[n:]
+		}
+	}
+	if len(chunks) > maxJWTCookieChunks {
+		return fmt.Errorf("token of %d bytes needs %d cookies, more than %d", len(token), len(chunks), maxJWTCookieChunks)
+	}
+
+	value := token
+	if len(chunks) > 0 {
+		value = fmt.Sprintf("%s%d:%s", jwtCookieChunkedPrefix, len(chunks), jwtDigest(token))
+	}
+	http.SetCookie(w, newJWTCookie(cookieJWT, value))
+	for i, chunk := range chunks {
+		http.SetCookie(w, newJWTCookie(jwtChunkCookieName(i), chunk))
+	}
+	clearJWTChunks(w, r, len(chunks))
+	jwtCookieChunks.Observe(int64(max(len(chunks), 1)))
+	return nil
+}
+
+func newJWTCookie(name, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		MaxAge:   jwtCookieLifetime(),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// readJWTCookie returns the token from shop_jwt, reassembling it from its
+// chunks if needed. It returns http.ErrNoCookie when there is no token.
+func readJWTCookie(r *http.Request) (string, error) {
+	c, err := r.Cookie(cookieJWT)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(c.Value, jwtCookieChunkedPrefix) {
+		return c.Value, nil
+	}
+
+	token, err := reassembleJWTCookie(r, strings.TrimPrefix(c.Value, jwtCookieChunkedPrefix))
+	if err != nil {
+		jwtCookieChunkErrors.Add(1)
+		return "", fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+	return token, nil
+}
+
+func reassembleJWTCookie(r *http.Request, manifest string) (string, error) {
+	countStr, digest, ok := strings.Cut(manifest, ":")
+	if !ok {
+		return "", fmt.Errorf("invalid chunk manifest %q", manifest)
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count < 1 || count > maxJWTCookieChunks {
+		return "", fmt.Errorf("invalid chunk count %q", countStr)
+	}
+	var b strings.Builder
+	for i := 0; i < count; i++ {
+		c, err := r.Cookie(jwtChunkCookieName(i))
+		if err != nil {
+			return "", fmt.Errorf("missing chunk %d of %d", i, count)
+		}
+		b.WriteString(c.Value)
+	}
+	token := b.String()
+	if jwtDigest(token) != digest {
+		return "", fmt.Errorf("chunk digest mismatch")
+	}
+	return token, nil
+}
+
+// clearJWTCookie expires shop_jwt and all of its chunks
+func clearJWTCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: cookieJWT, Value: "", MaxAge: -1})
+	clearJWTChunks(w, r, 0)
+}
+
+// clearJWTChunks expires the chunk cookies present on r from index keep on
+func clearJWTChunks(w http.ResponseWriter, r *http.Request, keep int) {
+	for i := keep; i < maxJWTCookieChunks; i++ {
+		if _, err := r.Cookie(jwtChunkCookieName(i)); err != nil {
+			break
+		}
+		http.SetCookie(w, &http.Cookie{Name: jwtChunkCookieName(i), Value: "", MaxAge: -1})
+	}
+}
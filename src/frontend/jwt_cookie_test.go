@@ -0,0 +1,104 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJWTCookieChunking(t *testing.T) {
+	defer func(n int) { jwtCookieChunkSize = n }(jwtCookieChunkSize)
+	jwtCookieChunkSize = 100
+	token := strings.Repeat("a", 150) + strings.Repeat("b", 150) + strings.Repeat("c", 50)
+
+	// set stores token on a request carrying cookies and returns the
+	// cookies of the response
+	set := func(token string, cookies ...*http.Cookie) ([]*http.Cookie, error) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		err := setJWTCookie(w, r, token)
+		return w.Result().Cookies(), err
+	}
+	read := func(cookies []*http.Cookie) (string, error) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, c := range cookies {
+			if c.MaxAge >= 0 {
+				r.AddCookie(c)
+			}
+		}
+		return readJWTCookie(r)
+	}
+
+	small, err := set("small.token")
+	if err != nil || len(small) != 1 || small[0].Value != "small.token" {
+		t.Fatalf("setJWTCookie(small) = %v, %v, want one shop_jwt cookie with the token", small, err)
+	}
+
+	chunked, err := set(token)
+	if err != nil {
+		t.Fatalf("setJWTCookie() error = %v", err)
+	}
+	if len(chunked) != 5 || chunked[0].Value != jwtCookieChunkedPrefix+"4:"+jwtDigest(token) {
+		t.Fatalf("setJWTCookie() set %v, want a manifest and 4 chunks", chunked)
+	}
+	if got, err := read(chunked); err != nil || got != token {
+		t.Errorf("readJWTCookie() = %q, %v, want the token reassembled", got, err)
+	}
+
+	tampered := append([]*http.Cookie(nil), chunked...)
+	tampered[2] = &http.Cookie{Name: tampered[2].Name, Value: strings.Repeat("x", 100)}
+	before := jwtCookieChunkErrors.Value()
+	if _, err := read(tampered); !errors.Is(err, errJWTMalformed) {
+		t.Errorf("readJWTCookie(tampered chunk) error = %v, want %v", err, errJWTMalformed)
+	}
+	if jwtCookieChunkErrors.Value() != before+1 {
+		t.Error("digest mismatch not counted")
+	}
+
+	// A smaller token expires the chunks it no longer needs
+	replaced, err := set(token[:150], chunked...)
+	if err != nil {
+		t.Fatalf("setJWTCookie() error = %v", err)
+	}
+	expired := make(map[string]bool)
+	for _, c := range replaced {
+		if c.MaxAge < 0 {
+			expired[c.Name] = true
+		}
+	}
+	if len(expired) != 2 || !expired[jwtChunkCookieName(2)] || !expired[jwtChunkCookieName(3)] {
+		t.Errorf("replacing with 2 chunks expired %v, want chunks 2 and 3", expired)
+	}
+	if got, err := read(replaced); err != nil || got != token[:150] {
+		t.Errorf("readJWTCookie() after replacing = %q, %v", got, err)
+	}
+	cleared, _ := set("small.token", chunked...)
+	if len(cleared) != 5 {
+		t.Errorf("replacing with one cookie set %v, want shop_jwt and 4 expired chunks", cleared)
+	}
+
+	// A token too large for maxJWTCookieChunks cookies is refused
+	oversized := strings.Repeat("a", jwtCookieChunkSize*maxJWTCookieChunks+1)
+	if cookies, err := set(oversized); err == nil || len(cookies) != 0 {
+		t.Errorf("setJWTCookie(oversized) = %v, %v, want an error and no cookies", cookies, err)
+	}
+}
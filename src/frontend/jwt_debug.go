@@ -0,0 +1,199 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	debugJWTSplitPath       = "/debug/jwt/split"
+	debugJWTReconstructPath = "/debug/jwt/reconstruct"
+
+	// maxDebugJWTBody bounds the request bodies of the debug endpoints
+	maxDebugJWTBody = 1 << 20
+)
+
+// IsJWTDebugEnabled reports whether the JWT debug endpoints are served
+// (ENABLE_JWT_DEBUG=true)
+func IsJWTDebugEnabled() bool {
+	return os.Getenv("ENABLE_JWT_DEBUG") == "true"
+}
+
+// jwtComponentsJSON is JWTComponents as the debug endpoints read and write
+// it
+type jwtComponentsJSON struct {
+	Static    string `json:"static"`
+	Session   string `json:"session"`
+	Dynamic   string `json:"dynamic"`
+	Signature string `json:"signature"`
+}
+
+// jwtDebugSizes is what a token costs in each representation. Header list
+// sizes are as headerListSize counts them, the way proxies and gRPC
+// servers do when enforcing header limits.
+type jwtDebugSizes struct {
+	TokenBytes            int            `json:"token_bytes"`
+	Components            map[string]int `json:"component_sizes"`
+	AuthorizationListSize int            `json:"authorization_header_list_size"`
+	SplitListSize         int            `json:"split_header_list_size"`
+}
+
+// jwtDebugResponse answers both endpoints with every representation
+type jwtDebugResponse struct {
+	Token      string            `json:"token"`
+	Components jwtComponentsJSON `json:"components"`
+	// Headers are the metadata the configured codec sends, with -bin
+	// values base64-encoded as they are on the wire
+	Headers map[string]string `json:"headers"`
+	Codec   string            `json:"codec"`
+	Sizes   jwtDebugSizes     `json:"sizes"`
+}
+
+// registerJWTDebugRoutes serves, with ENABLE_JWT_DEBUG=true, conversions
+// between a token and its split form, to reproduce header limit issues in
+// proxies without writing code:
+//
+//	POST /debug/jwt/split        {"token": "eyJ..."}
+//	POST /debug/jwt/reconstruct  {"components": {"static": "...", ...}}
+//	POST /debug/jwt/reconstruct  {"headers": {"x-jwt-static": "...", ...}}
+//
+// Nothing is verified beyond what decoding the headers checks, so the
+// endpoints must not be exposed beyond operators.
+func registerJWTDebugRoutes(r *mux.Router) {
+	if !IsJWTDebugEnabled() {
+		return
+	}
+	r.HandleFunc(baseUrl+debugJWTSplitPath, debugJWTSplitHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl+debugJWTReconstructPath, debugJWTReconstructHandler).Methods(http.MethodPost)
+}
+
+func debugJWTSplitHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := decodeDebugJWTRequest(w, r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	token := strings.TrimPrefix(strings.TrimSpace(req.Token), "Bearer ")
+	if token == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("token is required"))
+		return
+	}
+	resp, err := newJWTDebugResponse(token)
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, resp)
+}
+
+func debugJWTReconstructHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Components *jwtComponentsJSON `json:"components"`
+		Headers    map[string]string  `json:"headers"`
+	}
+	if err := decodeDebugJWTRequest(w, r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	var token string
+	var err error
+	switch {
+	case req.Components != nil:
+		c := req.Components
+		token, err = ReassembleJWT(&JWTComponents{Static: c.Static, Session: c.Session, Dynamic: c.Dynamic, Signature: c.Signature})
+	case len(req.Headers) > 0:
+		token, err = reconstructFromHeaders(req.Headers)
+	default:
+		writeAPIError(w, http.StatusBadRequest, errors.New("components or headers are required"))
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	resp, err := newJWTDebugResponse(token)
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, resp)
+}
+
+func decodeDebugJWTRequest(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxDebugJWTBody))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// reconstructFromHeaders decodes headers as a proxy logs them: -bin values
+// are base64, which gRPC would have decoded before the codec sees them
+func reconstructFromHeaders(headers map[string]string) (string, error) {
+	h := http.Header{}
+	for k, v := range headers {
+		h.Set(k, v)
+	}
+	decoded, err := ExtractJWT(headerCarrier(h))
+	if err != nil {
+		return "", err
+	}
+	if decoded == nil {
+		return "", errors.New("headers carry no split JWT")
+	}
+	return decoded.Token, nil
+}
+
+// newJWTDebugResponse splits token with the configured codec
+func newJWTDebugResponse(token string) (*jwtDebugResponse, error) {
+	components, err := DecomposeJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	pairs, err := jwtCodec.Encode(token)
+	if err != nil {
+		return nil, err
+	}
+	resp := &jwtDebugResponse{
+		Token: token,
+		Components: jwtComponentsJSON{
+			Static:    components.Static,
+			Session:   components.Session,
+			Dynamic:   components.Dynamic,
+			Signature: components.Signature,
+		},
+		Headers: make(map[string]string, len(pairs)/2),
+		Codec:   jwtCodec.Name(),
+		Sizes: jwtDebugSizes{
+			TokenBytes:            len(token),
+			Components:            GetJWTComponentSizes(components),
+			AuthorizationListSize: headerListSize([]string{"authorization", "Bearer " + token}),
+			SplitListSize:         headerListSize(pairs),
+		},
+	}
+	h := http.Header{}
+	setJWTPairs(headerCarrier(h), pairs)
+	for k, v := range h {
+		resp.Headers[strings.ToLower(k)] = v[0]
+	}
+	return resp, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestJWTDebugEndpoints splits a token and reconstructs it from both the
+// components and the headers the split returned
+func TestJWTDebugEndpoints(t *testing.T) {
+	loadTestRSAKeys(t)
+	token, err := generateJWTFromClaims(jwtGoldenClaims())
+	if err != nil {
+		t.Fatalf("generateJWTFromClaims() error = %v", err)
+	}
+	r := mux.NewRouter()
+	registerJWTDebugRoutes(r)
+	t.Setenv("ENABLE_JWT_DEBUG", "true")
+	enabled := mux.NewRouter()
+	registerJWTDebugRoutes(enabled)
+
+	post := func(r *mux.Router, path string, body interface{}) (*httptest.ResponseRecorder, jwtDebugResponse) {
+		b, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b)))
+		var resp jwtDebugResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w, resp
+	}
+	if w, _ := post(r, debugJWTSplitPath, map[string]string{"token": token}); w.Code != http.StatusNotFound {
+		t.Errorf("split without ENABLE_JWT_DEBUG: status %d, want 404", w.Code)
+	}
+
+	w, split := post(enabled, debugJWTSplitPath, map[string]string{"token": "Bearer " + token})
+	if w.Code != http.StatusOK {
+		t.Fatalf("split: status %d: %s", w.Code, w.Body)
+	}
+	if split.Sizes.TokenBytes != len(token) || split.Sizes.SplitListSize == 0 || split.Sizes.AuthorizationListSize <= len(token) {
+		t.Errorf("split sizes = %+v", split.Sizes)
+	}
+	for name, body := range map[string]interface{}{
+		"components": map[string]interface{}{"components": split.Components},
+		"headers":    map[string]interface{}{"headers": split.Headers},
+	} {
+		w, got := post(enabled, debugJWTReconstructPath, body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("reconstruct from %s: status %d: %s", name, w.Code, w.Body)
+		}
+		if got.Components != split.Components {
+			t.Errorf("reconstruct from %s: components = %+v, want %+v", name, got.Components, split.Components)
+		}
+	}
+	if w, _ := post(enabled, debugJWTReconstructPath, map[string]interface{}{"headers": map[string]string{"x-other": "1"}}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reconstruct without a split JWT: status %d, want 422", w.Code)
+	}
+}
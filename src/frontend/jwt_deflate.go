@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// The deflate codec sends the whole compact JWT in one header, its payload
+// segment raw-DEFLATE compressed before base64url as JWE does for zip=DEF.
+// The JOSE header and signature segments go as they are, so the receiver
+// inflates the payload back to the exact bytes that were signed. A mode
+// header names the compression, leaving room for others.
+const (
+	deflateTokenField = "zjwt"
+	deflateModeField  = "zip"
+	deflateModeDEF    = "DEF"
+
+	// maxInflatedPayloadSize bounds the inflated payload, so a small
+	// header cannot expand into an unbounded allocation
+	maxInflatedPayloadSize = 64 << 10
+)
+
+var deflateWriterPool = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.BestCompression)
+	return w
+}}
+
+// deflateCodec sends the token with a DEFLATE-compressed payload segment
+type deflateCodec struct {
+	scheme JWTHeaderScheme
+}
+
+func (c deflateCodec) tokenKey() string { return c.scheme.Prefix + deflateTokenField }
+
+func (c deflateCodec) modeKey() string { return c.scheme.Prefix + deflateModeField }
+
+func (c deflateCodec) Name() string { return jwtCodecDeflate }
+
+func (c deflateCodec) Encode(jwtToken string) ([]string, error) {
+	segments, err := splitJWT(jwtToken)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(segments.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode payload: %w", err)
+	}
+	var buf bytes.Buffer
+	w := deflateWriterPool.Get().(*flate.Writer)
+	defer deflateWriterPool.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(payload); err != nil {
+		return nil, fmt.Errorf("failed to deflate payload: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to deflate payload: %w", err)
+	}
+	token := segments.Header + "." + base64.RawURLEncoding.EncodeToString(buf.Bytes()) + "." + segments.Signature
+	pairs := appendJWTMeta(jwtCodecDeflate, c.scheme, []string{c.modeKey(), deflateModeDEF, c.tokenKey(), token})
+	return appendComponentMAC(c.scheme, pairs), nil
+}
+
+func (c deflateCodec) Decode(md metadata.MD) (*DecodedJWT, error) {
+	value := firstMD(md, c.tokenKey())
+	if value == "" {
+		return nil, nil
+	}
+	mode := firstMD(md, c.modeKey())
+	if mode != deflateModeDEF {
+		return nil, fmt.Errorf("%w: unsupported %s mode %q", errJWTMalformed, c.modeKey(), mode)
+	}
+	if err := verifyJWTMeta(jwtCodecDeflate, c.scheme, md); err != nil {
+		return nil, err
+	}
+	if err := verifyComponentMAC(c.scheme, md); err != nil {
+		return nil, err
+	}
+	jws, err := verifyDetachedJWS(c.scheme, md)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := splitJWT(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+	compressed, err := base64.RawURLEncoding.DecodeString(segments.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: deflated payload is not base64url: %v", errJWTMalformed, err)
+	}
+	payload, err := inflatePayload(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+	token := segments.Header + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + segments.Signature
+	return &DecodedJWT{Token: token, WireSize: len(value) + len(mode), Codec: jwtCodecDeflate, DetachedJWS: jws}, nil
+}
+
+// inflatePayload decompresses a raw DEFLATE payload of at most
+// maxInflatedPayloadSize bytes
+func inflatePayload(compressed []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+	payload, err := io.ReadAll(io.LimitReader(r, maxInflatedPayloadSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to inflate payload: %w", err)
+	}
+	if len(payload) > maxInflatedPayloadSize {
+		return nil, fmt.Errorf("inflated payload exceeds %d bytes", maxInflatedPayloadSize)
+	}
+	return payload, nil
+}
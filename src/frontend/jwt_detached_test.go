@@ -0,0 +1,66 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestDetachedJWSDetectsAlteredHeaders(t *testing.T) {
+	loadTestRSAKeys(t)
+	t.Setenv("JWT_DETACHED_SIGNATURE", "true")
+	token, err := generateJWTFromClaims(jwtGoldenClaims())
+	if err != nil {
+		t.Fatalf("generateJWTFromClaims() error = %v", err)
+	}
+	pairs, err := perClassCodec{}.Encode(token)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	pairs = withDetachedJWS(pairs)
+	jws := firstMD(metadata.Pairs(pairs...), jwtHeaders.Prefix+detachedJWSField)
+	if !strings.HasPrefix(jws, detachedJWSHeader+"..") {
+		t.Fatalf("detached JWS = %q, want the compact detached serialization", jws)
+	}
+
+	for name, tc := range map[string]struct {
+		alter func(md metadata.MD)
+		ok    bool
+	}{
+		"as sent": {func(md metadata.MD) {}, true},
+		// Mode negotiation headers are added after the JWS is signed
+		"negotiated": {func(md metadata.MD) { md.Set("x-jwt-modes", "full,split") }, true},
+		"dropped":    {func(md metadata.MD) { delete(md, jwtHeaders.Dynamic) }, false},
+		"altered":    {func(md metadata.MD) { md.Set(jwtHeaders.Session, md.Get(jwtHeaders.Static)...) }, false},
+		"no jws":     {func(md metadata.MD) { delete(md, jwtHeaders.Prefix+detachedJWSField) }, false},
+		"attached":   {func(md metadata.MD) { md.Set(jwtHeaders.Prefix+detachedJWSField, token) }, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			md := metadata.Pairs(pairs...)
+			tc.alter(md)
+			got, err := verifyDetachedJWS(jwtHeaders, md)
+			if tc.ok && (err != nil || got != jws) {
+				t.Errorf("verifyDetachedJWS() = %q, %v; want the JWS sent", got, err)
+			}
+			if !tc.ok && !errors.Is(err, errJWTSignatureInvalid) {
+				t.Errorf("verifyDetachedJWS() error = %v, want %v", err, errJWTSignatureInvalid)
+			}
+		})
+	}
+}
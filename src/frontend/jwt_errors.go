@@ -0,0 +1,127 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// jwtReasonExpired is the ErrorInfo reason downstream services attach when
+// they reject a token because exp has passed
+const jwtReasonExpired = "JWT_EXPIRED"
+
+// Sentinel errors for the ways a JWT can be rejected. Callers should use
+// errors.Is against these rather than matching on error strings.
+var (
+	errJWTExpired          = errors.New("jwt expired")
+	errJWTNotYetValid      = errors.New("jwt not yet valid")
+	errJWTMalformed        = errors.New("jwt malformed")
+	errJWTSignatureInvalid = errors.New("jwt signature invalid")
+	errJWTSessionMismatch  = errors.New("jwt session mismatch")
+	errJWTKeysUnavailable  = errors.New("jwt signing keys not loaded")
+	errJWTRevoked          = errors.New("jwt revoked")
+	errJWTWrongPurpose     = errors.New("jwt purpose mismatch")
+	errJWTIssuerMismatch   = errors.New("jwt issuer not accepted")
+	errJWTAudienceMismatch = errors.New("jwt audience not accepted")
+)
+
+// classifyJWTError wraps a jwt library error with the matching sentinel so
+// that it can be mapped to an HTTP status.
+func classifyJWTError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return fmt.Errorf("%w: %v", errJWTExpired, err)
+	case errors.Is(err, jwt.ErrTokenNotValidYet):
+		return fmt.Errorf("%w: %v", errJWTNotYetValid, err)
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return fmt.Errorf("%w: %v", errJWTIssuerMismatch, err)
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return fmt.Errorf("%w: %v", errJWTAudienceMismatch, err)
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return fmt.Errorf("%w: %v", errJWTSignatureInvalid, err)
+	default:
+		return fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+}
+
+// jwtErrorStatus returns the HTTP status code for a JWT error.
+func jwtErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errJWTMalformed):
+		return http.StatusBadRequest
+	case errors.Is(err, errJWTExpired), errors.Is(err, errJWTNotYetValid), errors.Is(err, errJWTSignatureInvalid), errors.Is(err, errJWTRevoked),
+		errors.Is(err, errJWTIssuerMismatch), errors.Is(err, errJWTAudienceMismatch):
+		return http.StatusUnauthorized
+	case errors.Is(err, errJWTSessionMismatch), errors.Is(err, errJWTWrongPurpose):
+		return http.StatusForbidden
+	case errors.Is(err, errJWTKeysUnavailable), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// renderJWTError clears the JWT cookie and renders the minimal jwt_error
+// page. It is used by ensureJWT, which runs before the request logger and the
+// common template data are available.
+func renderJWTError(w http.ResponseWriter, r *http.Request, err error) {
+	code := jwtErrorStatus(err)
+	log.WithField("error", err).WithField("http.req.path", r.URL.Path).Warn("jwt rejected")
+	recordInvalidJWT(r, err)
+
+	clearJWTCookie(w, r)
+	w.WriteHeader(code)
+	if templateErr := templates.ExecuteTemplate(w, "jwt_error", map[string]interface{}{
+		"error":       err.Error(),
+		"status_code": code,
+		"status":      http.StatusText(code),
+		"baseUrl":     baseUrl,
+	}); templateErr != nil {
+		log.Println(templateErr)
+	}
+}
+
+// jwtRejectionReason returns the ErrorInfo reason of a downstream status
+// rejecting the JWT, e.g. JWT_EXPIRED or JWT_SIGNATURE_INVALID
+func jwtRejectionReason(err error) (string, bool) {
+	st, ok := status.FromError(err)
+	if !ok || err == nil {
+		return "", false
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && strings.HasPrefix(info.Reason, "JWT_") {
+			return info.Reason, true
+		}
+	}
+	return "", false
+}
+
+// isJWTExpiredStatus reports whether err is a gRPC Unauthenticated status
+// whose details say the JWT expired
+func isJWTExpiredStatus(err error) bool {
+	reason, ok := jwtRejectionReason(err)
+	return ok && status.Code(err) == codes.Unauthenticated && reason == jwtReasonExpired
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"expvar"
+	"net/http"
+	"os"
+)
+
+// With JWT_FINGERPRINT_BINDING=true tokens carry an fph claim, a hash of
+// the User-Agent and Accept-Language of the browser they were issued to.
+// A token presented by another browser is refused, and that browser gets
+// a session of its own rather than the one the token belonged to, as does
+// one presenting a token issued without the claim.
+var jwtFingerprintBinding = os.Getenv("JWT_FINGERPRINT_BINDING") == "true"
+
+// jwtFingerprintMismatches counts tokens presented by another browser
+var jwtFingerprintMismatches = expvar.NewInt("jwt_fingerprint_mismatches")
+
+type ctxKeyFingerprint struct{}
+
+// browserFingerprint is the fph claim for the browser sending r
+func browserFingerprint(r *http.Request) string {
+	sum := sha256.Sum256([]byte(r.UserAgent() + "\n" + r.Header.Get("Accept-Language")))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// withFingerprint stores the browser's fingerprint in the request context,
+// for generateJWTContext, when binding is enabled
+func withFingerprint(r *http.Request) *http.Request {
+	if !jwtFingerprintBinding {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), ctxKeyFingerprint{}, browserFingerprint(r)))
+}
+
+// fingerprintFromContext returns the fph claim for tokens minted for ctx
+func fingerprintFromContext(ctx context.Context) string {
+	fph, _ := ctx.Value(ctxKeyFingerprint{}).(string)
+	return fph
+}
+
+// fingerprintMismatch reports whether claims are bound to a browser other
+// than the one sending r, or to none at all
+func fingerprintMismatch(r *http.Request, claims *JWTClaims) bool {
+	if !jwtFingerprintBinding || claims.FingerprintHash == fingerprintFromContext(r.Context()) {
+		return false
+	}
+	jwtFingerprintMismatches.Add(1)
+	entry := log.WithField("http.req.path", r.URL.Path).WithField("jwt.jti", claims.ID)
+	if claims.FingerprintHash == "" {
+		entry.Warn("jwt without fph presented while fingerprint binding is on")
+	} else {
+		entry.Warn("jwt presented by another browser")
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestFingerprintBoundTokensStayWithTheirBrowser(t *testing.T) {
+	useRSAKeys(t)
+	defer func(b bool) { jwtFingerprintBinding = b }(jwtFingerprintBinding)
+	jwtFingerprintBinding = true
+
+	var got *JWTClaims
+	handler := ensureSessionID(ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = getJWTFromContext(r.Context())
+	})))
+	call := func(userAgent string, cookies ...*http.Cookie) *http.Response {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("User-Agent", userAgent)
+		r.Header.Set("Accept-Language", "en-US")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	first := call("Browser/1.0")
+	cookies := first.Cookies()
+	session, token := got.SessionID, ""
+	for _, c := range cookies {
+		if c.Name == cookieJWT {
+			token = c.Value
+		}
+	}
+	if got.FingerprintHash == "" || token == "" {
+		t.Fatalf("issued claims %+v without fph", got)
+	}
+
+	if resp := call("Browser/1.0", cookies...); len(resp.Cookies()) != 0 || got.SessionID != session {
+		t.Errorf("same browser: cookies %v, session %q, want %q", resp.Cookies(), got.SessionID, session)
+	}
+	resp := call("Thief/1.0", cookies...)
+	if got.SessionID == session || got.FingerprintHash == "" {
+		t.Errorf("other browser got session %q with fph %q, want a new session", got.SessionID, got.FingerprintHash)
+	}
+	var newSession bool
+	for _, c := range resp.Cookies() {
+		newSession = newSession || c.Name == cookieSessionID && c.Value == got.SessionID
+	}
+	if !newSession {
+		t.Errorf("other browser: cookies %v, want a new session cookie", resp.Cookies())
+	}
+
+	// The REST API refuses a token presented by another client
+	r := httptest.NewRequest(http.MethodGet, apiPrefix+"/cart", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("User-Agent", "Thief/1.0")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("API call from another client: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestFingerprintBindingWithTokenPool(t *testing.T) {
+	useRSAKeys(t)
+	defer func(b bool) { jwtFingerprintBinding = b }(jwtFingerprintBinding)
+	jwtFingerprintBinding = true
+	defer func(p *tokenPool) { jwtPool = p }(jwtPool)
+	jwtPool = newTokenPool(1, rate.Inf)
+	if err := jwtPool.refill(context.Background()); err != nil {
+		t.Fatalf("refill() error = %v", err)
+	}
+	pooled := jwtPool.tokens[0]
+
+	var got *JWTClaims
+	handler := ensureSessionID(ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = getJWTFromContext(r.Context())
+	})))
+	call := func(cookies ...*http.Cookie) (jwtCookie string) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("User-Agent", "Browser/1.0")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		for _, c := range w.Result().Cookies() {
+			if c.Name == cookieJWT {
+				jwtCookie = c.Value
+			}
+		}
+		return jwtCookie
+	}
+
+	// The pooled token is bound to no browser, so the session mints its own
+	if tok := call(); tok == "" || tok == pooled.token || got.FingerprintHash == "" {
+		t.Errorf("new session got token %q with fph %q, want its own bound token", tok, got.FingerprintHash)
+	}
+
+	// A token without fph, such as one issued before binding was turned
+	// on, starts a new session
+	unbound, err := generateJWT("unbound-session", defaultCurrency, defaultClaimsProfile)
+	if err != nil {
+		t.Fatalf("generateJWT() error = %v", err)
+	}
+	before := jwtFingerprintMismatches.Value()
+	tok := call(&http.Cookie{Name: cookieSessionID, Value: "unbound-session"}, &http.Cookie{Name: cookieJWT, Value: unbound})
+	if tok == "" || got.SessionID == "unbound-session" || got.FingerprintHash == "" {
+		t.Errorf("token without fph kept session %q with fph %q, want a new bound session", got.SessionID, got.FingerprintHash)
+	}
+	if jwtFingerprintMismatches.Value() != before+1 {
+		t.Error("token without fph not counted as a mismatch")
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The fuzz targets run their seeds as part of go test. Explore further with
+//
+//	go test -run '^$' -fuzz FuzzDecomposeReassemble -fuzztime 1m
+
+// jwtFuzzSeeds are header and payload JSON the codec sees in practice, and
+// some it must reject
+var jwtFuzzSeeds = []struct{ header, payload string }{
+	{`{"alg":"RS256","typ":"JWT"}`, `{"aud":["urn:hipstershop:frontend"],"cart_id":"cart-s","exp":4102444800,"iat":1,"iss":"https://auth.hipstershop.com","jti":"j","market_id":"US","name":"Jane Doe","random_value":"cg==","session_id":"s","sub":"urn:hipstershop:user:s"}`},
+	{`{"alg":"RS256","typ":"JWT"}`, `{"act":{"sub":"spiffe://example.org/a"},"pad":"xxxxxxxx"}`},
+	{`{"alg":"RS256","typ":"JWT"}`, `{"sub": "a", "exp": 1.5e9, "name": "Zoë"}`},
+	{`{"alg":"RS256","typ":"JWT"}`, `{"sub":"a","sub":"b"}`},
+	{`{"alg":"RS256","typ":"JWT"}`, `null`},
+	{`{"alg":"RS256","kid":"k1","typ":"JWT"}`, `{}`},
+	{`{"alg":"RS256"}`, `[1,2]`},
+	{`not json`, `{"sub":"a"}`},
+}
+
+func fuzzJWT(header, payload []byte, signature string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(header) + "." + enc.EncodeToString(payload) + "." + signature
+}
+
+// roundTrips reports whether the codec must reassemble token to the same
+// claims: the header is exactly alg and typ, which is all the static
+// component keeps of it, and no claim is shadowed by them
+func roundTrips(header, payload map[string]interface{}) bool {
+	_, alg := header["alg"]
+	_, typ := header["typ"]
+	_, algClaim := payload["alg"]
+	_, typClaim := payload["typ"]
+	return len(header) == 2 && alg && typ && !algClaim && !typClaim
+}
+
+// nonNil treats a null payload as the empty object it reassembles to
+func nonNil(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return map[string]interface{}{}
+	}
+	return m
+}
+
+func FuzzSplitJWT(f *testing.F) {
+	for _, s := range []string{"", ".", "..", "a.b.c", "a.b.c.d", "a..c", fuzzJWT([]byte(jwtFuzzSeeds[0].header), []byte(jwtFuzzSeeds[0].payload), "sig")} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, token string) {
+		segments, err := splitJWT(token)
+		if strings.Count(token, ".") != 2 {
+			if err == nil {
+				t.Fatalf("splitJWT(%q) error = nil", token)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("splitJWT(%q) error = %v", token, err)
+		}
+		if got := segments.SigningInput(token) + "." + segments.Signature; got != token {
+			t.Errorf("segments rejoin to %q, want %q", got, token)
+		}
+		var claims jwtClaimSet
+		segments.DecodePayload(&claims)
+		segments.DecodeHeader(&claims)
+	})
+}
+
+func FuzzDecomposeReassemble(f *testing.F) {
+	for _, s := range jwtFuzzSeeds {
+		f.Add([]byte(s.header), []byte(s.payload), "c2ln")
+	}
+	f.Fuzz(func(t *testing.T, headerJSON, payloadJSON []byte, signature string) {
+		token := fuzzJWT(headerJSON, payloadJSON, signature)
+		components, err := DecomposeJWT(token)
+		header, payload, _, parseErr := parseJWT(token)
+		if (err == nil) != (parseErr == nil) {
+			t.Fatalf("DecomposeJWT() error = %v, but parseJWT() error = %v", err, parseErr)
+		}
+		if err != nil {
+			return
+		}
+		if fast, ok := decomposeJWTFast(token); ok {
+			generic, err := decomposeJWTGeneric(token)
+			if err != nil || *fast != *generic {
+				t.Fatalf("decomposeJWTFast() = %+v, generic = %+v, %v", *fast, generic, err)
+			}
+		}
+
+		reassembled, err := ReassembleJWT(components)
+		if err != nil {
+			t.Fatalf("ReassembleJWT(%+v) error = %v", *components, err)
+		}
+		if generic, err := reassembleJWTGeneric(components); err != nil || generic != reassembled {
+			t.Fatalf("ReassembleJWT() = %q, generic = %q, %v", reassembled, generic, err)
+		}
+		gotHeader, gotPayload, gotSignature, err := parseJWT(reassembled)
+		if err != nil {
+			t.Fatalf("parseJWT(reassembled) error = %v", err)
+		}
+		if gotSignature != signature {
+			t.Errorf("signature = %q, want %q", gotSignature, signature)
+		}
+		if !roundTrips(header, payload) {
+			return
+		}
+		if !reflect.DeepEqual(gotHeader, header) {
+			t.Errorf("header = %v, want %v", gotHeader, header)
+		}
+		if !reflect.DeepEqual(gotPayload, nonNil(payload)) {
+			t.Errorf("payload = %v, want %v", gotPayload, payload)
+		}
+	})
+}
+
+// FuzzReassembleJWT feeds ReassembleJWT components as they arrive from an
+// untrusted peer
+func FuzzReassembleJWT(f *testing.F) {
+	f.Add(`{"alg":"RS256","iss":"a","typ":"JWT"}`, `{"sub":"s"}`, `{"exp":1}`, "c2ln")
+	f.Add(`{"alg":"RS256","typ":"JWT"}`, `null`, `{}`, "")
+	f.Add(`[]`, `{"sub":`, `"x"`, "a.b")
+	f.Add(``, ``, ``, ``)
+	f.Fuzz(func(t *testing.T, static, session, dynamic, signature string) {
+		components := &JWTComponents{Static: static, Session: session, Dynamic: dynamic, Signature: signature}
+		token, err := ReassembleJWT(components)
+		if err != nil {
+			return
+		}
+		if fast, ok := reassembleJWTFast(components); ok {
+			if generic, err := reassembleJWTGeneric(components); err != nil || generic != fast {
+				t.Fatalf("reassembleJWTFast() = %q, generic = %q, %v", fast, generic, err)
+			}
+		}
+		if !strings.Contains(signature, ".") {
+			if _, _, _, err := parseJWT(token); err != nil {
+				t.Errorf("ReassembleJWT() = %q, which does not parse: %v", token, err)
+			}
+		}
+	})
+}
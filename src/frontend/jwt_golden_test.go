@@ -0,0 +1,377 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The golden fixtures pin the metadata the frontend sends for a fixed set
+// of tokens. checkoutservice, shippingservice and emailauthshim decode the
+// same files in their own jwt_golden_test.go, so the copies of the codec in
+// each service cannot drift apart unnoticed. Regenerate after an intended format change
+// with:
+//
+//	go test -run TestJWTGolden -update
+//
+// and keep the old files, renamed with their version, so receivers keep
+// understanding senders that have not been upgraded yet.
+
+var updateGolden = flag.Bool("update", false, "rewrite the JWT golden fixtures")
+
+const jwtGoldenDir = "testdata/jwt-golden"
+
+// jwtGoldenFixture is one token and the metadata it encodes to. -bin values
+// are base64-encoded, as on the wire.
+type jwtGoldenFixture struct {
+	Codec     string                 `json:"codec"`
+	MACSecret string                 `json:"mac_secret,omitempty"`
+	Detached  bool                   `json:"detached_jws,omitempty"`
+	Meta      bool                   `json:"meta_header,omitempty"`
+	Token     string                 `json:"token"`
+	Claims    map[string]interface{} `json:"claims"`
+	Metadata  map[string]string      `json:"metadata"`
+}
+
+// jwtGoldenExpiry is far enough out that the fixtures stay unexpired
+var jwtGoldenExpiry = time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// jwtGoldenCases are the current fixtures, keyed by file name
+var jwtGoldenCases = map[string]jwtGoldenFixture{
+	"v1-per-class.json":      {Codec: jwtCodecPerClass},
+	"v1-per-claim.json":      {Codec: jwtCodecPerClaim},
+	"v1-per-class-mac.json":  {Codec: jwtCodecPerClass, MACSecret: "golden-fixture-secret"},
+	"v1-per-class-jws.json":  {Codec: jwtCodecPerClass, Detached: true},
+	"v1-per-class-meta.json": {Codec: jwtCodecPerClass, Meta: true},
+	"v1-per-claim-meta.json": {Codec: jwtCodecPerClaim, Meta: true},
+}
+
+func jwtGoldenClaims() *JWTClaims {
+	return &JWTClaims{
+		SessionID:   "golden-session",
+		Name:        "Jane Doe",
+		MarketID:    "US",
+		Currency:    "EUR",
+		CartID:      "cart-golden-session",
+		LoyaltyTier: "gold",
+		RandomValue: "Z29sZGVuLXJhbmRvbQ==",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   "urn:hipstershop:user:golden-session",
+			Audience:  jwt.ClaimStrings{jwtAudience},
+			ExpiresAt: jwt.NewNumericDate(jwtGoldenExpiry),
+			IssuedAt:  jwt.NewNumericDate(jwtGoldenExpiry.Add(-jwtLifetime)),
+			ID:        "00000000-0000-4000-8000-000000000001",
+		},
+	}
+}
+
+// encodeGolden encodes token the way the interceptor would with the
+// fixture's options
+func encodeGolden(t *testing.T, f jwtGoldenFixture, token string) map[string]string {
+	t.Helper()
+	defer func(key []byte) { componentMACKey = key }(componentMACKey)
+	componentMACKey = nil
+	if f.MACSecret != "" {
+		t.Setenv("JWT_COMPONENT_MAC_SECRET", f.MACSecret)
+		componentMACKey = loadComponentMACKey()
+	}
+	t.Setenv("JWT_DETACHED_SIGNATURE", "")
+	if f.Detached {
+		t.Setenv("JWT_DETACHED_SIGNATURE", "true")
+	}
+	t.Setenv("JWT_META_HEADER", "")
+	if f.Meta {
+		t.Setenv("JWT_META_HEADER", "true")
+	}
+
+	var codec JWTCodec = perClassCodec{}
+	if f.Codec == jwtCodecPerClaim {
+		codec = perClaimCodec{scheme: jwtHeaders}
+	}
+	pairs, err := codec.Encode(token)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	pairs = withDetachedJWS(pairs)
+
+	md := make(map[string]string, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		v := pairs[i+1]
+		if strings.HasSuffix(pairs[i], "-bin") {
+			v = base64.StdEncoding.EncodeToString([]byte(v))
+		}
+		md[pairs[i]] = v
+	}
+	return md
+}
+
+func TestJWTGolden(t *testing.T) {
+	loadTestRSAKeys(t)
+
+	if *updateGolden {
+		token, err := generateJWTFromClaims(jwtGoldenClaims())
+		if err != nil {
+			t.Fatalf("generateJWTFromClaims() error = %v", err)
+		}
+		claims := &JWTClaims{}
+		_, _, _ = jwt.NewParser().ParseUnverified(token, claims)
+		payload, _ := json.Marshal(claims)
+		var claimMap map[string]interface{}
+		json.Unmarshal(payload, &claimMap)
+
+		if err := os.MkdirAll(jwtGoldenDir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for name, f := range jwtGoldenCases {
+			f.Token, f.Claims = token, claimMap
+			f.Metadata = encodeGolden(t, f, token)
+			b, err := json.MarshalIndent(f, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(jwtGoldenDir, name), append(b, '\n'), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for name := range jwtGoldenCases {
+		t.Run(name, func(t *testing.T) {
+			b, err := os.ReadFile(filepath.Join(jwtGoldenDir, name))
+			if err != nil {
+				t.Fatalf("missing fixture, run with -update: %v", err)
+			}
+			var f jwtGoldenFixture
+			if err := json.Unmarshal(b, &f); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := validateJWT(f.Token); err != nil {
+				t.Errorf("fixture token does not validate: %v", err)
+			}
+			if got := encodeGolden(t, f, f.Token); !reflect.DeepEqual(got, f.Metadata) {
+				t.Errorf("encoding changed\n got: %v\nwant: %v", got, f.Metadata)
+			}
+		})
+	}
+}
+
+// rawJWT builds an unsigned token from literal JSON, for inputs the JWT
+// library would never produce
+func rawJWT(header, payload string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(header)) + "." + enc.EncodeToString([]byte(payload)) + ".c2ln"
+}
+
+func TestJWTFastPathMatchesGeneric(t *testing.T) {
+	loadTestRSAKeys(t)
+	golden, err := generateJWTFromClaims(jwtGoldenClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const header = `{"alg":"RS256","typ":"JWT"}`
+	tests := []struct {
+		name  string
+		token string
+		fast  bool
+	}{
+		{"golden", golden, true},
+		{"extra header field", rawJWT(`{"alg":"RS256","kid":"k1","typ":"JWT"}`, `{"sub":"a"}`), true},
+		{"missing typ", rawJWT(`{"alg":"RS256"}`, `{"sub":"a","exp":1}`), true},
+		{"claim shadowed by header", rawJWT(header, `{"alg":"none","sub":"a"}`), true},
+		{"arrays and literals", rawJWT(header, `{"aud":["a","b"],"ok":true,"no":false,"nil":null,"n":-42,"e":[]}`), true},
+		{"empty payload", rawJWT(header, `{}`), true},
+		{"whitespace", rawJWT(header, `{"sub": "a"}`), false},
+		{"escaped string", rawJWT(header, `{"name":"a\/b"}`), false},
+		{"html", rawJWT(header, `{"name":"<b>"}`), false},
+		{"unicode", rawJWT(header, `{"name":"Zoë"}`), false},
+		{"float", rawJWT(header, `{"exp":1.5}`), false},
+		{"exponent", rawJWT(header, `{"exp":1e9}`), false},
+		{"big integer", rawJWT(header, `{"exp":12345678901234567}`), false},
+		{"object", rawJWT(header, `{"act":{"sub":"spiffe://example.org/a"},"cnf":{"a":1,"jkt":"x"},"e":{}}`), true},
+		{"unsorted object", rawJWT(header, `{"cnf":{"jkt":"x","a":1}}`), false},
+		{"nested object", rawJWT(header, `{"act":{"act":{"sub":"x"}}}`), false},
+		{"duplicate key", rawJWT(header, `{"sub":"a","sub":"b"}`), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := decomposeJWTGeneric(tt.token)
+			if err != nil {
+				t.Fatalf("decomposeJWTGeneric() error = %v", err)
+			}
+			got, ok := decomposeJWTFast(tt.token)
+			if ok != tt.fast {
+				t.Fatalf("decomposeJWTFast() ok = %v, want %v", ok, tt.fast)
+			}
+			if ok && *got != *want {
+				t.Errorf("decomposeJWTFast() = %+v, want %+v", *got, *want)
+			}
+
+			wantToken, err := reassembleJWTGeneric(want)
+			if err != nil {
+				t.Fatalf("reassembleJWTGeneric() error = %v", err)
+			}
+			gotToken, ok := reassembleJWTFast(want)
+			if ok && gotToken != wantToken || tt.fast && !ok {
+				t.Errorf("reassembleJWTFast() = %q, %v, want %q", gotToken, ok, wantToken)
+			}
+		})
+	}
+
+	const static = `{"alg":"RS256","iss":"a","typ":"JWT"}`
+	components := map[string]struct {
+		components JWTComponents
+		fast       bool
+	}{
+		// Later components win, as when ReassembleJWT merges maps
+		"overlap":       {JWTComponents{Static: static, Session: `{"iss":"b","sub":"s"}`, Dynamic: `{"sub":"d"}`}, true},
+		"null":          {JWTComponents{Static: static, Session: `null`, Dynamic: `{}`}, false},
+		"whitespace":    {JWTComponents{Static: static, Session: `{ "sub":"s"}`, Dynamic: `{}`}, false},
+		"duplicate key": {JWTComponents{Static: static, Session: `{}`, Dynamic: `{"exp":1,"exp":2}`}, false},
+	}
+	for name, tt := range components {
+		want, err := reassembleJWTGeneric(&tt.components)
+		if err != nil {
+			t.Fatalf("%s: reassembleJWTGeneric() error = %v", name, err)
+		}
+		got, ok := reassembleJWTFast(&tt.components)
+		if ok != tt.fast || ok && got != want {
+			t.Errorf("%s: reassembleJWTFast() = %q, %v, want %q, %v", name, got, ok, want, tt.fast)
+		}
+	}
+}
+
+func BenchmarkDecomposeJWT(b *testing.B) {
+	if err := loadRSAKeys(); err != nil {
+		b.Fatal(err)
+	}
+	token, err := generateJWTFromClaims(jwtGoldenClaims())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("generic", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			decomposeJWTGeneric(token)
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			decomposeJWTFast(token)
+		}
+	})
+}
+
+func BenchmarkReassembleJWT(b *testing.B) {
+	if err := loadRSAKeys(); err != nil {
+		b.Fatal(err)
+	}
+	token, err := generateJWTFromClaims(jwtGoldenClaims())
+	if err != nil {
+		b.Fatal(err)
+	}
+	components, err := decomposeJWTGeneric(token)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("generic", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reassembleJWTGeneric(components)
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reassembleJWTFast(components)
+		}
+	})
+}
+
+func TestSplitJWT(t *testing.T) {
+	token := rawJWT(`{"alg":"RS256","typ":"JWT"}`, `{"sub":"a","jti":"j","exp":4102444800}`)
+	segments, err := splitJWT(token)
+	if err != nil {
+		t.Fatalf("splitJWT() error = %v", err)
+	}
+	if got := segments.SigningInput(token) + "." + segments.Signature; got != token {
+		t.Errorf("segments rejoin to %q, want %q", got, token)
+	}
+	var claims jwtClaimSet
+	if err := segments.DecodePayload(&claims); err != nil {
+		t.Fatalf("DecodePayload() error = %v", err)
+	}
+	if claims.Subject != "a" || claims.ID != "j" || claims.ExpiresAt == nil || *claims.ExpiresAt != 4102444800 {
+		t.Errorf("DecodePayload() = %+v", claims)
+	}
+	if n := testing.AllocsPerRun(100, func() { splitJWT(token) }); n != 0 {
+		t.Errorf("splitJWT() allocates %v times, want 0", n)
+	}
+
+	for _, bad := range []string{"a", "a.b", "a.b.c.d"} {
+		if _, err := splitJWT(bad); err == nil {
+			t.Errorf("splitJWT(%q) error = nil", bad)
+		}
+	}
+}
+
+// BenchmarkForwardedJWT compares what a service forwarding a token
+// unchanged spends reading its exp, jti and sub
+func BenchmarkForwardedJWT(b *testing.B) {
+	if err := loadRSAKeys(); err != nil {
+		b.Fatal(err)
+	}
+	token, err := generateJWTFromClaims(jwtGoldenClaims())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("split/strings.Split", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = strings.Split(token, ".")
+		}
+	})
+	b.Run("split/splitJWT", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			splitJWT(token)
+		}
+	})
+	b.Run("claims/parseJWT", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			parseJWT(token)
+		}
+	})
+	b.Run("claims/DecodePayload", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			segments, _ := splitJWT(token)
+			var claims jwtClaimSet
+			segments.DecodePayload(&claims)
+		}
+	})
+}
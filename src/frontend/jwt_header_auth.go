@@ -0,0 +1,146 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clients that keep no cookies, such as mobile apps and load generators,
+// send "X-Client-Type: api" to browse the shop through the same middleware
+// as browsers, authenticated by headers alone. The refresh handshake:
+//
+//  1. A request without a token starts a session. Its token is returned in
+//     the X-JWT-Token response header, and its lifetime in seconds in
+//     X-JWT-Expires-In.
+//  2. Later requests send the token back, as "Authorization: Bearer <jwt>"
+//     or in X-JWT-Token.
+//  3. An expired token is renewed for the same session, and the new one
+//     returned in X-JWT-Token; so is one close to expiry with
+//     JWT_SLIDING_SESSION, while a session idle for longer than
+//     SESSION_IDLE_TIMEOUT is replaced by a new one. Clients replace their
+//     token whenever a response carries one.
+//
+// Invalid and revoked tokens are answered with a JSON error, as on the
+// REST API; nothing is ever stored in a cookie.
+const (
+	headerClientType   = "X-Client-Type"
+	headerJWTToken     = "X-JWT-Token"
+	headerJWTExpiresIn = "X-JWT-Expires-In"
+
+	clientTypeAPI = "api"
+)
+
+// jwtHeaderOnlyRequests counts header-only requests by what happened to
+// their token: issued, renewed, exchanged or reused
+var jwtHeaderOnlyRequests = expvar.NewMap("jwt_header_only_requests")
+
+// isHeaderOnlyClient reports whether the request asked for header-only auth
+func isHeaderOnlyClient(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get(headerClientType), clientTypeAPI)
+}
+
+// headerJWT returns the token a header-only client sent
+func headerJWT(r *http.Request) (string, bool) {
+	if token, ok := bearerToken(r); ok {
+		return token, true
+	}
+	token := r.Header.Get(headerJWTToken)
+	return token, token != ""
+}
+
+// ensureHeaderJWT is ensureJWT for header-only clients. The token's
+// session_id claim is the session for the request.
+func ensureHeaderJWT(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	tokenString, claims, outcome, err := headerOnlyToken(r)
+	if err != nil {
+		log.WithField("error", err).WithField("http.req.path", r.URL.Path).Warn("jwt rejected")
+		recordInvalidJWT(r, err)
+		writeAPIError(w, jwtErrorStatus(err), err)
+		return
+	}
+	jwtHeaderOnlyRequests.Add(outcome, 1)
+	if outcome != "reused" {
+		w.Header().Set(headerJWTToken, tokenString)
+		w.Header().Set(headerJWTExpiresIn, strconv.Itoa(int(jwtUntil(claims.ExpiresAt.Time)/time.Second)))
+	}
+	ctx := context.WithValue(r.Context(), ctxKeyJWTToken{}, tokenString)
+	ctx = context.WithValue(ctx, ctxKeyJWT{}, claims)
+	ctx = context.WithValue(ctx, ctxKeySessionID{}, claims.SessionID)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// headerOnlyToken returns the token for a header-only request, minting or
+// renewing it as the handshake requires
+func headerOnlyToken(r *http.Request) (string, *JWTClaims, string, error) {
+	ctx := r.Context()
+	tokenString, ok := headerJWT(r)
+	if !ok {
+		return newHeaderOnlySession(ctx)
+	}
+	if oidc.issued(tokenString) {
+		token, claims, err := oidc.exchange(ctx, tokenString)
+		return token, claims, "exchanged", err
+	}
+
+	claims, err := validateJWTContext(ctx, tokenString)
+	if err == nil && fingerprintMismatch(r, claims) {
+		return newHeaderOnlySession(ctx)
+	}
+	if err == nil && !needsSlidingRenewal(claims) {
+		return tokenString, claims, "reused", nil
+	}
+	if err != nil && !errors.Is(err, errJWTExpired) {
+		return "", nil, "", err
+	}
+	if err != nil {
+		if claims, err = expiredJWTClaims(tokenString); err != nil {
+			return "", nil, "", err
+		}
+		if sessionIdle(claims) {
+			jwtSessionRenewals.Add("idle_expired", 1)
+			return newHeaderOnlySession(ctx)
+		}
+		if fingerprintMismatch(r, claims) {
+			return newHeaderOnlySession(ctx)
+		}
+	}
+	token, err := refreshJWTContext(ctx, claims)
+	if err != nil {
+		return "", nil, "", err
+	}
+	claims, err = validateJWT(token)
+	return token, claims, "renewed", err
+}
+
+// newHeaderOnlySession starts a session for a client without a token
+func newHeaderOnlySession(ctx context.Context) (string, *JWTClaims, string, error) {
+	sessionID, ctx := newSessionID(ctx)
+	token, ok := ctx.Value(ctxKeyPooledJWT{}).(string)
+	if !ok {
+		var err error
+		if token, err = issueJWT(ctx, sessionID, defaultCurrency); err != nil {
+			return "", nil, "", err
+		}
+	}
+	claims, err := validateJWT(token)
+	return token, claims, "issued", err
+}
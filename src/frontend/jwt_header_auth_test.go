@@ -0,0 +1,84 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestHeaderOnlyClientsNeverGetCookies(t *testing.T) {
+	useRSAKeys(t)
+
+	var got *JWTClaims
+	handler := ensureSessionID(ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = getJWTFromContext(r.Context())
+		if got == nil || sessionID(r) != got.SessionID {
+			t.Errorf("session %q does not match claims %+v", sessionID(r), got)
+		}
+	})))
+	call := func(header, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/cart", nil)
+		r.Header.Set(headerClientType, "API")
+		if token != "" {
+			r.Header.Set(header, token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if cookies := w.Result().Cookies(); len(cookies) > 0 {
+			t.Errorf("header-only response set cookies %v", cookies)
+		}
+		return w
+	}
+
+	w := call("", "")
+	token := w.Header().Get(headerJWTToken)
+	if w.Code != http.StatusOK || token == "" || w.Header().Get(headerJWTExpiresIn) == "" {
+		t.Fatalf("first request: status %d, X-JWT-Token %q", w.Code, token)
+	}
+	session := got.SessionID
+
+	for _, header := range []string{"Authorization", headerJWTToken} {
+		value := token
+		if header == "Authorization" {
+			value = "Bearer " + token
+		}
+		if w := call(header, value); w.Code != http.StatusOK || w.Header().Get(headerJWTToken) != "" || got.SessionID != session {
+			t.Errorf("%s: status %d, renewed %q, session %q, want %q", header, w.Code, w.Header().Get(headerJWTToken), got.SessionID, session)
+		}
+	}
+
+	// An expired token is renewed for the same session
+	expired := *got
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	expiredToken, err := generateJWTFromClaims(&expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = call(headerJWTToken, expiredToken)
+	renewed := w.Header().Get(headerJWTToken)
+	if w.Code != http.StatusOK || renewed == "" || renewed == expiredToken || got.SessionID != session {
+		t.Errorf("expired token: status %d, renewed %q, session %q, want %q", w.Code, renewed, got.SessionID, session)
+	}
+
+	if w := call(headerJWTToken, "not-a-jwt"); w.Code != http.StatusBadRequest || !strings.Contains(w.Header().Get("Content-Type"), "json") {
+		t.Errorf("malformed token: status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// JWTHeaderScheme names the metadata keys carrying each JWT component
+type JWTHeaderScheme struct {
+	Prefix    string
+	Static    string
+	Session   string
+	Dynamic   string
+	Signature string
+}
+
+// jwtHeaders is the scheme used for outgoing metadata, configured once at startup
+var jwtHeaders = loadJWTHeaderScheme()
+
+// NewJWTHeaderScheme builds a scheme from a prefix and the four field names
+// in static, session, dynamic, signature order
+func NewJWTHeaderScheme(prefix string, fields [4]string) JWTHeaderScheme {
+	return JWTHeaderScheme{
+		Prefix:    prefix,
+		Static:    prefix + fields[0],
+		Session:   prefix + fields[1],
+		Dynamic:   prefix + fields[2],
+		Signature: prefix + fields[3],
+	}
+}
+
+// loadJWTHeaderScheme reads JWT_HEADER_PREFIX and JWT_HEADER_FIELDS
+// (comma-separated static,session,dynamic,signature names)
+func loadJWTHeaderScheme() JWTHeaderScheme {
+	prefix := jwtHeaderPrefixDefault
+	if v := os.Getenv("JWT_HEADER_PREFIX"); v != "" {
+		prefix = strings.ToLower(v)
+	}
+	fields := defaultJWTHeaderFields
+	if v := os.Getenv("JWT_HEADER_FIELDS"); v != "" {
+		if parts := strings.Split(strings.ToLower(v), ","); len(parts) == 4 {
+			for i, p := range parts {
+				fields[i] = strings.TrimSpace(p)
+			}
+		}
+	}
+	return NewJWTHeaderScheme(prefix, fields)
+}
+
+// IsJWTHeaderCompatEnabled reports whether incoming metadata may use any
+// known scheme rather than only the configured one
+func IsJWTHeaderCompatEnabled() bool {
+	return os.Getenv("JWT_HEADER_COMPAT") == "true"
+}
+
+// acceptedJWTHeaderSchemes lists the schemes tried when decoding, configured scheme first
+func acceptedJWTHeaderSchemes() []JWTHeaderScheme {
+	schemes := []JWTHeaderScheme{jwtHeaders}
+	if IsJWTHeaderCompatEnabled() {
+		for _, prefix := range []string{jwtHeaderPrefixDefault, jwtHeaderPrefixAuth} {
+			if s := NewJWTHeaderScheme(prefix, defaultJWTHeaderFields); s != jwtHeaders {
+				schemes = append(schemes, s)
+			}
+		}
+	}
+	return schemes
+}
+
+// IsJWTSignatureSplitEnabled reports whether outgoing signatures are sent
+// in two headers of about half the size, see SignaturePairs. Receivers
+// recombine split signatures whether or not it is set.
+func IsJWTSignatureSplitEnabled() bool {
+	return os.Getenv("JWT_SIGNATURE_SPLIT") == "true"
+}
+
+// IsJWTRawSignatureEnabled reports whether outgoing signatures are sent as
+// their raw bytes rather than base64url text (JWT_BINARY_METADATA=raw).
+// gRPC base64-encodes -bin values itself, so text in a -bin header is
+// encoded twice; raw bytes save about a quarter of the signature header.
+// The dynamic component already travels as raw JSON bytes. Receivers
+// accept either form whether or not it is set.
+func IsJWTRawSignatureEnabled() bool {
+	return os.Getenv("JWT_BINARY_METADATA") == "raw"
+}
+
+// rawSignatureMarker starts a signature value holding raw bytes. No
+// base64url text starts with it, so receivers tell the forms apart without
+// knowing the sender's setting.
+const rawSignatureMarker = "\x00"
+
+// Pairs returns the key/value list for metadata.AppendToOutgoingContext
+func (s JWTHeaderScheme) Pairs(components *JWTComponents) []string {
+	pairs := []string{
+		s.Static, components.Static,
+		s.Session, components.Session,
+		s.Dynamic, components.Dynamic,
+	}
+	return append(pairs, s.SignaturePairs(components.Signature, IsJWTSignatureSplitEnabled(), IsJWTRawSignatureEnabled())...)
+}
+
+// SignaturePairs returns the pairs carrying signature: one header, or with
+// split two, the first half in SignaturePart(1) and the rest in
+// SignaturePart(2). Splitting trades a larger header for one more header
+// of half the size, to tell which of the two proxies pay more for. With
+// raw, the signature is sent as its bytes when the header is a -bin one.
+func (s JWTHeaderScheme) SignaturePairs(signature string, split, raw bool) []string {
+	if raw && strings.HasSuffix(s.Signature, "-bin") {
+		if b, err := base64.RawURLEncoding.DecodeString(signature); err == nil {
+			signature = rawSignatureMarker + string(b)
+		}
+	}
+	if !split {
+		return []string{s.Signature, signature}
+	}
+	half := len(signature) / 2
+	return []string{s.SignaturePart(1), signature[:half], s.SignaturePart(2), signature[half:]}
+}
+
+// SignaturePart names the header of part i of a split signature, keeping
+// the -bin suffix: x-jwt-sig-1-bin for x-jwt-sig-bin
+func (s JWTHeaderScheme) SignaturePart(i int) string {
+	name, bin := strings.CutSuffix(s.Signature, "-bin")
+	name += "-" + strconv.Itoa(i)
+	if bin {
+		name += "-bin"
+	}
+	return name
+}
+
+// SignatureFrom returns the base64url signature in md, recombining a split
+// one and encoding a raw one. For -bin fields the plain name is accepted as
+// a fallback.
+func (s JWTHeaderScheme) SignatureFrom(md metadata.MD) string {
+	signature := firstMD(md, s.Signature, strings.TrimSuffix(s.Signature, "-bin"))
+	if signature == "" {
+		first, second := firstMD(md, s.SignaturePart(1)), firstMD(md, s.SignaturePart(2))
+		if first == "" || second == "" {
+			return ""
+		}
+		signature = first + second
+	}
+	if raw, ok := strings.CutPrefix(signature, rawSignatureMarker); ok {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+	return signature
+}
+
+// ExtractJWTComponents looks for decomposed JWT headers in md using each
+// accepted scheme and returns the scheme that matched. For -bin fields the
+// plain name is accepted as a fallback.
+func ExtractJWTComponents(md metadata.MD) (*JWTComponents, JWTHeaderScheme, bool) {
+	for _, s := range acceptedJWTHeaderSchemes() {
+		static := firstMD(md, s.Static)
+		if static == "" {
+			continue
+		}
+		return &JWTComponents{
+			Static:    static,
+			Session:   firstMD(md, s.Session),
+			Dynamic:   firstMD(md, s.Dynamic, strings.TrimSuffix(s.Dynamic, "-bin")),
+			Signature: s.SignatureFrom(md),
+		}, s, true
+	}
+	return nil, JWTHeaderScheme{}, false
+}
+
+// firstMD returns the first value found for any of keys
+func firstMD(md metadata.MD, keys ...string) string {
+	for _, k := range keys {
+		if v := md.Get(k); len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestJWTSignatureSplit(t *testing.T) {
+	loadTestRSAKeys(t)
+	token, err := generateJWTFromClaims(jwtGoldenClaims())
+	if err != nil {
+		t.Fatalf("generateJWTFromClaims() error = %v", err)
+	}
+	components, err := DecomposeJWT(token)
+	if err != nil {
+		t.Fatalf("DecomposeJWT() error = %v", err)
+	}
+	t.Setenv("JWT_SIGNATURE_SPLIT", "true")
+	t.Setenv("JWT_META_HEADER", "true")
+	// The meta header counts the parts like any other header; the
+	// component MAC leaves them out as it does the whole signature
+	defer func(key []byte) { componentMACKey = key }(componentMACKey)
+	componentMACKey = []byte("split-signature-test")
+
+	for _, codec := range []JWTCodec{perClassCodec{}, perClaimCodec{scheme: jwtHeaders}} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			pairs, err := codec.Encode(token)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			md := metadata.Pairs(pairs...)
+			if _, ok := md[jwtHeaders.Signature]; ok {
+				t.Errorf("%s sent with the signature split", jwtHeaders.Signature)
+			}
+			first, second := firstMD(md, jwtHeaders.SignaturePart(1)), firstMD(md, jwtHeaders.SignaturePart(2))
+			if first+second != components.Signature || len(first) != len(components.Signature)/2 {
+				t.Errorf("signature parts are %d and %d bytes, want halves of %d", len(first), len(second), len(components.Signature))
+			}
+			decoded, err := DecodeJWTMetadata(md)
+			if err != nil || decoded == nil {
+				t.Fatalf("DecodeJWTMetadata() = %v, %v", decoded, err)
+			}
+			if !strings.HasSuffix(decoded.Token, "."+components.Signature) {
+				t.Errorf("reassembled token %q does not end in the whole signature", decoded.Token)
+			}
+
+			// Losing a part fails the meta check rather than sending half a
+			// signature on to verification
+			delete(md, jwtHeaders.SignaturePart(2))
+			if decoded, err := DecodeJWTMetadata(md); !errors.Is(err, errJWTMalformed) {
+				t.Errorf("DecodeJWTMetadata() without the second part = %v, %v; want %v", decoded, err, errJWTMalformed)
+			}
+		})
+	}
+}
+
+func TestJWTHeaderSchemes(t *testing.T) {
+	loadTestRSAKeys(t)
+	t.Setenv("JWT_HEADER_PREFIX", "Tenant-JWT-")
+	t.Setenv("JWT_HEADER_FIELDS", "st, sess ,dyn-bin,sig-bin")
+	if got, want := loadJWTHeaderScheme(), (JWTHeaderScheme{"tenant-jwt-", "tenant-jwt-st", "tenant-jwt-sess", "tenant-jwt-dyn-bin", "tenant-jwt-sig-bin"}); got != want {
+		t.Errorf("loadJWTHeaderScheme() = %+v, want %+v", got, want)
+	}
+	t.Setenv("JWT_HEADER_FIELDS", "st,sess")
+	if got, want := loadJWTHeaderScheme(), NewJWTHeaderScheme("tenant-jwt-", defaultJWTHeaderFields); got != want {
+		t.Errorf("loadJWTHeaderScheme() with 2 fields = %+v, want the default fields %+v", got, want)
+	}
+
+	token, err := generateJWTFromClaims(jwtGoldenClaims())
+	if err != nil {
+		t.Fatalf("generateJWTFromClaims() error = %v", err)
+	}
+	components, err := DecomposeJWT(token)
+	if err != nil {
+		t.Fatalf("DecomposeJWT() error = %v", err)
+	}
+	defaultScheme := NewJWTHeaderScheme(jwtHeaderPrefixDefault, defaultJWTHeaderFields)
+	authScheme := NewJWTHeaderScheme(jwtHeaderPrefixAuth, defaultJWTHeaderFields)
+	defer func(s JWTHeaderScheme) { jwtHeaders = s }(jwtHeaders)
+	jwtHeaders = defaultScheme
+	fromAuth := metadata.Pairs(authScheme.Pairs(components)...)
+
+	// Only the configured scheme is accepted unless compatibility is on
+	t.Setenv("JWT_HEADER_COMPAT", "false")
+	if _, _, ok := ExtractJWTComponents(fromAuth); ok {
+		t.Error("headers of another scheme accepted without JWT_HEADER_COMPAT")
+	}
+	t.Setenv("JWT_HEADER_COMPAT", "true")
+	got, scheme, ok := ExtractJWTComponents(fromAuth)
+	if !ok || scheme != authScheme || *got != *components {
+		t.Errorf("ExtractJWTComponents() with compatibility = %+v, %+v, %v; want the components in %+v", got, scheme, ok, authScheme)
+	}
+
+	// A custom scheme still accepts both known ones, and is tried first
+	jwtHeaders = NewJWTHeaderScheme("tenant-jwt-", defaultJWTHeaderFields)
+	if schemes := acceptedJWTHeaderSchemes(); len(schemes) != 3 || schemes[0] != jwtHeaders {
+		t.Errorf("acceptedJWTHeaderSchemes() = %+v, want the configured scheme and both known ones", schemes)
+	}
+	both := metadata.Join(fromAuth, metadata.Pairs(jwtHeaders.Pairs(components)...))
+	if _, scheme, ok := ExtractJWTComponents(both); !ok || scheme != jwtHeaders {
+		t.Errorf("ExtractJWTComponents() of two schemes matched %+v, want the configured one", scheme)
+	}
+}
+
+func TestJWTRawSignature(t *testing.T) {
+	loadTestRSAKeys(t)
+	token, err := generateJWTFromClaims(jwtGoldenClaims())
+	if err != nil {
+		t.Fatalf("generateJWTFromClaims() error = %v", err)
+	}
+	text, err := perClassCodec{}.Encode(token)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	want, err := DecodeJWTMetadata(metadata.Pairs(text...))
+	if err != nil || want == nil {
+		t.Fatalf("DecodeJWTMetadata() = %v, %v", want, err)
+	}
+
+	t.Setenv("JWT_BINARY_METADATA", "raw")
+	for _, split := range []string{"false", "true"} {
+		t.Run("split="+split, func(t *testing.T) {
+			t.Setenv("JWT_SIGNATURE_SPLIT", split)
+			for _, codec := range []JWTCodec{perClassCodec{}, perClaimCodec{scheme: jwtHeaders}} {
+				pairs, err := codec.Encode(token)
+				if err != nil {
+					t.Fatalf("%s: Encode() error = %v", codec.Name(), err)
+				}
+				md := metadata.Pairs(pairs...)
+				signature := jwtHeaders.SignatureFrom(md)
+				if signature != want.Components.Signature {
+					t.Errorf("%s: SignatureFrom() = %q, want %q", codec.Name(), signature, want.Components.Signature)
+				}
+				decoded, err := DecodeJWTMetadata(md)
+				if err != nil || decoded == nil {
+					t.Fatalf("%s: DecodeJWTMetadata() = %v, %v", codec.Name(), decoded, err)
+				}
+				if !strings.HasSuffix(decoded.Token, "."+want.Components.Signature) {
+					t.Errorf("%s: reassembled token %q does not end in the signature", codec.Name(), decoded.Token)
+				}
+			}
+		})
+	}
+
+	// gRPC base64-encodes -bin values, so raw bytes are a quarter smaller
+	// on the wire than base64url text encoded again
+	raw, err := perClassCodec{}.Encode(token)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	saved := headerListSize(text) - headerListSize(raw)
+	if sig := len(want.Components.Signature); saved < sig/4 {
+		t.Errorf("raw signature saves %d bytes of a %d byte signature, want at least %d", saved, sig, sig/4)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// signingKeyName is the name the frontend's key pair is published under in
+// jwt_key_versions. Its fingerprint is the public key's, as the services'
+// verification key.
+const signingKeyName = "signing"
+
+var (
+	// rsaKeysMu guards privateKey and publicKey, which a rotation of the
+	// Secret they are mounted from replaces while tokens are signed, and
+	// the public key they replaced
+	rsaKeysMu sync.RWMutex
+
+	// retiredPublicKey still verifies until retiredUntil, so tokens signed
+	// before a rotation live out their lifetime
+	retiredPublicKey *rsa.PublicKey
+	retiredUntil     time.Time
+)
+
+// rsaKeys returns the key pair tokens of jwtIssuer are signed with
+func rsaKeys() (*rsa.PrivateKey, *rsa.PublicKey) {
+	rsaKeysMu.RLock()
+	defer rsaKeysMu.RUnlock()
+	return privateKey, publicKey
+}
+
+// retiredRSAKey returns the public key replaced by the last rotation,
+// while tokens it signed may still be alive
+func retiredRSAKey() *rsa.PublicKey {
+	rsaKeysMu.RLock()
+	defer rsaKeysMu.RUnlock()
+	if retiredPublicKey == nil || jwtClock.Now().After(retiredUntil) {
+		return nil
+	}
+	return retiredPublicKey
+}
+
+// setRSAKeys makes priv and pub the signing pair
+func setRSAKeys(priv *rsa.PrivateKey, pub *rsa.PublicKey, version keyVersion) {
+	rsaKeysMu.Lock()
+	if publicKey != nil && !publicKey.Equal(pub) {
+		retiredPublicKey, retiredUntil = publicKey, jwtClock.Now().Add(jwtLifetime)
+	}
+	privateKey, publicKey = priv, pub
+	rsaKeysMu.Unlock()
+	recordKeyVersion(signingKeyName, version)
+}
+
+// rsaKeyPaths are JWT_PRIVATE_KEY_PATH and JWT_PUBLIC_KEY_PATH, by default
+// jwt_private_key.pem and jwt_public_key.pem
+func rsaKeyPaths() (priv, pub string) {
+	if priv = os.Getenv("JWT_PRIVATE_KEY_PATH"); priv == "" {
+		priv = "jwt_private_key.pem"
+	}
+	if pub = os.Getenv("JWT_PUBLIC_KEY_PATH"); pub == "" {
+		pub = "jwt_public_key.pem"
+	}
+	return priv, pub
+}
+
+// loadRSAKeyFiles reads the signing pair from its PEM files
+func loadRSAKeyFiles() error {
+	priv, pub, err := readRSAKeyFiles()
+	if err != nil {
+		return err
+	}
+	_, pubPath := rsaKeyPaths()
+	setRSAKeys(priv, pub, newKeyVersion(pubPath, pub))
+	return nil
+}
+
+// reloadRSAKeyFiles is loadRSAKeyFiles for watchKeyFiles
+func reloadRSAKeyFiles() error {
+	priv, pub, err := readRSAKeyFiles()
+	if err != nil {
+		return err
+	}
+	if keyInUse(signingKeyName, pub) {
+		return errKeyUnchanged
+	}
+	_, pubPath := rsaKeyPaths()
+	setRSAKeys(priv, pub, newKeyVersion(pubPath, pub))
+	return nil
+}
+
+// readRSAKeyFiles reads the signing pair, which must match: a Secret
+// rotates both files at once, but plain files may be caught between writes
+func readRSAKeyFiles() (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	privPath, pubPath := rsaKeyPaths()
+	privateKeyData, err := os.ReadFile(privPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	priv, err := jwt.ParseRSAPrivateKeyFromPEM(privateKeyData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	publicKeyData, err := os.ReadFile(pubPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+	pub, err := jwt.ParseRSAPublicKeyFromPEM(publicKeyData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	if !priv.PublicKey.Equal(pub) {
+		return nil, nil, errors.New("public key does not match the private key")
+	}
+	return priv, pub, nil
+}
+
+// watchRSAKeyFiles reloads the signing pair when its files change, as when
+// the Secret they are mounted from rotates
+func watchRSAKeyFiles(log logrus.FieldLogger) {
+	if IsJWTAutogenKeysEnabled() {
+		return
+	}
+	priv, pub := rsaKeyPaths()
+	if _, err := watchKeyFiles(signingKeyName, []string{priv, pub}, reloadRSAKeyFiles); err != nil {
+		log.Warnf("not reloading the JWT keys on rotation: %v", err)
+	}
+}
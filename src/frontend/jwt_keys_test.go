@@ -0,0 +1,138 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestRSAKeysReloadOnSecretRotation(t *testing.T) {
+	t.Cleanup(func() {
+		if err := loadRSAKeys(); err != nil {
+			t.Errorf("loadRSAKeys() error = %v", err)
+		}
+		rsaKeysMu.Lock()
+		retiredPublicKey = nil
+		rsaKeysMu.Unlock()
+	})
+	clock := useFakeClock(t)
+	// mount writes a key pair as a Kubernetes Secret generation: the
+	// kubelet swaps ..data to a new timestamped directory
+	dir := t.TempDir()
+	mount := func(generation string) *rsa.PrivateKey {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := map[string][]byte{
+			"jwt_private_key.pem": pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+			"jwt_public_key.pem":  pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+		}
+		if err := os.Mkdir(filepath.Join(dir, generation), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for name, data := range files {
+			if err := os.WriteFile(filepath.Join(dir, generation, name), data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Lstat(filepath.Join(dir, name)); os.IsNotExist(err) {
+				if err := os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := os.Symlink(generation, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	t.Setenv("JWT_PRIVATE_KEY_PATH", filepath.Join(dir, "jwt_private_key.pem"))
+	t.Setenv("JWT_PUBLIC_KEY_PATH", filepath.Join(dir, "jwt_public_key.pem"))
+
+	first := mount("..2024_06_01_12_00_00.1")
+	loadTestRSAKeys(t)
+	if priv, _ := rsaKeys(); !priv.Equal(first) {
+		t.Fatal("loadRSAKeys() did not load the mounted key pair")
+	}
+	old, err := generateJWT("rotation-session", "USD", claimsProfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	privPath, pubPath := rsaKeyPaths()
+	w, err := watchKeyFiles(signingKeyName, []string{privPath, pubPath}, reloadRSAKeyFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	second := mount("..2024_06_01_13_00_00.2")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if priv, _ := rsaKeys(); priv.Equal(second) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("signing key not reloaded after the Secret rotated")
+		}
+	}
+	var version keyVersion
+	if err := json.Unmarshal([]byte(jwtKeyVersions.Get(signingKeyName).String()), &version); err != nil {
+		t.Fatal(err)
+	}
+	if version.Generation != "..2024_06_01_13_00_00.2" || version.Fingerprint != rsaKeyFingerprint(&second.PublicKey) {
+		t.Errorf("jwt_key_versions[%s] = %+v", signingKeyName, version)
+	}
+
+	fresh, err := generateJWT("rotation-session", "USD", claimsProfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwt.Parse(fresh, func(*jwt.Token) (interface{}, error) { return &second.PublicKey, nil }); err != nil {
+		t.Errorf("token minted after the rotation is not signed with the new key: %v", err)
+	}
+	// Tokens signed before the rotation verify until they expire
+	if _, err := validateJWT(old); err != nil {
+		t.Errorf("validateJWT(token signed before the rotation) error = %v", err)
+	}
+	clock.Advance(jwtLifetime + time.Second)
+	if retiredRSAKey() != nil {
+		t.Error("the replaced key still verifies after the token lifetime")
+	}
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestJWTLogFields(t *testing.T) {
+	loadTestRSAKeys(t)
+	claims := jwtGoldenClaims()
+	token, err := generateJWTFromClaims(claims)
+	if err != nil {
+		t.Fatalf("generateJWTFromClaims() error = %v", err)
+	}
+
+	fields := jwtLogFields(token, jwtModeFull, len(token))
+	if fields[logFieldJTI] != claims.ID {
+		t.Errorf("%s = %v, want %q", logFieldJTI, fields[logFieldJTI], claims.ID)
+	}
+	if fields[logFieldSubHash] != hashSubject(claims.Subject) || fields[logFieldSubHash] == claims.Subject {
+		t.Errorf("%s = %v, want the hash of %q", logFieldSubHash, fields[logFieldSubHash], claims.Subject)
+	}
+	if fields[logFieldMode] != jwtModeFull || fields[logFieldSize] != len(token) {
+		t.Errorf("mode, size = %v, %v, want %q, %d", fields[logFieldMode], fields[logFieldSize], jwtModeFull, len(token))
+	}
+
+	ref := jwtLogFields(opaqueTokenPrefix+"abc", jwtModeReference, 7)
+	if _, ok := ref[logFieldJTI]; ok {
+		t.Errorf("reference token logged a jti: %v", ref)
+	}
+}
+
+// TestJWTFlowSampler caps the lines per method and second, lets through
+// calls with larger metadata, and summarizes every call
+func TestJWTFlowSampler(t *testing.T) {
+	clock := useFakeClock(t)
+	s := &jwtFlowSampler{rate: 2, interval: time.Minute, methods: make(map[string]*jwtFlowStats)}
+	s.start.Do(func() {}) // summarized by hand below
+
+	const method = "/hipstershop.CartService/GetCart"
+	var logged []bool
+	for _, size := range []int{100, 100, 100, 100, 200} {
+		logged = append(logged, s.Sample(method, jwtModeCompressed, size))
+	}
+	clock.Advance(time.Second)
+	logged = append(logged, s.Sample(method, jwtModeFull, 90))
+	if want := []bool{true, true, false, false, true, true}; !reflect.DeepEqual(logged, want) {
+		t.Errorf("logged = %v, want %v", logged, want)
+	}
+	if !s.Sample("/hipstershop.CurrencyService/Convert", jwtModeFull, 10) {
+		t.Error("first call of another method not logged")
+	}
+
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.Out = &buf
+	l.Formatter = &logrus.JSONFormatter{}
+	s.summarize(l)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("summary has %d lines, want one per method:\n%s", len(lines), buf.String())
+	}
+	var summary map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &summary); err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]interface{}{
+		"jwt.flow.calls":          6.0,
+		"jwt.flow.logged":         4.0,
+		"jwt.flow.avg_size_bytes": 115.0,
+		"jwt.flow.max_size_bytes": 200.0,
+		"jwt.flow.modes":          "compressed=5 full=1",
+	} {
+		if summary[field] != want {
+			t.Errorf("%s = %v, want %v", field, summary[field], want)
+		}
+	}
+
+	buf.Reset()
+	s.summarize(l)
+	if buf.Len() != 0 {
+		t.Errorf("summary without calls: %s", buf.String())
+	}
+	if every := (&jwtFlowSampler{rate: -1}); !every.Sample(method, jwtModeFull, 100) || !every.Sample(method, jwtModeFull, 100) {
+		t.Error("unset JWT_FLOW_LOG_RATE dropped a line")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestComponentMACDetectsAlteredHeaders(t *testing.T) {
+	loadTestRSAKeys(t)
+	defer func(key []byte) { componentMACKey = key }(componentMACKey)
+	t.Setenv("JWT_COMPONENT_MAC_SECRET", "mac-secret")
+	componentMACKey = loadComponentMACKey()
+	token, err := generateJWTFromClaims(jwtGoldenClaims())
+	if err != nil {
+		t.Fatalf("generateJWTFromClaims() error = %v", err)
+	}
+	pairs, err := perClassCodec{}.Encode(token)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		alter func(md metadata.MD)
+		ok    bool
+	}{
+		"as sent": {func(md metadata.MD) {}, true},
+		// Mode negotiation headers are added after the MAC is computed
+		"negotiated": {func(md metadata.MD) { md.Set("x-jwt-mode", "full") }, true},
+		"dropped":    {func(md metadata.MD) { delete(md, jwtHeaders.Dynamic) }, false},
+		"altered":    {func(md metadata.MD) { md.Set(jwtHeaders.Session, md.Get(jwtHeaders.Static)...) }, false},
+		"no mac":     {func(md metadata.MD) { delete(md, jwtHeaders.Prefix+componentMACField) }, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			md := metadata.Pairs(pairs...)
+			tc.alter(md)
+			err := verifyComponentMAC(jwtHeaders, md)
+			if tc.ok && err != nil {
+				t.Errorf("verifyComponentMAC() error = %v", err)
+			}
+			if !tc.ok && !errors.Is(err, errJWTSignatureInvalid) {
+				t.Errorf("verifyComponentMAC() error = %v, want %v", err, errJWTSignatureInvalid)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestMeshTokenSurvivesDecomposition(t *testing.T) {
+	loadTestRSAKeys(t)
+	t.Setenv("JWT_MESH_SECRET", "mesh-test-secret")
+	resetMeshKey(t)
+
+	token, err := generateJWTFromClaims(jwtGoldenClaims())
+	if err != nil {
+		t.Fatalf("generateJWTFromClaims() error = %v", err)
+	}
+	mesh := meshToken(token)
+	if mesh == token {
+		t.Fatal("meshToken() did not re-sign the token")
+	}
+	sig := func(tok string) string { return tok[strings.LastIndexByte(tok, '.')+1:] }
+	if len(sig(mesh)) >= len(sig(token)) {
+		t.Errorf("mesh signature is %d bytes, RS256 is %d", len(sig(mesh)), len(sig(token)))
+	}
+
+	pairs, err := perClassCodec{}.Encode(mesh)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	decoded, err := perClassCodec{}.Decode(metadata.Pairs(pairs...))
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if decoded.Token != mesh {
+		t.Fatalf("reassembled token differs from the mesh token:\n got %s\nwant %s", decoded.Token, mesh)
+	}
+	if err := verifyMeshToken(decoded.Token); err != nil {
+		t.Errorf("verifyMeshToken(reassembled) error = %v", err)
+	}
+	if _, verifiedBy, err := verifyToken(decoded.Token); err != nil || verifiedBy != "mesh" {
+		t.Errorf("verifyToken() = %q, %v, want mesh", verifiedBy, err)
+	}
+
+	if _, err := validateJWT(mesh); err == nil {
+		t.Error("validateJWT() accepted a mesh token as a cookie")
+	}
+	if err := verifyMeshToken(token); !errors.Is(err, errJWTSignatureInvalid) {
+		t.Errorf("verifyMeshToken(RS256 token) error = %v, want %v", err, errJWTSignatureInvalid)
+	}
+	tampered := mesh[:len(mesh)-2] + "AA"
+	if err := verifyMeshToken(tampered); !errors.Is(err, errJWTSignatureInvalid) {
+		t.Errorf("verifyMeshToken(tampered) error = %v, want %v", err, errJWTSignatureInvalid)
+	}
+}
+
+func TestMeshTokenTruncatedMAC(t *testing.T) {
+	loadTestRSAKeys(t)
+	t.Setenv("JWT_MESH_SECRET", "mesh-test-secret")
+	resetMeshKey(t)
+	token, err := generateJWTFromClaims(jwtGoldenClaims())
+	if err != nil {
+		t.Fatalf("generateJWTFromClaims() error = %v", err)
+	}
+	full := meshToken(token)
+
+	t.Setenv("JWT_MESH_MAC_BYTES", "16")
+	resetMeshKey(t)
+	truncated := meshToken(token)
+	sig := truncated[strings.LastIndexByte(truncated, '.')+1:]
+	if want := base64.RawURLEncoding.EncodedLen(16); len(sig) != want {
+		t.Errorf("truncated signature is %d characters, want %d", len(sig), want)
+	}
+	if err := verifyMeshToken(truncated); err != nil {
+		t.Errorf("verifyMeshToken(truncated) error = %v", err)
+	}
+	if _, verifiedBy, err := verifyToken(truncated); err != nil || verifiedBy != "mesh" {
+		t.Errorf("verifyToken(truncated) = %q, %v, want mesh", verifiedBy, err)
+	}
+
+	rejected := func() string {
+		if v := meshTokenStats.Get("rejected"); v != nil {
+			return v.String()
+		}
+		return "0"
+	}
+	before := rejected()
+	if err := verifyMeshToken(full); !errors.Is(err, errJWTSignatureInvalid) {
+		t.Errorf("verifyMeshToken(full MAC) error = %v, want %v", err, errJWTSignatureInvalid)
+	}
+	if after := rejected(); after == before {
+		t.Errorf("jwt_mesh_tokens.rejected = %s, want it incremented", after)
+	}
+}
+
+// resetMeshKey makes meshKey reload the mesh settings from the environment
+func resetMeshKey(t *testing.T) {
+	t.Helper()
+	reset := func() { meshKeyOnce, meshKeyVal, meshMACBytes = sync.Once{}, nil, sha256.Size }
+	reset()
+	t.Cleanup(reset)
+}
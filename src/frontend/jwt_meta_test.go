@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestJWTMetaDetectsAlteredHeaders(t *testing.T) {
+	loadTestRSAKeys(t)
+	t.Setenv("JWT_META_HEADER", "true")
+	token, err := generateJWTFromClaims(jwtGoldenClaims())
+	if err != nil {
+		t.Fatalf("generateJWTFromClaims() error = %v", err)
+	}
+	pairs, err := perClassCodec{}.Encode(token)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if decoded, err := DecodeJWTMetadata(metadata.Pairs(pairs...)); err != nil || decoded == nil {
+		t.Fatalf("DecodeJWTMetadata() = %v, %v", decoded, err)
+	}
+
+	swap := func(md metadata.MD) {
+		md[jwtHeaders.Static], md[jwtHeaders.Session] = md[jwtHeaders.Session], md[jwtHeaders.Static]
+	}
+	for name, tc := range map[string]struct {
+		alter func(md metadata.MD)
+		want  string
+	}{
+		"dropped":  {func(md metadata.MD) { delete(md, jwtHeaders.Dynamic) }, "4 components sent, 3 received"},
+		"swapped":  {swap, "checksum mismatch"},
+		"no meta":  {func(md metadata.MD) { delete(md, jwtHeaders.Prefix+jwtMetaField) }, "missing"},
+		"bad meta": {func(md metadata.MD) { md.Set(jwtHeaders.Prefix+jwtMetaField, "v=9") }, "unsupported"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			md := metadata.Pairs(pairs...)
+			tc.alter(md)
+			_, err := DecodeJWTMetadata(md)
+			if !errors.Is(err, errJWTMalformed) || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("DecodeJWTMetadata() error = %v, want %v containing %q", err, errJWTMalformed, tc.want)
+			}
+		})
+	}
+}
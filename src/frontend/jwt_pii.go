@@ -0,0 +1,67 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+)
+
+// profileRefBytes is the length of a profile reference before encoding,
+// short enough that the reference is smaller than the claims it replaces
+const profileRefBytes = 8
+
+// IsJWTPIIIncluded reports whether tokens carry the name and market_id
+// claims. With JWT_INCLUDE_PII=false they carry a profile_ref instead,
+// which keeps personal data out of every header and log downstream and
+// shrinks the session component.
+func IsJWTPIIIncluded() bool {
+	return os.Getenv("JWT_INCLUDE_PII") != "false"
+}
+
+// profileRef is the profile reference of a session. It is stable for the
+// session, so the session component stays cacheable, but does not reveal
+// the session ID.
+func profileRef(sessionID string) string {
+	sum := sha256.Sum256([]byte("hipstershop/profile-ref/v1\x00" + sessionID))
+	return base64.RawURLEncoding.EncodeToString(sum[:profileRefBytes])
+}
+
+// minimizeClaims replaces the personal claims with a profile reference
+// unless JWT_INCLUDE_PII allows them
+func minimizeClaims(claims *JWTClaims) {
+	if IsJWTPIIIncluded() {
+		return
+	}
+	claims.Name, claims.MarketID = "", ""
+	claims.ProfileRef = profileRef(claims.SessionID)
+}
+
+// resolveProfileClaims fills in the name and market_id of minimized claims
+// from the claims provider, for the services that introspect tokens
+func resolveProfileClaims(ctx context.Context, claims *JWTClaims) {
+	if claims.ProfileRef == "" {
+		return
+	}
+	p := profiles.lookup(ctx, claims.SessionID)
+	if claims.Name == "" {
+		claims.Name = p.Name
+	}
+	if claims.MarketID == "" {
+		claims.MarketID = p.MarketID
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestJWTIncludePII(t *testing.T) {
+	loadTestRSAKeys(t)
+	session := func(token string) (string, map[string]interface{}) {
+		t.Helper()
+		components, err := DecomposeJWT(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, payload, _, err := parseJWT(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return components.Session, payload
+	}
+	full, err := generateJWT("pii-session", "USD", defaultClaimsProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JWT_INCLUDE_PII", "false")
+	minimized, err := generateJWT("pii-session", "USD", defaultClaimsProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fullSession, _ := session(full)
+	minSession, payload := session(minimized)
+	if _, ok := payload["name"]; ok {
+		t.Errorf("name sent with JWT_INCLUDE_PII=false: %v", payload)
+	}
+	if _, ok := payload["market_id"]; ok {
+		t.Errorf("market_id sent with JWT_INCLUDE_PII=false: %v", payload)
+	}
+	if payload["profile_ref"] != profileRef("pii-session") {
+		t.Errorf("profile_ref = %v, want %s", payload["profile_ref"], profileRef("pii-session"))
+	}
+	if len(minSession) >= len(fullSession) {
+		t.Errorf("session component is %d bytes minimized, %d in full", len(minSession), len(fullSession))
+	}
+
+	// Services that introspect the token get the profile back
+	resp, err := (&tokenServer{}).Introspect(context.Background(), &pb.IntrospectRequest{Token: minimized})
+	if err != nil || !resp.GetActive() {
+		t.Fatalf("Introspect() = %v, %v", resp, err)
+	}
+	if got := resp.GetClaims(); got["name"] != defaultClaimsProfile.Name || got["market_id"] != defaultClaimsProfile.MarketID {
+		t.Errorf("introspected claims = %v, want the default profile", got)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	mrand "math/rand/v2"
+	"os"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// jwtRand is the source of the random parts of what the frontend mints:
+// token IDs, random_value, generated injected claims, reference tokens and
+// new session IDs. It is crypto/rand unless JWT_DETERMINISTIC_SEED is set;
+// tests replace it like jwtClock.
+var jwtRand io.Reader = rand.Reader
+
+// loadJWTRandom returns a stream seeded from JWT_DETERMINISTIC_SEED, any
+// string, or crypto/rand when it is unset. Two load-test runs with the same
+// seed sending the same requests in the same order get the same token
+// stream, apart from the times in it, so runs differing in one setting can
+// be compared token for token.
+func loadJWTRandom() io.Reader {
+	seed := os.Getenv("JWT_DETERMINISTIC_SEED")
+	if seed == "" {
+		return rand.Reader
+	}
+	log.Warn("JWT_DETERMINISTIC_SEED is set: token IDs and session IDs are reproducible, and so guessable; use it for experiments only")
+	return newSeededRand(seed)
+}
+
+// seededRand is a ChaCha8 stream safe for concurrent use. Concurrent
+// readers take their bytes in the order they arrive.
+type seededRand struct {
+	mu  sync.Mutex
+	src *mrand.ChaCha8
+}
+
+func newSeededRand(seed string) *seededRand {
+	return &seededRand{src: mrand.NewChaCha8(sha256.Sum256([]byte(seed)))}
+}
+
+func (r *seededRand) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.src.Read(p)
+}
+
+// newJWTUUID returns a random UUID read from jwtRand
+func newJWTUUID() uuid.UUID {
+	u, _ := uuid.NewRandomFromReader(jwtRand)
+	return u
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestJWTDeterministicSeed(t *testing.T) {
+	loadTestRSAKeys(t)
+	useFakeClock(t)
+	defer func(r io.Reader) { jwtRand = r }(jwtRand)
+
+	// run mints tokens for two new sessions from a source seeded with seed
+	run := func(seed string) []string {
+		t.Setenv("JWT_DETERMINISTIC_SEED", seed)
+		jwtRand = loadJWTRandom()
+		var out []string
+		for i := 0; i < 2; i++ {
+			sessionID, _ := newSessionID(context.Background())
+			token, err := generateJWT(sessionID, defaultCurrency, defaultClaimsProfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, token)
+		}
+		return out
+	}
+	a, b := run("experiment-1"), run("experiment-1")
+	if !reflect.DeepEqual(a, b) {
+		t.Error("two runs with the same seed minted different tokens")
+	}
+	if a[0] == a[1] {
+		t.Error("a run minted the same token twice")
+	}
+	if c := run("experiment-2"); c[0] == a[0] {
+		t.Error("another seed minted the same token")
+	}
+	if c, d := run(""), run(""); c[0] == d[0] {
+		t.Error("two unseeded runs minted the same token")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+type ctxKeyRegeneratedJWT struct{}
+
+// regeneratedJWT is the token the client interceptors regenerated from a
+// request's claims when its context carried none, signed once and shared
+// by every call the request makes
+type regeneratedJWT struct {
+	mu     sync.Mutex
+	claims *JWTClaims
+	token  string
+}
+
+// withJWTRegeneration makes room in a request's context for the token
+// regenerated from its claims
+func withJWTRegeneration(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyRegeneratedJWT{}, &regeneratedJWT{})
+}
+
+// regenerateJWT signs claims again for a call whose context has claims but
+// no token. The claims are signed as they are, keeping their jti, iat and
+// exp, so the token stands for the original one rather than a new one; an
+// expired token is rejected downstream and refreshed by the interceptor's
+// retry. Within a request prepared by withJWTRegeneration, the claims are
+// signed only once, and concurrent calls wait for that signature.
+func regenerateJWT(ctx context.Context, claims *JWTClaims) (string, error) {
+	if claims.ID == "" || claims.IssuedAt == nil || claims.ExpiresAt == nil {
+		return "", errors.New("claims without jti, iat and exp cannot be regenerated")
+	}
+	memo, ok := ctx.Value(ctxKeyRegeneratedJWT{}).(*regeneratedJWT)
+	if !ok {
+		return generateJWTFromClaimsContext(ctx, claims)
+	}
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+	if memo.claims == claims && memo.token != "" {
+		return memo.token, nil
+	}
+	token, err := generateJWTFromClaimsContext(ctx, claims)
+	if err != nil {
+		return "", err
+	}
+	memo.claims, memo.token = claims, token
+	return token, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// jwtInfrastructurePrefixes are the services whose methods never carry a
+// JWT: probes and tooling call them without a user
+var jwtInfrastructurePrefixes = []string{
+	"/grpc.health.v1.Health/",
+	"/grpc.reflection.",
+}
+
+var (
+	jwtSkipOnce    sync.Once
+	jwtSkipPattern *regexp.Regexp
+)
+
+// loadJWTSkipPattern compiles JWT_SKIP_METHODS, a regular expression
+// matched against full method names such as
+// "/hipstershop.CurrencyService/Convert"
+func loadJWTSkipPattern() *regexp.Regexp {
+	v := os.Getenv("JWT_SKIP_METHODS")
+	if v == "" {
+		return nil
+	}
+	re, err := regexp.Compile(v)
+	if err != nil {
+		log.Warnf("ignoring invalid JWT_SKIP_METHODS %q: %v", v, err)
+		return nil
+	}
+	return re
+}
+
+// skipJWTMethod reports whether the JWT interceptors leave method alone:
+// health checks, reflection and methods matching JWT_SKIP_METHODS
+func skipJWTMethod(method string) bool {
+	for _, prefix := range jwtInfrastructurePrefixes {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+	jwtSkipOnce.Do(func() { jwtSkipPattern = loadJWTSkipPattern() })
+	return jwtSkipPattern != nil && jwtSkipPattern.MatchString(method)
+}
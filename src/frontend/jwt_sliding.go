@@ -0,0 +1,109 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Sliding sessions make the short token lifetime workable for real
+// browsing. With JWT_SLIDING_SESSION=true a token in the last quarter of
+// its lifetime is replaced on the next request, keeping its session
+// claims. SESSION_IDLE_TIMEOUT ends sessions idle for longer: the JWT
+// cookie then outlives the token by as much, so the frontend can tell an
+// idle session from a new one, and starts a new session for it.
+const jwtRenewalFraction = 4
+
+var (
+	jwtSlidingSession  = os.Getenv("JWT_SLIDING_SESSION") == "true"
+	sessionIdleTimeout = loadSessionIdleTimeout()
+
+	// jwtSessionRenewals counts sliding renewals and sessions ended for
+	// inactivity
+	jwtSessionRenewals = expvar.NewMap("jwt_session_renewals")
+)
+
+func loadSessionIdleTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SESSION_IDLE_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return 0
+}
+
+// jwtCookieLifetime is the MaxAge of the JWT cookies
+func jwtCookieLifetime() int {
+	if sessionIdleTimeout > 0 {
+		return int(sessionIdleTimeout / time.Second)
+	}
+	return jwtCookieMaxAge
+}
+
+// needsSlidingRenewal reports whether claims are valid but close enough to
+// expiry to be replaced
+func needsSlidingRenewal(claims *JWTClaims) bool {
+	return jwtSlidingSession && claims.ExpiresAt != nil &&
+		jwtUntil(claims.ExpiresAt.Time) < jwtLifetime/jwtRenewalFraction
+}
+
+// sessionIdle reports whether the session of an expired token saw no
+// request for longer than SESSION_IDLE_TIMEOUT. Active sessions are renewed
+// within the last quarter of every lifetime, so the token's iat is at most
+// that much older than the last request.
+func sessionIdle(claims *JWTClaims) bool {
+	return sessionIdleTimeout > 0 && claims.IssuedAt != nil &&
+		jwtSince(claims.IssuedAt.Time) > sessionIdleTimeout
+}
+
+// expiredJWTClaims returns the claims of a token validateJWT rejected as
+// expired. Its signature was checked before its expiry, so they are genuine.
+func expiredJWTClaims(tokenString string) (*JWTClaims, error) {
+	claims := &JWTClaims{}
+	if _, err := jwt.ParseWithClaims(tokenString, claims, jwtKeyFunc, jwt.WithoutClaimsValidation()); err != nil {
+		return nil, classifyJWTError(err)
+	}
+	if tokens.isRevoked(claims.ID) {
+		return nil, fmt.Errorf("%w: jti=%s", errJWTRevoked, claims.ID)
+	}
+	return claims, nil
+}
+
+// idleCookieSession reports whether the request belongs to a session whose
+// JWT cookie lapsed, which with SESSION_IDLE_TIMEOUT means it went idle.
+// Sessions of signed-in users follow their identity and never lapse.
+func idleCookieSession(r *http.Request) bool {
+	if sessionIdleTimeout == 0 || oidcIdentityFromContext(r.Context()) != nil {
+		return false
+	}
+	_, err := r.Cookie(cookieSessionID)
+	return err == nil
+}
+
+// restartSession replaces the request's session with a new one
+func restartSession(w http.ResponseWriter, r *http.Request) *http.Request {
+	sessionID, ctx := newSessionID(r.Context())
+	http.SetCookie(w, &http.Cookie{
+		Name:   cookieSessionID,
+		Value:  sessionID,
+		MaxAge: cookieMaxAge,
+	})
+	return r.WithContext(context.WithValue(ctx, ctxKeySessionID{}, sessionID))
+}
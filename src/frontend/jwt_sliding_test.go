@@ -0,0 +1,105 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestSlidingSessionRenewsAndIdleSessionsEnd(t *testing.T) {
+	useRSAKeys(t)
+	defer func(sliding bool, idle time.Duration) {
+		jwtSlidingSession, sessionIdleTimeout = sliding, idle
+	}(jwtSlidingSession, sessionIdleTimeout)
+	jwtSlidingSession, sessionIdleTimeout = true, 10*time.Minute
+
+	var got *JWTClaims
+	handler := ensureSessionID(ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = getJWTFromContext(r.Context())
+	})))
+	// token signs claims for the session "sliding" issued at iat, expiring
+	// at exp
+	token := func(iat, exp time.Time) string {
+		claims := jwtGoldenClaims()
+		claims.SessionID, claims.Currency = "sliding", defaultCurrency
+		claims.Audience = jwt.ClaimStrings{jwtAudience}
+		claims.IssuedAt, claims.ExpiresAt = jwt.NewNumericDate(iat), jwt.NewNumericDate(exp)
+		s, err := generateJWTFromClaims(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	call := func(jwtCookie string) *http.Response {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: "sliding"})
+		if jwtCookie != "" {
+			r.AddCookie(&http.Cookie{Name: cookieJWT, Value: jwtCookie})
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+	setCookie := func(resp *http.Response, name string) *http.Cookie {
+		for _, c := range resp.Cookies() {
+			if c.Name == name {
+				return c
+			}
+		}
+		return nil
+	}
+	now := time.Now()
+
+	fresh := token(now, now.Add(jwtLifetime))
+	if resp := call(fresh); setCookie(resp, cookieJWT) != nil {
+		t.Error("a fresh token was renewed")
+	}
+
+	// Within the last quarter of its lifetime the token is replaced, for
+	// the same session
+	old := token(now.Add(-jwtLifetime*9/10), now.Add(jwtLifetime/10))
+	resp := call(old)
+	renewed := setCookie(resp, cookieJWT)
+	if renewed == nil || renewed.Value == old || got.SessionID != "sliding" {
+		t.Fatalf("token near expiry: cookie %v, session %q", renewed, got.SessionID)
+	}
+	if renewed.MaxAge != int(sessionIdleTimeout/time.Second) {
+		t.Errorf("JWT cookie MaxAge = %d, want the idle timeout", renewed.MaxAge)
+	}
+	if time.Until(got.ExpiresAt.Time) < jwtLifetime*9/10 {
+		t.Errorf("renewed token expires at %v", got.ExpiresAt)
+	}
+
+	// An expired token of a recently active session is renewed
+	if resp := call(token(now.Add(-3*time.Minute), now.Add(-time.Minute))); setCookie(resp, cookieSessionID) != nil || got.SessionID != "sliding" {
+		t.Errorf("recently expired token: session %q, want sliding", got.SessionID)
+	}
+
+	// Idle sessions end, whether the browser still sends the expired token
+	// or already dropped the cookie
+	idle := token(now.Add(-time.Hour), now.Add(-time.Hour+jwtLifetime))
+	for name, cookie := range map[string]string{"expired token": idle, "no token": ""} {
+		resp := call(cookie)
+		session := setCookie(resp, cookieSessionID)
+		if session == nil || session.Value == "sliding" || got.SessionID != session.Value {
+			t.Errorf("%s of an idle session: new session cookie %v, claims session %q", name, session, got.SessionID)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// jwtTenantIssued counts tokens issued per market tenant, so experiments
+// can relate issuer cardinality to how many static headers HPACK holds
+var jwtTenantIssued = expvar.NewMap("jwt_tenant_issued")
+
+// jwtTenant is the issuer and key pair tokens of one market are signed with
+type jwtTenant struct {
+	market     string
+	issuer     string
+	privateKey *rsa.PrivateKey
+	publicKey  *rsa.PublicKey
+}
+
+// jwtTenantConfig is the file at JWT_TENANTS_PATH, typically a mounted
+// ConfigMap:
+//
+//	tenants:
+//	  - market: EU
+//	    issuer: https://eu.auth.hipstershop.com
+//	    private_key: /etc/jwt-tenants/eu/private.pem
+//	    public_key: /etc/jwt-tenants/eu/public.pem
+type jwtTenantConfig struct {
+	Tenants []struct {
+		Market     string `yaml:"market"`
+		Issuer     string `yaml:"issuer"`
+		PrivateKey string `yaml:"private_key"`
+		PublicKey  string `yaml:"public_key"`
+	} `yaml:"tenants"`
+}
+
+var (
+	// jwtTenantsByMarket and jwtTenantsByIssuer are empty unless
+	// JWT_TENANTS_PATH is set. Markets without a tenant get jwtIssuer.
+	jwtTenantsByMarket map[string]*jwtTenant
+	jwtTenantsByIssuer map[string]*jwtTenant
+)
+
+// loadJWTTenants reads the tenant config at JWT_TENANTS_PATH and the keys
+// it names. It is called with the default keys, so tenants are in place
+// before the frontend reports ready.
+func loadJWTTenants() error {
+	byMarket, byIssuer := make(map[string]*jwtTenant), make(map[string]*jwtTenant)
+	path := os.Getenv("JWT_TENANTS_PATH")
+	if path == "" {
+		jwtTenantsByMarket, jwtTenantsByIssuer = byMarket, byIssuer
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read tenant config: %w", err)
+	}
+	var cfg jwtTenantConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, t := range cfg.Tenants {
+		market := strings.ToUpper(t.Market)
+		switch {
+		case market == "" || t.Issuer == "":
+			return fmt.Errorf("%s: tenant needs a market and an issuer", path)
+		case byMarket[market] != nil:
+			return fmt.Errorf("%s: duplicate tenant for market %s", path, market)
+		case t.Issuer == jwtIssuer:
+			return fmt.Errorf("%s: market %s: %s is the default issuer", path, market, t.Issuer)
+		}
+		tenant := byIssuer[t.Issuer]
+		if tenant == nil {
+			tenant = &jwtTenant{market: market, issuer: t.Issuer}
+			if tenant.privateKey, tenant.publicKey, err = readRSAKeyPair(t.PrivateKey, t.PublicKey); err != nil {
+				return fmt.Errorf("%s: market %s: %w", path, market, err)
+			}
+			byIssuer[t.Issuer] = tenant
+		}
+		// Markets may share an issuer, to vary cardinality without new keys
+		byMarket[market] = tenant
+	}
+	jwtTenantsByMarket, jwtTenantsByIssuer = byMarket, byIssuer
+	log.Infof("issuing JWTs for %d markets with %d tenant issuers", len(byMarket), len(byIssuer))
+	return nil
+}
+
+func readRSAKeyPair(privatePath, publicPath string) (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	data, err := os.ReadFile(privatePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	priv, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	if data, err = os.ReadFile(publicPath); err != nil {
+		return nil, nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+	pub, err := jwt.ParseRSAPublicKeyFromPEM(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	if !priv.PublicKey.Equal(pub) {
+		return nil, nil, fmt.Errorf("%s is not the public key of %s", publicPath, privatePath)
+	}
+	return priv, pub, nil
+}
+
+// issuerFor returns the issuer of tokens for market
+func issuerFor(market string) string {
+	if t, ok := jwtTenantsByMarket[strings.ToUpper(market)]; ok {
+		jwtTenantIssued.Add(t.market, 1)
+		return t.issuer
+	}
+	jwtTenantIssued.Add("default", 1)
+	return jwtIssuer
+}
+
+// signingKeyFor returns the key tokens of issuer are signed with
+func signingKeyFor(issuer string) (*rsa.PrivateKey, error) {
+	if issuer == jwtIssuer {
+		priv, _ := rsaKeys()
+		return priv, nil
+	}
+	if t, ok := jwtTenantsByIssuer[issuer]; ok {
+		return t.privateKey, nil
+	}
+	return nil, fmt.Errorf("no signing key for issuer %q", issuer)
+}
+
+// verificationKeyFor returns the key tokens claiming issuer are verified
+// with. The issuer is unverified until the signature is, so an unknown one
+// is an invalid signature rather than a malformed token.
+func verificationKeyFor(issuer string) (*rsa.PublicKey, error) {
+	if issuer == jwtIssuer {
+		_, pub := rsaKeys()
+		return pub, nil
+	}
+	if t, ok := jwtTenantsByIssuer[issuer]; ok {
+		return t.publicKey, nil
+	}
+	return nil, fmt.Errorf("%w: unknown issuer %q", errJWTSignatureInvalid, issuer)
+}
+
+// jwtKeyFunc is the jwt.Keyfunc for tokens the frontend issued, for any
+// tenant
+func jwtKeyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	issuer, err := token.Claims.GetIssuer()
+	if err != nil {
+		return nil, err
+	}
+	if retired := retiredRSAKey(); issuer == jwtIssuer && retired != nil {
+		_, pub := rsaKeys()
+		return jwt.VerificationKeySet{Keys: []jwt.VerificationKey{pub, retired}}, nil
+	}
+	return verificationKeyFor(issuer)
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestMarketTenantsIssueAndVerify(t *testing.T) {
+	euKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writePEM := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&euKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privPath := writePEM("eu.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(euKey))
+	pubPath := writePEM("eu.pub.pem", "PUBLIC KEY", pubDER)
+	config := filepath.Join(dir, "tenants.yaml")
+	const euIssuer = "https://eu.auth.hipstershop.com"
+	yaml := "tenants:\n" +
+		"  - {market: EU, issuer: " + euIssuer + ", private_key: " + privPath + ", public_key: " + pubPath + "}\n" +
+		"  - {market: uk, issuer: " + euIssuer + ", private_key: " + privPath + ", public_key: " + pubPath + "}\n"
+	if err := os.WriteFile(config, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JWT_TENANTS_PATH", config)
+	loadTestRSAKeys(t)
+	defer func() { jwtTenantsByMarket, jwtTenantsByIssuer = nil, nil }()
+
+	for market, wantIssuer := range map[string]string{"EU": euIssuer, "UK": euIssuer, "US": jwtIssuer} {
+		token, err := generateJWT("tenant-session", "EUR", claimsProfile{MarketID: market})
+		if err != nil {
+			t.Fatalf("%s: generateJWT() error = %v", market, err)
+		}
+		claims, err := validateJWT(token)
+		if err != nil {
+			t.Fatalf("%s: validateJWT() error = %v", market, err)
+		}
+		if claims.Issuer != wantIssuer {
+			t.Errorf("%s: iss = %q, want %q", market, claims.Issuer, wantIssuer)
+		}
+	}
+
+	// A token claiming a tenant issuer must carry that tenant's signature
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodRS256, &JWTClaims{
+		MarketID: "EU",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    euIssuer,
+			Audience:  jwt.ClaimStrings{jwtAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}).SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateJWT(forged); !errors.Is(err, errJWTSignatureInvalid) {
+		t.Errorf("validateJWT(token of the EU issuer signed with the default key) error = %v, want %v", err, errJWTSignatureInvalid)
+	}
+
+	// Allowlists narrow the issuers and audiences taken
+	defer func(issuers, audiences []string) {
+		jwtAcceptedIssuers, jwtAcceptedAudiences = issuers, audiences
+	}(jwtAcceptedIssuers, jwtAcceptedAudiences)
+	eu, _ := generateJWT("tenant-session", "EUR", claimsProfile{MarketID: "EU"})
+	us, _ := generateJWT("tenant-session", "USD", claimsProfile{MarketID: "US"})
+	for _, tc := range []struct {
+		issuers, audiences string
+		eu, us             error
+	}{
+		{"", "", nil, nil},
+		{euIssuer, "", nil, errJWTIssuerMismatch},
+		{euIssuer + ", " + jwtIssuer, "", nil, nil},
+		{jwtIssuer, "", errJWTIssuerMismatch, nil},
+		{"", "urn:hipstershop:partner-api", errJWTAudienceMismatch, errJWTAudienceMismatch},
+		{"", "urn:hipstershop:partner-api," + jwtAudience, nil, nil},
+	} {
+		t.Setenv("JWT_ACCEPTED_ISSUERS", tc.issuers)
+		t.Setenv("JWT_ACCEPTED_AUDIENCES", tc.audiences)
+		if err := loadJWTAllowlists(); err != nil {
+			t.Fatalf("loadJWTAllowlists(%q, %q) error = %v", tc.issuers, tc.audiences, err)
+		}
+		for token, want := range map[string]error{eu: tc.eu, us: tc.us} {
+			if _, err := validateJWT(token); !errors.Is(err, want) || (want == nil) != (err == nil) {
+				t.Errorf("issuers %q, audiences %q: validateJWT() error = %v, want %v", tc.issuers, tc.audiences, err, want)
+			}
+		}
+	}
+	t.Setenv("JWT_ACCEPTED_ISSUERS", "https://unknown.example.com")
+	if err := loadJWTAllowlists(); err == nil {
+		t.Error("loadJWTAllowlists() accepted an issuer without a key")
+	}
+}
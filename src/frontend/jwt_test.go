@@ -0,0 +1,290 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// loadTestRSAKeys loads the signing key pair checked in beside the tests
+func loadTestRSAKeys(t *testing.T) {
+	t.Helper()
+	if err := loadRSAKeys(); err != nil {
+		t.Fatalf("loadRSAKeys() error = %v", err)
+	}
+}
+
+// useRSAKeys is loadTestRSAKeys for tests that serve requests through
+// ensureJWT, which refuses them until the keys are marked loaded
+func useRSAKeys(t *testing.T) {
+	t.Helper()
+	loadTestRSAKeys(t)
+	ready.keysLoaded.Store(true)
+	t.Cleanup(func() { ready.keysLoaded.Store(false) })
+}
+
+func TestEnsureJWTConcurrentMissesShareToken(t *testing.T) {
+	useRSAKeys(t)
+
+	// A slow claims provider keeps the first mint in flight while the other
+	// requests arrive
+	var lookups atomic.Int32
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		json.NewEncoder(w).Encode(claimsProfile{Name: "Test User", MarketID: "US"})
+	}))
+	defer provider.Close()
+	defer func(p *claimsProvider) { profiles = p }(profiles)
+	profiles = newClaimsProvider(provider.URL)
+
+	handler := ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	const requests = 8
+	tokens := make([]string, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), ctxKeySessionID{}, "parallel-session"))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			for _, c := range w.Result().Cookies() {
+				if c.Name == cookieJWT {
+					tokens[i] = c.Value
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, tok := range tokens {
+		if tok == "" {
+			t.Fatalf("request %d got no JWT cookie", i)
+		}
+		if tok != tokens[0] {
+			t.Errorf("request %d got a different token than request 0", i)
+		}
+	}
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("claims provider called %d times, want 1", n)
+	}
+}
+
+func TestEnsureJWTSequentialMissesMintNewTokens(t *testing.T) {
+	useRSAKeys(t)
+
+	handler := ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	mint := func() string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeySessionID{}, "sequential-session"))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		for _, c := range w.Result().Cookies() {
+			if c.Name == cookieJWT {
+				return c.Value
+			}
+		}
+		t.Fatal("no JWT cookie set")
+		return ""
+	}
+	if mint() == mint() {
+		t.Error("sequential misses shared a token; singleflight should only collapse concurrent calls")
+	}
+}
+
+func TestEnsureJWTHonorsRequestDeadline(t *testing.T) {
+	useRSAKeys(t)
+
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		json.NewEncoder(w).Encode(claimsProfile{Name: "Test User", MarketID: "US"})
+	}))
+	defer provider.Close()
+	defer func(p *claimsProvider) { profiles = p }(profiles)
+	profiles = newClaimsProvider(provider.URL)
+
+	handler := ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler ran without a token")
+	}))
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), ctxKeySessionID{}, "deadline-session"), 20*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	handler.ServeHTTP(w, r)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("ensureJWT took %v, want it to give up at the 20ms deadline", elapsed)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := generateJWTFromClaimsContext(cancelled, jwtGoldenClaims()); !errors.Is(err, context.Canceled) {
+		t.Errorf("generateJWTFromClaimsContext(cancelled) error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestJWTNotBeforePredate(t *testing.T) {
+	loadTestRSAKeys(t)
+	clock := useFakeClock(t)
+
+	for predate, want := range map[string]*jwt.NumericDate{
+		"":     nil,
+		"30s":  jwt.NewNumericDate(clock.Now().Add(-30 * time.Second)),
+		"-5s":  nil,
+		"soon": nil,
+	} {
+		t.Setenv("JWT_NBF_PREDATE", predate)
+		token, err := generateJWT("nbf-session", defaultCurrency, defaultClaimsProfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := validateJWT(token)
+		if err != nil {
+			t.Fatalf("JWT_NBF_PREDATE=%q: %v", predate, err)
+		}
+		if (claims.NotBefore == nil) != (want == nil) || want != nil && !claims.NotBefore.Equal(want.Time) {
+			t.Errorf("JWT_NBF_PREDATE=%q: nbf = %v, want %v", predate, claims.NotBefore, want)
+		}
+	}
+
+	claims := jwtGoldenClaims()
+	claims.ExpiresAt = jwt.NewNumericDate(clock.Now().Add(time.Minute))
+	claims.NotBefore = jwt.NewNumericDate(clock.Now().Add(10 * time.Second))
+	token, err := generateJWTFromClaims(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateJWT(token); !errors.Is(err, errJWTNotYetValid) || jwtErrorStatus(err) != http.StatusUnauthorized {
+		t.Fatalf("before nbf: err = %v, want %v", err, errJWTNotYetValid)
+	}
+	clock.Advance(10 * time.Second)
+	if _, err := validateJWT(token); err != nil {
+		t.Fatalf("at nbf: %v", err)
+	}
+}
+
+func TestCurrencyChangeReissuesToken(t *testing.T) {
+	useRSAKeys(t)
+	token, err := generateJWT(jwtSessionFor("currency-session"), "USD", defaultClaimsProfile)
+	if err != nil {
+		t.Fatalf("generateJWT() error = %v", err)
+	}
+	original, _ := validateJWT(token)
+
+	serve := func(token string) (reissued string, seen *JWTClaims) {
+		handler := ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen, _ = getJWTFromContext(r.Context())
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeySessionID{}, "currency-session"))
+		r.AddCookie(&http.Cookie{Name: cookieJWT, Value: token})
+		r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "EUR"})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		for _, c := range w.Result().Cookies() {
+			if c.Name == cookieJWT {
+				reissued = c.Value
+			}
+		}
+		return reissued, seen
+	}
+
+	before := expvarInt(jwtClaimRefreshes, "currency")
+	reissued, seen := serve(token)
+	if reissued == "" {
+		t.Fatal("token not re-issued for the currency change")
+	}
+	claims, err := validateJWT(reissued)
+	if err != nil {
+		t.Fatalf("re-issued token: %v", err)
+	}
+	if claims.Currency != "EUR" || claims.SessionID != original.SessionID || claims.Subject != original.Subject {
+		t.Errorf("re-issued claims = %+v, want currency EUR for session %s", claims, original.SessionID)
+	}
+	if seen == nil || seen.Currency != "EUR" {
+		t.Errorf("handler saw claims %+v, want the re-issued ones", seen)
+	}
+	if n := expvarInt(jwtClaimRefreshes, "currency") - before; n != 1 {
+		t.Errorf("jwt_claim_refreshes[currency] += %d, want 1", n)
+	}
+
+	// The re-issued token matches the cookie and is kept
+	if again, _ := serve(reissued); again != "" {
+		t.Error("token re-issued again for an unchanged currency")
+	}
+}
+
+func TestJWTSessionForUserPool(t *testing.T) {
+	defer func(n int) { loadtestUserPoolSize = n }(loadtestUserPoolSize)
+	for v, want := range map[string]int{"": 0, "abc": 0, "-1": 0, "8": 8} {
+		t.Setenv("LOADTEST_USER_POOL_SIZE", v)
+		if got := loadLoadtestUserPoolSize(); got != want {
+			t.Errorf("LOADTEST_USER_POOL_SIZE=%q: pool size = %d, want %d", v, got, want)
+		}
+	}
+
+	loadtestUserPoolSize = 0
+	if got := jwtSessionFor("session-1"); got != "session-1" {
+		t.Errorf("jwtSessionFor() without a pool = %q, want the session", got)
+	}
+
+	loadtestUserPoolSize = 8
+	users := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		user := jwtSessionFor(session)
+		if again := jwtSessionFor(session); again != user {
+			t.Fatalf("jwtSessionFor(%s) = %q, then %q", session, user, again)
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(user, "loadtest-user-"))
+		if err != nil || n < 0 || n >= loadtestUserPoolSize {
+			t.Fatalf("jwtSessionFor(%s) = %q, outside the pool", session, user)
+		}
+		users[user]++
+	}
+	if len(users) != loadtestUserPoolSize {
+		t.Errorf("1000 sessions mapped onto %d users, want all %d", len(users), loadtestUserPoolSize)
+	}
+
+	// Tokens are issued for the pooled user, so sessions share them
+	loadTestRSAKeys(t)
+	token, err := generateJWT("session-1", "USD", defaultClaimsProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := validateJWT(token); err != nil || claims.SessionID != jwtSessionFor("session-1") {
+		t.Errorf("token session = %+v, %v; want %s", claims, err, jwtSessionFor("session-1"))
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Latency histograms are in seconds, Prometheus style, with buckets from a
+// microsecond up so that signing, parsing and the codec resolve next to
+// whole RPCs. They are published with expvar, and on the debug server's
+// /metrics in the OpenMetrics text format, which Prometheus scrapes with
+// exemplars: each bucket carries the trace of its latest observation, so a
+// Grafana panel links from a slow bucket to the trace.
+
+// latencyBuckets are the upper bounds, 1µs to 2.5s
+var latencyBuckets = []float64{
+	1e-6, 2.5e-6, 5e-6, 10e-6, 25e-6, 50e-6, 100e-6, 250e-6, 500e-6,
+	1e-3, 2.5e-3, 5e-3, 10e-3, 25e-3, 50e-3, 100e-3, 250e-3, 500e-3,
+	1, 2.5,
+}
+
+// jwtOperationLatency times the JWT steps by op: generate and validate in
+// the frontend, decompose and reassemble in every copy of the codec
+var jwtOperationLatency = newLatencyHistogram("jwt_operation_seconds",
+	"Latency of JWT operations.", "op")
+
+// latencyHistograms are the histograms /metrics serves, in creation order
+var (
+	latencyHistogramsMu sync.Mutex
+	latencyHistograms   []*latencyHistogram
+)
+
+// latencyHistogram is a histogram family with one label, possibly empty
+type latencyHistogram struct {
+	name, help, label string
+
+	mu     sync.Mutex
+	series map[string]*latencySeries
+}
+
+// latencySeries is the histogram of one label value. counts and exemplars
+// are per bucket, not cumulative, the last being the overflow bucket.
+type latencySeries struct {
+	counts    []uint64
+	exemplars []latencyExemplar
+	count     uint64
+	sum       float64
+}
+
+// latencyExemplar is an observation and the trace it was made in
+type latencyExemplar struct {
+	traceID, spanID string
+	value           float64
+	at              time.Time
+}
+
+// newLatencyHistogram publishes a histogram family under name
+func newLatencyHistogram(name, help, label string) *latencyHistogram {
+	h := &latencyHistogram{name: name, help: help, label: label, series: make(map[string]*latencySeries)}
+	expvar.Publish(name, h)
+	latencyHistogramsMu.Lock()
+	latencyHistograms = append(latencyHistograms, h)
+	latencyHistogramsMu.Unlock()
+	return h
+}
+
+// Observe records d under the label value, with the trace of ctx, if it
+// has one, as the bucket's exemplar
+func (h *latencyHistogram) Observe(ctx context.Context, value string, d time.Duration) {
+	v := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	var ex latencyExemplar
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		ex = latencyExemplar{traceID: sc.TraceID().String(), spanID: sc.SpanID().String(), value: v, at: time.Now()}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[value]
+	if s == nil {
+		s = &latencySeries{
+			counts:    make([]uint64, len(latencyBuckets)+1),
+			exemplars: make([]latencyExemplar, len(latencyBuckets)+1),
+		}
+		h.series[value] = s
+	}
+	s.counts[i]++
+	s.count++
+	s.sum += v
+	if ex.traceID != "" {
+		s.exemplars[i] = ex
+	}
+}
+
+// ObserveSince records the time since start, for use in a defer
+func (h *latencyHistogram) ObserveSince(ctx context.Context, value string, start time.Time) {
+	h.Observe(ctx, value, time.Since(start))
+}
+
+// String implements expvar.Var: per label value the count, the sum and the
+// cumulative bucket counts
+func (h *latencyHistogram) String() string {
+	type series struct {
+		Count   uint64            `json:"count"`
+		Sum     float64           `json:"sum"`
+		Buckets map[string]uint64 `json:"buckets"`
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make(map[string]series, len(h.series))
+	for value, s := range h.series {
+		buckets := make(map[string]uint64, len(s.counts))
+		var cumulative uint64
+		for i, c := range s.counts {
+			cumulative += c
+			buckets[latencyBucketLabel(i)] = cumulative
+		}
+		out[value] = series{s.count, s.sum, buckets}
+	}
+	b, _ := json.Marshal(out)
+	return string(b)
+}
+
+// writeOpenMetrics writes the family in the OpenMetrics text format
+func (h *latencyHistogram) writeOpenMetrics(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# TYPE %s histogram\n# HELP %s %s\n", h.name, h.name, h.help)
+	values := make([]string, 0, len(h.series))
+	for value := range h.series {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		s := h.series[value]
+		labels := ""
+		if h.label != "" {
+			labels = h.label + `="` + openMetricsEscaper.Replace(value) + `",`
+		}
+		var cumulative uint64
+		for i, c := range s.counts {
+			cumulative += c
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d", h.name, labels, latencyBucketLabel(i), cumulative)
+			if ex := s.exemplars[i]; ex.traceID != "" {
+				fmt.Fprintf(w, " # {trace_id=\"%s\",span_id=\"%s\"} %s %s", ex.traceID, ex.spanID,
+					formatOpenMetricsFloat(ex.value), formatOpenMetricsFloat(float64(ex.at.UnixNano())/1e9))
+			}
+			fmt.Fprintln(w)
+		}
+		labels = strings.TrimSuffix(labels, ",")
+		if labels != "" {
+			labels = "{" + labels + "}"
+		}
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatOpenMetricsFloat(s.sum))
+	}
+}
+
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func latencyBucketLabel(i int) string {
+	if i == len(latencyBuckets) {
+		return "+Inf"
+	}
+	return formatOpenMetricsFloat(latencyBuckets[i])
+}
+
+func formatOpenMetricsFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// serveOpenMetrics serves the latency histograms for Prometheus
+func serveOpenMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	latencyHistogramsMu.Lock()
+	histograms := append([]*latencyHistogram(nil), latencyHistograms...)
+	latencyHistogramsMu.Unlock()
+	for _, h := range histograms {
+		h.writeOpenMetrics(w)
+	}
+	fmt.Fprintln(w, "# EOF")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Levels accepted by LOG_REDACTION_LEVEL
+const (
+	// redactionNone logs tokens and claims as they are; for local debugging
+	redactionNone = "none"
+	// redactionStandard keeps enough of a token to tell tokens apart: its
+	// jti, a hash of its subject and the start of its signature
+	redactionStandard = "standard"
+	// redactionStrict replaces tokens and names entirely
+	redactionStrict = "strict"
+)
+
+// redactionSignaturePrefix is how much of a signature standard redaction keeps
+const redactionSignaturePrefix = 8
+
+// logRedactionLevel is read from LOG_REDACTION_LEVEL, standard by default
+var logRedactionLevel = loadLogRedactionLevel()
+
+func loadLogRedactionLevel() string {
+	switch v := strings.ToLower(os.Getenv("LOG_REDACTION_LEVEL")); v {
+	case redactionNone, redactionStrict:
+		return v
+	}
+	return redactionStandard
+}
+
+var (
+	// compactJWTPattern matches a compact JWT anywhere in a string. Header
+	// and payload are JSON objects, so both start with "eyJ" ({").
+	compactJWTPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*`)
+	// opaqueTokenPattern matches a TokenService reference token
+	opaqueTokenPattern = regexp.MustCompile(regexp.QuoteMeta(opaqueTokenPrefix) + `[A-Za-z0-9_-]+`)
+	// nameClaimPattern matches the name claim in decoded JSON, such as a
+	// session component quoted in an error
+	nameClaimPattern = regexp.MustCompile(`"name"\s*:\s*"((?:[^"\\]|\\.)*)"`)
+)
+
+// redactToken returns what may be logged of token
+func redactToken(token string) string {
+	switch {
+	case logRedactionLevel == redactionNone:
+		return token
+	case logRedactionLevel == redactionStrict:
+		return "[redacted token]"
+	case strings.HasPrefix(token, opaqueTokenPrefix):
+		return opaqueTokenPrefix + "…"
+	}
+	_, payload, signature, err := parseJWT(token)
+	if err != nil {
+		return "[redacted token]"
+	}
+	jti, _ := payload["jti"].(string)
+	sub, _ := payload["sub"].(string)
+	if len(signature) > redactionSignaturePrefix {
+		signature = signature[:redactionSignaturePrefix] + "…"
+	}
+	return fmt.Sprintf("jwt(jti=%s sub=%s sig=%s)", jti, hashSubject(sub), signature)
+}
+
+// redactName masks the name claim: standard keeps the first letter
+func redactName(name string) string {
+	switch logRedactionLevel {
+	case redactionNone:
+		return name
+	case redactionStandard:
+		if r, _ := utf8.DecodeRuneInString(name); r != utf8.RuneError {
+			return string(r) + "***"
+		}
+	}
+	return "***"
+}
+
+// redactString redacts every token and name claim found in s
+func redactString(s string) string {
+	if logRedactionLevel == redactionNone {
+		return s
+	}
+	s = compactJWTPattern.ReplaceAllStringFunc(s, redactToken)
+	s = opaqueTokenPattern.ReplaceAllStringFunc(s, redactToken)
+	return nameClaimPattern.ReplaceAllStringFunc(s, func(m string) string {
+		name := nameClaimPattern.FindStringSubmatch(m)[1]
+		return `"name":"` + redactName(name) + `"`
+	})
+}
+
+// redactionHook applies redactString to the message and the string and
+// error fields of every entry, so no log statement can leak a token
+type redactionHook struct{}
+
+func (redactionHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (redactionHook) Fire(entry *logrus.Entry) error {
+	if logRedactionLevel == redactionNone {
+		return nil
+	}
+	entry.Message = redactString(entry.Message)
+	for k, v := range entry.Data {
+		switch v := v.(type) {
+		case string:
+			entry.Data[k] = redactString(v)
+		case error:
+			entry.Data[k] = redactString(v.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLogRedactionAttachJWT(t *testing.T) {
+	loadTestRSAKeys(t)
+	token, err := generateJWTFromClaims(jwtGoldenClaims())
+	if err != nil {
+		t.Fatalf("generateJWTFromClaims() error = %v", err)
+	}
+	var buf bytes.Buffer
+	defer func(out io.Writer) { log.Out = out }(log.Out)
+	log.Out = &buf
+
+	attachJWT(context.Background(), "/hipstershop.CartService/GetCart", "cartservice:7070", token)
+	log.WithField("token", token).Warnf("jwt rejected: %s", token)
+
+	for what, secret := range map[string]string{
+		"token":     token,
+		"signature": token[strings.LastIndexByte(token, '.')+1:],
+		"name":      "Jane Doe",
+	} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("log contains the %s:\n%s", what, buf.String())
+		}
+	}
+}
@@ -25,7 +25,6 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
@@ -100,6 +99,7 @@ func main() {
 		TimestampFormat: time.RFC3339Nano,
 	}
 	log.Out = os.Stdout
+	log.AddHook(redactionHook{})
 
 	svc := new(frontendServer)
 
@@ -137,20 +137,42 @@ func main() {
 	mustMapEnv(&svc.adSvcAddr, "AD_SERVICE_ADDR")
 	mustMapEnv(&svc.shoppingAssistantSvcAddr, "SHOPPING_ASSISTANT_SERVICE_ADDR")
 
-	// Load RSA keys for JWT
+	// jwtRand and the token shape are set before the key loader's canary
+	// self-test signs with them
+	jwtRand = loadJWTRandom()
+	loadTokenShape()
+	// Load RSA keys for JWT. Until they load and pass the canary self-test
+	// the frontend reports not ready.
 	log.Info("Loading RSA keys for JWT...")
-	if err := loadRSAKeys(); err != nil {
-		log.Fatalf("Failed to load RSA keys: %v", err)
+	go ready.loadKeys(log)
+	if jwtPool = loadTokenPool(); jwtPool != nil {
+		go jwtPool.run(context.Background())
 	}
-	log.Info("RSA keys loaded successfully")
-
-	mustConnGRPC(ctx, &svc.currencySvcConn, svc.currencySvcAddr)
-	mustConnGRPC(ctx, &svc.productCatalogSvcConn, svc.productCatalogSvcAddr)
-	mustConnGRPC(ctx, &svc.cartSvcConn, svc.cartSvcAddr)
-	mustConnGRPC(ctx, &svc.recommendationSvcConn, svc.recommendationSvcAddr)
-	mustConnGRPC(ctx, &svc.shippingSvcConn, svc.shippingSvcAddr)
-	mustConnGRPC(ctx, &svc.checkoutSvcConn, svc.checkoutSvcAddr)
-	mustConnGRPC(ctx, &svc.adSvcConn, svc.adSvcAddr)
+	oidc = loadOIDCProvider()
+	serviceClients = loadServiceClients()
+	spiffeMTLS = loadSPIFFEConfig()
+	claimTransformers = loadClaimTransformers()
+	cartIDCutover = loadCartIDCutover()
+	// GRPC_PORT serves gRPC health and the TokenService downstream services
+	// use for introspection. HEALTH_GRPC_PORT is the older name.
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort == "" {
+		grpcPort = os.Getenv("HEALTH_GRPC_PORT")
+	}
+	if grpcPort != "" {
+		go serveGRPC(log, grpcPort)
+	}
+	go serveDebug(log)
+
+	mustConnGRPC(&svc.currencySvcConn, svc.currencySvcAddr, downstreamFeatures("CURRENCY_SERVICE")...)
+	mustConnGRPC(&svc.productCatalogSvcConn, svc.productCatalogSvcAddr, downstreamFeatures("PRODUCT_CATALOG_SERVICE")...)
+	mustConnGRPC(&svc.cartSvcConn, svc.cartSvcAddr, downstreamFeatures("CART_SERVICE")...)
+	mustConnGRPC(&svc.recommendationSvcConn, svc.recommendationSvcAddr, downstreamFeatures("RECOMMENDATION_SERVICE")...)
+	mustConnGRPC(&svc.shippingSvcConn, svc.shippingSvcAddr, downstreamFeatures("SHIPPING_SERVICE")...)
+	mustConnGRPC(&svc.checkoutSvcConn, svc.checkoutSvcAddr, downstreamFeatures("CHECKOUT_SERVICE")...)
+	mustConnGRPC(&svc.adSvcConn, svc.adSvcAddr, downstreamFeatures("AD_SERVICE")...)
+	go ready.waitForDownstream(log, svc.currencySvcConn, svc.productCatalogSvcConn, svc.cartSvcConn,
+		svc.recommendationSvcConn, svc.shippingSvcConn, svc.checkoutSvcConn, svc.adSvcConn)
 
 	r := mux.NewRouter()
 	r.HandleFunc(baseUrl + "/", svc.homeHandler).Methods(http.MethodGet, http.MethodHead)
@@ -162,16 +184,28 @@ func main() {
 	r.HandleFunc(baseUrl + "/logout", svc.logoutHandler).Methods(http.MethodGet)
 	r.HandleFunc(baseUrl + "/cart/checkout", svc.placeOrderHandler).Methods(http.MethodPost)
 	r.HandleFunc(baseUrl + "/assistant", svc.assistantHandler).Methods(http.MethodGet)
+	r.HandleFunc(baseUrl + sessionInfoPath, sessionInfoHandler).Methods(http.MethodGet)
 	r.PathPrefix(baseUrl + "/static/").Handler(http.StripPrefix(baseUrl + "/static/", http.FileServer(http.Dir("./static/"))))
 	r.HandleFunc(baseUrl + "/robots.txt", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "User-agent: *\nDisallow: /") })
 	r.HandleFunc(baseUrl + "/_healthz", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "ok") })
+	r.Handle(baseUrl + "/_readyz", ready)
 	r.HandleFunc(baseUrl + "/product-meta/{ids}", svc.getProductByID).Methods(http.MethodGet)
 	r.HandleFunc(baseUrl + "/bot", svc.chatBotHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl + "/ws/orders", svc.ordersStreamHandler).Methods(http.MethodGet)
+	svc.registerAPIRoutes(r)
+	registerAdminRoutes(r)
+	registerJWTDebugRoutes(r)
+	registerHPACKDebugRoutes(r)
+	registerSignedURLRoutes(r)
 
 	var handler http.Handler = r
-	handler = &logHandler{log: log, next: handler}     // add logging
+	handler = &logHandler{log: log, next: handler} // add logging
+	logged := handler
+	handler = rateLimitBySubject(handler)              // throttle per JWT subject
 	handler = ensureJWT(handler)                       // add JWT (after sessionID)
+	handler = detectJWTAbuse(handler)                  // count and flag invalid tokens per IP and session
 	handler = ensureSessionID(handler)                 // add session ID (first)
+	handler = bypassJWT(handler, logged)               // static assets, probes and signed URLs skip the above
 	handler = otelhttp.NewHandler(handler, "frontend") // add OTel tracing
 
 	log.Infof("starting server on " + addr + ":" + srvPort)
@@ -183,7 +217,7 @@ func initStats(log logrus.FieldLogger) {
 
 func initTracing(log logrus.FieldLogger, ctx context.Context, svc *frontendServer) (*sdktrace.TracerProvider, error) {
 	mustMapEnv(&svc.collectorAddr, "COLLECTOR_SERVICE_ADDR")
-	mustConnGRPC(ctx, &svc.collectorConn, svc.collectorAddr)
+	mustConnGRPC(&svc.collectorConn, svc.collectorAddr)
 	exporter, err := otlptracegrpc.New(
 		ctx,
 		otlptracegrpc.WithGRPCConn(svc.collectorConn))
@@ -229,60 +263,9 @@ func mustMapEnv(target *string, envKey string) {
 	*target = v
 }
 
-func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
+func mustConnGRPC(conn **grpc.ClientConn, addr string, features ...Feature) {
 	var err error
-	ctx, cancel := context.WithTimeout(ctx, time.Second*3)
-	defer cancel()
-	
-	// Chain unary interceptors: JWT first, then OTel
-	unaryChain := func(
-		ctx context.Context,
-		method string,
-		req, reply interface{},
-		cc *grpc.ClientConn,
-		invoker grpc.UnaryInvoker,
-		opts ...grpc.CallOption,
-	) error {
-		// First apply JWT interceptor
-		jwtInterceptor := jwtUnaryClientInterceptor()
-		return jwtInterceptor(ctx, method, req, reply, cc, func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
-			// Then apply OTel interceptor
-			otelInterceptor := otelgrpc.UnaryClientInterceptor()
-			return otelInterceptor(ctx, method, req, reply, cc, invoker, opts...)
-		}, opts...)
-	}
-	
-	// Chain stream interceptors: JWT first, then OTel
-	streamChain := func(
-		ctx context.Context,
-		desc *grpc.StreamDesc,
-		cc *grpc.ClientConn,
-		method string,
-		streamer grpc.Streamer,
-		opts ...grpc.CallOption,
-	) (grpc.ClientStream, error) {
-		// First apply JWT interceptor
-		jwtInterceptor := jwtStreamClientInterceptor()
-		return jwtInterceptor(ctx, desc, cc, method, func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
-			// Then apply OTel interceptor
-			otelInterceptor := otelgrpc.StreamClientInterceptor()
-			return otelInterceptor(ctx, desc, cc, method, streamer, opts...)
-		}, opts...)
-	}
-	
-	// Configure HPACK table size: 256KB total (224KB HPACK table + 32KB overhead)
-	// Default is 4KB (~18 users), increased 64x for high-concurrency scenarios
-	// With JWT shredding + indexing control, 256KB supports:
-	//   - 1 static header (156 bytes, shared by all)
-	//   - 1052 session headers (213 bytes each)
-	//   - Dynamic/signature headers are NOT cached (0 bytes in table)
-	*conn, err = grpc.DialContext(ctx, addr,
-		grpc.WithInsecure(),
-		grpc.WithUnaryInterceptor(unaryChain),
-		grpc.WithStreamInterceptor(streamChain),
-		grpc.WithInitialWindowSize(65535),
-		grpc.WithInitialConnWindowSize(65535),
-		grpc.WithMaxHeaderListSize(262144)) // 256KB (224KB HPACK table + 32KB overhead)
+	*conn, err = newClientConn(addr, features...)
 	if err != nil {
 		panic(errors.Wrapf(err, "grpc: failed to connect %s", addr))
 	}
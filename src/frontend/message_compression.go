@@ -0,0 +1,121 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip" // registers "gzip" for calls and responses
+	"google.golang.org/grpc/stats"
+)
+
+// Message compression shrinks the protobuf payloads, JWT compression the
+// headers. Both are counted per downstream target, in grpc_messages here
+// and hpack_connections for headers, so their gains can be told apart.
+const (
+	messageCompressionIdentity = "identity"
+	messageCompressionGzip     = "gzip"
+	// messageCompressionZstd needs a compressor registered under "zstd"
+	// with encoding.RegisterCompressor; none is built in
+	messageCompressionZstd = "zstd"
+)
+
+// grpcMessages holds a map per target: compressor, and the payload bytes
+// sent and received before ("sent payload_bytes") and after ("sent
+// compressed_bytes") compression
+var grpcMessages = expvar.NewMap("grpc_messages")
+
+// messageCompressionFor returns the compressor for calls to a downstream,
+// from <SERVICE>_MESSAGE_COMPRESSION or else MESSAGE_COMPRESSION: identity
+// (the default), gzip or zstd. A compressor that is not registered is
+// logged and identity is used.
+func messageCompressionFor(service string) string {
+	for _, key := range []string{service + "_MESSAGE_COMPRESSION", "MESSAGE_COMPRESSION"} {
+		v := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
+		switch {
+		case v == "":
+			continue
+		case v != messageCompressionIdentity && v != messageCompressionGzip && v != messageCompressionZstd:
+			log.Warnf("ignoring invalid %s=%q: want identity, gzip or zstd", key, v)
+			continue
+		case v != messageCompressionIdentity && encoding.GetCompressor(v) == nil:
+			log.Warnf("%s=%s: no %s compressor is registered, sending identity", key, v, v)
+			return messageCompressionIdentity
+		}
+		return v
+	}
+	return messageCompressionIdentity
+}
+
+// withMessageCompression compresses the messages of every call on the
+// connection with the named registered compressor, and counts payload bytes
+// before and after compression. Servers answer with the compressor of the
+// call when they have it registered.
+func withMessageCompression(name string) Feature {
+	return func(c *clientConnConfig) {
+		m := messageStatsFor(c.target)
+		m.Set("compressor", stringVar(name))
+		if name != messageCompressionIdentity {
+			c.dialOpts = append(c.dialOpts, grpc.WithDefaultCallOptions(grpc.UseCompressor(name)))
+		}
+		c.dialOpts = append(c.dialOpts, grpc.WithStatsHandler(messageStatsHandler{stats: m}))
+	}
+}
+
+func messageStatsFor(target string) *expvar.Map {
+	if m, ok := grpcMessages.Get(target).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map).Init()
+	grpcMessages.Set(target, m)
+	return m
+}
+
+func stringVar(s string) *expvar.String {
+	v := new(expvar.String)
+	v.Set(s)
+	return v
+}
+
+// messageStatsHandler counts the payloads of a connection's calls
+type messageStatsHandler struct {
+	stats *expvar.Map
+}
+
+func (h messageStatsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (h messageStatsHandler) HandleRPC(_ context.Context, s stats.RPCStats) {
+	switch p := s.(type) {
+	case *stats.OutPayload:
+		h.stats.Add("sent payload_bytes", int64(p.Length))
+		h.stats.Add("sent compressed_bytes", int64(p.CompressedLength))
+	case *stats.InPayload:
+		h.stats.Add("received payload_bytes", int64(p.Length))
+		h.stats.Add("received compressed_bytes", int64(p.CompressedLength))
+	}
+}
+
+func (h messageStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h messageStatsHandler) HandleConn(context.Context, stats.ConnStats) {}
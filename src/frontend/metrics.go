@@ -0,0 +1,80 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"strconv"
+	"sync"
+)
+
+// Metrics are published with expvar and served as JSON on /debug/vars of
+// the DEBUG_ADDR listener, off the service port.
+
+// histogram is an expvar.Var counting observations into fixed upper-bound
+// buckets, plus an overflow bucket
+type histogram struct {
+	mu     sync.Mutex
+	bounds []int64
+	counts []int64
+	count  int64
+	sum    int64
+}
+
+// newHistogram publishes a histogram under name. bounds must be ascending.
+func newHistogram(name string, bounds ...int64) *histogram {
+	h := &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+	expvar.Publish(name, h)
+	return h
+}
+
+// Observe records v in the first bucket whose bound is >= v
+func (h *histogram) Observe(v int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+type histogramBucket struct {
+	Le    string `json:"le"`
+	Count int64  `json:"count"`
+}
+
+// String implements expvar.Var
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets := make([]histogramBucket, len(h.counts))
+	for i, c := range h.counts {
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatInt(h.bounds[i], 10)
+		}
+		buckets[i] = histogramBucket{Le: le, Count: c}
+	}
+	b, _ := json.Marshal(struct {
+		Count   int64             `json:"count"`
+		Sum     int64             `json:"sum"`
+		Buckets []histogramBucket `json:"buckets"`
+	}{h.count, h.sum, buckets})
+	return string(b)
+}
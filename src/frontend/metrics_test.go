@@ -0,0 +1,143 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+func TestDebugHandler(t *testing.T) {
+	h := debugHandler()
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	if w := get("/debug/pprof/"); w.Code != http.StatusOK {
+		t.Errorf("/debug/pprof/: status %d", w.Code)
+	}
+	if w := get("/debug/pprof/goroutine?debug=1"); w.Code != http.StatusOK {
+		t.Errorf("/debug/pprof/goroutine: status %d", w.Code)
+	}
+
+	w := get("/debug/vars")
+	var vars struct {
+		GoRuntime map[string]float64 `json:"go_runtime"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("/debug/vars: %v", err)
+	}
+	for _, name := range []string{"goroutines", "gc_cycles", "gc_cpu_seconds", "heap_live_bytes"} {
+		if _, ok := vars.GoRuntime[name]; !ok {
+			t.Errorf("go_runtime has no %s: %v", name, vars.GoRuntime)
+		}
+	}
+	if vars.GoRuntime["goroutines"] < 1 {
+		t.Errorf("go_runtime goroutines = %v, want at least 1", vars.GoRuntime["goroutines"])
+	}
+}
+
+func TestLatencyHistogramExemplars(t *testing.T) {
+	h := &latencyHistogram{name: "test_seconds", help: "Test latency.", label: "op", series: make(map[string]*latencySeries)}
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		SpanID:  trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+	})
+	h.Observe(trace.ContextWithSpanContext(context.Background(), sc), "sign", 3*time.Microsecond)
+	h.Observe(context.Background(), "sign", 3*time.Second)
+
+	var buf bytes.Buffer
+	h.writeOpenMetrics(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE test_seconds histogram\n",
+		`test_seconds_bucket{op="sign",le="2.5e-06"} 0` + "\n",
+		`test_seconds_bucket{op="sign",le="5e-06"} 1 # {trace_id="0102030405060708090a0b0c0d0e0f10",span_id="0102030405060708"} 3e-06 `,
+		`test_seconds_bucket{op="sign",le="2.5"} 1` + "\n",
+		`test_seconds_bucket{op="sign",le="+Inf"} 2` + "\n",
+		`test_seconds_count{op="sign"} 2` + "\n",
+		`test_seconds_sum{op="sign"} 3.000003` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("OpenMetrics output has no %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestRPCLatencyByJWTMode(t *testing.T) {
+	loadTestRSAKeys(t)
+	t.Setenv("ENABLE_JWT_COMPRESSION", "true")
+	token, err := generateJWT("latency-session", "USD", defaultClaimsProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := newClientConn("127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("newClientConn() error = %v", err)
+	}
+	defer conn.Close()
+
+	count := func(h *latencyHistogram, value string) uint64 {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if s := h.series[value]; s != nil {
+			return s.count
+		}
+		return 0
+	}
+	interceptor := jwtUnaryClientInterceptor()
+	invoker := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		return nil
+	}
+	ctx := context.WithValue(context.Background(), ctxKeyJWTToken{}, token)
+	for _, tc := range []struct{ method, mode string }{
+		{"/hipstershop.CartService/GetCart", jwtModeCompressed},
+		{"/hipstershop.ProductCatalogService/ListProducts", jwtModeNone},
+	} {
+		before := count(grpcClientLatency, tc.mode)
+		if err := interceptor(ctx, tc.method, nil, nil, conn, invoker); err != nil {
+			t.Fatalf("%s: %v", tc.method, err)
+		}
+		if got := count(grpcClientLatency, tc.mode); got != before+1 {
+			t.Errorf("%s: grpc_client_latency_seconds{jwt_mode=%q} count = %d, want %d", tc.method, tc.mode, got, before+1)
+		}
+	}
+	for _, op := range []string{"generate", "decompose"} {
+		if count(jwtOperationLatency, op) == 0 {
+			t.Errorf("jwt_operation_seconds{op=%q} has no observations", op)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	debugHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("/metrics Content-Type = %q", ct)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `grpc_client_latency_seconds_count{jwt_mode="compressed"}`) || !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("/metrics = %s", body)
+	}
+}
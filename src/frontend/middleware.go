@@ -15,10 +15,12 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"net"
 	"net/http"
 	"time"
-	"os"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
@@ -27,6 +29,15 @@ import (
 type ctxKeyLog struct{}
 type ctxKeyRequestID struct{}
 
+// requestLogger returns the logger of the HTTP request ctx belongs to,
+// falling back to the package logger outside of one
+func requestLogger(ctx context.Context) logrus.FieldLogger {
+	if l, ok := ctx.Value(ctxKeyLog{}).(logrus.FieldLogger); ok {
+		return l
+	}
+	return log
+}
+
 type logHandler struct {
 	log  *logrus.Logger
 	next http.Handler
@@ -54,6 +65,16 @@ func (r *responseRecorder) WriteHeader(statusCode int) {
 	r.w.WriteHeader(statusCode)
 }
 
+// Hijack lets WebSocket handlers take over the connection
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
 func (lh *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	requestID, _ := uuid.NewRandom()
@@ -78,21 +99,43 @@ func (lh *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	ctx = context.WithValue(ctx, ctxKeyLog{}, log)
+	ctx = withJWTRegeneration(ctx)
 	r = r.WithContext(ctx)
 	lh.next.ServeHTTP(rr, r)
 }
 
 func ensureSessionID(next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// API and header-only clients are identified by their token, not a
+		// cookie
+		if isAPIPath(r.URL.Path) || isHeaderOnlyClient(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
 		var sessionID string
+		ctx := r.Context()
 		c, err := r.Cookie(cookieSessionID)
-		if err == http.ErrNoCookie {
-			if os.Getenv("ENABLE_SINGLE_SHARED_SESSION") == "true" {
+		if id, idErr := oidcIdentityFromRequest(r); idErr != nil {
+			renderJWTError(w, r, idErr)
+			return
+		} else if id != nil {
+			// Users signed in at the IdP keep one session wherever they
+			// sign in from
+			sessionID = id.SessionID()
+			ctx = context.WithValue(ctx, ctxKeyOIDCIdentity{}, id)
+			if c == nil || c.Value != sessionID {
+				http.SetCookie(w, &http.Cookie{
+					Name:   cookieSessionID,
+					Value:  sessionID,
+					MaxAge: cookieMaxAge,
+				})
+			}
+		} else if err == http.ErrNoCookie {
+			if IsSingleSharedSessionEnabled() {
 				// Hard coded user id, shared across sessions
-				sessionID = "12345678-1234-1234-1234-123456789123"
+				sessionID = sharedSessionID
 			} else {
-				u, _ := uuid.NewRandom()
-				sessionID = u.String()
+				sessionID, ctx = newSessionID(ctx)
 			}
 			http.SetCookie(w, &http.Cookie{
 				Name:   cookieSessionID,
@@ -102,9 +145,9 @@ func ensureSessionID(next http.Handler) http.HandlerFunc {
 		} else if err != nil {
 			return
 		} else {
-			sessionID = c.Value
+			sessionID, ctx, _ = migrateSession(ctx, w, c.Value)
 		}
-		ctx := context.WithValue(r.Context(), ctxKeySessionID{}, sessionID)
+		ctx = context.WithValue(ctx, ctxKeySessionID{}, sessionID)
 		r = r.WithContext(ctx)
 		next.ServeHTTP(w, r)
 	}
@@ -0,0 +1,450 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultOIDCTimeout      = 2 * time.Second
+	defaultOIDCJWKSCacheTTL = time.Hour
+
+	// oidcJWKSRefetchInterval is the least time between JWKS fetches
+	oidcJWKSRefetchInterval = time.Minute
+
+	// oidcExchangeMinLifetime is the least lifetime a cached internal token
+	// must have left to be handed out again
+	oidcExchangeMinLifetime = 15 * time.Second
+)
+
+// oidcSigningMethods are the algorithms accepted from the IdP; never HS256,
+// whose key would be public
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// oidcSessionNamespace derives session IDs from IdP identities
+var oidcSessionNamespace = uuid.MustParse("6f1e7c52-3b2a-4d8e-9a41-0c7d5e2f8b13")
+
+var (
+	// oidcStats counts external tokens validated and rejected, internal
+	// tokens issued for them and served from cache, and JWKS fetches
+	oidcStats = expvar.NewMap("oidc")
+
+	// oidc is nil unless OIDC_ISSUER_URL is set
+	oidc *oidcProvider
+)
+
+type ctxKeyOIDCIdentity struct{}
+
+// oidcIdentity is a user authenticated by the external IdP
+type oidcIdentity struct {
+	Issuer    string
+	Subject   string
+	ExpiresAt time.Time
+	// claims are the internal claims mapped from the IdP token; empty ones
+	// come from the claims provider
+	claims map[string]string
+}
+
+// SessionID is the internal session of the identity. It is derived from
+// the IdP subject, so the cart follows the user across devices.
+func (id *oidcIdentity) SessionID() string {
+	return uuid.NewSHA1(oidcSessionNamespace, []byte(id.Issuer+"\x00"+id.Subject)).String()
+}
+
+// profile merges the mapped claims over the claims provider's profile
+func (id *oidcIdentity) profile(ctx context.Context, sessionID string) claimsProfile {
+	p := profiles.lookup(ctx, jwtSessionFor(sessionID))
+	if v := id.claims["name"]; v != "" {
+		p.Name = v
+	}
+	if v := id.claims["market_id"]; v != "" {
+		p.MarketID = v
+	}
+	if v := id.claims["loyalty_tier"]; v != "" {
+		p.LoyaltyTier = v
+	}
+	return p
+}
+
+// oidcProvider validates tokens of an external OpenID Connect provider
+// against its published keys and exchanges them for internal tokens
+type oidcProvider struct {
+	issuer   string
+	audience string
+	// claimMap maps internal profile claims to IdP claims
+	claimMap map[string]string
+	client   *http.Client
+	ttl      time.Duration
+
+	keysMu      sync.Mutex
+	jwksURI     string
+	keys        map[string]interface{}
+	fetchedAt   time.Time
+	lastRefetch time.Time
+
+	mu        sync.Mutex
+	exchanged map[[sha256.Size]byte]exchangedToken
+}
+
+type exchangedToken struct {
+	token  string
+	claims *JWTClaims
+}
+
+// loadOIDCProvider reads OIDC_ISSUER_URL, OIDC_AUDIENCE (the client ID
+// tokens must be issued for), OIDC_CLAIM_MAP (internal=external pairs,
+// default name=name), OIDC_TIMEOUT and OIDC_JWKS_CACHE_TTL
+func loadOIDCProvider() *oidcProvider {
+	issuer := os.Getenv("OIDC_ISSUER_URL")
+	if issuer == "" {
+		return nil
+	}
+	audience := os.Getenv("OIDC_AUDIENCE")
+	if audience == "" {
+		log.Warn("ignoring OIDC_ISSUER_URL: OIDC_AUDIENCE is not set")
+		return nil
+	}
+	claimMap := map[string]string{"name": "name"}
+	if v := os.Getenv("OIDC_CLAIM_MAP"); v != "" {
+		claimMap = make(map[string]string)
+		for _, pair := range strings.Split(v, ",") {
+			internal, external, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || !oidcMappableClaim(internal) {
+				log.Warnf("ignoring OIDC_CLAIM_MAP entry %q", pair)
+				continue
+			}
+			claimMap[internal] = external
+		}
+	}
+	log.Infof("accepting tokens from OIDC issuer %s for audience %s", issuer, audience)
+	return newOIDCProvider(issuer, audience, claimMap)
+}
+
+func newOIDCProvider(issuer, audience string, claimMap map[string]string) *oidcProvider {
+	return &oidcProvider{
+		issuer:    strings.TrimSuffix(issuer, "/"),
+		audience:  audience,
+		claimMap:  claimMap,
+		client:    &http.Client{Timeout: durationEnv("OIDC_TIMEOUT", defaultOIDCTimeout)},
+		ttl:       durationEnv("OIDC_JWKS_CACHE_TTL", defaultOIDCJWKSCacheTTL),
+		exchanged: make(map[[sha256.Size]byte]exchangedToken),
+	}
+}
+
+// oidcMappableClaim reports whether an internal claim may come from the IdP
+func oidcMappableClaim(name string) bool {
+	return name == "name" || name == "market_id" || name == "loyalty_tier"
+}
+
+// issued reports whether token claims to come from this provider. It does
+// not verify anything; internal tokens are told apart by their issuer.
+func (p *oidcProvider) issued(token string) bool {
+	if p == nil {
+		return false
+	}
+	segments, err := splitJWT(token)
+	if err != nil {
+		return false
+	}
+	var claims jwtClaimSet
+	segments.DecodePayload(&claims)
+	return strings.TrimSuffix(claims.Issuer, "/") == p.issuer
+}
+
+// validate verifies an IdP token and maps its claims
+func (p *oidcProvider) validate(ctx context.Context, token string) (*oidcIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, kid)
+	},
+		jwt.WithValidMethods(oidcSigningMethods),
+		jwt.WithIssuer(p.issuer),
+		jwt.WithAudience(p.audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+		jwt.WithTimeFunc(jwtClock.Now),
+	)
+	if err != nil {
+		oidcStats.Add("rejected", 1)
+		return nil, classifyJWTError(err)
+	}
+	sub, _ := claims.GetSubject()
+	if sub == "" {
+		oidcStats.Add("rejected", 1)
+		return nil, fmt.Errorf("%w: OIDC token has no sub", errJWTMalformed)
+	}
+	exp, _ := claims.GetExpirationTime()
+	id := &oidcIdentity{Issuer: p.issuer, Subject: sub, ExpiresAt: exp.Time, claims: make(map[string]string)}
+	for internal, external := range p.claimMap {
+		if v, ok := claims[external].(string); ok {
+			id.claims[internal] = v
+		}
+	}
+	oidcStats.Add("validated", 1)
+	return id, nil
+}
+
+// exchange validates an IdP token and returns an internal token for its
+// identity. Internal tokens are cached per IdP token while they have
+// oidcExchangeMinLifetime left, so API clients sending the same IdP token
+// on every call do not cost an RSA signature each.
+func (p *oidcProvider) exchange(ctx context.Context, token string) (string, *JWTClaims, error) {
+	key := sha256.Sum256([]byte(token))
+	now := jwtClock.Now()
+	p.mu.Lock()
+	cached, ok := p.exchanged[key]
+	p.mu.Unlock()
+	if ok && cached.claims.ExpiresAt.Sub(now) > oidcExchangeMinLifetime && !tokens.isRevoked(cached.claims.ID) {
+		oidcStats.Add("exchange_cache_hits", 1)
+		return cached.token, cached.claims, nil
+	}
+
+	id, err := p.validate(ctx, token)
+	if err != nil {
+		return "", nil, err
+	}
+	sessionID := id.SessionID()
+	internal, err := generateJWTContext(ctx, sessionID, defaultCurrency, id.profile(ctx, sessionID))
+	if err != nil {
+		return "", nil, err
+	}
+	claims, err := validateJWT(internal)
+	if err != nil {
+		return "", nil, err
+	}
+	oidcStats.Add("exchanged", 1)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, v := range p.exchanged {
+		if now.After(v.claims.ExpiresAt.Time) {
+			delete(p.exchanged, k)
+		}
+	}
+	// Never outlive the IdP token
+	if id.ExpiresAt.After(claims.ExpiresAt.Time) {
+		p.exchanged[key] = exchangedToken{token: internal, claims: claims}
+	}
+	return internal, claims, nil
+}
+
+// key returns the IdP's public key kid. Keys are cached for
+// OIDC_JWKS_CACHE_TTL; an unknown kid refetches them early, as after the
+// IdP rotates its keys. Either way they are fetched at most once per
+// oidcJWKSRefetchInterval, so tokens with made-up kids cannot hammer the
+// IdP.
+func (p *oidcProvider) key(ctx context.Context, kid string) (interface{}, error) {
+	p.keysMu.Lock()
+	defer p.keysMu.Unlock()
+	now := time.Now()
+	if k, ok := p.lookupKey(kid); ok && now.Sub(p.fetchedAt) < p.ttl {
+		return k, nil
+	}
+	if now.Sub(p.lastRefetch) > oidcJWKSRefetchInterval {
+		p.lastRefetch = now
+		if err := p.fetchKeys(ctx); err != nil {
+			// Keep verifying with the old keys while the IdP is down
+			log.Warnf("failed to fetch OIDC keys from %s: %v", p.issuer, err)
+		}
+	}
+	if k, ok := p.lookupKey(kid); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: no OIDC key with kid %q", jwt.ErrTokenUnverifiable, kid)
+}
+
+// lookupKey finds kid among the cached keys; a token without a kid may use
+// the only key; call with p.keysMu held
+func (p *oidcProvider) lookupKey(kid string) (interface{}, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k, true
+		}
+	}
+	k, ok := p.keys[kid]
+	return k, ok
+}
+
+// fetchKeys discovers the JWKS URI, once, and loads the key set; call with
+// p.keysMu held
+func (p *oidcProvider) fetchKeys(ctx context.Context) error {
+	oidcStats.Add("jwks_fetches", 1)
+	if p.jwksURI == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return fmt.Errorf("discovery: %w", err)
+		}
+		if strings.TrimSuffix(discovery.Issuer, "/") != p.issuer {
+			return fmt.Errorf("discovery document is for issuer %q", discovery.Issuer)
+		}
+		if discovery.JWKSURI == "" {
+			return errors.New("discovery document has no jwks_uri")
+		}
+		p.jwksURI = discovery.JWKSURI
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.jwksURI, &set); err != nil {
+		return fmt.Errorf("JWKS: %w", err)
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Warnf("skipping OIDC key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS has no usable signing keys")
+	}
+	p.keys, p.fetchedAt = keys, time.Now()
+	return nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jsonWebKey is an RSA or EC public key from a JWKS (RFC 7517)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent out of range")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid key parameter %q", s)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// oidcIdentityFromRequest validates the IdP token an authenticating proxy
+// in front of the frontend put in the Authorization header. Requests
+// without one, or with a token of another issuer, have no identity.
+func oidcIdentityFromRequest(r *http.Request) (*oidcIdentity, error) {
+	token, ok := bearerToken(r)
+	if !ok || !oidc.issued(token) {
+		return nil, nil
+	}
+	return oidc.validate(r.Context(), token)
+}
+
+// oidcIdentityFromContext returns the identity ensureSessionID stored
+func oidcIdentityFromContext(ctx context.Context) *oidcIdentity {
+	id, _ := ctx.Value(ctxKeyOIDCIdentity{}).(*oidcIdentity)
+	return id
+}
+
+// profileFor returns the profile claims of a new token for sessionID: the
+// IdP's mapped claims when the request carries an identity, otherwise the
+// claims provider's
+func profileFor(ctx context.Context, sessionID string) claimsProfile {
+	if id := oidcIdentityFromContext(ctx); id != nil {
+		return id.profile(ctx, sessionID)
+	}
+	return profiles.lookup(ctx, jwtSessionFor(sessionID))
+}
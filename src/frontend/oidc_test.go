@@ -0,0 +1,149 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestOIDCTokensAreExchanged(t *testing.T) {
+	useRSAKeys(t)
+
+	idpKeys := map[string]*rsa.PrivateKey{}
+	newIdPKey := func(kid string) {
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idpKeys[kid] = k
+	}
+	newIdPKey("k1")
+	var jwksFetches atomic.Int32
+	var idp *httptest.Server
+	idp = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": idp.URL, "jwks_uri": idp.URL + "/jwks"})
+		case "/jwks":
+			jwksFetches.Add(1)
+			var keys []map[string]string
+			for kid, k := range idpKeys {
+				keys = append(keys, map[string]string{
+					"kty": "RSA", "kid": kid, "use": "sig",
+					"n": base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+					"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+				})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer idp.Close()
+	defer func(p *oidcProvider) { oidc = p }(oidc)
+	oidc = newOIDCProvider(idp.URL, "shop", map[string]string{"name": "name", "loyalty_tier": "tier"})
+
+	idpToken := func(kid, aud string) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss": idp.URL, "aud": aud, "sub": "alice", "name": "Alice", "tier": "platinum",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		tok.Header["kid"] = kid
+		s, err := tok.SignedString(idpKeys[kid])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	wantSession := (&oidcIdentity{Issuer: idp.URL, Subject: "alice"}).SessionID()
+
+	var got *JWTClaims
+	var gotToken string
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = getJWTFromContext(r.Context())
+		gotToken, _ = r.Context().Value(ctxKeyJWTToken{}).(string)
+	})
+	api := ensureJWT(inner)
+	callAPI := func(token string) int {
+		r := httptest.NewRequest(http.MethodGet, apiPrefix+"/cart", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	external := idpToken("k1", "shop")
+	if code := callAPI(external); code != http.StatusOK {
+		t.Fatalf("API call with IdP token: status %d", code)
+	}
+	if got.SessionID != wantSession || got.Name != "Alice" || got.LoyaltyTier != "platinum" || got.Issuer != jwtIssuer {
+		t.Errorf("exchanged claims = %+v, want session %s for Alice (platinum)", got, wantSession)
+	}
+	first := gotToken
+	if _, err := validateJWT(first); err != nil {
+		t.Errorf("exchanged token does not validate: %v", err)
+	}
+	if callAPI(external); gotToken != first {
+		t.Error("second call with the same IdP token minted a new internal token")
+	}
+
+	if code := callAPI(idpToken("k1", "someone-else")); code != http.StatusUnauthorized {
+		t.Errorf("IdP token for another audience: status %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// A kid the cached keys don't have refetches the JWKS
+	newIdPKey("k2")
+	oidc.keysMu.Lock()
+	oidc.lastRefetch = time.Time{}
+	oidc.keysMu.Unlock()
+	fetches := jwksFetches.Load()
+	if code := callAPI(idpToken("k2", "shop")); code != http.StatusOK {
+		t.Errorf("IdP token signed with a rotated key: status %d", code)
+	}
+	if jwksFetches.Load() != fetches+1 {
+		t.Error("unknown kid did not refetch the JWKS")
+	}
+
+	// Behind an authenticating proxy, browsers move to the user's session
+	browser := ensureSessionID(ensureJWT(inner))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+external)
+	r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: "anonymous-session"})
+	w := httptest.NewRecorder()
+	browser.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || got.SessionID != wantSession || got.Name != "Alice" {
+		t.Errorf("browser request: status %d, claims %+v", w.Code, got)
+	}
+	var sessionCookie string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == cookieSessionID {
+			sessionCookie = c.Value
+		}
+	}
+	if sessionCookie != wantSession {
+		t.Errorf("session cookie = %q, want %q", sessionCookie, wantSession)
+	}
+}
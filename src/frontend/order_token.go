@@ -0,0 +1,155 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	// orderTokenHeader is the PlaceOrder response header (and REST API
+	// response header) carrying checkoutservice's order-confirmation token
+	orderTokenHeader = "x-order-token"
+	orderTokenIssuer = "urn:hipstershop:checkoutservice"
+	cookieOrderToken = cookiePrefix + "order-token"
+)
+
+// orderTokenKey verifies order-confirmation tokens. It is the
+// ORDER_TOKEN_SECRET checkoutservice signs them with; nil disables them.
+var orderTokenKey = loadOrderTokenKey()
+
+func loadOrderTokenKey() []byte {
+	if secret := os.Getenv("ORDER_TOKEN_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return nil
+}
+
+// OrderTokenClaims are the claims of an order-confirmation token: which
+// order the subject (the cart owner) placed and what it cost
+type OrderTokenClaims struct {
+	OrderID string    `json:"order_id"`
+	Amount  *pb.Money `json:"amount"`
+	jwt.RegisteredClaims
+}
+
+// validateOrderToken verifies an order-confirmation token
+func validateOrderToken(tokenStr string) (*OrderTokenClaims, error) {
+	if orderTokenKey == nil {
+		return nil, fmt.Errorf("order tokens are not configured")
+	}
+	claims := &OrderTokenClaims{}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, func(*jwt.Token) (interface{}, error) {
+		return orderTokenKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(orderTokenIssuer), jwt.WithExpirationRequired(), jwt.WithTimeFunc(jwtClock.Now))
+	if err != nil {
+		return nil, classifyJWTError(err)
+	}
+	return claims, nil
+}
+
+// orderTokenFromHeader returns the order token in PlaceOrder response
+// metadata, if checkoutservice minted one
+func orderTokenFromHeader(md metadata.MD) string {
+	if v := md.Get(orderTokenHeader); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// setOrderTokenCookie stores a verified order token in a cookie that lives
+// exactly as long as the token
+func setOrderTokenCookie(w http.ResponseWriter, token string, claims *OrderTokenClaims) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieOrderToken,
+		Value:    token,
+		MaxAge:   int(jwtUntil(claims.ExpiresAt.Time).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// keepOrderToken verifies the order token checkoutservice returned for
+// order and keeps it in a cookie for the confirmation page. A missing or
+// invalid token only costs the customer that shortcut.
+func (fe *frontendServer) keepOrderToken(w http.ResponseWriter, r *http.Request, order *pb.OrderResult, token string) {
+	if token == "" || orderTokenKey == nil {
+		return
+	}
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	claims, err := validateOrderToken(token)
+	if err == nil && !fe.ownsOrder(r.Context(), claims, order.GetOrderId()) {
+		err = fmt.Errorf("token minted for order %q", claims.OrderID)
+	}
+	if err != nil {
+		log.WithField("error", err).Warn("discarding order token")
+		return
+	}
+	setOrderTokenCookie(w, token, claims)
+}
+
+// ownsOrder reports whether claims prove that the caller placed orderID:
+// the token must name the order and have been minted for the caller's cart
+func (fe *frontendServer) ownsOrder(ctx context.Context, claims *OrderTokenClaims, orderID string) bool {
+	return claims.OrderID == orderID && claims.Subject == fe.cartUserID(ctx)
+}
+
+// apiOrderHandler confirms an order from its order token alone, without
+// asking any service about it. The token is read from the X-Order-Token
+// header, falling back to the cookie set at checkout.
+func (fe *frontendServer) apiOrderHandler(w http.ResponseWriter, r *http.Request) {
+	claims, code, err := fe.requestOrderToken(r, mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, code, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"order_id":   claims.OrderID,
+		"amount":     claims.Amount,
+		"expires_at": claims.ExpiresAt.Time,
+	})
+}
+
+// requestOrderToken returns the claims of the order token r carries for
+// orderID, or the status to answer with
+func (fe *frontendServer) requestOrderToken(r *http.Request, orderID string) (*OrderTokenClaims, int, error) {
+	token := r.Header.Get(orderTokenHeader)
+	if token == "" {
+		if c, err := r.Cookie(cookieOrderToken); err == nil {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		return nil, http.StatusNotFound, fmt.Errorf("no order token")
+	}
+	claims, err := validateOrderToken(token)
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	if !fe.ownsOrder(r.Context(), claims, orderID) {
+		return nil, http.StatusForbidden, fmt.Errorf("order token does not cover this order")
+	}
+	return claims, http.StatusOK, nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestOrderTokenVerify(t *testing.T) {
+	defer func(k []byte) { orderTokenKey = k }(orderTokenKey)
+	orderTokenKey = []byte("order-secret")
+	clock := useFakeClock(t)
+
+	// Tokens as checkoutservice mints them
+	mint := func(key []byte, method jwt.SigningMethod, claims jwt.MapClaims) string {
+		t.Helper()
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	claims := func(orderID, subject string) jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":      orderTokenIssuer,
+			"sub":      subject,
+			"order_id": orderID,
+			"amount":   map[string]interface{}{"currency_code": "EUR", "units": 42},
+			"iat":      clock.Now().Unix(),
+			"exp":      clock.Now().Add(15 * time.Minute).Unix(),
+		}
+	}
+	token := mint(orderTokenKey, jwt.SigningMethodHS256, claims("order-1", "cart-1"))
+
+	got, err := validateOrderToken(token)
+	if err != nil {
+		t.Fatalf("validateOrderToken() error = %v", err)
+	}
+	if got.OrderID != "order-1" || got.Subject != "cart-1" || got.Amount.GetCurrencyCode() != "EUR" || got.Amount.GetUnits() != 42 {
+		t.Errorf("validateOrderToken() = %+v", got)
+	}
+
+	wrongIssuer := claims("order-1", "cart-1")
+	wrongIssuer["iss"] = "https://auth.hipstershop.com"
+	noExp := claims("order-1", "cart-1")
+	delete(noExp, "exp")
+	for name, bad := range map[string]string{
+		"wrong key":    mint([]byte("other-secret"), jwt.SigningMethodHS256, claims("order-1", "cart-1")),
+		"wrong alg":    mint(orderTokenKey, jwt.SigningMethodHS512, claims("order-1", "cart-1")),
+		"wrong issuer": mint(orderTokenKey, jwt.SigningMethodHS256, wrongIssuer),
+		"no exp":       mint(orderTokenKey, jwt.SigningMethodHS256, noExp),
+	} {
+		if _, err := validateOrderToken(bad); err == nil {
+			t.Errorf("validateOrderToken(%s) accepted the token", name)
+		}
+	}
+
+	// The confirmation API wants the caller's own order
+	fe := &frontendServer{}
+	request := func(orderID string, header, cookie string) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/orders/"+orderID, nil)
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeySessionID{}, "cart-1"))
+		if header != "" {
+			r.Header.Set(orderTokenHeader, header)
+		}
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: cookieOrderToken, Value: cookie})
+		}
+		_, code, _ := fe.requestOrderToken(r, orderID)
+		return code
+	}
+	for _, tt := range []struct {
+		name, orderID, header, cookie string
+		want                          int
+	}{
+		{"header", "order-1", token, "", http.StatusOK},
+		{"cookie", "order-1", "", token, http.StatusOK},
+		{"no token", "order-1", "", "", http.StatusNotFound},
+		{"another order", "order-2", token, "", http.StatusForbidden},
+		{"another cart", "order-1", mint(orderTokenKey, jwt.SigningMethodHS256, claims("order-1", "cart-2")), "", http.StatusForbidden},
+		{"invalid token", "order-1", token + "x", "", http.StatusUnauthorized},
+	} {
+		if got := request(tt.orderID, tt.header, tt.cookie); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	clock.Advance(16 * time.Minute)
+	if _, err := validateOrderToken(token); !errors.Is(err, errJWTExpired) {
+		t.Errorf("validateOrderToken(expired) error = %v, want errJWTExpired", err)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	orderStreamPingPeriod = 30 * time.Second
+	orderStreamWriteWait  = 5 * time.Second
+	orderStreamBuffer     = 16
+)
+
+var (
+	// orderStreamReauthGrace is how long a client has to present a fresh
+	// token once the one the stream was opened with expires
+	orderStreamReauthGrace = 10 * time.Second
+
+	orderStreamUpgrader = websocket.Upgrader{}
+
+	orderStreamsOpen   = expvar.NewInt("order_streams_open")
+	orderStreamReauths = expvar.NewMap("order_stream_reauths")
+	orderEventsDropped = expvar.NewInt("order_events_dropped")
+)
+
+// orderEvent is a checkout status update as streamed to /ws/orders
+type orderEvent struct {
+	Type       string    `json:"type"`
+	Status     string    `json:"status"`
+	OrderID    string    `json:"order_id,omitempty"`
+	TrackingID string    `json:"shipping_tracking_id,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// orderEventHub fans checkout events out to the streams of the session that
+// placed the order. Sessions are keyed by the JWT session_id claim, so the
+// cookie and Bearer flows share one keyspace.
+type orderEventHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan orderEvent]struct{}
+}
+
+var orderEvents = &orderEventHub{subs: make(map[string]map[chan orderEvent]struct{})}
+
+func (h *orderEventHub) subscribe(session string) chan orderEvent {
+	ch := make(chan orderEvent, orderStreamBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[session] == nil {
+		h.subs[session] = make(map[chan orderEvent]struct{})
+	}
+	h.subs[session][ch] = struct{}{}
+	return ch
+}
+
+func (h *orderEventHub) unsubscribe(session string, ch chan orderEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[session], ch)
+	if len(h.subs[session]) == 0 {
+		delete(h.subs, session)
+	}
+}
+
+// publish never blocks checkout: events for a stream that isn't keeping up
+// are dropped
+func (h *orderEventHub) publish(session string, ev orderEvent) {
+	ev.Type, ev.Time = "order_status", time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[session] {
+		select {
+		case ch <- ev:
+		default:
+			orderEventsDropped.Add(1)
+		}
+	}
+}
+
+// publishOrderEvent publishes ev for the session of the request's JWT
+func publishOrderEvent(ctx context.Context, ev orderEvent) {
+	if claims, ok := getJWTFromContext(ctx); ok && claims != nil {
+		orderEvents.publish(claims.SessionID, ev)
+	}
+}
+
+// orderStreamMessage is sent by clients to re-authenticate a stream
+type orderStreamMessage struct {
+	Type  string `json:"type"`
+	Token string `json:"token"`
+}
+
+// ordersStreamHandler streams checkout status updates for the session over a
+// WebSocket. The connection is authenticated by the JWT cookie (checked by
+// ensureJWT before the upgrade) and only lives as long as a valid token:
+// when it expires the server asks for a new one and closes the stream if no
+// valid token for the same session arrives within orderStreamReauthGrace.
+// Browsers, which cannot read the HttpOnly cookie, reconnect instead and
+// pick up a renewed cookie from ensureJWT on the handshake.
+func (fe *frontendServer) ordersStreamHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	claims, ok := getJWTFromContext(r.Context())
+	if !ok || claims == nil {
+		renderJWTError(w, r, fmt.Errorf("%w: no token for stream", errJWTMalformed))
+		return
+	}
+	// Keep any cookie ensureJWT set (a renewed token), since the upgrade
+	// response is written straight to the connection
+	conn, err := orderStreamUpgrader.Upgrade(w, r, http.Header{"Set-Cookie": w.Header()["Set-Cookie"]})
+	if err != nil {
+		log.WithField("error", err).Warn("websocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+	orderStreamsOpen.Add(1)
+	defer orderStreamsOpen.Add(-1)
+
+	session := claims.SessionID
+	events := orderEvents.subscribe(session)
+	defer orderEvents.unsubscribe(session, events)
+
+	// Client messages are only re-authentication; read them on their own
+	// goroutine so the writer below can select on them
+	reauth := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			var msg orderStreamMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				readErr <- err
+				return
+			}
+			if msg.Type == "auth" {
+				select {
+				case reauth <- msg.Token:
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+	}()
+
+	write := func(v interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(orderStreamWriteWait))
+		return conn.WriteJSON(v)
+	}
+	closeWith := func(code int, reason string) {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason),
+			time.Now().Add(orderStreamWriteWait))
+	}
+
+	expiry := time.NewTimer(time.Until(claims.ExpiresAt.Time))
+	defer expiry.Stop()
+	ping := time.NewTicker(orderStreamPingPeriod)
+	defer ping.Stop()
+	var grace <-chan time.Time
+
+	for {
+		select {
+		case ev := <-events:
+			if err := write(ev); err != nil {
+				return
+			}
+		case <-expiry.C:
+			// The token the stream was opened with has expired
+			orderStreamReauths.Add("requested", 1)
+			if err := write(map[string]string{"type": "reauth_required"}); err != nil {
+				return
+			}
+			grace = time.After(orderStreamReauthGrace)
+		case <-grace:
+			orderStreamReauths.Add("timed_out", 1)
+			closeWith(websocket.ClosePolicyViolation, errJWTExpired.Error())
+			return
+		case token := <-reauth:
+			fresh, err := validateJWT(token)
+			if err == nil && fresh.SessionID != session {
+				err = fmt.Errorf("%w: token issued for session %q", errJWTSessionMismatch, fresh.SessionID)
+			}
+			if err != nil {
+				orderStreamReauths.Add("rejected", 1)
+				log.WithField("error", err).Info("order stream re-authentication rejected")
+				closeWith(websocket.ClosePolicyViolation, err.Error())
+				return
+			}
+			orderStreamReauths.Add("accepted", 1)
+			expiry.Reset(time.Until(fresh.ExpiresAt.Time))
+			grace = nil
+			if err := write(map[string]string{"type": "reauth_ok"}); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(orderStreamWriteWait)); err != nil {
+				return
+			}
+		case <-readErr:
+			return
+		}
+	}
+}
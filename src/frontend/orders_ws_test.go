@@ -0,0 +1,105 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+func TestOrdersStreamRevalidatesOnExpiry(t *testing.T) {
+	loadTestRSAKeys(t)
+	defer func(d time.Duration) { orderStreamReauthGrace = d }(orderStreamReauthGrace)
+	orderStreamReauthGrace = 200 * time.Millisecond
+
+	// The stream opens with a token that expires right away
+	const session = "stream-session"
+	logger := logrus.New()
+	logger.Out = io.Discard
+	fe := &frontendServer{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := &JWTClaims{SessionID: session}
+		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(100 * time.Millisecond))
+		ctx := context.WithValue(r.Context(), ctxKeyLog{}, logrus.FieldLogger(logger))
+		ctx = context.WithValue(ctx, ctxKeyJWT{}, claims)
+		fe.ordersStreamHandler(w, r.WithContext(ctx))
+	}))
+	defer srv.Close()
+
+	dial := func() *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg map[string]string
+		if err := conn.ReadJSON(&msg); err != nil || msg["type"] != "reauth_required" {
+			t.Fatalf("first message = %v, %v; want reauth_required", msg, err)
+		}
+		return conn
+	}
+	wantClosed := func(conn *websocket.Conn, what string) {
+		t.Helper()
+		var msg map[string]string
+		err := conn.ReadJSON(&msg)
+		if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Errorf("%s: read = %v, %v; want a policy violation close", what, msg, err)
+		}
+	}
+
+	// A fresh token for the same session keeps the stream going
+	conn := dial()
+	fresh, err := generateJWT(session, "USD", defaultClaimsProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(orderStreamMessage{Type: "auth", Token: fresh}); err != nil {
+		t.Fatal(err)
+	}
+	var msg orderEvent
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "reauth_ok" {
+		t.Fatalf("after re-authentication = %+v, %v; want reauth_ok", msg, err)
+	}
+	orderEvents.publish(session, orderEvent{Status: "placed", OrderID: "o1"})
+	if err := conn.ReadJSON(&msg); err != nil || msg.OrderID != "o1" {
+		t.Errorf("event after re-authentication = %+v, %v", msg, err)
+	}
+	conn.Close()
+
+	// A token for another session closes it
+	conn = dial()
+	other, err := generateJWT("other-session", "USD", defaultClaimsProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteJSON(orderStreamMessage{Type: "auth", Token: other})
+	wantClosed(conn, "token for another session")
+	conn.Close()
+
+	// and so does no token within the grace period
+	conn = dial()
+	wantClosed(conn, "no token")
+	conn.Close()
+}
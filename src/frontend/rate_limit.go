@@ -0,0 +1,151 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterIdle is how long a subject's bucket is kept after its last
+// request. An idle bucket has refilled long before, so dropping it loses
+// nothing.
+const rateLimiterIdle = 10 * time.Minute
+
+var (
+	errRateLimited = errors.New("too many requests")
+
+	// rateLimited counts rejected requests; rateLimitSubjects is the number
+	// of subjects currently tracked
+	rateLimited       = expvar.NewInt("rate_limited_requests")
+	rateLimitSubjects = expvar.NewInt("rate_limit_subjects")
+)
+
+// subjectLimiter keeps a token bucket per JWT subject
+type subjectLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*subjectBucket
+	lastPrune time.Time
+}
+
+type subjectBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// loadSubjectLimiter reads RATE_LIMIT_RPS (requests per second per subject,
+// 0 or unset disables the limiter) and RATE_LIMIT_BURST (default the RPS,
+// rounded up)
+func loadSubjectLimiter() *subjectLimiter {
+	v := os.Getenv("RATE_LIMIT_RPS")
+	if v == "" {
+		return nil
+	}
+	rps, err := strconv.ParseFloat(v, 64)
+	if err != nil || rps < 0 {
+		log.Warnf("ignoring invalid RATE_LIMIT_RPS=%q", v)
+		return nil
+	}
+	if rps == 0 {
+		return nil
+	}
+	burst := int(math.Ceil(rps))
+	if v := os.Getenv("RATE_LIMIT_BURST"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			burst = n
+		} else {
+			log.Warnf("ignoring invalid RATE_LIMIT_BURST=%q", v)
+		}
+	}
+	log.Infof("rate limiting each JWT subject to %g requests/s, burst %d", rps, burst)
+	return &subjectLimiter{
+		limit:   rate.Limit(rps),
+		burst:   burst,
+		buckets: make(map[string]*subjectBucket),
+	}
+}
+
+// reserve takes a token from subject's bucket. When none is left it
+// returns false and how long until one is.
+func (l *subjectLimiter) reserve(subject string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastPrune) > rateLimiterIdle {
+		for s, b := range l.buckets {
+			if now.Sub(b.lastSeen) > rateLimiterIdle {
+				delete(l.buckets, s)
+			}
+		}
+		l.lastPrune = now
+	}
+	b, ok := l.buckets[subject]
+	if !ok {
+		b = &subjectBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[subject] = b
+	}
+	b.lastSeen = now
+	rateLimitSubjects.Set(int64(len(l.buckets)))
+
+	r := b.limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// rateLimitBySubject throttles requests per JWT sub claim, so one abusive
+// session (or load test user) cannot starve the others. It runs after
+// ensureJWT; requests without claims, such as probes, are not limited.
+func rateLimitBySubject(next http.Handler) http.Handler {
+	limiter := loadSubjectLimiter()
+	if limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := getJWTFromContext(r.Context())
+		if !ok || claims == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		subject := claims.Subject
+		if subject == "" {
+			subject = claims.SessionID
+		}
+		if ok, retryAfter := limiter.reserve(subject); !ok {
+			rateLimited.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			if isAPIPath(r.URL.Path) {
+				writeAPIError(w, http.StatusTooManyRequests, errRateLimited)
+			} else {
+				renderHTTPError(requestLogger(r.Context()), r, w, errRateLimited, http.StatusTooManyRequests)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimitBySubject(t *testing.T) {
+	t.Setenv("RATE_LIMIT_RPS", "0.001")
+	t.Setenv("RATE_LIMIT_BURST", "2")
+	handler := rateLimitBySubject(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	request := func(subject string) *httptest.ResponseRecorder {
+		claims := jwtGoldenClaims()
+		claims.Subject = subject
+		r := httptest.NewRequest(http.MethodGet, baseUrl+apiPrefix+"/cart", nil)
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeyJWT{}, claims))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := request("urn:hipstershop:user:a"); w.Code != http.StatusNoContent {
+			t.Fatalf("request %d within burst: status %d", i, w.Code)
+		}
+	}
+	w := request("urn:hipstershop:user:a")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over burst: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("throttled response has no Retry-After")
+	}
+	// Buckets are per subject
+	if w := request("urn:hipstershop:user:b"); w.Code != http.StatusNoContent {
+		t.Errorf("other subject: status %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	readinessRetryMin = time.Second
+	readinessRetryMax = 30 * time.Second
+)
+
+// readiness tracks the startup conditions the frontend needs before it can
+// serve shop traffic: JWT keys loaded and self-tested, and every downstream
+// connection established once. It backs both /_readyz and the gRPC health
+// service.
+type readiness struct {
+	keysLoaded   atomic.Bool
+	downstreamUp atomic.Bool
+	healthServer *health.Server
+}
+
+var ready = &readiness{healthServer: health.NewServer()}
+
+func init() {
+	ready.healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+}
+
+func (rd *readiness) isReady() bool {
+	return rd.keysLoaded.Load() && rd.downstreamUp.Load()
+}
+
+func (rd *readiness) update() {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if rd.isReady() {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	rd.healthServer.SetServingStatus("", status)
+}
+
+// ServeHTTP implements the /_readyz endpoint
+func (rd *readiness) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	if !rd.isReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not ready: keys_loaded=%v downstream_up=%v", rd.keysLoaded.Load(), rd.downstreamUp.Load())
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// loadKeys loads the RSA keys and signs and validates a canary token,
+// retrying with backoff until both succeed
+func (rd *readiness) loadKeys(log logrus.FieldLogger) {
+	for d := readinessRetryMin; ; d = min(d*2, readinessRetryMax) {
+		err := loadRSAKeys()
+		if err == nil {
+			err = selfTestJWT()
+		}
+		if err == nil {
+			break
+		}
+		log.Warnf("JWT keys not ready, retrying in %v: %v", d, err)
+		time.Sleep(d)
+	}
+	log.Info("RSA keys loaded and canary token verified")
+	watchRSAKeyFiles(log)
+	rd.keysLoaded.Store(true)
+	rd.update()
+}
+
+// waitForDownstream blocks until every connection has reached READY once
+func (rd *readiness) waitForDownstream(log logrus.FieldLogger, conns ...*grpc.ClientConn) {
+	for _, conn := range conns {
+		conn.Connect()
+		for state := conn.GetState(); state != connectivity.Ready; state = conn.GetState() {
+			if state == connectivity.Idle {
+				conn.Connect()
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), readinessRetryMax)
+			if !conn.WaitForStateChange(ctx, state) {
+				log.Warnf("still waiting for downstream %s (state %v)", conn.Target(), state)
+			}
+			cancel()
+		}
+	}
+	log.Info("all downstream connections established")
+	rd.downstreamUp.Store(true)
+	rd.update()
+}
+
+// selfTestJWT signs and validates a canary token to prove the loaded key
+// pair matches
+func selfTestJWT() error {
+	const canarySession = "readiness-canary"
+	token, err := generateJWT(canarySession, defaultCurrency, defaultClaimsProfile)
+	if err != nil {
+		return fmt.Errorf("canary sign failed: %w", err)
+	}
+	claims, err := validateJWT(token)
+	if err != nil {
+		return fmt.Errorf("canary validation failed: %w", err)
+	}
+	if claims.SessionID != jwtSessionFor(canarySession) {
+		return fmt.Errorf("canary round trip returned session %q", claims.SessionID)
+	}
+	return nil
+}
+
+// serveGRPC exposes the standard gRPC health service and the TokenService
+// on port
+func serveGRPC(log logrus.FieldLogger, port string) {
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Errorf("failed to listen for gRPC on %s: %v", port, err)
+		return
+	}
+	srv := grpc.NewServer(spiffeMTLS.serverOption(), keepaliveServerOption(), keepaliveEnforcementOption())
+	healthpb.RegisterHealthServer(srv, ready.healthServer)
+	pb.RegisterTokenServiceServer(srv, &tokenServer{})
+	log.Infof("serving gRPC health and token service on :%s", port)
+	if err := srv.Serve(lis); err != nil {
+		log.Errorf("gRPC server stopped: %v", err)
+	}
+}
+
+// isProbePath reports whether the request is a liveness or readiness probe,
+// which must be answered without a JWT
+func isProbePath(path string) bool {
+	return path == baseUrl+"/_healthz" || path == baseUrl+"/_readyz"
+}
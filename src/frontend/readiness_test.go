@@ -0,0 +1,142 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// probe returns the /_readyz status code and the gRPC health status of rd
+func probe(t *testing.T, rd *readiness) (int, healthpb.HealthCheckResponse_ServingStatus) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	rd.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_readyz", nil))
+	resp, err := rd.healthServer.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	return w.Code, resp.Status
+}
+
+func TestReadiness(t *testing.T) {
+	rd := &readiness{healthServer: health.NewServer()}
+	rd.update()
+	if code, status := probe(t, rd); code != http.StatusServiceUnavailable || status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("before startup: /_readyz %d, health %v; want 503, NOT_SERVING", code, status)
+	}
+
+	// Both conditions must hold
+	rd.keysLoaded.Store(true)
+	rd.update()
+	if code, status := probe(t, rd); code != http.StatusServiceUnavailable || status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("keys loaded only: /_readyz %d, health %v; want 503, NOT_SERVING", code, status)
+	}
+	rd.downstreamUp.Store(true)
+	rd.update()
+	if code, status := probe(t, rd); code != http.StatusOK || status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("ready: /_readyz %d, health %v; want 200, SERVING", code, status)
+	}
+}
+
+func TestKeysLoadedGate(t *testing.T) {
+	defer ready.keysLoaded.Store(ready.keysLoaded.Load())
+	ready.keysLoaded.Store(false)
+	handler := ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	serve := func(path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	if code := serve("/"); code != http.StatusServiceUnavailable {
+		t.Errorf("page before the keys loaded: status %d, want 503", code)
+	}
+	if code := serve(baseUrl + "/_readyz"); code != http.StatusNoContent {
+		t.Errorf("probe before the keys loaded: status %d, want it passed through", code)
+	}
+}
+
+func TestLoadKeysRetries(t *testing.T) {
+	// The key files appear only after the first attempt failed
+	dir := t.TempDir()
+	t.Setenv("JWT_PRIVATE_KEY_PATH", filepath.Join(dir, "jwt_private_key.pem"))
+	t.Setenv("JWT_PUBLIC_KEY_PATH", filepath.Join(dir, "jwt_public_key.pem"))
+	retrying := make(chan struct{}, 1)
+	logger := logrus.New()
+	logger.Out = logWriter(func(p []byte) {
+		if bytes.Contains(p, []byte("retrying")) {
+			select {
+			case retrying <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	rd := &readiness{healthServer: health.NewServer()}
+	rd.downstreamUp.Store(true)
+	rd.update()
+	done := make(chan struct{})
+	go func() {
+		rd.loadKeys(logger)
+		close(done)
+	}()
+	select {
+	case <-retrying:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loadKeys() did not fail without the key files")
+	}
+	if code, status := probe(t, rd); code != http.StatusServiceUnavailable || status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("keys missing: /_readyz %d, health %v; want 503, NOT_SERVING", code, status)
+	}
+
+	for _, name := range []string{"jwt_private_key.pem", "jwt_public_key.pem"} {
+		pem, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), pem, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(readinessRetryMin + 5*time.Second):
+		t.Fatal("loadKeys() did not retry once the key files appeared")
+	}
+	if code, status := probe(t, rd); code != http.StatusOK || status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("keys loaded: /_readyz %d, health %v; want 200, SERVING", code, status)
+	}
+}
+
+// logWriter passes each log line to a func
+type logWriter func(p []byte)
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w(p)
+	return len(p), nil
+}
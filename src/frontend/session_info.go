@@ -0,0 +1,89 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+const sessionInfoPath = "/session/info"
+
+// sessionInfo is what /session/info reports about the request's session,
+// so the load generator can refresh ahead of expiry and tests can check
+// that a session carries over between requests
+type sessionInfo struct {
+	SessionID string     `json:"session_id"`
+	Claims    *JWTClaims `json:"claims"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	// ExpiresIn is the seconds left until the token expires
+	ExpiresIn   float64            `json:"expires_in"`
+	TokenBytes  int                `json:"token_bytes"`
+	Compression sessionCompression `json:"compression"`
+	Components  map[string]int     `json:"component_sizes,omitempty"`
+	CartID      string             `json:"cart_id"`
+	Currency    string             `json:"currency"`
+}
+
+// sessionCompression is how the token travels to downstream services
+type sessionCompression struct {
+	Enabled      bool   `json:"enabled"`
+	Mode         string `json:"mode"`
+	Codec        string `json:"codec"`
+	HeaderPrefix string `json:"header_prefix"`
+	Negotiated   bool   `json:"negotiated"`
+}
+
+// sessionInfoHandler reports the session of the request's token, after
+// ensureJWT renewed it if needed
+func sessionInfoHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := getJWTFromContext(r.Context())
+	token, _ := r.Context().Value(ctxKeyJWTToken{}).(string)
+	if !ok || claims == nil || token == "" {
+		writeAPIError(w, http.StatusUnauthorized, errors.New("no session token"))
+		return
+	}
+	info := sessionInfo{
+		SessionID:  sessionID(r),
+		Claims:     claims,
+		TokenBytes: len(token),
+		Compression: sessionCompression{
+			Enabled:      IsJWTCompressionEnabled(),
+			Mode:         jwtModeFull,
+			Codec:        jwtCodec.Name(),
+			HeaderPrefix: jwtHeaders.Prefix,
+			Negotiated:   IsJWTModeNegotiationEnabled(),
+		},
+		CartID:   claims.CartID,
+		Currency: claims.Currency,
+	}
+	if info.CartID == "" {
+		// As cartUserID, without moving a legacy cart on a read
+		info.CartID = info.SessionID
+	}
+	if claims.ExpiresAt != nil {
+		info.ExpiresAt = claims.ExpiresAt.Time
+		info.ExpiresIn = jwtUntil(info.ExpiresAt).Seconds()
+	}
+	if info.Compression.Enabled {
+		info.Compression.Mode = jwtModeCompressed
+		if components, err := DecomposeJWT(token); err == nil {
+			info.Components = GetJWTComponentSizes(components)
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeAPIJSON(w, http.StatusOK, info)
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSessionInfoReportsTheSession(t *testing.T) {
+	useRSAKeys(t)
+
+	handler := ensureSessionID(ensureJWT(http.HandlerFunc(sessionInfoHandler)))
+	info := func(token string) (sessionInfo, string) {
+		r := httptest.NewRequest(http.MethodGet, sessionInfoPath, nil)
+		r.Header.Set(headerClientType, clientTypeAPI)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d: %s", sessionInfoPath, w.Code, w.Body)
+		}
+		var got sessionInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		return got, w.Header().Get(headerJWTToken)
+	}
+
+	first, token := info("")
+	if first.SessionID == "" || first.Claims == nil || first.Claims.SessionID != first.SessionID {
+		t.Fatalf("info = %+v", first)
+	}
+	if first.ExpiresIn <= 0 || first.ExpiresIn > jwtLifetime.Seconds() || first.TokenBytes != len(token) {
+		t.Errorf("expires_in = %v, token_bytes = %d, want (0, %v] and %d", first.ExpiresIn, first.TokenBytes, jwtLifetime.Seconds(), len(token))
+	}
+	if first.CartID != "cart-"+first.SessionID || first.Currency != defaultCurrency {
+		t.Errorf("cart_id = %q, currency = %q", first.CartID, first.Currency)
+	}
+	if second, _ := info(token); second.SessionID != first.SessionID || second.Claims.ID != first.Claims.ID {
+		t.Errorf("second request: session %q, jti %q, want %q, %q", second.SessionID, second.Claims.ID, first.SessionID, first.Claims.ID)
+	}
+}
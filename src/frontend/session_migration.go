@@ -0,0 +1,78 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sharedSessionID is the session every browser gets with
+// ENABLE_SINGLE_SHARED_SESSION=true
+const sharedSessionID = "12345678-1234-1234-1234-123456789123"
+
+// sessionMigrations counts session cookies moved after
+// ENABLE_SINGLE_SHARED_SESSION changed: "to_shared" for per-browser
+// sessions mapped onto the shared one, "to_per_browser" for the shared
+// session replaced by a browser's own
+var sessionMigrations = expvar.NewMap("session_migrations")
+
+type ctxKeySessionMigrated struct{}
+
+// IsSingleSharedSessionEnabled reports whether all browsers share one
+// session (ENABLE_SINGLE_SHARED_SESSION=true)
+func IsSingleSharedSessionEnabled() bool {
+	return os.Getenv("ENABLE_SINGLE_SHARED_SESSION") == "true"
+}
+
+// migrateSession moves a session cookie set before
+// ENABLE_SINGLE_SHARED_SESSION was toggled into the mode now configured:
+// a browser's own session onto the shared one, or the shared session to a
+// new one of the browser's. It returns the session to use and whether it
+// changed. The cart of the old session stays behind with it; the JWT
+// cookie, issued for the old session, is replaced by ensureJWT rather than
+// rejected (see sessionMigrated).
+func migrateSession(ctx context.Context, w http.ResponseWriter, sessionID string) (string, context.Context, bool) {
+	shared := IsSingleSharedSessionEnabled()
+	if shared == (sessionID == sharedSessionID) {
+		return sessionID, ctx, false
+	}
+	direction, migrated := "to_shared", sharedSessionID
+	if !shared {
+		direction = "to_per_browser"
+		migrated, ctx = newSessionID(ctx)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   cookieSessionID,
+		Value:  migrated,
+		MaxAge: cookieMaxAge,
+	})
+	sessionMigrations.Add(direction, 1)
+	requestLogger(ctx).WithFields(logrus.Fields{
+		"session.migration": direction,
+	}).Info("moved session after ENABLE_SINGLE_SHARED_SESSION changed")
+	return migrated, context.WithValue(ctx, ctxKeySessionMigrated{}, true), true
+}
+
+// sessionMigrated reports whether migrateSession moved the request's
+// session, so that its JWT belongs to the session it left
+func sessionMigrated(r *http.Request) bool {
+	migrated, _ := r.Context().Value(ctxKeySessionMigrated{}).(bool)
+	return migrated
+}
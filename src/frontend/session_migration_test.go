@@ -0,0 +1,87 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSessionMigrationOnSharedSessionToggle(t *testing.T) {
+	useRSAKeys(t)
+
+	var got *JWTClaims
+	handler := ensureSessionID(ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = getJWTFromContext(r.Context())
+	})))
+	cookies := make(map[string]*http.Cookie)
+	visit := func() {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		for _, c := range w.Result().Cookies() {
+			cookies[c.Name] = c
+		}
+	}
+	migrations := func(direction string) int64 {
+		if v, ok := sessionMigrations.Get(direction).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+
+	t.Setenv("ENABLE_SINGLE_SHARED_SESSION", "false")
+	visit()
+	own := cookies[cookieSessionID].Value
+	if own == sharedSessionID || got.SessionID != own {
+		t.Fatalf("first visit: session %q, token for %q", own, got.SessionID)
+	}
+
+	// Turning the shared session on moves the browser onto it, with a
+	// token for it instead of a session mismatch
+	t.Setenv("ENABLE_SINGLE_SHARED_SESSION", "true")
+	before := migrations("to_shared")
+	visit()
+	if s := cookies[cookieSessionID].Value; s != sharedSessionID || got.SessionID != sharedSessionID {
+		t.Errorf("after enabling: session %q, token for %q, want %q", s, got.SessionID, sharedSessionID)
+	}
+	if n := migrations("to_shared") - before; n != 1 {
+		t.Errorf("to_shared migrations = %d, want 1", n)
+	}
+	visit()
+	if n := migrations("to_shared") - before; n != 1 {
+		t.Errorf("to_shared migrations after another visit = %d, want 1", n)
+	}
+
+	// Turning it off gives the browser a session of its own again
+	t.Setenv("ENABLE_SINGLE_SHARED_SESSION", "false")
+	before = migrations("to_per_browser")
+	visit()
+	if s := cookies[cookieSessionID].Value; s == sharedSessionID || got.SessionID != s {
+		t.Errorf("after disabling: session %q, token for %q, want a new session", s, got.SessionID)
+	}
+	if n := migrations("to_per_browser") - before; n != 1 {
+		t.Errorf("to_per_browser migrations = %d, want 1", n)
+	}
+}
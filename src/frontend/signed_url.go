@@ -0,0 +1,243 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// Signed URLs carry a short-lived token in their ?token= query parameter,
+// so a link can be opened where no cookie or Authorization header goes,
+// such as a receipt download from an email or another device. A token
+// names the purpose and path it was minted for and opens that URL once.
+const (
+	// signedURLAudience keeps signed URL tokens from passing for a user's
+	// token, see validateJWT
+	signedURLAudience   = "urn:hipstershop:signed-url"
+	signedURLQueryParam = "token"
+	// signedURLPrefix is where signed URLs are served, without the session
+	// and JWT middleware
+	signedURLPrefix = "/signed/"
+
+	signedURLPurposeReceipt = "order-receipt"
+
+	defaultSignedURLLifetime = 5 * time.Minute
+)
+
+// signedURLStats counts signed URLs issued, and their use: accepted,
+// rejected, and replayed when opened a second time
+var signedURLStats = expvar.NewMap("signed_urls")
+
+type ctxKeySignedURL struct{}
+
+// signedURLClaims are the claims of a signed URL token. Params hold what the
+// purpose needs to serve the URL without asking any service.
+type signedURLClaims struct {
+	Purpose string            `json:"purpose"`
+	Path    string            `json:"path"`
+	Params  map[string]string `json:"params,omitempty"`
+	jwt.RegisteredClaims
+}
+
+var (
+	signedURLLifetimeOnce sync.Once
+	signedURLLifetime     time.Duration
+)
+
+// loadSignedURLLifetime reads SIGNED_URL_TTL, how long a signed URL can be
+// opened (default 5m)
+func loadSignedURLLifetime() time.Duration {
+	v := os.Getenv("SIGNED_URL_TTL")
+	if v == "" {
+		return defaultSignedURLLifetime
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Warnf("ignoring invalid SIGNED_URL_TTL=%q", v)
+		return defaultSignedURLLifetime
+	}
+	return d
+}
+
+// isSignedURLPath reports whether path is served by signed URLs alone
+func isSignedURLPath(path string) bool {
+	return strings.HasPrefix(path, baseUrl+signedURLPrefix)
+}
+
+// issueSignedURL returns a URL opening path once for purpose, on behalf of
+// subject, and when it stops working
+func issueSignedURL(ctx context.Context, purpose, path, subject string, params map[string]string) (string, time.Time, error) {
+	signedURLLifetimeOnce.Do(func() { signedURLLifetime = loadSignedURLLifetime() })
+	now := jwtClock.Now()
+	exp := now.Add(signedURLLifetime)
+	jti := newJWTUUID()
+	token, err := signJWT(ctx, &signedURLClaims{
+		Purpose: purpose,
+		Path:    path,
+		Params:  params,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   subject,
+			Audience:  jwt.ClaimStrings{signedURLAudience},
+			ExpiresAt: jwt.NewNumericDate(exp),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwtNotBefore(now),
+			ID:        jti.String(),
+		},
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	signedURLStats.Add("issued", 1)
+	return path + "?" + url.Values{signedURLQueryParam: {token}}.Encode(), exp, nil
+}
+
+// validateSignedURLToken verifies a signed URL token for purpose and path
+func validateSignedURLToken(tokenStr, purpose, path string) (*signedURLClaims, error) {
+	claims := &signedURLClaims{}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, jwtKeyFunc,
+		jwt.WithAudience(signedURLAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(jwtClock.Now))
+	if err != nil {
+		return nil, classifyJWTError(err)
+	}
+	if claims.Purpose != purpose {
+		return nil, fmt.Errorf("%w: token is for %q, not %q", errJWTWrongPurpose, claims.Purpose, purpose)
+	}
+	if claims.Path != path {
+		return nil, fmt.Errorf("%w: token is for another URL", errJWTWrongPurpose)
+	}
+	if claims.ID == "" {
+		return nil, fmt.Errorf("%w: token has no jti", errJWTMalformed)
+	}
+	return claims, nil
+}
+
+// signedURLUses remembers the signed URL tokens used, until they expire
+var signedURLUses = &usedTokens{used: make(map[string]time.Time)}
+
+type usedTokens struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// use marks jti used and reports whether it was unused
+func (u *usedTokens) use(jti string, exp time.Time) bool {
+	now := jwtClock.Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for k, e := range u.used {
+		if now.After(e) {
+			delete(u.used, k)
+		}
+	}
+	if _, ok := u.used[jti]; ok {
+		return false
+	}
+	u.used[jti] = exp
+	return true
+}
+
+// requireSignedURL serves next only to requests whose ?token= is a signed
+// URL token for purpose and the requested path, used for the first time.
+// The claims are in the context for next, see signedURLFromContext.
+func requireSignedURL(purpose string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The token must not outlive the response in caches or leak to
+		// other sites through the Referer
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+
+		tokenStr := r.URL.Query().Get(signedURLQueryParam)
+		if tokenStr == "" {
+			signedURLStats.Add("rejected", 1)
+			writeAPIError(w, http.StatusUnauthorized, errors.New("missing token query parameter"))
+			return
+		}
+		claims, err := validateSignedURLToken(tokenStr, purpose, r.URL.Path)
+		if err == nil && !signedURLUses.use(claims.ID, claims.ExpiresAt.Time) {
+			signedURLStats.Add("replayed", 1)
+			writeAPIError(w, http.StatusGone, errors.New("signed URL already used"))
+			return
+		}
+		if err != nil {
+			signedURLStats.Add("rejected", 1)
+			log.WithField("error", err).WithField("http.req.path", r.URL.Path).Warn("signed URL rejected")
+			writeAPIError(w, jwtErrorStatus(err), err)
+			return
+		}
+		signedURLStats.Add("accepted", 1)
+		next(w, r.WithContext(context.WithValue(r.Context(), ctxKeySignedURL{}, claims)))
+	}
+}
+
+// signedURLFromContext returns the claims requireSignedURL accepted
+func signedURLFromContext(ctx context.Context) (*signedURLClaims, bool) {
+	claims, ok := ctx.Value(ctxKeySignedURL{}).(*signedURLClaims)
+	return claims, ok
+}
+
+func orderReceiptPath(orderID string) string {
+	return baseUrl + signedURLPrefix + "orders/" + orderID + "/receipt"
+}
+
+// apiOrderReceiptURLHandler issues a signed URL for the receipt of an
+// order, for the holder of its order token
+func (fe *frontendServer) apiOrderReceiptURLHandler(w http.ResponseWriter, r *http.Request) {
+	claims, code, err := fe.requestOrderToken(r, mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, code, err)
+		return
+	}
+	params := map[string]string{"order_id": claims.OrderID}
+	if claims.Amount != nil {
+		params["amount"] = renderMoney(*claims.Amount)
+	}
+	u, exp, err := issueSignedURL(r.Context(), signedURLPurposeReceipt, orderReceiptPath(claims.OrderID), claims.Subject, params)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"url":        u,
+		"expires_at": exp,
+	})
+}
+
+// orderReceiptHandler serves an order receipt through a signed URL
+func orderReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := signedURLFromContext(r.Context())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "receipt-"+claims.Params["order_id"]+".txt"))
+	fmt.Fprintf(w, "Online Boutique\nOrder: %s\nTotal: %s\n", claims.Params["order_id"], claims.Params["amount"])
+}
+
+// registerSignedURLRoutes serves the signed URL downloads
+func registerSignedURLRoutes(r *mux.Router) {
+	r.HandleFunc(baseUrl+signedURLPrefix+"orders/{id}/receipt", requireSignedURL(signedURLPurposeReceipt, orderReceiptHandler)).Methods(http.MethodGet)
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSignedURLs(t *testing.T) {
+	loadTestRSAKeys(t)
+	r := mux.NewRouter()
+	registerSignedURLRoutes(r)
+	get := func(u string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u, nil))
+		return w
+	}
+
+	params := map[string]string{"order_id": "order-1", "amount": "$12.50"}
+	u, _, err := issueSignedURL(context.Background(), signedURLPurposeReceipt, orderReceiptPath("order-1"), "user-1", params)
+	if err != nil {
+		t.Fatalf("issueSignedURL() error = %v", err)
+	}
+	if !isSignedURLPath(strings.SplitN(u, "?", 2)[0]) {
+		t.Errorf("signed URL %s is not below %s, so it would need a session", u, signedURLPrefix)
+	}
+	w := get(u)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "order-1") || !strings.Contains(w.Body.String(), "$12.50") {
+		t.Fatalf("first use: status %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", w.Header().Get("Cache-Control"))
+	}
+	if w := get(u); w.Code != http.StatusGone {
+		t.Errorf("second use: status %d, want 410", w.Code)
+	}
+
+	token := strings.SplitN(u, "token=", 2)[1]
+	if w := get(orderReceiptPath("order-2") + "?token=" + token); w.Code != http.StatusForbidden {
+		t.Errorf("token for another path: status %d, want 403", w.Code)
+	}
+	if w := get(orderReceiptPath("order-1")); w.Code != http.StatusUnauthorized {
+		t.Errorf("without token: status %d, want 401", w.Code)
+	}
+	other, _, err := issueSignedURL(context.Background(), "other-purpose", orderReceiptPath("order-1"), "user-1", nil)
+	if err != nil {
+		t.Fatalf("issueSignedURL() error = %v", err)
+	}
+	if w := get(other); w.Code != http.StatusForbidden {
+		t.Errorf("token for another purpose: status %d, want 403", w.Code)
+	}
+	if _, err := validateJWT(token); err == nil {
+		t.Error("validateJWT() accepted a signed URL token as a session token")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"google.golang.org/grpc"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// testSPIFFEConfig returns a spiffeConfig for id whose SVID is signed by a
+// throwaway CA, as a SPIRE agent would hand out
+func testSPIFFEConfig(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, id string) *spiffeConfig {
+	t.Helper()
+	spiffeID := spiffeid.RequireFromString(id)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := url.Parse(id)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &spiffeConfig{
+		svids:       &x509svid.SVID{ID: spiffeID, Certificates: []*x509.Certificate{cert}, PrivateKey: key},
+		bundles:     x509bundle.FromX509Authorities(spiffeID.TrustDomain(), []*x509.Certificate{ca}),
+		authorizer:  tlsconfig.AuthorizeMemberOf(spiffeID.TrustDomain()),
+		requireMTLS: true,
+		targets:     make(map[string]bool),
+	}
+}
+
+func TestExchangeOverSPIFFEMTLSNamesActor(t *testing.T) {
+	loadTestRSAKeys(t)
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := testSPIFFEConfig(t, ca, caKey, "spiffe://example.org/ns/default/sa/frontend")
+	client := testSPIFFEConfig(t, ca, caKey, "spiffe://example.org/ns/default/sa/checkoutservice")
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(server.serverOption())
+	pb.RegisterTokenServiceServer(srv, &tokenServer{})
+	go srv.Serve(lis)
+	defer srv.Stop()
+	addr := lis.Addr().String()
+	client.targets[addr] = true
+
+	userToken, err := generateJWT("spiffe-session", "USD", claimsProfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(c *spiffeConfig) pb.TokenServiceClient {
+		conn, err := grpc.Dial(addr, c.dialOption(addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return pb.NewTokenServiceClient(conn)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := dial(client).Exchange(ctx, &pb.ExchangeRequest{Token: userToken})
+	if err != nil {
+		t.Fatalf("Exchange() over mTLS error = %v", err)
+	}
+	var claims JWTClaims
+	if _, err := jwt.ParseWithClaims(resp.GetToken(), &claims, func(*jwt.Token) (interface{}, error) {
+		return publicKey, nil
+	}); err != nil {
+		t.Fatalf("exchanged token does not verify: %v", err)
+	}
+	if claims.Actor == nil || claims.Actor.Subject != "spiffe://example.org/ns/default/sa/checkoutservice" {
+		t.Errorf("act = %+v, want the client's SPIFFE ID", claims.Actor)
+	}
+	if claims.SessionID != "spiffe-session" {
+		t.Errorf("session_id = %q", claims.SessionID)
+	}
+	// act takes the fast path through the codec like the flat claims
+	if _, ok := decomposeJWTFast(resp.GetToken()); !ok {
+		t.Error("decomposeJWTFast() rejected a token with an act claim")
+	}
+
+	// Clients without an SVID cannot connect
+	if _, err := dial(nil).Exchange(ctx, &pb.ExchangeRequest{Token: userToken}); err == nil {
+		t.Error("Exchange() over plaintext succeeded against an mTLS server")
+	}
+}
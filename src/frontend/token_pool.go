@@ -0,0 +1,200 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// tokenPoolMaxAge is how long a pre-minted token waits in the pool. Older
+// ones are discarded, so a session handed a pooled token still gets most of
+// the token's lifetime.
+const tokenPoolMaxAge = jwtLifetime / 4
+
+var (
+	// tokenPoolStats counts new sessions served from the pool (hits) or
+	// minted inline (misses), pooled tokens discarded as stale, and tokens
+	// minted in the background; tokenPoolSize is the current pool size
+	tokenPoolStats = expvar.NewMap("jwt_token_pool")
+	tokenPoolSize  = expvar.NewInt("jwt_token_pool_size")
+
+	// jwtPool is nil unless TOKEN_POOL_SIZE is set
+	jwtPool *tokenPool
+)
+
+type ctxKeyPooledJWT struct{}
+
+// pooledToken is a token minted ahead of time for a session ID nobody has
+// been given yet
+type pooledToken struct {
+	sessionID string
+	token     string
+	mintedAt  time.Time
+}
+
+// tokenPool keeps tokens for new anonymous sessions, minted in the
+// background, so a first visit doesn't wait on an RSA signature
+type tokenPool struct {
+	size    int
+	limiter *rate.Limiter
+
+	mu     sync.Mutex
+	tokens []pooledToken
+}
+
+// loadTokenPool reads TOKEN_POOL_SIZE (tokens kept ready, 0 or unset
+// disables the pool) and TOKEN_POOL_REFILL_RATE (tokens minted per second,
+// default 10)
+func loadTokenPool() *tokenPool {
+	v := os.Getenv("TOKEN_POOL_SIZE")
+	if v == "" {
+		return nil
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || size < 0 {
+		log.Warnf("ignoring invalid TOKEN_POOL_SIZE=%q", v)
+		return nil
+	}
+	if size == 0 {
+		return nil
+	}
+	if IsSingleSharedSessionEnabled() {
+		log.Warn("ignoring TOKEN_POOL_SIZE: every request shares one session")
+		return nil
+	}
+	if jwtFingerprintBinding {
+		log.Warn("ignoring TOKEN_POOL_SIZE: tokens are bound to the browser they are issued to")
+		return nil
+	}
+	refill := 10.0
+	if v := os.Getenv("TOKEN_POOL_REFILL_RATE"); v != "" {
+		if r, err := strconv.ParseFloat(v, 64); err == nil && r > 0 {
+			refill = r
+		} else {
+			log.Warnf("ignoring invalid TOKEN_POOL_REFILL_RATE=%q", v)
+		}
+	}
+	log.Infof("pre-minting up to %d tokens for new sessions at %g tokens/s", size, refill)
+	return newTokenPool(size, rate.Limit(refill))
+}
+
+func newTokenPool(size int, refill rate.Limit) *tokenPool {
+	return &tokenPool{size: size, limiter: rate.NewLimiter(refill, 1)}
+}
+
+// run keeps the pool full until ctx is done, minting at most at the refill
+// rate. Nothing is minted until the signing keys have loaded.
+func (p *tokenPool) run(ctx context.Context) {
+	for {
+		if err := p.limiter.Wait(ctx); err != nil {
+			return
+		}
+		if !ready.keysLoaded.Load() {
+			continue
+		}
+		if err := p.refill(ctx); err != nil {
+			log.Warnf("failed to pre-mint token: %v", err)
+		}
+	}
+}
+
+// refill drops stale tokens and mints one more if the pool is not full
+func (p *tokenPool) refill(ctx context.Context) error {
+	p.mu.Lock()
+	p.dropStale(jwtClock.Now())
+	full := len(p.tokens) >= p.size
+	p.mu.Unlock()
+	if full {
+		return nil
+	}
+
+	u := newJWTUUID()
+	sessionID := u.String()
+	profile := profiles.lookup(ctx, jwtSessionFor(sessionID))
+	token, err := generateJWTContext(ctx, sessionID, defaultCurrency, profile)
+	if err != nil {
+		return err
+	}
+	tokenPoolStats.Add("minted", 1)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tokens = append(p.tokens, pooledToken{sessionID: sessionID, token: token, mintedAt: jwtClock.Now()})
+	tokenPoolSize.Set(int64(len(p.tokens)))
+	return nil
+}
+
+// take hands out the oldest fresh token, if any. A nil pool is disabled.
+func (p *tokenPool) take() (pooledToken, bool) {
+	if p == nil {
+		return pooledToken{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dropStale(jwtClock.Now())
+	if len(p.tokens) == 0 {
+		tokenPoolStats.Add("misses", 1)
+		return pooledToken{}, false
+	}
+	t := p.tokens[0]
+	p.tokens = p.tokens[1:]
+	tokenPoolSize.Set(int64(len(p.tokens)))
+	tokenPoolStats.Add("hits", 1)
+	return t, true
+}
+
+// dropStale discards tokens older than tokenPoolMaxAge; call with p.mu held
+func (p *tokenPool) dropStale(now time.Time) {
+	n := 0
+	for n < len(p.tokens) && now.Sub(p.tokens[n].mintedAt) > tokenPoolMaxAge {
+		n++
+	}
+	if n > 0 {
+		p.tokens = p.tokens[n:]
+		tokenPoolSize.Set(int64(len(p.tokens)))
+		tokenPoolStats.Add("expired", int64(n))
+	}
+}
+
+// newSessionID picks the ID of a session without a cookie: a pooled
+// session, whose token ensureJWT then uses instead of minting one, or a
+// fresh UUID
+func newSessionID(ctx context.Context) (string, context.Context) {
+	if t, ok := jwtPool.take(); ok {
+		return t.sessionID, context.WithValue(ctx, ctxKeyPooledJWT{}, t.token)
+	}
+	u := newJWTUUID()
+	return u.String(), ctx
+}
+
+// pooledJWT returns the pre-minted token for the request's session. It is
+// minted in the default currency and for no browser, so a request that
+// already set another currency, or whose token must carry its browser's
+// fingerprint, mints its own.
+func pooledJWT(r *http.Request) (string, bool) {
+	token, ok := r.Context().Value(ctxKeyPooledJWT{}).(string)
+	if !ok || selectedCurrency(r) != defaultCurrency || jwtFingerprintBinding {
+		return "", false
+	}
+	return token, true
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestTokenPoolServesNewSessions(t *testing.T) {
+	useRSAKeys(t)
+	defer func(p *tokenPool) { jwtPool = p }(jwtPool)
+	jwtPool = newTokenPool(1, rate.Inf)
+	if err := jwtPool.refill(context.Background()); err != nil {
+		t.Fatalf("refill() error = %v", err)
+	}
+	pooled := jwtPool.tokens[0]
+
+	var gotSession string
+	handler := ensureSessionID(ensureJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSession = sessionID(r)
+	})))
+	visit := func() (jwtCookie string) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		for _, c := range w.Result().Cookies() {
+			if c.Name == cookieJWT {
+				jwtCookie = c.Value
+			}
+		}
+		return jwtCookie
+	}
+
+	hits := func() string {
+		if v := tokenPoolStats.Get("hits"); v != nil {
+			return v.String()
+		}
+		return "0"
+	}
+	before := hits()
+	if tok := visit(); tok != pooled.token || gotSession != pooled.sessionID {
+		t.Errorf("first visit got session %q, want the pooled session %q with its token", gotSession, pooled.sessionID)
+	}
+	if hits() == before {
+		t.Error("pool hit not counted")
+	}
+	// The pool is empty now, so the next visit mints its own token
+	if tok := visit(); tok == "" || tok == pooled.token || gotSession == pooled.sessionID {
+		t.Errorf("second visit reused the pooled session %q", gotSession)
+	}
+
+	jwtPool.tokens = []pooledToken{{sessionID: "stale", token: pooled.token, mintedAt: time.Now().Add(-2 * tokenPoolMaxAge)}}
+	if _, ok := jwtPool.take(); ok {
+		t.Error("take() returned a token older than tokenPoolMaxAge")
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const (
+	opaqueTokenPrefix = "hso_"
+
+	// tokenRegistrySweepInterval is how often expired registry entries
+	// are dropped
+	tokenRegistrySweepInterval = time.Minute
+)
+
+// issuedToken is what the frontend remembers about each JWT it signed, so it
+// can vouch for reassembled tokens whose signature no longer verifies
+type issuedToken struct {
+	sessionID string
+	subject   string
+	expiresAt time.Time
+	// claimsHash is the claimSetHash of the signed payload
+	claimsHash [sha256.Size]byte
+}
+
+// tokenRegistry tracks issued and revoked JWT IDs and opaque reference
+// tokens. Entries are dropped by a sweep once the token they describe has
+// expired.
+type tokenRegistry struct {
+	sweep sync.Once
+
+	mu      sync.Mutex
+	issued  map[string]issuedToken
+	revoked map[string]time.Time
+	opaque  map[string]opaqueToken
+	// refs maps a JWT to the reference token already minted for it
+	refs map[string]string
+}
+
+type opaqueToken struct {
+	jwt       string
+	expiresAt time.Time
+}
+
+var tokens = &tokenRegistry{
+	issued:  make(map[string]issuedToken),
+	revoked: make(map[string]time.Time),
+	opaque:  make(map[string]opaqueToken),
+	refs:    make(map[string]string),
+}
+
+// claimSetHash hashes the claims in the payload of tokenString, whatever
+// their order and formatting, so a reassembled token hashes as the token
+// that was signed
+func claimSetHash(tokenString string) ([sha256.Size]byte, error) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 {
+		return [sha256.Size]byte{}, fmt.Errorf("%w: %d segments", errJWTMalformed, len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("%w: payload: %v", errJWTMalformed, err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("%w: payload: %v", errJWTMalformed, err)
+	}
+	// Maps marshal with sorted keys
+	canonical, err := json.Marshal(claims)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(canonical), nil
+}
+
+// recordIssued remembers tokenString, just signed with claims
+func (tr *tokenRegistry) recordIssued(claims *JWTClaims, tokenString string) {
+	if claims.ExpiresAt == nil {
+		return
+	}
+	hash, err := claimSetHash(tokenString)
+	if err != nil {
+		return
+	}
+	tr.sweep.Do(func() { go tr.run() })
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.issued[claims.ID] = issuedToken{
+		sessionID:  claims.SessionID,
+		subject:    claims.Subject,
+		expiresAt:  claims.ExpiresAt.Time,
+		claimsHash: hash,
+	}
+}
+
+func (tr *tokenRegistry) run() {
+	ticker := time.NewTicker(tokenRegistrySweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		tr.expire(jwtClock.Now())
+	}
+}
+
+// expire drops the entries for tokens that expired by now
+func (tr *tokenRegistry) expire(now time.Time) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for jti, t := range tr.issued {
+		if now.After(t.expiresAt) {
+			delete(tr.issued, jti)
+		}
+	}
+	for jti, exp := range tr.revoked {
+		if now.After(exp) {
+			delete(tr.revoked, jti)
+		}
+	}
+	for ref, t := range tr.opaque {
+		if now.After(t.expiresAt) {
+			delete(tr.opaque, ref)
+			delete(tr.refs, t.jwt)
+		}
+	}
+}
+
+func (tr *tokenRegistry) isRevoked(jti string) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	_, ok := tr.revoked[jti]
+	return ok
+}
+
+func (tr *tokenRegistry) revoke(jti string, exp time.Time) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.revoked[jti] = exp
+}
+
+func (tr *tokenRegistry) lookupIssued(jti string) (issuedToken, bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	t, ok := tr.issued[jti]
+	return t, ok
+}
+
+// newOpaque stores jwtToken, which expires at exp, behind a reference
+// token. A JWT gets one reference token however often it is asked for.
+func (tr *tokenRegistry) newOpaque(jwtToken string, exp time.Time) (string, error) {
+	tr.sweep.Do(func() { go tr.run() })
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if ref, ok := tr.refs[jwtToken]; ok {
+		return ref, nil
+	}
+	b := make([]byte, 24)
+	if _, err := io.ReadFull(jwtRand, b); err != nil {
+		return "", fmt.Errorf("failed to generate opaque token: %w", err)
+	}
+	ref := opaqueTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	tr.opaque[ref] = opaqueToken{jwt: jwtToken, expiresAt: exp}
+	tr.refs[jwtToken] = ref
+	return ref, nil
+}
+
+func (tr *tokenRegistry) resolveOpaque(ref string) (string, bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	t, ok := tr.opaque[ref]
+	return t.jwt, ok && !jwtClock.Now().After(t.expiresAt)
+}
+
+// tokenServer implements the TokenService for downstream services
+type tokenServer struct {
+	pb.UnimplementedTokenServiceServer
+}
+
+// verifyToken checks a token's signature, falling back to the issued
+// registry for compressed tokens whose reassembled bytes differ from what
+// was signed. It returns the claims and how they were verified.
+func verifyToken(tokenString string) (*JWTClaims, string, error) {
+	if len(tokenString) > len(opaqueTokenPrefix) && tokenString[:len(opaqueTokenPrefix)] == opaqueTokenPrefix {
+		jwtToken, ok := tokens.resolveOpaque(tokenString)
+		if !ok {
+			return nil, "", fmt.Errorf("%w: unknown opaque token", errJWTMalformed)
+		}
+		tokenString = jwtToken
+	}
+
+	claims, err := validateJWT(tokenString)
+	if err == nil {
+		return claims, "signature", nil
+	}
+	if IsMeshTokenEnabled() && errors.Is(err, errJWTSignatureInvalid) {
+		if claims, meshErr := validateMeshJWT(tokenString); meshErr == nil {
+			return claims, "mesh", nil
+		}
+	}
+	if !errors.Is(err, errJWTSignatureInvalid) {
+		return nil, "", err
+	}
+
+	// Reassembled tokens are re-serialized, so the signature cannot match.
+	// Accept them if they carry exactly the claims issued under that jti.
+	claims = &JWTClaims{}
+	if _, _, parseErr := jwt.NewParser().ParseUnverified(tokenString, claims); parseErr != nil {
+		return nil, "", classifyJWTError(parseErr)
+	}
+	issued, ok := tokens.lookupIssued(claims.ID)
+	if !ok || issued.sessionID != claims.SessionID || issued.subject != claims.Subject ||
+		claims.ExpiresAt == nil || !claims.ExpiresAt.Time.Equal(issued.expiresAt) {
+		return nil, "", err
+	}
+	if hash, hashErr := claimSetHash(tokenString); hashErr != nil || hash != issued.claimsHash {
+		return nil, "", err
+	}
+	if jwtClock.Now().After(issued.expiresAt) {
+		return nil, "", fmt.Errorf("%w: exp=%d", errJWTExpired, issued.expiresAt.Unix())
+	}
+	if tokens.isRevoked(claims.ID) {
+		return nil, "", fmt.Errorf("%w: jti=%s", errJWTRevoked, claims.ID)
+	}
+	return claims, "registry", nil
+}
+
+func (ts *tokenServer) Introspect(ctx context.Context, req *pb.IntrospectRequest) (*pb.IntrospectResponse, error) {
+	claims, verifiedBy, err := verifyToken(req.GetToken())
+	if err != nil {
+		return &pb.IntrospectResponse{Active: false, Reason: err.Error()}, nil
+	}
+	resolveProfileClaims(ctx, claims)
+	return &pb.IntrospectResponse{
+		Active:     true,
+		SessionId:  claims.SessionID,
+		Subject:    claims.Subject,
+		Jti:        claims.ID,
+		IssuedAt:   claims.IssuedAt.Unix(),
+		ExpiresAt:  claims.ExpiresAt.Unix(),
+		VerifiedBy: verifiedBy,
+		Claims: map[string]string{
+			"name":         claims.Name,
+			"market_id":    claims.MarketID,
+			"loyalty_tier": claims.LoyaltyTier,
+			"currency":     claims.Currency,
+			"cart_id":      claims.CartID,
+			"profile_ref":  claims.ProfileRef,
+		},
+	}, nil
+}
+
+func (ts *tokenServer) Revoke(ctx context.Context, req *pb.RevokeRequest) (*pb.RevokeResponse, error) {
+	jti, exp := req.GetJti(), jwtClock.Now().Add(jwtLifetime)
+	if req.GetToken() != "" {
+		claims, _, err := verifyToken(req.GetToken())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot revoke token: %v", err)
+		}
+		jti, exp = claims.ID, claims.ExpiresAt.Time
+	}
+	if jti == "" {
+		return nil, status.Error(codes.InvalidArgument, "token or jti is required")
+	}
+	tokens.revoke(jti, exp)
+	log.WithField("jti", jti).Info("jwt revoked")
+	return &pb.RevokeResponse{Revoked: true}, nil
+}
+
+func (ts *tokenServer) Exchange(ctx context.Context, req *pb.ExchangeRequest) (*pb.ExchangeResponse, error) {
+	claims, _, err := verifyToken(req.GetToken())
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "cannot exchange token: %v", err)
+	}
+	// The exchanged token names the service it was exchanged for, if it
+	// connected with an SVID
+	if spiffeID, ok := peerSPIFFEID(ctx); ok {
+		claims.Actor = &jwtActor{Subject: spiffeID}
+	}
+	fresh, err := refreshJWTContext(ctx, claims)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mint token: %v", err)
+	}
+	exp := jwtClock.Now().Add(jwtLifetime)
+	resp := &pb.ExchangeResponse{Token: fresh, ExpiresAt: exp.Unix()}
+	if req.GetOpaque() {
+		if resp.Token, err = tokens.newOpaque(fresh, exp); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	return resp, nil
+}
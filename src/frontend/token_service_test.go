@@ -0,0 +1,123 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestTokenServiceIntrospectExchangeRevoke(t *testing.T) {
+	loadTestRSAKeys(t)
+	clock := useFakeClock(t)
+	token, err := generateJWT("introspect-session", "EUR", defaultClaimsProfile)
+	if err != nil {
+		t.Fatalf("generateJWT() error = %v", err)
+	}
+
+	original, err := validateJWT(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &tokenServer{}
+	ctx := context.Background()
+	resp, err := ts.Introspect(ctx, &pb.IntrospectRequest{Token: token})
+	if err != nil {
+		t.Fatalf("Introspect() error = %v", err)
+	}
+	if !resp.GetActive() || resp.GetSessionId() != "introspect-session" || resp.GetVerifiedBy() != "signature" || resp.GetClaims()["currency"] != "EUR" {
+		t.Errorf("Introspect(valid) = %+v", resp)
+	}
+	// A token that does not verify is inactive, not an error
+	if resp, err := ts.Introspect(ctx, &pb.IntrospectRequest{Token: "not-a-jwt"}); err != nil || resp.GetActive() || resp.GetReason() == "" {
+		t.Errorf("Introspect(garbage) = %+v, %v; want inactive with a reason", resp, err)
+	}
+
+	// A reassembled token is vouched for by the registry only if it
+	// carries exactly the claims that were signed
+	reserialize := func(edit func(map[string]interface{})) string {
+		parts := strings.Split(token, ".")
+		raw, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var payload map[string]interface{}
+		if err := json.Unmarshal(raw, &payload); err != nil {
+			t.Fatal(err)
+		}
+		edit(payload)
+		b, _ := json.Marshal(payload)
+		return parts[0] + "." + base64.RawURLEncoding.EncodeToString(b) + "." + parts[2]
+	}
+	if resp, _ := ts.Introspect(ctx, &pb.IntrospectRequest{Token: reserialize(func(map[string]interface{}) {})}); !resp.GetActive() || resp.GetVerifiedBy() != "registry" {
+		t.Errorf("Introspect(reassembled) = %+v, want active via the registry", resp)
+	}
+	for claim, value := range map[string]interface{}{"currency": "JPY", "cart_id": "cart-other", "extra": "x"} {
+		forged := reserialize(func(p map[string]interface{}) { p[claim] = value })
+		if resp, _ := ts.Introspect(ctx, &pb.IntrospectRequest{Token: forged}); resp.GetActive() {
+			t.Errorf("Introspect() with %s changed = %+v, want inactive", claim, resp)
+		}
+	}
+
+	// An opaque exchange returns a reference that introspects as the session
+	ex, err := ts.Exchange(ctx, &pb.ExchangeRequest{Token: token, Opaque: true})
+	if err != nil {
+		t.Fatalf("Exchange(opaque) error = %v", err)
+	}
+	if !strings.HasPrefix(ex.GetToken(), opaqueTokenPrefix) {
+		t.Fatalf("Exchange(opaque) token = %q, want the %s prefix", ex.GetToken(), opaqueTokenPrefix)
+	}
+	if resp, _ := ts.Introspect(ctx, &pb.IntrospectRequest{Token: ex.GetToken()}); !resp.GetActive() || resp.GetSessionId() != "introspect-session" {
+		t.Errorf("Introspect(opaque) = %+v", resp)
+	}
+	if resp, _ := ts.Introspect(ctx, &pb.IntrospectRequest{Token: opaqueTokenPrefix + "unknown"}); resp.GetActive() {
+		t.Error("an unknown opaque reference introspected as active")
+	}
+
+	if _, err := ts.Revoke(ctx, &pb.RevokeRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Revoke() without token or jti: err = %v, want InvalidArgument", err)
+	}
+	if _, err := ts.Revoke(ctx, &pb.RevokeRequest{Token: token}); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	if resp, _ := ts.Introspect(ctx, &pb.IntrospectRequest{Token: token}); resp.GetActive() {
+		t.Error("a revoked token introspected as active")
+	}
+	if _, err := ts.Exchange(ctx, &pb.ExchangeRequest{Token: token}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Exchange(revoked) err = %v, want Unauthenticated", err)
+	}
+
+	// The reference lives no longer than the token it stands for
+	clock.Advance(jwtLifetime + time.Second)
+	if resp, _ := ts.Introspect(ctx, &pb.IntrospectRequest{Token: ex.GetToken()}); resp.GetActive() {
+		t.Error("an expired opaque reference introspected as active")
+	}
+
+	// and the sweep forgets both
+	tokens.expire(clock.Now())
+	if _, ok := tokens.resolveOpaque(ex.GetToken()); ok {
+		t.Error("expired opaque reference kept after the sweep")
+	}
+	if _, ok := tokens.lookupIssued(original.ID); ok {
+		t.Error("expired token kept in the registry after the sweep")
+	}
+}
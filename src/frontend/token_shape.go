@@ -0,0 +1,179 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// Token shapes are presets of the synthetic claims in minted tokens, so
+// that one build serves several experiment scenarios. JWT_TOKEN_SHAPE picks
+// one at startup and PUT /admin/token-shape switches at runtime:
+//
+//   - realistic: only the claims a production token carries, without
+//     random_value or injected claims
+//   - worst-case-unique, the default: random_value makes every session's
+//     dynamic component unique, and injected claims are added
+//   - pathological-large: worst-case-unique with a shape_pad claim of
+//     tokenShapePadBytes random characters, new in every token
+const (
+	tokenShapeRealistic         = "realistic"
+	tokenShapeWorstCaseUnique   = "worst-case-unique"
+	tokenShapePathologicalLarge = "pathological-large"
+
+	adminTokenShapePath = "/admin/token-shape"
+
+	// tokenShapePadClaim carries the padding of pathological-large tokens
+	tokenShapePadClaim = "shape_pad"
+	tokenShapePadBytes = 8 << 10
+)
+
+// tokenShape is what a preset adds to the claims the frontend sets
+type tokenShape struct {
+	Name string `json:"name"`
+	// RandomValue adds the random_value claim
+	RandomValue bool `json:"random_value"`
+	// Injected adds the claims of the claim injection API
+	Injected bool `json:"injected_claims"`
+	// PadBytes adds a unique shape_pad claim of that many characters
+	PadBytes int `json:"pad_bytes"`
+}
+
+var tokenShapes = map[string]tokenShape{
+	tokenShapeRealistic:         {Name: tokenShapeRealistic},
+	tokenShapeWorstCaseUnique:   {Name: tokenShapeWorstCaseUnique, RandomValue: true, Injected: true},
+	tokenShapePathologicalLarge: {Name: tokenShapePathologicalLarge, RandomValue: true, Injected: true, PadBytes: tokenShapePadBytes},
+}
+
+var (
+	currentTokenShape atomic.Pointer[tokenShape]
+
+	// jwtTokenShape is the name of the shape tokens are minted in
+	jwtTokenShape = expvar.NewString("jwt_token_shape")
+)
+
+// loadTokenShape sets the shape named by JWT_TOKEN_SHAPE, or the default
+func loadTokenShape() {
+	name := os.Getenv("JWT_TOKEN_SHAPE")
+	if name == "" {
+		name = tokenShapeWorstCaseUnique
+	}
+	if err := setTokenShape(name); err != nil {
+		log.Warnf("ignoring JWT_TOKEN_SHAPE: %v", err)
+		setTokenShape(tokenShapeWorstCaseUnique)
+	}
+}
+
+// setTokenShape makes name the shape of tokens minted from now on
+func setTokenShape(name string) error {
+	shape, ok := tokenShapes[name]
+	if !ok {
+		return fmt.Errorf("unknown token shape %q, want one of %v", name, tokenShapeNames())
+	}
+	currentTokenShape.Store(&shape)
+	jwtTokenShape.Set(name)
+	return nil
+}
+
+// activeTokenShape is the shape new tokens are minted in
+func activeTokenShape() tokenShape {
+	if shape := currentTokenShape.Load(); shape != nil {
+		return *shape
+	}
+	return tokenShapes[tokenShapeWorstCaseUnique]
+}
+
+func tokenShapeNames() []string {
+	names := make([]string, 0, len(tokenShapes))
+	for name := range tokenShapes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newRandomValue returns a random_value claim: 16 random bytes, base64
+func newRandomValue() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(jwtRand, b); err != nil {
+		return "", fmt.Errorf("failed to generate random value: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// shapeRandomValue returns the random_value of a token minted in shape,
+// keeping current if it has one
+func shapeRandomValue(shape tokenShape, current string) (string, error) {
+	if !shape.RandomValue {
+		return "", nil
+	}
+	if current != "" {
+		return current, nil
+	}
+	return newRandomValue()
+}
+
+// shapeExtraClaims returns the unlisted claims a token minted in shape
+// carries
+func shapeExtraClaims(shape tokenShape) []injectedClaim {
+	var extra []injectedClaim
+	if shape.Injected {
+		extra = claimInjections.snapshot()
+	}
+	if shape.PadBytes > 0 {
+		b := make([]byte, base64.RawURLEncoding.DecodedLen(shape.PadBytes)+1)
+		if _, err := io.ReadFull(jwtRand, b); err != nil {
+			log.Warnf("leaving out %s: %v", tokenShapePadClaim, err)
+			return extra
+		}
+		pad := injectedClaim{Name: tokenShapePadClaim, Value: base64.RawURLEncoding.EncodeToString(b)[:shape.PadBytes]}
+		pad.Size = len(pad.Value)
+		extra = append(append([]injectedClaim(nil), extra...), pad)
+	}
+	return extra
+}
+
+// tokenShapeHandler shows the shape tokens are minted in, and with PUT
+// {"name": "realistic"} switches it
+func tokenShapeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var req struct {
+			Name string `json:"name"`
+		}
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := setTokenShape(req.Name); err != nil {
+			writeAPIError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		log.WithField("shape", req.Name).Info("minting new tokens in another shape")
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"shape":  activeTokenShape(),
+		"shapes": tokenShapeNames(),
+	})
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTokenShapePresets(t *testing.T) {
+	loadTestRSAKeys(t)
+	t.Setenv("ADMIN_TOKEN", "s3cret")
+	r := mux.NewRouter()
+	registerAdminRoutes(r)
+	defer setTokenShape(tokenShapeWorstCaseUnique)
+	defer claimInjections.remove("")
+	claimInjections.set(injectedClaim{Name: "tag", Value: "experiment-7", Size: len("experiment-7")})
+
+	admin := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, adminTokenShapePath, strings.NewReader(body))
+		req.Header.Set("X-Admin-Token", "s3cret")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	payload := func(token string) map[string]interface{} {
+		t.Helper()
+		var claims map[string]interface{}
+		raw, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+		if err := json.Unmarshal(raw, &claims); err != nil {
+			t.Fatal(err)
+		}
+		return claims
+	}
+	mint := func() map[string]interface{} {
+		t.Helper()
+		token, err := generateJWT("shape-session", "USD", claimsProfile{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := validateJWT(token); err != nil {
+			t.Fatalf("validateJWT() error = %v", err)
+		}
+		return payload(token)
+	}
+
+	if rec := admin(http.MethodPut, `{"name":"tiny"}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("PUT of an unknown shape = %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+	if rec := admin(http.MethodPut, `{"name":"realistic"}`); rec.Code != http.StatusOK {
+		t.Fatalf("PUT = %d: %s", rec.Code, rec.Body)
+	}
+	if got := jwtTokenShape.Value(); got != tokenShapeRealistic {
+		t.Errorf("jwt_token_shape = %q, want %q", got, tokenShapeRealistic)
+	}
+	claims := mint()
+	if _, ok := claims["random_value"]; ok {
+		t.Errorf("realistic token has random_value: %v", claims)
+	}
+	if _, ok := claims["tag"]; ok {
+		t.Errorf("realistic token has injected claims: %v", claims)
+	}
+	// Refreshing a worst-case-unique token in the realistic shape drops
+	// its random value
+	setTokenShape(tokenShapeWorstCaseUnique)
+	old, err := generateJWT("shape-session", "USD", claimsProfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload(old)["random_value"] == nil || payload(old)["tag"] != "experiment-7" {
+		t.Errorf("worst-case-unique token = %v", payload(old))
+	}
+	setTokenShape(tokenShapeRealistic)
+	oldClaims, err := validateJWT(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed, err := refreshJWT(oldClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := payload(refreshed)["random_value"]; ok {
+		t.Errorf("token refreshed in the realistic shape has random_value")
+	}
+
+	if rec := admin(http.MethodPut, `{"name":"pathological-large"}`); rec.Code != http.StatusOK {
+		t.Fatalf("PUT = %d: %s", rec.Code, rec.Body)
+	}
+	first, second := mint(), mint()
+	pad, _ := first[tokenShapePadClaim].(string)
+	if len(pad) != tokenShapePadBytes {
+		t.Errorf("len(%s) = %d, want %d", tokenShapePadClaim, len(pad), tokenShapePadBytes)
+	}
+	if pad == second[tokenShapePadClaim] {
+		t.Errorf("two pathological-large tokens share their %s", tokenShapePadClaim)
+	}
+	if first["random_value"] == nil || first["tag"] != "experiment-7" {
+		t.Errorf("pathological-large token = %v", first)
+	}
+
+	rec := admin(http.MethodGet, "")
+	var got struct {
+		Shape tokenShape `json:"shape"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Shape != tokenShapes[tokenShapePathologicalLarge] {
+		t.Errorf("GET = %s", rec.Body)
+	}
+}
@@ -38,9 +38,13 @@ func (p *productCatalog) Watch(req *healthpb.HealthCheckRequest, ws healthpb.Hea
 	return status.Errorf(codes.Unimplemented, "health check via Watch not implemented")
 }
 
-func (p *productCatalog) ListProducts(context.Context, *pb.Empty) (*pb.ListProductsResponse, error) {
+func (p *productCatalog) ListProducts(ctx context.Context, _ *pb.Empty) (*pb.ListProductsResponse, error) {
 	time.Sleep(extraLatency)
 
+	if locale, ok := sessionLocaleFromContext(ctx); ok {
+		log.Debugf("listing products for market %q in %q", locale.MarketID, locale.Currency)
+	}
+
 	return &pb.ListProductsResponse{Products: p.parseCatalog()}, nil
 }
 
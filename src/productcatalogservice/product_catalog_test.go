@@ -20,7 +20,9 @@ import (
 	"testing"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/productcatalogservice/genproto"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -99,3 +101,37 @@ func TestSearchProducts(t *testing.T) {
 		t.Errorf("got %d, want %d", got, want)
 	}
 }
+
+func TestSessionLocaleInterceptor(t *testing.T) {
+	interceptor := sessionLocaleInterceptor("x-jwt-session")
+	for _, tc := range []struct {
+		name    string
+		md      metadata.MD
+		want    sessionLocale
+		wantSet bool
+	}{
+		{"no session", metadata.MD{}, sessionLocale{}, false},
+		{"session", metadata.Pairs("x-jwt-session", `{"session_id":"s1","name":"Jane","market_id":"EU","currency":"EUR"}`),
+			sessionLocale{Currency: "EUR", MarketID: "EU"}, true},
+		{"bad currency", metadata.Pairs("x-jwt-session", `{"market_id":"US","currency":"dollars"}`),
+			sessionLocale{MarketID: "US"}, true},
+		{"nothing usable", metadata.Pairs("x-jwt-session", `{"session_id":"s1"}`), sessionLocale{}, false},
+		{"not json", metadata.Pairs("x-jwt-session", `{"currency":`), sessionLocale{}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), tc.md)
+			var got sessionLocale
+			var gotSet bool
+			_, err := interceptor(ctx, &pb.Empty{}, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+				got, gotSet = sessionLocaleFromContext(ctx)
+				return nil, nil
+			})
+			if err != nil {
+				t.Fatalf("interceptor() error = %v, want the call to go through", err)
+			}
+			if got != tc.want || gotSet != tc.wantSet {
+				t.Errorf("sessionLocaleFromContext() = %+v, %v; want %+v, %v", got, gotSet, tc.want, tc.wantSet)
+			}
+		})
+	}
+}
@@ -129,9 +129,15 @@ func run(port string) string {
 	otel.SetTextMapPropagator(
 		propagation.NewCompositeTextMapPropagator(
 			propagation.TraceContext{}, propagation.Baggage{}))
+	unaryInterceptors := []grpc.UnaryServerInterceptor{otelgrpc.UnaryServerInterceptor()}
+	if isSessionPersonalizationEnabled() {
+		header := sessionComponentHeader()
+		log.Infof("Session personalization enabled, reading %s.", header)
+		unaryInterceptors = append(unaryInterceptors, sessionLocaleInterceptor(header))
+	}
 	var srv *grpc.Server
 	srv = grpc.NewServer(
-		grpc.UnaryInterceptor(otelgrpc.UnaryServerInterceptor()),
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
 		grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor()))
 
 	svc := &productCatalog{}
@@ -0,0 +1,105 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// The catalog is public and needs no token, but the frontend can send it
+// the session component of the user's JWT (JWT_CATALOG_SESSION=true) so
+// prices can be localized. The component arrives alone, without the
+// signature, so nothing in it is authenticated: it is a hint, never a
+// reason to reject a call.
+
+var (
+	currencyCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
+	marketIDPattern     = regexp.MustCompile(`^[A-Za-z0-9_-]{1,16}$`)
+)
+
+// sessionLocale is what the catalog reads of the session component
+type sessionLocale struct {
+	Currency string `json:"currency"`
+	MarketID string `json:"market_id"`
+}
+
+type ctxKeySessionLocale struct{}
+
+// isSessionPersonalizationEnabled reports whether the session component is
+// read at all (ENABLE_SESSION_PERSONALIZATION=true)
+func isSessionPersonalizationEnabled() bool {
+	return os.Getenv("ENABLE_SESSION_PERSONALIZATION") == "true"
+}
+
+// sessionComponentHeader is the metadata key of the session component, from
+// the same JWT_HEADER_PREFIX and JWT_HEADER_FIELDS the other services read
+func sessionComponentHeader() string {
+	prefix := "x-jwt-"
+	if v := os.Getenv("JWT_HEADER_PREFIX"); v != "" {
+		prefix = strings.ToLower(v)
+	}
+	field := "session"
+	if v := os.Getenv("JWT_HEADER_FIELDS"); v != "" {
+		if parts := strings.Split(strings.ToLower(v), ","); len(parts) == 4 {
+			field = strings.TrimSpace(parts[1])
+		}
+	}
+	return prefix + field
+}
+
+// sessionLocaleInterceptor attaches the currency and market of the session
+// component in header to the context, when present and well formed
+func sessionLocaleInterceptor(header string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if locale, ok := readSessionLocale(ctx, header); ok {
+			ctx = context.WithValue(ctx, ctxKeySessionLocale{}, locale)
+		}
+		return handler(ctx, req)
+	}
+}
+
+func readSessionLocale(ctx context.Context, header string) (sessionLocale, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(header)
+	if len(values) == 0 {
+		return sessionLocale{}, false
+	}
+	var locale sessionLocale
+	if err := json.Unmarshal([]byte(values[0]), &locale); err != nil {
+		log.Debugf("ignoring %s: %v", header, err)
+		return sessionLocale{}, false
+	}
+	if !currencyCodePattern.MatchString(locale.Currency) {
+		locale.Currency = ""
+	}
+	if !marketIDPattern.MatchString(locale.MarketID) {
+		locale.MarketID = ""
+	}
+	return locale, locale.Currency != "" || locale.MarketID != ""
+}
+
+// sessionLocaleFromContext returns the locale the caller's session asked
+// for, if it sent one
+func sessionLocaleFromContext(ctx context.Context) (sessionLocale, bool) {
+	locale, ok := ctx.Value(ctxKeySessionLocale{}).(sessionLocale)
+	return locale, ok
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
+)
+
+// The e2e fixtures chain the services' tests into one checkout flow, see
+// testdata/e2e/README.md in the frontend. This test, the last hop, replays
+// the calls checkout's e2e_test.go recorded to shipping through this
+// service's interceptors and checks the claims arrive as the frontend
+// issued them.
+const e2eCheckoutDir = "../checkoutservice/testdata/e2e"
+
+// e2eFixture is what one hop sent downstream in a compression mode
+type e2eFixture struct {
+	Mode   string                 `json:"mode"`
+	Now    int64                  `json:"now"`
+	Claims map[string]interface{} `json:"claims"`
+	Calls  []struct {
+		Method   string              `json:"method"`
+		Metadata map[string][]string `json:"metadata"`
+	} `json:"calls"`
+}
+
+func TestE2EShipping(t *testing.T) {
+	defer func(prev Clock) { jwtClock = prev }(jwtClock)
+
+	for _, mode := range []string{"full", "compressed"} {
+		t.Run(mode, func(t *testing.T) {
+			b, err := os.ReadFile(filepath.Join(e2eCheckoutDir, mode+".json"))
+			if err != nil {
+				t.Fatalf("missing fixture, run checkoutservice's TestE2EPlaceOrder with -update: %v", err)
+			}
+			var in e2eFixture
+			if err := json.Unmarshal(b, &in); err != nil {
+				t.Fatal(err)
+			}
+			jwtClock = &fakeClock{now: time.Unix(in.Now, 0)}
+			t.Setenv("ENABLE_JWT_COMPRESSION", strconv.FormatBool(mode == "compressed"))
+
+			// The claims the handlers see, by method
+			received := make(map[string]jwtClaimSet)
+			var token string
+			capture := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				received[info.FullMethod], _ = claimsFromContext(ctx)
+				token, _ = ctx.Value(ctxKeyJWT{}).(string)
+				return handler(ctx, req)
+			}
+			lis := bufconn.Listen(1 << 20)
+			srv := grpc.NewServer(append(serverOptions(), grpc.ChainUnaryInterceptor(capture))...)
+			pb.RegisterShippingServiceServer(srv, &server{})
+			go srv.Serve(lis)
+			defer srv.Stop()
+			conn, err := grpc.Dial("bufnet", grpc.WithTransportCredentials(insecure.NewCredentials()),
+				grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			client := pb.NewShippingServiceClient(conn)
+			address := &pb.Address{StreetAddress: "1600 Amphitheatre Parkway", City: "Mountain View", State: "CA", Country: "United States", ZipCode: 94043}
+
+			replayed := 0
+			for _, call := range in.Calls {
+				if !strings.HasPrefix(call.Method, "/hipstershop.ShippingService/") {
+					continue
+				}
+				replayed++
+				md := metadata.MD{}
+				for k, values := range call.Metadata {
+					for _, v := range values {
+						if strings.HasSuffix(k, "-bin") {
+							raw, err := base64.StdEncoding.DecodeString(v)
+							if err != nil {
+								t.Fatalf("%s %s: %v", call.Method, k, err)
+							}
+							v = string(raw)
+						}
+						md.Append(k, v)
+					}
+				}
+				ctx := metadata.NewOutgoingContext(context.Background(), md)
+				token = ""
+				switch call.Method {
+				case pb.ShippingService_GetQuote_FullMethodName:
+					var header metadata.MD
+					if _, err := client.GetQuote(ctx, &pb.GetQuoteRequest{Address: address}, grpc.Header(&header)); err != nil {
+						t.Fatalf("GetQuote() error = %v", err)
+					}
+					// The quote is personalized for the shopper's market
+					if got := header.Get("x-shipping-market"); len(got) != 1 || got[0] != in.Claims["market_id"] {
+						t.Errorf("GetQuote() x-shipping-market = %q, want %q", got, in.Claims["market_id"])
+					}
+				case pb.ShippingService_ShipOrder_FullMethodName:
+					if _, err := client.ShipOrder(ctx, &pb.ShipOrderRequest{Address: address}); err != nil {
+						t.Fatalf("ShipOrder() error = %v", err)
+					}
+				default:
+					t.Fatalf("fixture calls unknown method %s", call.Method)
+				}
+
+				segments, err := splitJWT(token)
+				if err != nil {
+					t.Fatalf("%s: reassembled token: %v", call.Method, err)
+				}
+				var claims map[string]interface{}
+				if err := segments.DecodePayload(&claims); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(claims, in.Claims) {
+					t.Errorf("%s: claims = %v, want %v as the frontend issued them", call.Method, claims, in.Claims)
+				}
+				if got := received[call.Method]; got.SessionID != in.Claims["session_id"] || got.Currency != in.Claims["currency"] {
+					t.Errorf("%s: claimsFromContext() = %+v, want session %v in %v", call.Method, got, in.Claims["session_id"], in.Claims["currency"])
+				}
+			}
+			if replayed == 0 {
+				t.Fatalf("%s mode fixture has no calls to shipping", mode)
+			}
+		})
+	}
+}
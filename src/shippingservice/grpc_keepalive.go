@@ -0,0 +1,103 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// A recycled connection starts with an empty HPACK dynamic table, so every
+// JWT header is sent in full again. The defaults keep connections open for
+// as long as possible and ping idle ones, so that proxies and NATs do not
+// drop them between requests.
+const (
+	defaultKeepaliveTime    = 30 * time.Second
+	defaultKeepaliveTimeout = 10 * time.Second
+	// keepaliveMinPingInterval is the shortest interval at which servers
+	// accept pings, the least grpc-go clients use
+	keepaliveMinPingInterval = 10 * time.Second
+)
+
+// keepaliveDuration reads a duration from the environment. 0 disables the
+// setting it configures.
+func keepaliveDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Warnf("ignoring invalid %s=%q", name, v)
+		return def
+	}
+	return d
+}
+
+// keepaliveClientParams reads GRPC_KEEPALIVE_TIME, the idle time after
+// which a client pings, GRPC_KEEPALIVE_TIMEOUT, how long it waits for the
+// ack, and GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM (default true)
+func keepaliveClientParams() keepalive.ClientParameters {
+	permit := true
+	if v := os.Getenv("GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM"); v != "" {
+		var err error
+		if permit, err = strconv.ParseBool(v); err != nil {
+			log.Warnf("ignoring invalid GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM=%q", v)
+			permit = true
+		}
+	}
+	return keepalive.ClientParameters{
+		Time:                keepaliveDuration("GRPC_KEEPALIVE_TIME", defaultKeepaliveTime),
+		Timeout:             keepaliveDuration("GRPC_KEEPALIVE_TIMEOUT", defaultKeepaliveTimeout),
+		PermitWithoutStream: permit,
+	}
+}
+
+// keepaliveServerParams reads GRPC_MAX_CONNECTION_AGE and
+// GRPC_MAX_CONNECTION_AGE_GRACE, after which connections are closed, and
+// GRPC_MAX_CONNECTION_IDLE. They default to 0: connections are never
+// recycled. Servers ping idle clients as clients ping servers.
+func keepaliveServerParams() keepalive.ServerParameters {
+	return keepalive.ServerParameters{
+		MaxConnectionIdle:     keepaliveDuration("GRPC_MAX_CONNECTION_IDLE", 0),
+		MaxConnectionAge:      keepaliveDuration("GRPC_MAX_CONNECTION_AGE", 0),
+		MaxConnectionAgeGrace: keepaliveDuration("GRPC_MAX_CONNECTION_AGE_GRACE", 0),
+		Time:                  keepaliveDuration("GRPC_KEEPALIVE_TIME", defaultKeepaliveTime),
+		Timeout:               keepaliveDuration("GRPC_KEEPALIVE_TIMEOUT", defaultKeepaliveTimeout),
+	}
+}
+
+// keepaliveDialOption applies keepaliveClientParams to a client connection
+func keepaliveDialOption() grpc.DialOption {
+	return grpc.WithKeepaliveParams(keepaliveClientParams())
+}
+
+// keepaliveServerOption applies keepaliveServerParams to a server
+func keepaliveServerOption() grpc.ServerOption {
+	return grpc.KeepaliveParams(keepaliveServerParams())
+}
+
+// keepaliveEnforcementOption lets clients ping at any interval they may
+// use, even without active calls, instead of being sent away
+func keepaliveEnforcementOption() grpc.ServerOption {
+	return grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		MinTime:             keepaliveMinPingInterval,
+		PermitWithoutStream: true,
+	})
+}
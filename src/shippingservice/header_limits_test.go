@@ -0,0 +1,128 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
+)
+
+// testJWT builds an unsigned token whose name claim is padded to grow the
+// session header. Shipping only checks expiry, so no key is needed.
+func testJWT(t *testing.T, nameLen int) string {
+	t.Helper()
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	header := enc(map[string]string{"alg": "RS256", "typ": "JWT"})
+	payload := enc(map[string]interface{}{
+		"session_id":   "s1",
+		"name":         strings.Repeat("x", nameLen),
+		"market_id":    "US",
+		"currency":     "USD",
+		"cart_id":      "cart-s1",
+		"random_value": "r",
+		"iss":          "https://auth.hipstershop.com",
+		"sub":          "urn:hipstershop:user:s1",
+		"aud":          []string{"urn:hipstershop:api"},
+		"exp":          time.Now().Add(time.Minute).Unix(),
+		"iat":          time.Now().Unix(),
+		"jti":          "j1",
+	})
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString([]byte("sig"))
+}
+
+// startLimitedServer serves the shipping service with the production
+// interceptors and the given max header list size
+func startLimitedServer(t *testing.T, limit uint32) pb.ShippingServiceClient {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(correlationUnaryServerInterceptor, jwtUnaryServerInterceptor),
+		grpc.MaxHeaderListSize(limit),
+	)
+	pb.RegisterShippingServiceServer(srv, &server{})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewShippingServiceClient(conn)
+}
+
+// TestMaxHeaderListSizeSplitJWT grows the split JWT headers towards a
+// 2KB limit: calls under it succeed, and past it the client refuses to send
+// rather than the server seeing truncated components.
+func TestMaxHeaderListSizeSplitJWT(t *testing.T) {
+	const limit = 2048
+	client := startLimitedServer(t, limit)
+
+	// Let the client receive the server's SETTINGS before measuring
+	req := &pb.GetQuoteRequest{Address: &pb.Address{}, Items: []*pb.CartItem{{ProductId: "1", Quantity: 1}}}
+	if _, err := client.GetQuote(context.Background(), req); err != nil {
+		t.Fatalf("GetQuote without JWT: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		nameLen int
+		wantErr bool
+	}{
+		{"well under", 16, false},
+		{"approaching", 900, false},
+		{"over", 2048, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pairs, err := jwtCodec.Encode(testJWT(t, tt.nameLen))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := metadata.AppendToOutgoingContext(context.Background(), pairs...)
+			_, err = client.GetQuote(ctx, req)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("GetQuote with %d byte JWT headers: %v", metadataPairsSize(pairs), err)
+				}
+				return
+			}
+			if status.Code(err) != codes.Internal || !strings.Contains(err.Error(), "header list size") {
+				t.Fatalf("GetQuote with %d byte JWT headers: got %v, want header list size violation", metadataPairsSize(pairs), err)
+			}
+		})
+	}
+}
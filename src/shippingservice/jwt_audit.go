@@ -0,0 +1,48 @@
+package main
+
+import (
+	"expvar"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// securityEvents counts the security events written to the audit log, by
+// event
+var securityEvents = expvar.NewMap("security_events")
+
+// auditLog receives security events as JSON lines, apart from the service
+// log so they can be shipped and kept separately. Events name sources and
+// reasons, never tokens or claims.
+var auditLog = loadAuditLog()
+
+// loadAuditLog opens JWT_AUDIT_LOG, a file security events are appended
+// to; unset, they go to stderr
+func loadAuditLog() *logrus.Logger {
+	l := logrus.New()
+	l.Formatter = &logrus.JSONFormatter{
+		FieldMap: logrus.FieldMap{
+			logrus.FieldKeyTime:  "timestamp",
+			logrus.FieldKeyLevel: "severity",
+			logrus.FieldKeyMsg:   "message",
+		},
+		TimestampFormat: time.RFC3339Nano,
+	}
+	l.Out = os.Stderr
+	if path := os.Getenv("JWT_AUDIT_LOG"); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			l.Warnf("writing security events to stderr: %v", err)
+		} else {
+			l.Out = f
+		}
+	}
+	return l
+}
+
+// auditSecurityEvent writes one security event to the audit log
+func auditSecurityEvent(event string, fields logrus.Fields) {
+	securityEvents.Add(event, 1)
+	auditLog.WithFields(fields).WithField("event", event).Warn("security event")
+}
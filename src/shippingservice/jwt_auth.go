@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// jwtAuthRequests counts calls seen by the JWT server interceptors of
+// services built with jwtAuthMetrics, by outcome: compressed, full,
+// missing or rejected
+var jwtAuthRequests = expvar.NewMap("jwt_auth_requests")
+
+// Context keys for the verified token, its detached JWS, forwarded
+// unchanged since only the frontend can sign, and its claims
+type (
+	ctxKeyJWT         struct{}
+	ctxKeyDetachedJWS struct{}
+	ctxKeyClaims      struct{}
+)
+
+// jwtAuthConfig is how jwtServerInterceptors authenticates calls
+type jwtAuthConfig struct {
+	flow             string
+	requireValid     bool
+	acceptCompressed bool
+	acceptFull       bool
+	propagateClaims  bool
+	metrics          bool
+	maxSkew          time.Duration
+	claimsCache      *claimsCache
+	breaker          *jwtBreaker
+	validateClaims   bool
+	verifyPool       *jwtVerifyPool
+	asyncMethods     map[string]bool
+}
+
+// jwtAuthOption configures jwtServerInterceptors
+type jwtAuthOption func(*jwtAuthConfig)
+
+// jwtAuthFlow names the hop in log lines, as in "Shipping Service ← Checkout"
+func jwtAuthFlow(flow string) jwtAuthOption {
+	return func(c *jwtAuthConfig) { c.flow = flow }
+}
+
+// jwtRequireValid rejects calls without a token. By default they are
+// served without claims.
+func jwtRequireValid() jwtAuthOption {
+	return func(c *jwtAuthConfig) { c.requireValid = true }
+}
+
+// jwtAcceptCompressed sets whether tokens split across metadata by any
+// codec are accepted (default true)
+func jwtAcceptCompressed(accept bool) jwtAuthOption {
+	return func(c *jwtAuthConfig) { c.acceptCompressed = accept }
+}
+
+// jwtAcceptFull sets whether tokens in the authorization header are
+// accepted (default true)
+func jwtAcceptFull(accept bool) jwtAuthOption {
+	return func(c *jwtAuthConfig) { c.acceptFull = accept }
+}
+
+// jwtPropagateClaims stores the token, its detached JWS and its claims in
+// the handler's context, for claimsFromContext and the client interceptors
+func jwtPropagateClaims() jwtAuthOption {
+	return func(c *jwtAuthConfig) { c.propagateClaims = true }
+}
+
+// jwtAuthMetrics counts outcomes in the jwt_auth_requests expvar
+func jwtAuthMetrics() jwtAuthOption {
+	return func(c *jwtAuthConfig) { c.metrics = true }
+}
+
+// loadJWTMaxSkew reads JWT_MAX_SKEW, the clock skew tolerated on exp
+func loadJWTMaxSkew() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("JWT_MAX_SKEW")); err == nil && d > 0 {
+		return d
+	}
+	return 0
+}
+
+// jwtMaxSkew accepts tokens up to d past their exp, for clocks that
+// disagree with the frontend's
+func jwtMaxSkew(d time.Duration) jwtAuthOption {
+	return func(c *jwtAuthConfig) { c.maxSkew = d }
+}
+
+// jwtCacheClaims keeps the decoded claims of up to size sessions, see
+// claimsCache. 0 decodes every token in full.
+func jwtCacheClaims(size int) jwtAuthOption {
+	return func(c *jwtAuthConfig) {
+		c.claimsCache = nil
+		if size > 0 {
+			c.claimsCache = newClaimsCache(size)
+		}
+	}
+}
+
+// jwtCircuitBreaker refuses the calls of peers that sent too many invalid
+// tokens, see jwtBreaker. A nil breaker verifies every call.
+func jwtCircuitBreaker(b *jwtBreaker) jwtAuthOption {
+	return func(c *jwtAuthConfig) { c.breaker = b }
+}
+
+// jwtValidateClaims sets whether the claims of user tokens are checked
+// against the claim schema as soon as they are reassembled, see
+// validateJWTClaims
+func jwtValidateClaims(validate bool) jwtAuthOption {
+	return func(c *jwtAuthConfig) { c.validateClaims = validate }
+}
+
+// jwtAsyncVerify lets the unary handlers of methods run while their token
+// is verified on pool, see jwtVerifyPool. methods must be idempotent reads.
+// A nil pool verifies every token before its handler.
+func jwtAsyncVerify(pool *jwtVerifyPool, methods ...string) jwtAuthOption {
+	return func(c *jwtAuthConfig) {
+		c.verifyPool, c.asyncMethods = pool, make(map[string]bool)
+		for _, m := range methods {
+			c.asyncMethods[m] = true
+		}
+	}
+}
+
+// jwtServerInterceptors returns the unary and stream server interceptors
+// that reassemble, verify and optionally propagate the caller's JWT
+func jwtServerInterceptors(opts ...jwtAuthOption) (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor) {
+	c := &jwtAuthConfig{flow: "Service", acceptCompressed: true, acceptFull: true}
+	for _, opt := range opts {
+		opt(c)
+	}
+	unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if skipJWTMethod(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		async := c.verifyPool != nil && c.asyncMethods[info.FullMethod]
+		ctx, wait, err := c.authenticate(ctx, info.FullMethod, async, func(t metadata.MD) error { return grpc.SetTrailer(ctx, t) })
+		if err != nil {
+			return nil, err
+		}
+		resp, err := handler(ctx, req)
+		if wait != nil {
+			if verr := wait(); verr != nil {
+				return nil, verr
+			}
+		}
+		return resp, err
+	}
+	stream := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if skipJWTMethod(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		ctx, _, err := c.authenticate(ss.Context(), info.FullMethod+" (stream)", false, func(t metadata.MD) error {
+			ss.SetTrailer(t)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if ctx != ss.Context() {
+			ss = &wrappedServerStream{ServerStream: ss, ctx: ctx}
+		}
+		return handler(srv, ss)
+	}
+	return unary, stream
+}
+
+// authenticate checks the JWT in the call's metadata and returns the
+// context for its handler. With async, the token may still be verifying
+// when it returns: wait is then non-nil and returns the rejection, if any,
+// once verification is done; the handler's response must not be sent
+// before it has returned nil.
+func (c *jwtAuthConfig) authenticate(ctx context.Context, method string, async bool, setTrailer func(metadata.MD) error) (_ context.Context, wait func() error, _ error) {
+	log := jwtLogFromContext(ctx)
+	if c.breaker != nil {
+		if err := c.breaker.allow(breakerPeerKey(ctx)); err != nil {
+			c.count("shed")
+			return nil, nil, err
+		}
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	advertiseJWTModes(md, setTrailer)
+
+	var jwtToken string
+
+	// Check for compressed JWT format (any accepted codec and header scheme)
+	decoded, err := DecodeJWTMetadata(md)
+	if err != nil {
+		log.Warnf("Failed to reassemble JWT: %v", err)
+		if !errors.Is(err, errJWTSignatureInvalid) {
+			err = fmt.Errorf("%w: %v", errJWTMalformed, err)
+		}
+		return nil, nil, c.reject(ctx, err)
+	}
+	if decoded != nil {
+		if !c.acceptCompressed {
+			return nil, nil, c.reject(ctx, fmt.Errorf("%w: compressed JWT not accepted", errJWTMalformed))
+		}
+		jwtToken = decoded.Token
+		log = jwtLogger(log, jwtToken, jwtModeCompressed, decoded.WireSize)
+		echoJWTReceipt(setTrailer, jwtModeCompressed, decoded.WireSize)
+		if jwtFlowLog.Sample(method, jwtModeCompressed, decoded.WireSize) {
+			log.Infof("[JWT-FLOW] %s: received JWT (codec=%s) via %s", c.flow, decoded.Codec, method)
+		}
+	} else if authHeaders := md.Get("authorization"); len(authHeaders) > 0 {
+		if !c.acceptFull {
+			return nil, nil, c.reject(ctx, fmt.Errorf("%w: full JWT not accepted", errJWTMalformed))
+		}
+		// Standard format: "Bearer <token>"
+		jwtToken = strings.TrimPrefix(authHeaders[0], "Bearer ")
+		log = jwtLogger(log, jwtToken, authorizationMode(jwtToken), len(jwtToken))
+		echoJWTReceipt(setTrailer, authorizationMode(jwtToken), len(jwtToken))
+		if jwtFlowLog.Sample(method, authorizationMode(jwtToken), len(jwtToken)) {
+			log.Infof("[JWT-FLOW] %s: received JWT via %s", c.flow, method)
+		}
+	}
+
+	if jwtToken == "" {
+		c.count("missing")
+		if c.requireValid {
+			log.Warnf("[JWT-FLOW] %s: rejecting %s without JWT", c.flow, method)
+			return nil, nil, status.Error(codes.Unauthenticated, "JWT required")
+		}
+		if jwtFlowLog.Sample(method, "none", 0) {
+			log.Infof("[JWT-FLOW] %s: no JWT received for %s", c.flow, method)
+		}
+		return ctx, nil, nil
+	}
+	hasClaims := !isOpaqueToken(jwtToken) && (decoded == nil || decoded.Codec != jwtCodecTicket)
+	verify := func(ctx context.Context) error {
+		if c.validateClaims && hasClaims {
+			if err := validateJWTClaims(jwtToken); err != nil {
+				log.Warnf("[JWT-FLOW] %s: rejecting JWT for %s: %v", c.flow, method, err)
+				return c.reject(ctx, err)
+			}
+		}
+		if err := verifyForwardedTokenWithin(ctx, jwtToken, c.maxSkew); err != nil {
+			log.Warnf("[JWT-FLOW] %s: rejecting JWT for %s: %v", c.flow, method, err)
+			return c.reject(ctx, err)
+		}
+		return nil
+	}
+	accept := func() {
+		// Tickets carry a hash of the subject instead of the claims
+		if hasClaims {
+			echoJWTClaimsHash(setTrailer, jwtToken)
+		}
+		if decoded != nil {
+			c.count(jwtModeCompressed)
+		} else {
+			c.count("full")
+		}
+	}
+	if async {
+		wait = c.verifyPool.start(ctx, verify, accept)
+	}
+	if wait == nil {
+		if err := verify(ctx); err != nil {
+			return nil, nil, err
+		}
+		accept()
+	}
+	if !c.propagateClaims {
+		return ctx, wait, nil
+	}
+	ctx = context.WithValue(ctx, ctxKeyJWT{}, jwtToken)
+	if decoded != nil && decoded.DetachedJWS != "" {
+		ctx = context.WithValue(ctx, ctxKeyDetachedJWS{}, decoded.DetachedJWS)
+	}
+	if decoded != nil && decoded.Components != nil && c.claimsCache != nil {
+		if claims, ok := c.claimsCache.claims(decoded.Components); ok {
+			ctx = context.WithValue(ctx, ctxKeyClaims{}, tokenService.resolveProfile(jwtToken, claims))
+		}
+		return ctx, wait, nil
+	}
+	return contextWithClaims(ctx, jwtToken), wait, nil
+}
+
+func (c *jwtAuthConfig) reject(ctx context.Context, err error) error {
+	c.count("rejected")
+	st := jwtStatusError(err)
+	if c.breaker != nil {
+		if key := breakerPeerKey(ctx); c.breaker.failure(key, jwtErrorReason(st)) && !c.breaker.detectOnly {
+			jwtLogFromContext(ctx).Warnf("[JWT-FLOW] %s: too many invalid JWTs from %s, refusing its calls for %s", c.flow, key, c.breaker.cooldown)
+		}
+	}
+	return st
+}
+
+// jwtErrorReason is the ErrorInfo reason of a status from jwtStatusError
+func jwtErrorReason(err error) string {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return "JWT_INVALID"
+}
+
+func (c *jwtAuthConfig) count(outcome string) {
+	if c.metrics {
+		jwtAuthRequests.Add(outcome, 1)
+	}
+}
+
+// contextWithClaims stores the claims of a verified token in ctx. Reference
+// tokens carry no claims, so requests using them get the defaults.
+func contextWithClaims(ctx context.Context, jwtToken string) context.Context {
+	if isOpaqueToken(jwtToken) {
+		return ctx
+	}
+	segments, err := splitJWT(jwtToken)
+	if err != nil {
+		return ctx
+	}
+	// A claim of the wrong type is left empty; the others still decode
+	var claims jwtClaimSet
+	if err := segments.DecodePayload(&claims); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			return ctx
+		}
+	}
+	return context.WithValue(ctx, ctxKeyClaims{}, tokenService.resolveProfile(jwtToken, claims))
+}
+
+// claimsFromContext returns the claims of the request's JWT, if it had one
+func claimsFromContext(ctx context.Context) (jwtClaimSet, bool) {
+	c, ok := ctx.Value(ctxKeyClaims{}).(jwtClaimSet)
+	return c, ok
+}
@@ -0,0 +1,725 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
+)
+
+// expiringJWT builds an unsigned token for session s1 expiring at exp
+func expiringJWT(t *testing.T, exp time.Time) string {
+	t.Helper()
+	return unsignedJWT(t, map[string]interface{}{"session_id": "s1", "currency": "EUR", "exp": exp.Unix()})
+}
+
+// unsignedJWT builds a token with claims and a placeholder signature
+func unsignedJWT(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	return enc(map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + enc(claims) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte("sig"))
+}
+
+func TestJWTServerInterceptorOptions(t *testing.T) {
+	valid := expiringJWT(t, time.Now().Add(time.Minute))
+	lapsed := expiringJWT(t, time.Now().Add(-10*time.Second))
+	full := metadata.Pairs("authorization", "Bearer "+valid)
+	compressed, err := jwtCodec.Encode(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		opts       []jwtAuthOption
+		md         metadata.MD
+		wantCode   codes.Code
+		wantClaims bool
+	}{
+		{"no token allowed by default", nil, metadata.MD{}, codes.OK, false},
+		{"no token with RequireValid", []jwtAuthOption{jwtRequireValid()}, metadata.MD{}, codes.Unauthenticated, false},
+		{"full token", []jwtAuthOption{jwtRequireValid()}, full, codes.OK, false},
+		{"full token refused", []jwtAuthOption{jwtAcceptFull(false)}, full, codes.InvalidArgument, false},
+		{"compressed token", []jwtAuthOption{jwtAcceptFull(false)}, metadata.Pairs(compressed...), codes.OK, false},
+		{"compressed token refused", []jwtAuthOption{jwtAcceptCompressed(false)}, metadata.Pairs(compressed...), codes.InvalidArgument, false},
+		{"claims propagated", []jwtAuthOption{jwtPropagateClaims()}, full, codes.OK, true},
+		{"expired", nil, metadata.Pairs("authorization", "Bearer "+lapsed), codes.Unauthenticated, false},
+		{"expired within MaxSkew", []jwtAuthOption{jwtMaxSkew(time.Minute)}, metadata.Pairs("authorization", "Bearer "+lapsed), codes.OK, false},
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: pb.ShippingService_GetQuote_FullMethodName}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unary, _ := jwtServerInterceptors(tt.opts...)
+			var gotClaims bool
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				claims, ok := claimsFromContext(ctx)
+				gotClaims = ok && claims.Currency == "EUR"
+				return nil, nil
+			}
+			ctx := withCorrelation(metadata.NewIncomingContext(context.Background(), tt.md))
+			_, err := unary(ctx, &pb.GetQuoteRequest{}, info, handler)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("code = %v, want %v (%v)", code, tt.wantCode, err)
+			}
+			if gotClaims != tt.wantClaims {
+				t.Errorf("claims in context = %v, want %v", gotClaims, tt.wantClaims)
+			}
+		})
+	}
+}
+
+func TestJWTClaimsCache(t *testing.T) {
+	token := expiringJWT(t, time.Now().Add(time.Minute))
+	pairs, err := (perClassCodec{}).Encode(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := claimsFromContext(contextWithClaims(context.Background(), token))
+
+	unary, _ := jwtServerInterceptors(jwtPropagateClaims(), jwtCacheClaims(8))
+	info := &grpc.UnaryServerInfo{FullMethod: pb.ShippingService_GetQuote_FullMethodName}
+	hits := func() int64 {
+		v, _ := jwtClaimsCache.Get("hits").(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+	before := hits()
+	for i := 0; i < 3; i++ {
+		var got jwtClaimSet
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			got, _ = claimsFromContext(ctx)
+			return nil, nil
+		}
+		ctx := withCorrelation(metadata.NewIncomingContext(context.Background(), metadata.Pairs(pairs...)))
+		if _, err := unary(ctx, &pb.GetQuoteRequest{}, info, handler); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("call %d: claims = %+v, want %+v", i, got, want)
+		}
+	}
+	if got := hits() - before; got != 2 {
+		t.Errorf("cache hits = %d, want 2", got)
+	}
+}
+
+// fakeClock is a Clock that only moves when told to
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+// TestJWTServerInterceptorExpiryBoundaries steps a fake clock across exp,
+// with and without MaxSkew
+func TestJWTServerInterceptorExpiryBoundaries(t *testing.T) {
+	clock := &fakeClock{now: time.Now().Truncate(time.Second)}
+	defer func(prev Clock) { jwtClock = prev }(jwtClock)
+	jwtClock = clock
+
+	md := metadata.Pairs("authorization", "Bearer "+expiringJWT(t, clock.now.Add(time.Minute)))
+	info := &grpc.UnaryServerInfo{FullMethod: pb.ShippingService_GetQuote_FullMethodName}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	strict, _ := jwtServerInterceptors()
+	lenient, _ := jwtServerInterceptors(jwtMaxSkew(5 * time.Second))
+
+	tests := []struct {
+		elapsed      time.Duration
+		strict, skew codes.Code
+	}{
+		{time.Minute, codes.OK, codes.OK},
+		{time.Minute + time.Second, codes.Unauthenticated, codes.OK},
+		{time.Minute + 5*time.Second, codes.Unauthenticated, codes.OK},
+		{time.Minute + 6*time.Second, codes.Unauthenticated, codes.Unauthenticated},
+	}
+	start := clock.now
+	for _, tt := range tests {
+		clock.now = start.Add(tt.elapsed)
+		ctx := withCorrelation(metadata.NewIncomingContext(context.Background(), md))
+		if _, err := strict(ctx, &pb.GetQuoteRequest{}, info, handler); status.Code(err) != tt.strict {
+			t.Errorf("%v after issue: code = %v, want %v", tt.elapsed, status.Code(err), tt.strict)
+		}
+		if _, err := lenient(ctx, &pb.GetQuoteRequest{}, info, handler); status.Code(err) != tt.skew {
+			t.Errorf("%v after issue with 5s skew: code = %v, want %v", tt.elapsed, status.Code(err), tt.skew)
+		}
+	}
+}
+
+// TestJWTServerInterceptorNotBefore rejects tokens before their nbf, less
+// MaxSkew, and accepts tokens without one
+func TestJWTServerInterceptorNotBefore(t *testing.T) {
+	clock := &fakeClock{now: time.Now().Truncate(time.Second)}
+	defer func(prev Clock) { jwtClock = prev }(jwtClock)
+	jwtClock = clock
+
+	nbf := clock.now.Add(10 * time.Second)
+	early := unsignedJWT(t, map[string]interface{}{"session_id": "s1", "exp": clock.now.Add(time.Minute).Unix(), "nbf": nbf.Unix()})
+	if err := checkJWTExpiry(early); !errors.Is(err, errJWTNotYetValid) {
+		t.Errorf("checkJWTExpiry() before nbf = %v, want %v", err, errJWTNotYetValid)
+	}
+	if err := checkJWTExpiryWithin(early, 10*time.Second); err != nil {
+		t.Errorf("checkJWTExpiryWithin() within skew of nbf = %v", err)
+	}
+	if err := checkJWTExpiry(expiringJWT(t, clock.now.Add(time.Minute))); err != nil {
+		t.Errorf("checkJWTExpiry() without nbf = %v", err)
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: pb.ShippingService_GetQuote_FullMethodName}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	unary, _ := jwtServerInterceptors()
+	ctx := withCorrelation(metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+early)))
+	_, err := unary(ctx, &pb.GetQuoteRequest{}, info, handler)
+	if got := jwtErrorReason(err); status.Code(err) != codes.Unauthenticated || got != "JWT_NOT_YET_VALID" {
+		t.Errorf("before nbf: code = %v, reason = %q; want Unauthenticated, JWT_NOT_YET_VALID", status.Code(err), got)
+	}
+	clock.now = nbf
+	if _, err := unary(ctx, &pb.GetQuoteRequest{}, info, handler); err != nil {
+		t.Errorf("at nbf: %v", err)
+	}
+}
+
+func TestSessionTicketCodec(t *testing.T) {
+	defer func(key []byte) { componentMACKey = key }(componentMACKey)
+	componentMACKey = nil
+	codec := sessionTicketCodec{scheme: jwtHeaders}
+	if _, err := codec.Encode(expiringJWT(t, time.Now().Add(time.Minute))); err == nil {
+		t.Fatal("Encode without JWT_COMPONENT_MAC_SECRET succeeded")
+	}
+	t.Setenv("JWT_COMPONENT_MAC_SECRET", "test-secret")
+	componentMACKey = loadComponentMACKey()
+
+	exp := time.Now().Add(time.Minute).Truncate(time.Second)
+	pairs, err := codec.Encode(expiringJWT(t, exp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 2 || len(pairs[1]) != 86 {
+		t.Fatalf("Encode() = %q, want one header of 86 characters", pairs)
+	}
+
+	decoded, err := DecodeJWTMetadata(metadata.Pairs(pairs...))
+	if err != nil || decoded == nil || decoded.Codec != jwtCodecTicket {
+		t.Fatalf("DecodeJWTMetadata() = %+v, %v", decoded, err)
+	}
+	// The stand-in JWT re-encodes to the same ticket
+	if again, err := codec.Encode(decoded.Token); err != nil || again[1] != pairs[1] {
+		t.Errorf("re-encoded ticket = %q, %v; want %q", again, err, pairs[1])
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: pb.ShippingService_GetQuote_FullMethodName}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	unary, _ := jwtServerInterceptors(jwtRequireValid())
+	ticket, _ := base64.RawURLEncoding.DecodeString(pairs[1])
+	ticket[15] ^= 1 // the last byte of exp
+	tampered := base64.RawURLEncoding.EncodeToString(ticket)
+	expired, err := codec.Encode(expiringJWT(t, time.Now().Add(-time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tt := range map[string]struct {
+		value string
+		want  codes.Code
+	}{
+		"valid":    {pairs[1], codes.OK},
+		"tampered": {tampered, codes.Unauthenticated},
+		"expired":  {expired[1], codes.Unauthenticated},
+	} {
+		ctx := withCorrelation(metadata.NewIncomingContext(context.Background(), metadata.Pairs(pairs[0], tt.value)))
+		if _, err := unary(ctx, &pb.GetQuoteRequest{}, info, handler); status.Code(err) != tt.want {
+			t.Errorf("%s ticket: code = %v, want %v (%v)", name, status.Code(err), tt.want, err)
+		}
+	}
+}
+
+func TestDeflateCodec(t *testing.T) {
+	codec := deflateCodec{scheme: jwtHeaders}
+	token := expiringJWT(t, time.Now().Add(time.Minute))
+	pairs, err := codec.Encode(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeJWTMetadata(metadata.Pairs(pairs...))
+	if err != nil || decoded == nil || decoded.Codec != jwtCodecDeflate {
+		t.Fatalf("DecodeJWTMetadata() = %+v, %v", decoded, err)
+	}
+	if decoded.Token != token {
+		t.Errorf("decoded token = %q, want %q", decoded.Token, token)
+	}
+
+	// A payload inflating past the limit is refused, as is an unknown mode
+	var bomb bytes.Buffer
+	w, _ := flate.NewWriter(&bomb, flate.BestCompression)
+	w.Write(make([]byte, maxInflatedPayloadSize+1))
+	w.Close()
+	segments, _ := splitJWT(pairs[3])
+	for name, md := range map[string]metadata.MD{
+		"oversized":    metadata.Pairs(pairs[0], pairs[1], pairs[2], segments.Header+"."+base64.RawURLEncoding.EncodeToString(bomb.Bytes())+"."),
+		"unknown mode": metadata.Pairs(pairs[0], "BR", pairs[2], pairs[3]),
+		"missing mode": metadata.Pairs(pairs[2], pairs[3]),
+	} {
+		if decoded, err := DecodeJWTMetadata(md); !errors.Is(err, errJWTMalformed) {
+			t.Errorf("%s: DecodeJWTMetadata() = %+v, %v; want errJWTMalformed", name, decoded, err)
+		}
+	}
+}
+
+func TestZstdDictCodec(t *testing.T) {
+	codec := zstdDictCodec{scheme: jwtHeaders}
+	token := expiringJWT(t, time.Now().Add(time.Minute))
+	pairs, err := codec.Encode(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pairs[0] != codec.dictKey() || pairs[1] != "1" {
+		t.Fatalf("Encode() = %q, want dictionary 1 named first", pairs)
+	}
+	decoded, err := DecodeJWTMetadata(metadata.Pairs(pairs...))
+	if err != nil || decoded == nil || decoded.Codec != jwtCodecZstdDict {
+		t.Fatalf("DecodeJWTMetadata() = %+v, %v", decoded, err)
+	}
+	if decoded.Token != token {
+		t.Errorf("decoded token = %q, want %q", decoded.Token, token)
+	}
+	for name, md := range map[string]metadata.MD{
+		"unknown dictionary": metadata.Pairs(pairs[0], "2", pairs[2], pairs[3]),
+		"missing dictionary": metadata.Pairs(pairs[2], pairs[3]),
+		"not zstd":           metadata.Pairs(pairs[0], pairs[1], pairs[2], "e30.e30."),
+	} {
+		if decoded, err := DecodeJWTMetadata(md); !errors.Is(err, errJWTMalformed) {
+			t.Errorf("%s: DecodeJWTMetadata() = %+v, %v; want errJWTMalformed", name, decoded, err)
+		}
+	}
+}
+
+func TestJWTBreakerShedsGarbageStorms(t *testing.T) {
+	clock := &fakeClock{now: time.Now().Truncate(time.Second)}
+	defer func(prev Clock) { jwtClock = prev }(jwtClock)
+	jwtClock = clock
+
+	breaker := newJWTBreaker(3, 10*time.Second, 30*time.Second)
+	unary, _ := jwtServerInterceptors(jwtCircuitBreaker(breaker))
+	info := &grpc.UnaryServerInfo{FullMethod: pb.ShippingService_GetQuote_FullMethodName}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	call := func(ip, token string) codes.Code {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000 + int(clock.now.Unix()%1000)}})
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+		_, err := unary(withCorrelation(ctx), &pb.GetQuoteRequest{}, info, handler)
+		return status.Code(err)
+	}
+	valid := expiringJWT(t, clock.now.Add(time.Hour))
+
+	for i := 0; i < 3; i++ {
+		if code := call("10.0.0.1", "garbage"); code != codes.InvalidArgument {
+			t.Fatalf("garbage token %d: code = %v, want InvalidArgument", i, code)
+		}
+	}
+	if code := call("10.0.0.1", valid); code != codes.Unavailable {
+		t.Errorf("call after the breaker tripped: code = %v, want Unavailable", code)
+	}
+	if code := call("10.0.0.2", valid); code != codes.OK {
+		t.Errorf("call from another peer: code = %v, want OK", code)
+	}
+	if got := breaker.openPeers(); got != 1 {
+		t.Errorf("openPeers() = %d, want 1", got)
+	}
+
+	clock.now = clock.now.Add(31 * time.Second)
+	if code := call("10.0.0.1", valid); code != codes.OK {
+		t.Errorf("call after the cooldown: code = %v, want OK", code)
+	}
+
+	// Failures spread wider than the window never trip it
+	for i := 0; i < 5; i++ {
+		clock.now = clock.now.Add(6 * time.Second)
+		if i%2 == 0 {
+			call("10.0.0.3", "garbage")
+		}
+	}
+	if code := call("10.0.0.3", valid); code != codes.OK {
+		t.Errorf("call after spread-out failures: code = %v, want OK", code)
+	}
+}
+
+func TestJWTBreakerDetectOnly(t *testing.T) {
+	clock := &fakeClock{now: time.Now().Truncate(time.Second)}
+	defer func(prev Clock) { jwtClock = prev }(jwtClock)
+	jwtClock = clock
+	var audit bytes.Buffer
+	defer func(prev io.Writer) { auditLog.Out = prev }(auditLog.Out)
+	auditLog.Out = &audit
+
+	breaker := newJWTBreaker(2, 10*time.Second, 30*time.Second)
+	breaker.detectOnly = true
+	unary, _ := jwtServerInterceptors(jwtCircuitBreaker(breaker))
+	info := &grpc.UnaryServerInfo{FullMethod: pb.ShippingService_GetQuote_FullMethodName}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.1.1"), Port: 40000}})
+	call := func(token string) codes.Code {
+		_, err := unary(withCorrelation(metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))), &pb.GetQuoteRequest{}, info, handler)
+		return status.Code(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		call("garbage")
+	}
+	if code := call(expiringJWT(t, clock.now.Add(time.Hour))); code != codes.OK {
+		t.Errorf("call after a detect-only trip: code = %v, want OK", code)
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(audit.Bytes(), &event); err != nil {
+		t.Fatalf("audit log %q: %v", audit.String(), err)
+	}
+	want := map[string]interface{}{"event": "jwt_breaker_tripped", "source": "10.0.1.1", "reason": "JWT_MALFORMED", "blocked": false}
+	for k, v := range want {
+		if event[k] != v {
+			t.Errorf("audit event %s = %v, want %v", k, event[k], v)
+		}
+	}
+}
+
+func TestJWTClaimsValidation(t *testing.T) {
+	now := time.Now().Unix()
+	claims := func(edit func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": "https://auth.hipstershop.com", "aud": []string{jwtAudience}, "sub": "urn:hipstershop:user:s1",
+			"exp": now + 60, "iat": now, "jti": "j1", "session_id": "s1", "currency": "EUR",
+		}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   map[string]string // claim to violation reason
+	}{
+		{"valid", claims(nil), nil},
+		{"audience as a string", claims(func(c map[string]interface{}) { c["aud"] = jwtAudience }), nil},
+		{"missing claims", claims(func(c map[string]interface{}) { delete(c, "jti"); c["session_id"] = nil }),
+			map[string]string{"jti": claimMissing, "session_id": claimMissing}},
+		{"wrong types", claims(func(c map[string]interface{}) { c["currency"] = 978; c["iat"] = "now"; c["act"] = "svc" }),
+			map[string]string{"currency": claimWrongType, "iat": claimWrongType, "act": claimWrongType}},
+		{"exp before iat", claims(func(c map[string]interface{}) { c["iat"] = now + 120 }),
+			map[string]string{"exp": claimExpNotAfterIat}},
+		{"other audience", claims(func(c map[string]interface{}) { c["aud"] = []string{"urn:hipstershop:svc"} }),
+			map[string]string{"aud": claimAudienceInvalid}},
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: pb.ShippingService_GetQuote_FullMethodName}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	unary, _ := jwtServerInterceptors(jwtValidateClaims(true))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := metadata.Pairs("authorization", "Bearer "+unsignedJWT(t, tt.claims))
+			_, err := unary(withCorrelation(metadata.NewIncomingContext(context.Background(), md)), &pb.GetQuoteRequest{}, info, handler)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("error = %v, want nil", err)
+				}
+				return
+			}
+			st := status.Convert(err)
+			if st.Code() != codes.Unauthenticated {
+				t.Fatalf("code = %v, want Unauthenticated (%v)", st.Code(), err)
+			}
+			got := make(map[string]string)
+			var reason string
+			for _, d := range st.Details() {
+				switch d := d.(type) {
+				case *errdetails.ErrorInfo:
+					reason = d.Reason
+				case *errdetails.BadRequest:
+					for _, v := range d.FieldViolations {
+						got[v.Field] = v.Reason
+					}
+				}
+			}
+			if reason != "JWT_CLAIMS_INVALID" {
+				t.Errorf("ErrorInfo reason = %q, want JWT_CLAIMS_INVALID", reason)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("violations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Without the option, the same tokens are only checked for expiry
+	unary, _ = jwtServerInterceptors()
+	md := metadata.Pairs("authorization", "Bearer "+unsignedJWT(t, tests[2].claims))
+	if _, err := unary(withCorrelation(metadata.NewIncomingContext(context.Background(), md)), &pb.GetQuoteRequest{}, info, handler); err != nil {
+		t.Errorf("without jwtValidateClaims: error = %v, want nil", err)
+	}
+}
+
+func TestJWTAsyncVerify(t *testing.T) {
+	pool := newJWTVerifyPool(1, 1)
+	unary, _ := jwtServerInterceptors(jwtPropagateClaims(), jwtAsyncVerify(pool, pb.ShippingService_GetQuote_FullMethodName))
+	var ran bool
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		ran = true
+		return &pb.GetQuoteResponse{}, nil
+	}
+	call := func(method, token string) (interface{}, error) {
+		ran = false
+		md := metadata.Pairs("authorization", "Bearer "+token)
+		return unary(withCorrelation(metadata.NewIncomingContext(context.Background(), md)), &pb.GetQuoteRequest{}, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+	}
+	valid, expired := expiringJWT(t, time.Now().Add(time.Hour)), expiringJWT(t, time.Now().Add(-time.Hour))
+	aborted := func() int64 {
+		v, _ := jwtAsyncVerifyStats.Get("aborted").(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+
+	if resp, err := call(pb.ShippingService_GetQuote_FullMethodName, valid); err != nil || resp == nil || !ran {
+		t.Errorf("valid token: response = %v, error = %v, handler ran = %v", resp, err, ran)
+	}
+
+	// The handler runs for an expired token, but its response is dropped
+	before := aborted()
+	resp, err := call(pb.ShippingService_GetQuote_FullMethodName, expired)
+	if status.Code(err) != codes.Unauthenticated || resp != nil {
+		t.Errorf("expired token: response = %v, error = %v; want Unauthenticated", resp, err)
+	}
+	if !ran {
+		t.Error("expired token: handler did not run while the token was verified")
+	}
+	if got := aborted() - before; got != 1 {
+		t.Errorf("aborted = %d, want 1", got)
+	}
+
+	// Other methods verify before their handler
+	if _, err := call(pb.ShippingService_ShipOrder_FullMethodName, expired); status.Code(err) != codes.Unauthenticated || ran {
+		t.Errorf("ShipOrder with an expired token: error = %v, handler ran = %v", err, ran)
+	}
+
+	// With the worker busy and no room in the queue, tokens verify inline
+	busy := newJWTVerifyPool(1, 0)
+	release := make(chan struct{})
+	defer close(release)
+	busy.jobs <- func() { <-release }
+	unary, _ = jwtServerInterceptors(jwtAsyncVerify(busy, pb.ShippingService_GetQuote_FullMethodName))
+	if _, err := call(pb.ShippingService_GetQuote_FullMethodName, expired); status.Code(err) != codes.Unauthenticated || ran {
+		t.Errorf("expired token with the queue full: error = %v, handler ran = %v", err, ran)
+	}
+}
+
+// fakeIntrospector answers Introspect with its active and exp, counting
+// the calls that reached it
+type fakeIntrospector struct {
+	pb.TokenServiceClient
+	active bool
+	exp    time.Time
+	calls  int
+}
+
+func (f *fakeIntrospector) Introspect(ctx context.Context, in *pb.IntrospectRequest, opts ...grpc.CallOption) (*pb.IntrospectResponse, error) {
+	f.calls++
+	if !f.active {
+		return &pb.IntrospectResponse{Reason: "revoked"}, nil
+	}
+	return &pb.IntrospectResponse{Active: true, ExpiresAt: f.exp.Unix()}, nil
+}
+
+func TestTokenIntrospectorCache(t *testing.T) {
+	var none *tokenIntrospector
+	if err := none.introspect(context.Background(), "any"); err != nil {
+		t.Errorf("introspect() without a token service = %v", err)
+	}
+
+	fake := &fakeIntrospector{active: true, exp: time.Now().Add(time.Hour)}
+	ti := &tokenIntrospector{client: fake, cache: make(map[[sha256.Size]byte]introspection)}
+	for i := 0; i < 3; i++ {
+		if err := ti.introspect(context.Background(), "token-a"); err != nil {
+			t.Fatalf("introspect() error = %v", err)
+		}
+	}
+	if fake.calls != 1 {
+		t.Errorf("Introspect called %d times for one token, want 1", fake.calls)
+	}
+
+	// Results expire with the cache TTL
+	ti.cache[sha256.Sum256([]byte("token-a"))] = introspection{active: true, expiresAt: time.Now().Add(-time.Second)}
+	if err := ti.introspect(context.Background(), "token-a"); err != nil || fake.calls != 2 {
+		t.Errorf("introspect() after the TTL = %v with %d calls, want a second call", err, fake.calls)
+	}
+
+	// and no later than the token's exp
+	fake.exp = time.Now().Add(-time.Second)
+	ti.introspect(context.Background(), "token-b")
+	ti.introspect(context.Background(), "token-b")
+	if fake.calls != 4 {
+		t.Errorf("Introspect called %d times, want 4: a result past the token's exp is not reused", fake.calls)
+	}
+
+	// An inactive token is rejected as invalid, and that is cached too
+	fake.active = false
+	for i := 0; i < 2; i++ {
+		if err := ti.introspect(context.Background(), "token-c"); !errors.Is(err, errJWTSignatureInvalid) {
+			t.Errorf("introspect(inactive) = %v, want errJWTSignatureInvalid", err)
+		}
+	}
+	if fake.calls != 5 {
+		t.Errorf("Introspect called %d times, want 5", fake.calls)
+	}
+}
+
+func TestResolveProfileOfMinimizedClaims(t *testing.T) {
+	token := unsignedJWT(t, map[string]interface{}{"session_id": "s1", "currency": "JPY", "profile_ref": "ref1"})
+	claims := jwtClaimSet{SessionID: "s1", Currency: "JPY", ProfileRef: "ref1"}
+
+	// Without introspection the market falls back to the currency's
+	var none *tokenIntrospector
+	if got := CreateQuoteForClaims(1, none.resolveProfile(token, claims)).Market; got != "JP" {
+		t.Errorf("market without introspection = %s, want JP", got)
+	}
+
+	ti := &tokenIntrospector{cache: map[[sha256.Size]byte]introspection{
+		sha256.Sum256([]byte(token)): {active: true, claims: map[string]string{"name": "Jane Doe", "market_id": "CA"}, expiresAt: time.Now().Add(time.Minute)},
+	}}
+	got := ti.resolveProfile(token, claims)
+	if got.Name != "Jane Doe" || got.MarketID != "CA" {
+		t.Errorf("resolveProfile() = %+v, want the introspected name and market", got)
+	}
+	if q := CreateQuoteForClaims(1, got); q.Market != "CA" {
+		t.Errorf("market = %s, want CA", q.Market)
+	}
+	if got := ti.resolveProfile(token, jwtClaimSet{MarketID: "GB"}); got.Name != "" || got.MarketID != "GB" {
+		t.Errorf("claims without profile_ref changed: %+v", got)
+	}
+}
+
+// writeSecretGeneration writes files into a Kubernetes Secret mount layout
+// under dir, as the kubelet does: a timestamped directory becomes ..data,
+// atomically, and the files are symlinks through ..data
+func writeSecretGeneration(t *testing.T, dir, generation string, files map[string][]byte) {
+	t.Helper()
+	if err := os.Mkdir(filepath.Join(dir, generation), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, generation, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		link := filepath.Join(dir, name)
+		if _, err := os.Lstat(link); os.IsNotExist(err) {
+			if err := os.Symlink(filepath.Join("..data", name), link); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := os.Symlink(generation, filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerificationKeyReloadsOnSecretRotation(t *testing.T) {
+	publicKeyPEM := func() (*rsa.PublicKey, []byte) {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &key.PublicKey, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}
+	defer func(key *rsa.PublicKey) { verificationKey.Store(key) }(verificationKey.Load())
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "jwt_public_key.pem")
+	first, data := publicKeyPEM()
+	writeSecretGeneration(t, dir, "..2024_06_01_12_00_00.1", map[string][]byte{"jwt_public_key.pem": data})
+	if err := loadVerificationKey(path); err != nil {
+		t.Fatalf("loadVerificationKey() error = %v", err)
+	}
+	if !verificationKey.Load().Equal(first) {
+		t.Fatal("loadVerificationKey() did not load the mounted key")
+	}
+	if err := loadVerificationKey(path); !errors.Is(err, errKeyUnchanged) {
+		t.Errorf("loadVerificationKey() of the key in use = %v, want errKeyUnchanged", err)
+	}
+
+	w, err := watchKeyFiles(verificationKeyName, []string{path}, func() error { return loadVerificationKey(path) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	reloads := func() int64 {
+		if v, ok := jwtKeyReloads.Get(verificationKeyName + " ok").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := reloads()
+	second, data := publicKeyPEM()
+	writeSecretGeneration(t, dir, "..2024_06_01_13_00_00.2", map[string][]byte{"jwt_public_key.pem": data})
+	for deadline := time.Now().Add(5 * time.Second); !verificationKey.Load().Equal(second); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("verification key not reloaded after the Secret rotated")
+		}
+	}
+	var version keyVersion
+	if err := json.Unmarshal([]byte(jwtKeyVersions.Get(verificationKeyName).String()), &version); err != nil {
+		t.Fatal(err)
+	}
+	if version.Generation != "..2024_06_01_13_00_00.2" || version.Fingerprint != rsaKeyFingerprint(second) {
+		t.Errorf("jwt_key_versions[%s] = %+v", verificationKeyName, version)
+	}
+	for deadline := time.Now().Add(time.Second); reloads() != before+1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("jwt_key_reloads[%s ok] = %d, want %d", verificationKeyName, reloads(), before+1)
+		}
+	}
+}
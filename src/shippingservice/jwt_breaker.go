@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultJWTBreakerWindow   = 10 * time.Second
+	defaultJWTBreakerCooldown = 30 * time.Second
+)
+
+// jwtBreakerStats counts breaker trips and the calls shed while a breaker
+// was open; open_peers is the number of peers tripped right now, the value
+// to alert on
+var jwtBreakerStats = expvar.NewMap("jwt_breaker")
+
+// jwtBreaker stops verifying the tokens of a client peer that sent too many
+// invalid ones: once threshold calls from the peer are rejected within
+// window, its calls are refused without looking at their token until
+// cooldown has passed. A storm of garbage tokens then costs no signature
+// verifications. Peers are told apart by SPIFFE ID, or else by IP address,
+// so a breaker also stops the valid calls the peer makes meanwhile. Every
+// trip is written to the audit log; a breaker that only detects does that
+// and refuses nothing.
+type jwtBreaker struct {
+	threshold  int
+	window     time.Duration
+	cooldown   time.Duration
+	detectOnly bool
+
+	mu    sync.Mutex
+	peers map[string]*jwtBreakerPeer
+}
+
+type jwtBreakerPeer struct {
+	windowStart time.Time
+	failures    int
+	openUntil   time.Time
+}
+
+// loadJWTBreaker reads JWT_BREAKER_THRESHOLD, the rejected calls from one
+// peer that trip its breaker (unset or 0 disables the breaker),
+// JWT_BREAKER_WINDOW, the time they are counted over (default 10s),
+// JWT_BREAKER_COOLDOWN, how long the peer's calls are then refused
+// (default 30s), and JWT_BREAKER_BLOCK=false to only audit trips
+func loadJWTBreaker() *jwtBreaker {
+	threshold, err := strconv.Atoi(os.Getenv("JWT_BREAKER_THRESHOLD"))
+	if err != nil || threshold <= 0 {
+		return nil
+	}
+	b := newJWTBreaker(threshold, defaultJWTBreakerWindow, defaultJWTBreakerCooldown)
+	if d, err := time.ParseDuration(os.Getenv("JWT_BREAKER_WINDOW")); err == nil && d > 0 {
+		b.window = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("JWT_BREAKER_COOLDOWN")); err == nil && d > 0 {
+		b.cooldown = d
+	}
+	b.detectOnly = os.Getenv("JWT_BREAKER_BLOCK") == "false"
+	return b
+}
+
+func newJWTBreaker(threshold int, window, cooldown time.Duration) *jwtBreaker {
+	b := &jwtBreaker{threshold: threshold, window: window, cooldown: cooldown, peers: make(map[string]*jwtBreakerPeer)}
+	jwtBreakerStats.Set("open_peers", expvar.Func(func() interface{} { return b.openPeers() }))
+	return b
+}
+
+// breakerPeerKey identifies the client peer of a call
+func breakerPeerKey(ctx context.Context) string {
+	if id, ok := peerSPIFFEID(ctx); ok {
+		return id
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "unknown"
+	}
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host
+	}
+	return p.Addr.String()
+}
+
+// allow returns an error to refuse the call with while the peer's breaker
+// is open
+func (b *jwtBreaker) allow(key string) error {
+	now := jwtClock.Now()
+	b.mu.Lock()
+	var openUntil time.Time
+	if p := b.peers[key]; p != nil {
+		openUntil = p.openUntil
+	}
+	b.mu.Unlock()
+	if b.detectOnly || !now.Before(openUntil) {
+		return nil
+	}
+	jwtBreakerStats.Add("shed", 1)
+	return status.Errorf(codes.Unavailable, "too many invalid JWTs from %s, retry after %s", key, openUntil.Sub(now).Round(time.Second))
+}
+
+// failure records a call from the peer rejected for reason, and reports
+// whether it tripped the peer's breaker
+func (b *jwtBreaker) failure(key, reason string) bool {
+	now := jwtClock.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := b.peers[key]
+	if p == nil {
+		b.pruneLocked(now)
+		p = &jwtBreakerPeer{windowStart: now}
+		b.peers[key] = p
+	}
+	if now.Sub(p.windowStart) > b.window {
+		p.windowStart, p.failures = now, 0
+	}
+	p.failures++
+	if p.failures < b.threshold {
+		return false
+	}
+	failures := p.failures
+	p.openUntil = now.Add(b.cooldown)
+	p.windowStart, p.failures = p.openUntil, 0
+	jwtBreakerStats.Add("trips", 1)
+	auditSecurityEvent("jwt_breaker_tripped", logrus.Fields{
+		"source":     key,
+		"reason":     reason,
+		"failures":   failures,
+		"window":     b.window.String(),
+		"blocked":    !b.detectOnly,
+		"open_until": p.openUntil.UTC().Format(time.RFC3339),
+	})
+	return true
+}
+
+// pruneLocked forgets peers whose window and cooldown are over
+func (b *jwtBreaker) pruneLocked(now time.Time) {
+	for k, p := range b.peers {
+		if now.After(p.openUntil) && now.Sub(p.windowStart) > b.window {
+			delete(b.peers, k)
+		}
+	}
+}
+
+func (b *jwtBreaker) openPeers() int {
+	now := jwtClock.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, p := range b.peers {
+		if now.Before(p.openUntil) {
+			n++
+		}
+	}
+	return n
+}
@@ -1,18 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"os"
-	"strings"
+	"time"
 )
 
 // JWTComponents represents the decomposed parts of a JWT for compression
 type JWTComponents struct {
-	Static    string // Highly cacheable: alg, typ, iss, aud, name
-	Session   string // Session-cacheable: sub, session_id, market_id, currency, cart_id
-	Dynamic   string // Not cacheable: exp, iat, jti
+	Static    string // Highly cacheable: alg, typ, iss, aud
+	Session   string // Session-cacheable: sub, session_id, name, market_id, loyalty_tier, currency, cart_id
+	Dynamic   string // Not cacheable: exp, iat, jti, random_value and unlisted claims
 	Signature string // Not compressible: cryptographic signature
 }
 
@@ -25,55 +26,41 @@ func IsJWTCompressionEnabled() bool {
 // Input: "header.payload.signature" JWT string
 // Output: JWTComponents with split JSON objects
 func DecomposeJWT(jwtToken string) (*JWTComponents, error) {
-	parts := strings.Split(jwtToken, ".")
-	if len(parts) != 3 {
-		return nil, fmt.Errorf("invalid JWT format: expected 3 parts, got %d", len(parts))
-	}
-
-	// Decode header (base64url)
-	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode JWT header: %w", err)
+	defer jwtOperationLatency.ObserveSince(context.Background(), "decompose", time.Now())
+	if components, ok := decomposeJWTFast(jwtToken); ok {
+		return components, nil
 	}
+	return decomposeJWTGeneric(jwtToken)
+}
 
-	// Decode payload (base64url)
-	payloadJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+// decomposeJWTGeneric is DecomposeJWT for any token, decoding the claims
+// into maps
+func decomposeJWTGeneric(jwtToken string) (*JWTComponents, error) {
+	header, payload, signature, err := parseJWT(jwtToken)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode JWT payload: %w", err)
-	}
-
-	var header map[string]interface{}
-	var payload map[string]interface{}
-
-	if err := json.Unmarshal(headerJSON, &header); err != nil {
-		return nil, fmt.Errorf("failed to parse JWT header: %w", err)
-	}
-
-	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
-		return nil, fmt.Errorf("failed to parse JWT payload: %w", err)
+		return nil, err
 	}
 
-	// Build static claims (highly cacheable - same across all requests)
+	// Build static claims (highly cacheable - same across all requests).
+	// typ is optional (RFC 7519, section 5.1), so it is only sent when
+	// the token has one
 	static := map[string]interface{}{
 		"alg": header["alg"],
-		"typ": header["typ"],
+	}
+	if typ, ok := header["typ"]; ok {
+		static["typ"] = typ
 	}
 	
 	// Add static payload claims if they exist
-	if iss, ok := payload["iss"]; ok {
-		static["iss"] = iss
-	}
-	if aud, ok := payload["aud"]; ok {
-		static["aud"] = aud
-	}
-	if name, ok := payload["name"]; ok {
-		static["name"] = name
+	for _, key := range jwtStaticClaims {
+		if val, ok := payload[key]; ok {
+			static[key] = val
+		}
 	}
 
 	// Build session claims (cacheable per user session)
 	session := make(map[string]interface{})
-	sessionKeys := []string{"sub", "session_id", "market_id", "currency", "cart_id"}
-	for _, key := range sessionKeys {
+	for _, key := range jwtSessionClaims {
 		if val, ok := payload[key]; ok {
 			session[key] = val
 		}
@@ -81,13 +68,23 @@ func DecomposeJWT(jwtToken string) (*JWTComponents, error) {
 
 	// Build dynamic claims (changes frequently, not cacheable)
 	dynamic := make(map[string]interface{})
-	dynamicKeys := []string{"exp", "iat", "jti"}
-	for _, key := range dynamicKeys {
+	for _, key := range jwtDynamicClaims {
 		if val, ok := payload[key]; ok {
 			dynamic[key] = val
 		}
 	}
 
+	// Claims no class lists ride in the dynamic component, so a service
+	// whose lists are older than the issuer's still forwards every claim.
+	// Payload alg and typ stay shadowed by the header's, present or not.
+	for key, val := range payload {
+		_, inStatic := static[key]
+		_, inSession := session[key]
+		if !inStatic && !inSession && key != "alg" && key != "typ" {
+			dynamic[key] = val
+		}
+	}
+
 	// Serialize components to JSON
 	staticJSON, _ := json.Marshal(static)
 	sessionJSON, _ := json.Marshal(session)
@@ -97,14 +94,55 @@ func DecomposeJWT(jwtToken string) (*JWTComponents, error) {
 		Static:    string(staticJSON),
 		Session:   string(sessionJSON),
 		Dynamic:   string(dynamicJSON),
-		Signature: parts[2], // Keep signature as-is (base64url encoded)
+		Signature: signature, // Keep signature as-is (base64url encoded)
 	}, nil
 }
 
+// parseJWT decodes the header and payload of a compact JWT into maps and
+// returns the signature segment unchanged
+func parseJWT(jwtToken string) (header, payload map[string]interface{}, signature string, err error) {
+	segments, err := splitJWT(jwtToken)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	// Decode header (base64url)
+	headerJSON, err := base64.RawURLEncoding.DecodeString(segments.Header)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to decode JWT header: %w", err)
+	}
+
+	// Decode payload (base64url)
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(segments.Payload)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to decode JWT payload: %w", err)
+	}
+
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, nil, "", fmt.Errorf("failed to parse JWT header: %w", err)
+	}
+
+	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+		return nil, nil, "", fmt.Errorf("failed to parse JWT payload: %w", err)
+	}
+
+	return header, payload, segments.Signature, nil
+}
+
 // ReassembleJWT reconstructs a JWT from its decomposed components
 // Input: JWTComponents
 // Output: "header.payload.signature" JWT string
 func ReassembleJWT(components *JWTComponents) (string, error) {
+	defer jwtOperationLatency.ObserveSince(context.Background(), "reassemble", time.Now())
+	if token, ok := reassembleJWTFast(components); ok {
+		return token, nil
+	}
+	return reassembleJWTGeneric(components)
+}
+
+// reassembleJWTGeneric is ReassembleJWT for any components, decoding them
+// into maps
+func reassembleJWTGeneric(components *JWTComponents) (string, error) {
 	var staticMap, sessionMap, dynamicMap map[string]interface{}
 
 	if err := json.Unmarshal([]byte(components.Static), &staticMap); err != nil {
@@ -122,7 +160,9 @@ func ReassembleJWT(components *JWTComponents) (string, error) {
 	// Rebuild header
 	header := map[string]interface{}{
 		"alg": staticMap["alg"],
-		"typ": staticMap["typ"],
+	}
+	if typ, ok := staticMap["typ"]; ok {
+		header["typ"] = typ
 	}
 
 	// Rebuild payload (merge all claims)
@@ -145,6 +185,12 @@ func ReassembleJWT(components *JWTComponents) (string, error) {
 		payload[k] = v
 	}
 
+	return assembleJWT(header, payload, components.Signature)
+}
+
+// assembleJWT serializes a header and payload and joins them with the
+// signature. It is the single reassembly path shared by all codecs.
+func assembleJWT(header, payload map[string]interface{}, signature string) (string, error) {
 	// Encode header and payload to JSON
 	headerJSON, err := json.Marshal(header)
 	if err != nil {
@@ -161,7 +207,7 @@ func ReassembleJWT(components *JWTComponents) (string, error) {
 	payloadB64 := base64.RawURLEncoding.EncodeToString(payloadJSON)
 
 	// Reconstruct JWT: header.payload.signature
-	return fmt.Sprintf("%s.%s.%s", headerB64, payloadB64, components.Signature), nil
+	return fmt.Sprintf("%s.%s.%s", headerB64, payloadB64, signature), nil
 }
 
 // GetJWTComponentSizes returns the byte sizes of each component for logging/metrics
@@ -0,0 +1,111 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// The codec's own properties are fuzzed in the frontend's jwt_fuzz_test.go.
+// These targets cover what the interceptors do with metadata from an
+// untrusted peer. Explore further with
+//
+//	go test -run '^$' -fuzz FuzzDecodeJWTMetadata -fuzztime 1m
+
+// FuzzDecodeJWTMetadata decodes arbitrary header values in both codecs'
+// formats: it may fail, but must not panic, and what it accepts must be a
+// compact JWT
+func FuzzDecodeJWTMetadata(f *testing.F) {
+	f.Add(`{"alg":"RS256","iss":"a","typ":"JWT"}`, `{"sub":"s"}`, `{"exp":1}`, "c2ln", "", "")
+	f.Add(`{"alg":"RS256","typ":"JWT"}`, `null`, `[]`, "", "", "")
+	f.Add("", "", "", "c2ln", `{"alg":"RS256","typ":"JWT"}`, `"s"`)
+	f.Add("", "", "", "", `null`, `{"a":`)
+	f.Fuzz(func(t *testing.T, static, session, dynamic, signature, hdr, claim string) {
+		pairs := []string{
+			jwtHeaders.Static, static,
+			jwtHeaders.Session, session,
+			jwtHeaders.Dynamic, dynamic,
+			jwtHeaders.Signature, signature,
+		}
+		perClaim := perClaimCodec{scheme: jwtHeaders}
+		for _, md := range []metadata.MD{
+			metadata.Pairs(pairs...),
+			metadata.Pairs(pairs[2:]...),
+			metadata.Pairs(perClaim.headerKey(), hdr, perClaim.claimPrefix()+"sub", claim, jwtHeaders.Signature, signature),
+		} {
+			decoded, err := DecodeJWTMetadata(md)
+			if err != nil || decoded == nil {
+				continue
+			}
+			if strings.Contains(signature, ".") {
+				continue
+			}
+			if _, _, _, err := parseJWT(decoded.Token); err != nil {
+				t.Errorf("DecodeJWTMetadata(%v) = %q, which does not parse: %v", md, decoded.Token, err)
+			}
+		}
+	})
+}
+
+// FuzzPerClassMetadataRoundTrip sends a token through the per-class codec
+// as the frontend does and checks the interceptor reassembles its claims
+func FuzzPerClassMetadataRoundTrip(f *testing.F) {
+	f.Add(`{"alg":"RS256","typ":"JWT"}`, `{"aud":["urn:hipstershop:frontend"],"exp":4102444800,"iss":"https://auth.hipstershop.com","session_id":"s","sub":"u"}`, "c2ln")
+	f.Add(`{"alg":"RS256","typ":"JWT"}`, `{"sub": "a", "exp": 1.5e9, "name": "Zoë"}`, "c2ln")
+	f.Add(`{"alg":"RS256","typ":"JWT"}`, `{"act":{"sub":"spiffe://example.org/a"}}`, "")
+	f.Fuzz(func(t *testing.T, headerJSON, payloadJSON, signature string) {
+		enc := base64.RawURLEncoding
+		token := enc.EncodeToString([]byte(headerJSON)) + "." + enc.EncodeToString([]byte(payloadJSON)) + "." + signature
+		header, payload, _, err := parseJWT(token)
+		if err != nil {
+			return
+		}
+		pairs, err := (perClassCodec{}).Encode(token)
+		if err != nil {
+			t.Fatalf("Encode() error = %v for a token parseJWT accepts", err)
+		}
+		decoded, err := DecodeJWTMetadata(metadata.Pairs(pairs...))
+		if err != nil || decoded == nil {
+			t.Fatalf("DecodeJWTMetadata() = %v, %v", decoded, err)
+		}
+		gotHeader, gotPayload, gotSignature, err := parseJWT(decoded.Token)
+		if err != nil {
+			t.Fatalf("parseJWT(decoded) error = %v", err)
+		}
+		if gotSignature != signature {
+			t.Errorf("signature = %q, want %q", gotSignature, signature)
+		}
+		// The static component keeps only alg and typ of the header, and
+		// they shadow claims of the same name
+		_, alg := header["alg"]
+		_, typ := header["typ"]
+		_, algClaim := payload["alg"]
+		_, typClaim := payload["typ"]
+		if len(header) != 2 || !alg || !typ || algClaim || typClaim {
+			return
+		}
+		if payload == nil {
+			payload = map[string]interface{}{}
+		}
+		if !reflect.DeepEqual(gotHeader, header) || !reflect.DeepEqual(gotPayload, payload) {
+			t.Errorf("decoded %v %v, want %v %v", gotHeader, gotPayload, header, payload)
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// verificationKeyName is the name the frontend's public key is published
+// under in jwt_key_versions
+const verificationKeyName = "verification"
+
+var (
+	verificationKeyOnce sync.Once
+	verificationKey     atomic.Pointer[rsa.PublicKey]
+)
+
+// jwtVerificationKey returns the frontend's public key, loaded on first use
+// from JWT_PUBLIC_KEY_PATH (default jwt_public_key.pem) and reloaded when
+// the file changes, as when the Secret it is mounted from rotates. It
+// returns nil until the key can be loaded, which fails every detached JWS
+// check.
+func jwtVerificationKey() *rsa.PublicKey {
+	verificationKeyOnce.Do(func() {
+		path := os.Getenv("JWT_PUBLIC_KEY_PATH")
+		if path == "" {
+			path = "jwt_public_key.pem"
+		}
+		reload := func() error { return loadVerificationKey(path) }
+		if err := reload(); err != nil {
+			log.Errorf("failed to load JWT verification key: %v", err)
+		}
+		if _, err := watchKeyFiles(verificationKeyName, []string{path}, reload); err != nil {
+			log.Warnf("not reloading the JWT verification key on rotation: %v", err)
+		}
+	})
+	return verificationKey.Load()
+}
+
+// loadVerificationKey makes the key at path the verification key, unless
+// it already is
+func loadVerificationKey(path string) error {
+	key, err := loadRSAPublicKey(path)
+	if err != nil {
+		return err
+	}
+	if keyInUse(verificationKeyName, key) {
+		return errKeyUnchanged
+	}
+	verificationKey.Store(key)
+	recordKeyVersion(verificationKeyName, newKeyVersion(path, key))
+	return nil
+}
+
+// loadRSAPublicKey reads a PKIX or PKCS#1 PEM-encoded RSA public key
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block", path)
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA public key", path)
+	}
+	return key, nil
+}
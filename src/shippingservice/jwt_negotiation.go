@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Headers of the JWT mode negotiation. A client names the mode of each
+// request in x-jwt-mode; a server that understands the header answers with
+// the modes it accepts in the x-jwt-modes trailer.
+const (
+	jwtModeHeader  = "x-jwt-mode"
+	jwtModesHeader = "x-jwt-modes"
+)
+
+// Wire modes, in the order they were introduced
+const (
+	// jwtWireFull is the compact token in the authorization header
+	jwtWireFull = "v1-full"
+	// jwtWireSplit is the per-class codec: static, session, dynamic and
+	// signature headers
+	jwtWireSplit = "v2-split"
+	// jwtWireComponents is the per-claim codec: one header per claim
+	jwtWireComponents = "v3-components"
+)
+
+// supportedJWTWireModes are the modes this service decodes
+var supportedJWTWireModes = []string{jwtWireFull, jwtWireSplit, jwtWireComponents}
+
+// IsJWTModeNegotiationEnabled reports whether clients pick each target's
+// mode from what it advertised, sending the full token until it has. A new
+// scheme can then be rolled out to clients before every server accepts it.
+func IsJWTModeNegotiationEnabled() bool {
+	return os.Getenv("JWT_MODE_NEGOTIATION") == "true"
+}
+
+// jwtWireMode names the wire mode of a codec
+func jwtWireMode(codec JWTCodec) string {
+	if codec.Name() == jwtCodecPerClaim {
+		return jwtWireComponents
+	}
+	return jwtWireSplit
+}
+
+// advertiseJWTModes answers a client that sent x-jwt-mode with the modes
+// this service accepts. Clients that do not negotiate get no trailer.
+func advertiseJWTModes(md metadata.MD, setTrailer func(metadata.MD) error) {
+	if len(md.Get(jwtModeHeader)) == 0 {
+		return
+	}
+	if err := setTrailer(metadata.Pairs(jwtModesHeader, strings.Join(supportedJWTWireModes, ","))); err != nil {
+		log.Debugf("failed to advertise JWT modes: %v", err)
+	}
+}
+
+// advertiseJWTModesUnary is advertiseJWTModes for a unary server call
+func advertiseJWTModesUnary(ctx context.Context, md metadata.MD) {
+	advertiseJWTModes(md, func(t metadata.MD) error { return grpc.SetTrailer(ctx, t) })
+}
+
+// advertiseJWTModesStream is advertiseJWTModes for a streaming server call
+func advertiseJWTModesStream(ss grpc.ServerStream, md metadata.MD) {
+	advertiseJWTModes(md, func(t metadata.MD) error {
+		ss.SetTrailer(t)
+		return nil
+	})
+}
+
+// jwtModeCache remembers the modes each target advertised
+type jwtModeCache struct {
+	mu    sync.RWMutex
+	modes map[string]map[string]bool
+}
+
+func newJWTModeCache() *jwtModeCache {
+	return &jwtModeCache{modes: make(map[string]map[string]bool)}
+}
+
+// learn records the modes advertised in a response trailer from target
+func (c *jwtModeCache) learn(target string, trailer metadata.MD) {
+	v := trailer.Get(jwtModesHeader)
+	if len(v) == 0 {
+		return
+	}
+	modes := make(map[string]bool)
+	for _, m := range strings.Split(v[0], ",") {
+		modes[strings.TrimSpace(m)] = true
+	}
+	c.mu.Lock()
+	c.modes[target] = modes
+	c.mu.Unlock()
+}
+
+// accepts reports whether target advertised mode. Every server accepts the
+// full token, whether it negotiates or not.
+func (c *jwtModeCache) accepts(target, mode string) bool {
+	if mode == jwtWireFull {
+		return true
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.modes[target][mode]
+}
+
+// negotiate returns the codec to send target, falling back from the
+// per-claim codec to the per-class one, or nil for the full token
+func (c *jwtModeCache) negotiate(target string, preferred JWTCodec) JWTCodec {
+	if c.accepts(target, jwtWireMode(preferred)) {
+		return preferred
+	}
+	if preferred.Name() == jwtCodecPerClaim && c.accepts(target, jwtWireSplit) {
+		return perClassCodec{}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Trailers in which a server reports how it received the JWT, so end-to-end
+// measurements need not correlate logs across pods
+const (
+	jwtReceivedBytesHeader = "x-jwt-received-bytes"
+	jwtModeSeenHeader      = "x-jwt-mode-seen"
+	// jwtClaimsHashHeader carries jwtClaimsHash of the reassembled token
+	jwtClaimsHashHeader = "x-jwt-claims-hash"
+)
+
+// IsJWTReceiptEnabled reports whether servers echo the size and mode of the
+// JWT they received in response trailers
+func IsJWTReceiptEnabled() bool {
+	return os.Getenv("JWT_RECEIPT_TRAILER") == "true"
+}
+
+// echoJWTReceipt reports the JWT's mode, as in the jwt.mode log field, and
+// its header value bytes, as in jwt.size_bytes
+func echoJWTReceipt(setTrailer func(metadata.MD) error, mode string, size int) {
+	if !IsJWTReceiptEnabled() {
+		return
+	}
+	if err := setTrailer(metadata.Pairs(jwtReceivedBytesHeader, strconv.Itoa(size), jwtModeSeenHeader, mode)); err != nil {
+		log.Debugf("failed to echo JWT receipt: %v", err)
+	}
+}
+
+// echoJWTReceiptUnary is echoJWTReceipt for a unary server call
+func echoJWTReceiptUnary(ctx context.Context, mode string, size int) {
+	echoJWTReceipt(func(t metadata.MD) error { return grpc.SetTrailer(ctx, t) }, mode, size)
+}
+
+// echoJWTReceiptStream is echoJWTReceipt for a streaming server call
+func echoJWTReceiptStream(ss grpc.ServerStream, mode string, size int) {
+	echoJWTReceipt(func(t metadata.MD) error {
+		ss.SetTrailer(t)
+		return nil
+	}, mode, size)
+}
+
+// parseJWTReceipt reads the receipt from a response trailer
+func parseJWTReceipt(trailer metadata.MD) (mode string, size int, ok bool) {
+	sizes, modes := trailer.Get(jwtReceivedBytesHeader), trailer.Get(jwtModeSeenHeader)
+	if len(sizes) == 0 || len(modes) == 0 {
+		return "", 0, false
+	}
+	size, err := strconv.Atoi(sizes[0])
+	if err != nil {
+		return "", 0, false
+	}
+	return modes[0], size, true
+}
+
+// IsJWTClaimsVerificationEnabled reports whether servers echo the hash of
+// the claims they reassembled, for the frontend to detect claims lost or
+// altered between the cookie and the gRPC metadata
+func IsJWTClaimsVerificationEnabled() bool {
+	return os.Getenv("JWT_CLAIMS_VERIFICATION") == "true"
+}
+
+// jwtClaimsHash hashes the token's claims independently of their order and
+// encoding, so only a change in the claims themselves changes it
+func jwtClaimsHash(token string) (string, error) {
+	segments, err := splitJWT(token)
+	if err != nil {
+		return "", err
+	}
+	var claims map[string]interface{}
+	if err := segments.DecodePayload(&claims); err != nil {
+		return "", err
+	}
+	// Maps marshal with sorted keys
+	canonical, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// echoJWTClaimsHash reports the hash of the claims of the verified token
+func echoJWTClaimsHash(setTrailer func(metadata.MD) error, token string) {
+	if !IsJWTClaimsVerificationEnabled() {
+		return
+	}
+	hash, err := jwtClaimsHash(token)
+	if err != nil {
+		return
+	}
+	if err := setTrailer(metadata.Pairs(jwtClaimsHashHeader, hash)); err != nil {
+		log.Debugf("failed to echo JWT claims hash: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
+)
+
+// goldenToken returns the signed token of a golden fixture, whose name
+// claim is "Jane Doe"
+func goldenToken(t *testing.T) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(jwtGoldenDir, "v1-per-class.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f jwtGoldenFixture
+	if err := json.Unmarshal(b, &f); err != nil {
+		t.Fatal(err)
+	}
+	return f.Token
+}
+
+// captureLog sends the output of the package and JWT loggers to a buffer
+// for the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	out, jwtOut := log.Out, jwtLog.Out
+	log.Out, jwtLog.Out = &buf, &buf
+	t.Cleanup(func() { log.Out, jwtLog.Out = out, jwtOut })
+	return &buf
+}
+
+// assertNoToken fails if any part of token that identifies it or its
+// owner reached the log
+func assertNoToken(t *testing.T, logged, token string) {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	for what, secret := range map[string]string{
+		"token":     token,
+		"payload":   parts[1],
+		"signature": parts[2],
+		"name":      "Jane Doe",
+	} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("log contains the %s:\n%s", what, logged)
+		}
+	}
+}
+
+func TestLogRedactionInterceptors(t *testing.T) {
+	token := goldenToken(t)
+	buf := captureLog(t)
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	info := &grpc.UnaryServerInfo{FullMethod: pb.ShippingService_GetQuote_FullMethodName}
+	calls := []metadata.MD{
+		metadata.Pairs("authorization", "Bearer "+token),
+		// A malformed split token, whose error quotes its components
+		metadata.Pairs(jwtHeaders.Static, "{}", jwtHeaders.Session, `{"name":"Jane Doe"`, jwtHeaders.Signature, strings.Split(token, ".")[2]),
+	}
+	for _, md := range calls {
+		ctx := withCorrelation(metadata.NewIncomingContext(context.Background(), md))
+		jwtUnaryServerInterceptor(ctx, &pb.GetQuoteRequest{}, info, handler)
+	}
+
+	// Statements that log the token outright are redacted too
+	log.Infof("token %s", token)
+	log.WithField("token", "Bearer "+token).WithError(errors.New("bad token "+token)).Warn("rejected")
+	log.WithField("claims", `{"sub":"u","name":"Jane Doe"}`).Info("claims")
+
+	if buf.Len() == 0 {
+		t.Fatal("nothing was logged")
+	}
+	assertNoToken(t, buf.String(), token)
+}
+
+func TestLogRedactionLevels(t *testing.T) {
+	token := goldenToken(t)
+	defer func(level string) { logRedactionLevel = level }(logRedactionLevel)
+
+	tests := []struct {
+		level string
+		want  string
+	}{
+		{redactionStandard, "jwt(jti=00000000-0000-4000-8000-000000000001 sub=" + hashSubject("urn:hipstershop:user:golden-session") + " sig=" + strings.Split(token, ".")[2][:redactionSignaturePrefix] + "…)"},
+		{redactionStrict, "[redacted token]"},
+		{redactionNone, token},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			logRedactionLevel = tt.level
+			if got := redactString("Bearer " + token); got != "Bearer "+tt.want {
+				t.Errorf("redactString() = %q, want %q", got, "Bearer "+tt.want)
+			}
+		})
+	}
+
+	logRedactionLevel = redactionStandard
+	if got := redactName("Jane Doe"); got != "J***" {
+		t.Errorf("redactName() = %q, want %q", got, "J***")
+	}
+	logRedactionLevel = redactionStrict
+	if got := redactName("Jane Doe"); got != "***" {
+		t.Errorf("strict redactName() = %q, want %q", got, "***")
+	}
+}
+
+// TestJWTLogLevel keeps the per-call JWT lines under JWT_LOG_LEVEL while
+// rejections still carry the request's correlation fields
+func TestJWTLogLevel(t *testing.T) {
+	buf := captureLog(t)
+	defer func(level logrus.Level) { jwtLog.Level = level }(jwtLog.Level)
+	t.Setenv("JWT_LOG_LEVEL", "warn")
+	jwtLog.Level = loadLogLevel("JWT_LOG_LEVEL", log.Level)
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	info := &grpc.UnaryServerInfo{FullMethod: pb.ShippingService_GetQuote_FullMethodName}
+	unary, _ := jwtServerInterceptors(jwtAuthFlow("test"))
+	call := func(token string) {
+		md := metadata.Pairs("authorization", "Bearer "+token, headerRequestID, "req-1")
+		unary(withCorrelation(metadata.NewIncomingContext(context.Background(), md)), &pb.GetQuoteRequest{}, info, handler)
+	}
+	call(expiringJWT(t, time.Now().Add(time.Minute)))
+	if buf.Len() != 0 {
+		t.Errorf("JWT_LOG_LEVEL=warn logged an accepted call:\n%s", buf.String())
+	}
+	call(expiringJWT(t, time.Now().Add(-time.Minute)))
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("rejection not logged as one JSON line: %v\n%s", err, buf.String())
+	}
+	if entry["severity"] != "warning" || entry["http.req.id"] != "req-1" || entry[logFieldMode] != jwtModeFull {
+		t.Errorf("rejection logged as %v, want a warning with the request id and JWT fields", entry)
+	}
+
+	t.Setenv("JWT_LOG_LEVEL", "loud")
+	if got := loadLogLevel("JWT_LOG_LEVEL", logrus.InfoLevel); got != logrus.InfoLevel {
+		t.Errorf("invalid JWT_LOG_LEVEL gave %v, want the default", got)
+	}
+}
@@ -25,6 +25,8 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip" // accepts gzip-compressed calls, see MESSAGE_COMPRESSION in the frontend
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 
@@ -38,18 +40,21 @@ const (
 
 var log *logrus.Logger
 
+// The JWT server interceptors of this service
+var jwtUnaryServerInterceptor, jwtStreamServerInterceptor = jwtServerInterceptors(
+	jwtAuthFlow("Shipping Service ← Checkout"),
+	jwtPropagateClaims(),
+	jwtAuthMetrics(),
+	jwtMaxSkew(loadJWTMaxSkew()),
+	jwtCacheClaims(loadClaimsCacheSize()),
+	jwtCircuitBreaker(loadJWTBreaker()),
+	jwtValidateClaims(loadJWTClaimsValidation()),
+	// Quotes only read; ShipOrder is always verified first
+	jwtAsyncVerify(loadJWTVerifyPool(), pb.ShippingService_GetQuote_FullMethodName),
+)
+
 func init() {
-	log = logrus.New()
-	log.Level = logrus.DebugLevel
-	log.Formatter = &logrus.JSONFormatter{
-		FieldMap: logrus.FieldMap{
-			logrus.FieldKeyTime:  "timestamp",
-			logrus.FieldKeyLevel: "severity",
-			logrus.FieldKeyMsg:   "message",
-		},
-		TimestampFormat: time.RFC3339Nano,
-	}
-	log.Out = os.Stdout
+	initLogging()
 }
 
 func main() {
@@ -68,6 +73,10 @@ func main() {
 		log.Info("Profiling disabled.")
 	}
 
+	spiffeMTLS = loadSPIFFEConfig()
+	tokenService = newTokenIntrospector(os.Getenv("TOKEN_SERVICE_ADDR"))
+	go serveDebug(log)
+
 	port := defaultPort
 	if value, ok := os.LookupEnv("PORT"); ok {
 		port = value
@@ -79,23 +88,12 @@ func main() {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	var srv *grpc.Server
-	// Configure HPACK table size: 256KB total (224KB HPACK table + 32KB overhead)
 	if os.Getenv("DISABLE_STATS") == "" {
 		log.Info("Stats enabled, but temporarily unavailable")
-		srv = grpc.NewServer(
-			grpc.ChainUnaryInterceptor(jwtUnaryServerInterceptor),
-			grpc.ChainStreamInterceptor(jwtStreamServerInterceptor),
-			grpc.MaxHeaderListSize(262144), // 256KB (224KB HPACK table + 32KB overhead)
-		)
 	} else {
 		log.Info("Stats disabled.")
-		srv = grpc.NewServer(
-			grpc.ChainUnaryInterceptor(jwtUnaryServerInterceptor),
-			grpc.ChainStreamInterceptor(jwtStreamServerInterceptor),
-			grpc.MaxHeaderListSize(262144), // 256KB (224KB HPACK table + 32KB overhead)
-		)
 	}
+	srv := grpc.NewServer(serverOptions()...)
 	svc := &server{}
 	pb.RegisterShippingServiceServer(srv, svc)
 	healthpb.RegisterHealthServer(srv, svc)
@@ -108,6 +106,21 @@ func main() {
 	}
 }
 
+// serverOptions are the options of the gRPC server: the interceptor chains
+// and transport settings
+func serverOptions() []grpc.ServerOption {
+	// Max header list size: MAX_HEADER_LIST_SIZE, 256KB by default (224KB HPACK table + 32KB overhead)
+	// Connection recycling: GRPC_MAX_CONNECTION_AGE, never by default
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(correlationUnaryServerInterceptor, svcIdentityUnaryServerInterceptor, jwtUnaryServerInterceptor),
+		grpc.ChainStreamInterceptor(correlationStreamServerInterceptor, svcIdentityStreamServerInterceptor, jwtStreamServerInterceptor),
+		grpc.MaxHeaderListSize(maxHeaderListSize),
+		spiffeMTLS.serverOption(),
+		keepaliveServerOption(),
+		keepaliveEnforcementOption(),
+	}
+}
+
 // server controls RPC service responses.
 type server struct {
 	pb.UnimplementedShippingServiceServer
@@ -124,11 +137,26 @@ func (s *server) Watch(req *healthpb.HealthCheckRequest, ws healthpb.Health_Watc
 
 // GetQuote produces a shipping quote (cost) in USD.
 func (s *server) GetQuote(ctx context.Context, in *pb.GetQuoteRequest) (*pb.GetQuoteResponse, error) {
+	log := logFromContext(ctx)
 	log.Info("[GetQuote] received request")
 	defer log.Info("[GetQuote] completed request")
 
-	// 1. Generate a quote based on the total number of items to be shipped.
+	// 1. Generate a quote based on the total number of items to be shipped,
+	// personalized by the shopper's market and loyalty tier when the
+	// request carried a JWT.
 	quote := CreateQuoteFromCount(0)
+	if claims, ok := claimsFromContext(ctx); ok {
+		personalized := CreateQuoteForClaims(0, claims)
+		quote = personalized.Quote
+		log.WithFields(logrus.Fields{
+			"market":       personalized.Market,
+			"carrier":      personalized.Carrier,
+			"loyalty_tier": personalized.LoyaltyTier,
+		}).Infof("[GetQuote] personalized quote %s", quote)
+		// The response message has no room for the carrier; report it in
+		// the response headers
+		grpc.SetHeader(ctx, metadata.Pairs("x-shipping-carrier", personalized.Carrier, "x-shipping-market", personalized.Market))
+	}
 
 	// 2. Generate a response.
 	return &pb.GetQuoteResponse{
@@ -143,6 +171,7 @@ func (s *server) GetQuote(ctx context.Context, in *pb.GetQuoteRequest) (*pb.GetQ
 // ShipOrder mocks that the requested items will be shipped.
 // It supplies a tracking ID for notional lookup of shipment delivery status.
 func (s *server) ShipOrder(ctx context.Context, in *pb.ShipOrderRequest) (*pb.ShipOrderResponse, error) {
+	log := logFromContext(ctx)
 	log.Info("[ShipOrder] received request")
 	defer log.Info("[ShipOrder] completed request")
 	// 1. Create a Tracking ID
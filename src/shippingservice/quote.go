@@ -42,4 +42,78 @@ func CreateQuoteFromFloat(value float64) Quote {
 		uint32(units),
 		uint32(math.Trunc(fraction * 100)),
 	}
-}
\ No newline at end of file
+}
+
+// carrier is the shipping carrier and base price in cents used for a market
+type carrier struct {
+	Name  string
+	Cents uint32
+}
+
+// defaultMarket is assumed when a request carries no market or currency
+const defaultMarket = "US"
+
+var (
+	marketCarriers = map[string]carrier{
+		"US": {"USPS", 899},
+		"CA": {"Canada Post", 1099},
+		"GB": {"Royal Mail", 1199},
+		"DE": {"DHL", 1299},
+		"FR": {"La Poste", 1299},
+		"JP": {"Japan Post", 1499},
+	}
+	internationalCarrier = carrier{"FedEx International", 1999}
+
+	// currencyMarkets infers the market from the currency claim for tokens
+	// without a market_id
+	currencyMarkets = map[string]string{
+		"USD": "US",
+		"CAD": "CA",
+		"GBP": "GB",
+		"EUR": "DE",
+		"JPY": "JP",
+	}
+
+	// loyaltyDiscounts is the fraction of the shipping price each loyalty
+	// tier pays; tiers not listed pay in full
+	loyaltyDiscounts = map[string]float64{
+		"silver":   0.5,
+		"gold":     0,
+		"platinum": 0,
+	}
+)
+
+// PersonalizedQuote is a quote along with how it was arrived at
+type PersonalizedQuote struct {
+	Quote
+	Market      string
+	Carrier     string
+	LoyaltyTier string
+}
+
+// CreateQuoteForClaims prices shipping for the shopper's market and loyalty
+// tier. Without claims it is the same as CreateQuoteFromCount.
+func CreateQuoteForClaims(count int, claims jwtClaimSet) PersonalizedQuote {
+	market := claims.MarketID
+	if market == "" {
+		market = currencyMarkets[claims.Currency]
+	}
+	if market == "" {
+		market = defaultMarket
+	}
+	c, ok := marketCarriers[market]
+	if !ok {
+		c = internationalCarrier
+	}
+
+	cents := c.Cents
+	if share, ok := loyaltyDiscounts[claims.LoyaltyTier]; ok {
+		cents = uint32(float64(cents) * share)
+	}
+	return PersonalizedQuote{
+		Quote:       Quote{Dollars: cents / 100, Cents: cents % 100},
+		Market:      market,
+		Carrier:     c.Name,
+		LoyaltyTier: claims.LoyaltyTier,
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// svcAuthorizationHeader carries the calling service's own token, next to
+// the user token it forwards. The JWT says on whose behalf a call is made;
+// this says who is making it.
+const svcAuthorizationHeader = "x-svc-authorization"
+
+// defaultSvcTokenAudience is the audience the frontend's TokenService
+// issues service tokens for
+const defaultSvcTokenAudience = "urn:hipstershop:services"
+
+// serviceIdentity is the verified caller of a request
+type serviceIdentity struct {
+	// Caller is the client ID of the calling service, or its SPIFFE ID
+	// when it sent no service token
+	Caller    string
+	Issuer    string
+	ExpiresAt time.Time
+	// SpiffeID is the ID in the caller's X.509 SVID, if it connected
+	// over SPIFFE mTLS
+	SpiffeID string
+}
+
+type ctxKeyServiceIdentity struct{}
+
+// callerFromContext returns the verified calling service, if the request
+// carried a service token
+func callerFromContext(ctx context.Context) (*serviceIdentity, bool) {
+	id, ok := ctx.Value(ctxKeyServiceIdentity{}).(*serviceIdentity)
+	return id, ok
+}
+
+var (
+	svcKeyOnce sync.Once
+	svcKey     *rsa.PublicKey
+)
+
+// svcVerificationKey returns the key service tokens are signed with:
+// SVC_TOKEN_PUBLIC_KEY_PATH for an external issuer, otherwise the
+// frontend's
+func svcVerificationKey() *rsa.PublicKey {
+	svcKeyOnce.Do(func() {
+		path := os.Getenv("SVC_TOKEN_PUBLIC_KEY_PATH")
+		if path == "" {
+			svcKey = jwtVerificationKey()
+			return
+		}
+		key, err := loadRSAPublicKey(path)
+		if err != nil {
+			log.Errorf("failed to load service token key: %v", err)
+			return
+		}
+		svcKey = key
+	})
+	return svcKey
+}
+
+// svcTokenAudience is read from SVC_TOKEN_AUDIENCE. Checking it keeps user
+// tokens, signed with the same key, from passing as a service's.
+var svcTokenAudience = loadSvcTokenAudience()
+
+func loadSvcTokenAudience() string {
+	if v := os.Getenv("SVC_TOKEN_AUDIENCE"); v != "" {
+		return v
+	}
+	return defaultSvcTokenAudience
+}
+
+// svcTokenIssuer is read from SVC_TOKEN_ISSUER; any issuer is accepted
+// when it is empty
+var svcTokenIssuer = os.Getenv("SVC_TOKEN_ISSUER")
+
+// svcTokenClaims are the claims read from a service token. External
+// issuers name the client in client_id or azp rather than sub.
+type svcTokenClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	ClientID  string          `json:"client_id"`
+	AZP       string          `json:"azp"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+}
+
+// verifyServiceToken checks the RS256 signature, expiry, audience and
+// issuer of a service token and returns the caller it names
+func verifyServiceToken(token string) (*serviceIdentity, error) {
+	segments, err := splitJWT(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := segments.DecodeHeader(&header); err != nil {
+		return nil, fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: unexpected service token alg %q", errJWTSignatureInvalid, header.Alg)
+	}
+	key := svcVerificationKey()
+	if key == nil {
+		return nil, fmt.Errorf("%w: no verification key for service tokens", errJWTSignatureInvalid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(segments.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errJWTSignatureInvalid, err)
+	}
+	digest := sha256.Sum256([]byte(segments.SigningInput(token)))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("%w: service token: %v", errJWTSignatureInvalid, err)
+	}
+
+	var claims svcTokenClaims
+	if err := segments.DecodePayload(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", errJWTMalformed, err)
+	}
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: service token has no exp", errJWTMalformed)
+	}
+	exp := time.Unix(int64(*claims.ExpiresAt), 0)
+	if time.Now().After(exp) {
+		return nil, fmt.Errorf("%w: service token exp=%d", errJWTExpired, exp.Unix())
+	}
+	if !audienceContains(claims.Audience, svcTokenAudience) {
+		return nil, fmt.Errorf("%w: service token not issued for %s", errJWTSignatureInvalid, svcTokenAudience)
+	}
+	if svcTokenIssuer != "" && claims.Issuer != svcTokenIssuer {
+		return nil, fmt.Errorf("%w: service token issued by %q", errJWTSignatureInvalid, claims.Issuer)
+	}
+
+	caller := claims.ClientID
+	if caller == "" {
+		caller = claims.AZP
+	}
+	if caller == "" {
+		caller = claims.Subject
+	}
+	if caller == "" {
+		return nil, fmt.Errorf("%w: service token names no client", errJWTMalformed)
+	}
+	return &serviceIdentity{Caller: caller, Issuer: claims.Issuer, ExpiresAt: exp}, nil
+}
+
+// audienceContains reports whether aud, a string or an array of strings,
+// holds want
+func audienceContains(aud json.RawMessage, want string) bool {
+	var one string
+	if json.Unmarshal(aud, &one) == nil {
+		return one == want
+	}
+	var many []string
+	if json.Unmarshal(aud, &many) != nil {
+		return false
+	}
+	for _, a := range many {
+		if a == want {
+			return true
+		}
+	}
+	return false
+}
+
+// withServiceIdentity verifies the service token in incoming metadata, if
+// any, and stores the caller and a logger naming it in ctx. A peer's SVID
+// identifies it as well when it sends no token. Requests with neither are
+// served as before, on the user's behalf only.
+func withServiceIdentity(ctx context.Context) (context.Context, error) {
+	spiffeID, mtls := peerSPIFFEID(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	v := md.Get(svcAuthorizationHeader)
+	var id *serviceIdentity
+	switch {
+	case len(v) > 0:
+		var err error
+		if id, err = verifyServiceToken(strings.TrimPrefix(v[0], "Bearer ")); err != nil {
+			return ctx, err
+		}
+		id.SpiffeID = spiffeID
+	case mtls:
+		id = &serviceIdentity{Caller: spiffeID, SpiffeID: spiffeID}
+	default:
+		return ctx, nil
+	}
+	ctx = context.WithValue(ctx, ctxKeyServiceIdentity{}, id)
+	l := logFromContext(ctx).WithField("svc.caller", id.Caller)
+	if mtls {
+		l = l.WithField("svc.spiffe_id", spiffeID)
+	}
+	return context.WithValue(ctx, ctxKeyLog{}, l), nil
+}
+
+// svcIdentityUnaryServerInterceptor identifies the calling service
+func svcIdentityUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if skipJWTMethod(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	ctx, err := withServiceIdentity(ctx)
+	if err != nil {
+		logFromContext(ctx).Warnf("rejecting service token for %s: %v", info.FullMethod, err)
+		return nil, jwtStatusError(err)
+	}
+	return handler(ctx, req)
+}
+
+// svcIdentityStreamServerInterceptor identifies the calling service of a stream
+func svcIdentityStreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if skipJWTMethod(info.FullMethod) {
+		return handler(srv, ss)
+	}
+	ctx, err := withServiceIdentity(ss.Context())
+	if err != nil {
+		logFromContext(ctx).Warnf("rejecting service token for stream %s: %v", info.FullMethod, err)
+		return jwtStatusError(err)
+	}
+	return handler(srv, &wrappedServerStream{ServerStream: ss, ctx: ctx})
+}
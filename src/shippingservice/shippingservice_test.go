@@ -88,3 +88,39 @@ func TestShipOrder(t *testing.T) {
 		t.Errorf("TestShipOrder: Tracking ID is malformed - has %d characters, %d expected", len(res.TrackingId), 18)
 	}
 }
+
+// TestGetQuoteWithClaims checks quotes are personalized by the JWT claims
+// the interceptor put in the context.
+func TestGetQuoteWithClaims(t *testing.T) {
+	s := server{}
+	req := &pb.GetQuoteRequest{
+		Address: &pb.Address{Country: "England"},
+		Items:   []*pb.CartItem{{ProductId: "23", Quantity: 1}},
+	}
+
+	tests := []struct {
+		name   string
+		claims jwtClaimSet
+		units  int64
+		nanos  int32
+	}{
+		{"default market", jwtClaimSet{MarketID: "US"}, 8, 990000000},
+		{"market carrier", jwtClaimSet{MarketID: "JP"}, 14, 990000000},
+		{"market from currency", jwtClaimSet{Currency: "CAD"}, 10, 990000000},
+		{"international", jwtClaimSet{MarketID: "IN"}, 19, 990000000},
+		{"silver discount", jwtClaimSet{MarketID: "US", LoyaltyTier: "silver"}, 4, 490000000},
+		{"gold ships free", jwtClaimSet{MarketID: "GB", LoyaltyTier: "gold"}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), ctxKeyClaims{}, tt.claims)
+			res, err := s.GetQuote(ctx, req)
+			if err != nil {
+				t.Fatalf("GetQuote() error = %v", err)
+			}
+			if res.CostUsd.GetUnits() != tt.units || res.CostUsd.GetNanos() != tt.nanos {
+				t.Errorf("GetQuote() = %d.%09d, want %d.%09d", res.CostUsd.GetUnits(), res.CostUsd.GetNanos(), tt.units, tt.nanos)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// userprofileservice is a stub claims provider for the frontend. It derives
+// a stable profile from the session ID, so the same session always gets the
+// same name, market and loyalty tier.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPort  = "8080"
+	profilesPath = "/v1/profiles/"
+)
+
+var log *logrus.Logger
+
+func init() {
+	log = logrus.New()
+	log.Level = logrus.DebugLevel
+	log.Formatter = &logrus.JSONFormatter{
+		FieldMap: logrus.FieldMap{
+			logrus.FieldKeyTime:  "timestamp",
+			logrus.FieldKeyLevel: "severity",
+			logrus.FieldKeyMsg:   "message",
+		},
+		TimestampFormat: time.RFC3339Nano,
+	}
+	log.Out = os.Stdout
+}
+
+var (
+	firstNames   = []string{"Jane", "John", "Aiko", "Mateo", "Priya", "Lars", "Amara", "Chen"}
+	lastNames    = []string{"Doe", "Smith", "Tanaka", "Garcia", "Patel", "Nilsson", "Okafor", "Wei"}
+	markets      = []string{"US", "US", "US", "CA", "GB", "DE", "JP", "IN"}
+	loyaltyTiers = []string{"none", "none", "bronze", "bronze", "silver", "gold"}
+)
+
+// profile is the JSON document the frontend's claims provider expects
+type profile struct {
+	Name        string `json:"name"`
+	MarketID    string `json:"market_id"`
+	LoyaltyTier string `json:"loyalty_tier"`
+}
+
+func profileFor(sessionID string) profile {
+	h := fnv.New64a()
+	h.Write([]byte(sessionID))
+	n := h.Sum64()
+	pick := func(list []string) string {
+		v := list[n%uint64(len(list))]
+		n /= uint64(len(list))
+		return v
+	}
+	first, last := pick(firstNames), pick(lastNames)
+	return profile{
+		Name:        first + " " + last,
+		MarketID:    pick(markets),
+		LoyaltyTier: pick(loyaltyTiers),
+	}
+}
+
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := strings.TrimPrefix(r.URL.Path, profilesPath)
+	if sessionID == "" || strings.Contains(sessionID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	p := profileFor(sessionID)
+	log.WithField("session_id", sessionID).Debugf("profile lookup: %+v", p)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Warnf("failed to write profile: %v", err)
+	}
+}
+
+func main() {
+	port := defaultPort
+	if v := os.Getenv("PORT"); v != "" {
+		port = v
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(profilesPath, profileHandler)
+	mux.HandleFunc("/_healthz", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "ok") })
+
+	log.Infof("user profile service listening on :%s", port)
+	log.Fatal(http.ListenAndServe(":"+port, mux))
+}